@@ -2,4 +2,4 @@ module github.com/zylisp/repl
 
 go 1.24.3
 
-require github.com/zylisp/lang v0.0.0-20251006061322-3f8b0b8fcf07 // indirect
+require github.com/zylisp/lang v0.0.0-20251006061322-3f8b0b8fcf07
@@ -0,0 +1,171 @@
+package repl
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zylisp/repl/operations"
+	"github.com/zylisp/repl/protocol"
+	"github.com/zylisp/repl/server"
+	"github.com/zylisp/repl/transport/inprocess"
+)
+
+// evalFunc evaluates code over a connected client.
+type evalFunc func(ctx context.Context, code string) (*Result, error)
+
+// integrationTransports lists the transports the integration test runs
+// over. connect starts a server for evaluator using codec, connects a client
+// to it and returns its eval function; both are stopped with the test.
+var integrationTransports = []struct {
+	name    string
+	codecs  []string
+	connect func(t *testing.T, codec string, evaluator operations.EvaluatorFunc) evalFunc
+}{
+	{"in-process", []string{"", "json", "msgpack"}, connectInProcess},
+	{"unix", []string{"json", "msgpack"}, connectNetwork("unix")},
+	{"tcp", []string{"json", "msgpack"}, connectNetwork("tcp")},
+}
+
+// integrationSteps run in order against one server, so later steps may rely
+// on definitions made by earlier ones. Numbers are compared after
+// normalizeNumbers, since codecs decode every number as float64.
+var integrationSteps = []struct {
+	code   string
+	value  interface{}
+	output string
+}{
+	{"(+ 1 2)", float64(3), ""},
+	{"(* (- 10 4) 7)", float64(42), ""},
+	{"(define x 40)", float64(40), ""},
+	{"(+ x 2)", float64(42), ""},
+	{`"hello"`, "hello", ""},
+	{"(list 1 (list 2 3))", []interface{}{float64(1), []interface{}{float64(2), float64(3)}}, ""},
+	{`(println "hi" x)`, nil, "hi 40\n"},
+	{"(/ 1 0)", map[string]interface{}{"error": "/: division by zero", "phase": "eval"}, ""},
+	{"undefined-var", map[string]interface{}{"error": "undefined variable: undefined-var", "phase": "eval"}, ""},
+}
+
+func TestIntegrationAcrossTransports(t *testing.T) {
+	for _, transport := range integrationTransports {
+		for _, codec := range transport.codecs {
+			transport, codec := transport, codec
+			t.Run(fmt.Sprintf("%s/%s", transport.name, codecName(codec)), func(t *testing.T) {
+				if codec != "" && !protocol.CodecAvailable(codec) {
+					t.Skipf("codec %s is not available", codec)
+				}
+
+				eval := transport.connect(t, codec, server.NewServer().EvaluatorFunc())
+				for _, step := range integrationSteps {
+					result, err := eval(context.Background(), step.code)
+					if err != nil {
+						t.Fatalf("Eval %s failed: %v", step.code, err)
+					}
+					if len(result.Status) != 1 || result.Status[0] != "done" {
+						t.Errorf("Eval %s: expected status done, got %v", step.code, result.Status)
+					}
+					if got := normalizeNumbers(result.Value); !reflect.DeepEqual(got, step.value) {
+						t.Errorf("Eval %s: got %#v, want %#v", step.code, got, step.value)
+					}
+					if result.Output != step.output {
+						t.Errorf("Eval %s: got output %q, want %q", step.code, result.Output, step.output)
+					}
+				}
+			})
+		}
+	}
+}
+
+// codecName names codec in subtest names; "" means direct Go values.
+func codecName(codec string) string {
+	if codec == "" {
+		return "direct"
+	}
+	return codec
+}
+
+// normalizeNumbers converts the integers an uncoded in-process transport
+// returns to the float64 every codec decodes numbers as.
+func normalizeNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int64:
+		return float64(v)
+	case int:
+		return float64(v)
+	case []interface{}:
+		normalized := make([]interface{}, len(v))
+		for i, element := range v {
+			normalized[i] = normalizeNumbers(element)
+		}
+		return normalized
+	default:
+		return value
+	}
+}
+
+func connectInProcess(t *testing.T, codec string, evaluator operations.EvaluatorFunc) evalFunc {
+	srv := inprocess.NewServer(evaluator)
+	srv.Codec = codec
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		srv.Start(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	client := inprocess.NewClient()
+	if err := client.Connect(context.Background(), srv); err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return func(ctx context.Context, code string) (*Result, error) {
+		result, err := client.Eval(ctx, code)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{ID: result.ID, Value: result.Value, Output: result.Output, Status: result.Status}, nil
+	}
+}
+
+// connectNetwork returns a connect function for the "unix" or "tcp"
+// transport, going through NewServer and the universal client.
+func connectNetwork(transport string) func(*testing.T, string, operations.EvaluatorFunc) evalFunc {
+	return func(t *testing.T, codec string, evaluator operations.EvaluatorFunc) evalFunc {
+		addr := "127.0.0.1:0"
+		if transport == "unix" {
+			addr = filepath.Join(os.TempDir(), fmt.Sprintf("zylisp-integration-%d.sock", time.Now().UnixNano()))
+			t.Cleanup(func() { os.Remove(addr) })
+		}
+
+		srv, err := NewServer(ServerConfig{
+			Transport: transport,
+			Addr:      addr,
+			Codec:     codec,
+			Evaluator: evaluator,
+		})
+		if err != nil {
+			t.Fatalf("NewServer failed: %v", err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		go func() {
+			srv.Start(ctx)
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		client := NewClientWithTransport(transport, codec)
+		if err := client.Connect(context.Background(), srv.Addr()); err != nil {
+			t.Fatalf("Failed to connect client: %v", err)
+		}
+		t.Cleanup(func() { client.Close() })
+
+		return client.Eval
+	}
+}
@@ -0,0 +1,91 @@
+package operations
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/zylisp/repl/protocol"
+)
+
+// handleDefineAlias processes the "define-alias" operation.
+// It maps data.name to the form in data.form for the request's session:
+// an "eval" whose code is exactly the name, apart from surrounding space,
+// evaluates the form instead. Aliases are not expanded inside other forms
+// and are not Zylisp definitions. An empty form removes the alias.
+//
+// A name already bound by the evaluator, as reported by Snapshot (or, if it
+// is not set, Symbols), is refused with status "alias-conflict" unless
+// data.shadow is true. An alias takes precedence over bindings made after
+// it is defined.
+func (h *Handler) handleDefineAlias(req *protocol.Message, resp *protocol.Message) *protocol.Message {
+	name, _ := req.Data["name"].(string)
+	form, ok := req.Data["form"].(string)
+	if !validAliasName(name) || !ok {
+		resp.Status = []string{"error"}
+		resp.ProtocolError = "define-alias operation requires a symbol 'name' and a 'form' in data field"
+		return resp
+	}
+
+	sess := h.session(req.Session)
+	form = strings.TrimSpace(form)
+	if form == "" {
+		sess.setAlias(name, "")
+		resp.Status = []string{"done"}
+		return resp
+	}
+
+	if shadow, _ := req.Data["shadow"].(bool); !shadow && h.bound(name) {
+		resp.Status = []string{"error", "alias-conflict"}
+		resp.ProtocolError = fmt.Sprintf("%q is already bound; set 'shadow' to alias it anyway", name)
+		return resp
+	}
+	sess.setAlias(name, form)
+	resp.Status = []string{"done"}
+	return resp
+}
+
+// validAliasName reports whether name could be sent as a lone symbol.
+func validAliasName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, " \t\r\n()\";")
+}
+
+// bound reports whether the evaluator binds name.
+func (h *Handler) bound(name string) bool {
+	if h.Snapshot != nil {
+		_, ok := h.Snapshot()[name]
+		return ok
+	}
+	if h.Symbols != nil {
+		for _, symbol := range h.Symbols() {
+			if symbol == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setAlias maps name to form, or removes the alias if form is empty.
+func (s *session) setAlias(name, form string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if form == "" {
+		delete(s.aliases, name)
+		return
+	}
+	if s.aliases == nil {
+		s.aliases = make(map[string]string)
+	}
+	s.aliases[name] = form
+}
+
+// expandAlias returns the form aliased by code if code is an alias name,
+// and code otherwise.
+func (s *session) expandAlias(code string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if form, ok := s.aliases[strings.TrimSpace(code)]; ok {
+		return form
+	}
+	return code
+}
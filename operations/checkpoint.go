@@ -0,0 +1,102 @@
+package operations
+
+import (
+	"fmt"
+
+	"github.com/zylisp/repl/protocol"
+)
+
+// CheckpointFunc saves the evaluation environment and returns an ID that
+// identifies the saved state.
+type CheckpointFunc func() (id string, err error)
+
+// RestoreFunc reverts the evaluation environment to a saved state.
+type RestoreFunc func(id string) error
+
+// sessionCheckpointLimit bounds how many checkpoint IDs a session remembers.
+// The oldest is forgotten first.
+const sessionCheckpointLimit = 64
+
+// handleCheckpoint processes the "checkpoint" operation.
+// It saves the environment with the configured Checkpointer, records the
+// checkpoint as the session's, and returns its ID in data.checkpoint.
+func (h *Handler) handleCheckpoint(sess *session, resp *protocol.Message) *protocol.Message {
+	if h.Checkpointer == nil {
+		resp.Status = []string{"error"}
+		resp.ProtocolError = "checkpoint operation not supported by this server"
+		return resp
+	}
+
+	id, err := h.Checkpointer()
+	if err != nil {
+		resp.Status = []string{"error"}
+		resp.ProtocolError = fmt.Sprintf("checkpoint failed: %v", err)
+		return resp
+	}
+
+	sess.addCheckpoint(id)
+	resp.Status = []string{"done"}
+	resp.Data = map[string]interface{}{
+		"checkpoint": id,
+	}
+	return resp
+}
+
+// handleRestore processes the "restore" operation.
+// It reverts the environment to the checkpoint named in data.checkpoint
+// using the configured Restorer. Only the session that created a checkpoint
+// can restore it; the environment it reverts is shared by all sessions.
+func (h *Handler) handleRestore(req *protocol.Message, sess *session, resp *protocol.Message) *protocol.Message {
+	if h.Restorer == nil {
+		resp.Status = []string{"error"}
+		resp.ProtocolError = "restore operation not supported by this server"
+		return resp
+	}
+
+	var id string
+	if req.Data != nil {
+		id, _ = req.Data["checkpoint"].(string)
+	}
+	if id == "" {
+		resp.Status = []string{"error"}
+		resp.ProtocolError = "restore operation requires 'checkpoint' in data field"
+		return resp
+	}
+	if sess == nil || !sess.hasCheckpoint(id) {
+		resp.Status = []string{"error"}
+		resp.ProtocolError = fmt.Sprintf("restore failed: no checkpoint %q in this session", id)
+		return resp
+	}
+
+	if err := h.Restorer(id); err != nil {
+		resp.Status = []string{"error"}
+		resp.ProtocolError = fmt.Sprintf("restore failed: %v", err)
+		return resp
+	}
+
+	resp.Status = []string{"done"}
+	return resp
+}
+
+// addCheckpoint records id as a checkpoint the session created, forgetting
+// the oldest beyond sessionCheckpointLimit.
+func (s *session) addCheckpoint(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkpoints = append(s.checkpoints, id)
+	if excess := len(s.checkpoints) - sessionCheckpointLimit; excess > 0 {
+		s.checkpoints = s.checkpoints[excess:]
+	}
+}
+
+// hasCheckpoint reports whether the session created the checkpoint id.
+func (s *session) hasCheckpoint(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, created := range s.checkpoints {
+		if created == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package operations
+
+import (
+	"strings"
+
+	"github.com/zylisp/repl/protocol"
+)
+
+// Stream names used in OutputChunk.
+const (
+	StdoutStream = "out"
+	StderrStream = "err"
+)
+
+// OutputChunk is a segment of evaluation output written to a single stream.
+type OutputChunk struct {
+	Stream string // StdoutStream or StderrStream
+	Text   string
+}
+
+// flattenChunks concatenates the chunks' text in order.
+func flattenChunks(chunks []OutputChunk) string {
+	var b strings.Builder
+	for _, chunk := range chunks {
+		b.WriteString(chunk.Text)
+	}
+	return b.String()
+}
+
+// setOutputChunks records chunks in resp.Data["output-chunks"] as a list of
+// {"stream", "text"} maps. It does nothing if there are no chunks.
+func setOutputChunks(resp *protocol.Message, chunks []OutputChunk) {
+	if len(chunks) == 0 {
+		return
+	}
+	if resp.Data == nil {
+		resp.Data = make(map[string]interface{})
+	}
+
+	segments := make([]interface{}, len(chunks))
+	for i, chunk := range chunks {
+		segments[i] = map[string]interface{}{
+			"stream": chunk.Stream,
+			"text":   chunk.Text,
+		}
+	}
+	resp.Data["output-chunks"] = segments
+}
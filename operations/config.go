@@ -0,0 +1,90 @@
+package operations
+
+import (
+	"strings"
+
+	"github.com/zylisp/repl/protocol"
+)
+
+// SettingsFunc returns the transport's configuration, such as its address
+// and limits, keyed by setting name.
+type SettingsFunc func() map[string]interface{}
+
+// redacted replaces the value of settings that look like secrets.
+const redacted = "[redacted]"
+
+// secretMarkers are substrings of setting names whose values are never
+// reported by the "config" operation.
+var secretMarkers = []string{"token", "secret", "password", "key", "credential"}
+
+// handleConfig processes the "config" operation.
+// It reports the running configuration in data: the handler's limits, the
+// enabled operations and, under data.transport, the settings from Settings.
+// Values of settings whose names look like secrets are redacted.
+func (h *Handler) handleConfig(resp *protocol.Message) *protocol.Message {
+	timeouts := make(map[string]interface{}, len(h.OpTimeouts))
+	for op, timeout := range h.OpTimeouts {
+		timeouts[op] = timeout.String()
+	}
+
+	resp.Status = []string{"done"}
+	resp.Data = map[string]interface{}{
+		"ops":                  h.enabledOps(),
+		"op-timeouts":          timeouts,
+		"default-eval-timeout": h.DefaultEvalTimeout.String(),
+		"slow-log-threshold":   h.SlowLogThreshold.String(),
+		"max-concurrent-evals": h.MaxConcurrentEvals,
+		"debug":                h.Debug,
+		"draining":             h.Draining(),
+	}
+	if h.Settings != nil {
+		resp.Data["transport"] = redact(h.Settings())
+	}
+	return resp
+}
+
+// enabledOps lists the supported operations, leaving out those that need a
+// function the handler was not given.
+func (h *Handler) enabledOps() []string {
+	disabled := map[string]bool{
+		"reset":      h.Resetter == nil,
+		"checkpoint": h.Checkpointer == nil,
+		"restore":    h.Restorer == nil,
+		"apropos":    h.Symbols == nil,
+	}
+	var ops []string
+	for _, op := range supportedOps() {
+		if !disabled[op] {
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+// redact returns a copy of settings with the values of secret-looking
+// settings replaced, descending into nested maps.
+func redact(settings map[string]interface{}) map[string]interface{} {
+	clean := make(map[string]interface{}, len(settings))
+	for name, value := range settings {
+		if isSecret(name) {
+			clean[name] = redacted
+			continue
+		}
+		if nested, ok := value.(map[string]interface{}); ok {
+			value = redact(nested)
+		}
+		clean[name] = value
+	}
+	return clean
+}
+
+// isSecret reports whether the setting called name may hold a secret.
+func isSecret(name string) bool {
+	name = strings.ToLower(name)
+	for _, marker := range secretMarkers {
+		if strings.Contains(name, marker) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+package operations
+
+import (
+	"context"
+
+	"github.com/zylisp/repl/protocol"
+)
+
+// SendFunc delivers a message to the client that issued the current request,
+// outside the normal one-request-one-response flow. Implementations must be
+// safe for concurrent use.
+type SendFunc func(msg *protocol.Message) error
+
+// sessionKey is the context key for the request's session ID.
+type sessionKey struct{}
+
+// optionsKey is the context key for the session's evaluation options.
+type optionsKey struct{}
+
+// bindingsKey is the context key for the request's data.bindings.
+type bindingsKey struct{}
+
+// dryRunKey is the context key for the request's data.dry-run flag.
+type dryRunKey struct{}
+
+// seedKey is the context key for the request's data.seed.
+type seedKey struct{}
+
+// senderKey is the context key for the connection's SendFunc.
+type senderKey struct{}
+
+// connInfoKey is the context key for the connection's ConnInfo.
+type connInfoKey struct{}
+
+// ConnInfo describes the connection a request arrived on.
+// It is reported by the "describe" operation under data.connection.
+type ConnInfo struct {
+	Transport  string // "in-process", "unix" or "tcp"
+	LocalAddr  string // server side of the connection
+	RemoteAddr string // client side of the connection
+	TLS        bool   // whether the connection is TLS-encrypted
+}
+
+// withSession returns a copy of ctx carrying the given session ID.
+func withSession(ctx context.Context, session string) context.Context {
+	return context.WithValue(ctx, sessionKey{}, session)
+}
+
+// SessionFromContext returns the session ID of the request being evaluated.
+// It returns "" if the request did not specify a session.
+func SessionFromContext(ctx context.Context) string {
+	session, _ := ctx.Value(sessionKey{}).(string)
+	return session
+}
+
+// withOptions returns a copy of ctx carrying the session's evaluation options.
+func withOptions(ctx context.Context, options map[string]interface{}) context.Context {
+	return context.WithValue(ctx, optionsKey{}, options)
+}
+
+// OptionsFromContext returns the evaluation options set with the "set-option"
+// operation for the request's session. The returned map is a snapshot taken
+// when the request started and may be freely read; it is never nil.
+func OptionsFromContext(ctx context.Context) map[string]interface{} {
+	options, _ := ctx.Value(optionsKey{}).(map[string]interface{})
+	if options == nil {
+		return map[string]interface{}{}
+	}
+	return options
+}
+
+// withBindings returns a copy of ctx carrying the request's bindings.
+func withBindings(ctx context.Context, bindings map[string]interface{}) context.Context {
+	return context.WithValue(ctx, bindingsKey{}, bindings)
+}
+
+// BindingsFromContext returns the names and values an "eval" request asked
+// to bind for its evaluation only, through data.bindings, or nil if there
+// are none. Evaluators should bind them in a child environment so that the
+// session's environment is left untouched.
+func BindingsFromContext(ctx context.Context) map[string]interface{} {
+	bindings, _ := ctx.Value(bindingsKey{}).(map[string]interface{})
+	return bindings
+}
+
+// withDryRun returns a copy of ctx marking the evaluation as a dry run.
+func withDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, true)
+}
+
+// DryRunFromContext reports whether an "eval" request asked, through
+// data.dry-run, to be evaluated without keeping its effects. Evaluators
+// should then evaluate in a throwaway child environment, still returning
+// the value and output.
+func DryRunFromContext(ctx context.Context) bool {
+	dryRun, _ := ctx.Value(dryRunKey{}).(bool)
+	return dryRun
+}
+
+// withSeed returns a copy of ctx carrying the request's random seed.
+func withSeed(ctx context.Context, seed int64) context.Context {
+	return context.WithValue(ctx, seedKey{}, seed)
+}
+
+// SeedFromContext returns the seed an "eval" request asked, through
+// data.seed, for the random number generator to be seeded with before
+// evaluating, and whether it asked. The same seed and code should yield the
+// same result.
+func SeedFromContext(ctx context.Context) (int64, bool) {
+	seed, ok := ctx.Value(seedKey{}).(int64)
+	return seed, ok
+}
+
+// WithSender returns a copy of ctx carrying the connection's SendFunc.
+// Transports that can push messages to their clients install one before
+// handling each request; operations that push use it to reach the client.
+func WithSender(ctx context.Context, send SendFunc) context.Context {
+	return context.WithValue(ctx, senderKey{}, send)
+}
+
+// senderFromContext returns the connection's SendFunc, or nil if the
+// transport does not support pushing messages.
+func senderFromContext(ctx context.Context) SendFunc {
+	send, _ := ctx.Value(senderKey{}).(SendFunc)
+	return send
+}
+
+// WithConnInfo returns a copy of ctx carrying the connection's ConnInfo.
+// Transports install it once per connection.
+func WithConnInfo(ctx context.Context, info ConnInfo) context.Context {
+	return context.WithValue(ctx, connInfoKey{}, info)
+}
+
+// connInfoFromContext returns the connection's ConnInfo, if the transport
+// provided one.
+func connInfoFromContext(ctx context.Context) (ConnInfo, bool) {
+	info, ok := ctx.Value(connInfoKey{}).(ConnInfo)
+	return info, ok
+}
@@ -0,0 +1,68 @@
+package operations
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"unicode/utf8"
+
+	"github.com/zylisp/repl/protocol"
+)
+
+// debugLogLimit is how much of a message's code, value and output is logged
+// in Debug mode.
+const debugLogLimit = 200
+
+// debugDispatch is handle with the request, every message pushed while it
+// runs and the response logged at debug level.
+func (h *Handler) debugDispatch(ctx context.Context, req *protocol.Message) *protocol.Message {
+	h.logMessage("request", req)
+	if send := senderFromContext(ctx); send != nil {
+		ctx = WithSender(ctx, func(msg *protocol.Message) error {
+			h.logMessage("push", msg)
+			return send(msg)
+		})
+	}
+	resp := h.handle(ctx, req)
+	h.logMessage("response", resp)
+	return resp
+}
+
+// logMessage logs msg at debug level under the given kind.
+func (h *Handler) logMessage(kind string, msg *protocol.Message) {
+	if !h.Log().Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	attrs := []interface{}{"id", msg.ID, "session", msg.Session}
+	if msg.Op != "" {
+		attrs = append(attrs, "op", msg.Op)
+	}
+	if msg.Code != "" {
+		attrs = append(attrs, "code", truncate(msg.Code, debugLogLimit))
+	}
+	if len(msg.Status) > 0 {
+		attrs = append(attrs, "status", msg.Status)
+	}
+	if msg.Value != nil {
+		attrs = append(attrs, "value", truncate(fmt.Sprint(msg.Value), debugLogLimit))
+	}
+	if msg.Output != "" {
+		attrs = append(attrs, "output", truncate(msg.Output, debugLogLimit))
+	}
+	if msg.ProtocolError != "" {
+		attrs = append(attrs, "error", msg.ProtocolError)
+	}
+	h.Log().Log(context.Background(), slog.LevelDebug, kind, attrs...)
+}
+
+// truncate shortens s to at most limit bytes, marking the cut with "...".
+// The cut backs up to a rune boundary, so that no rune is split.
+func truncate(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	for limit > 0 && !utf8.RuneStart(s[limit]) {
+		limit--
+	}
+	return s[:limit] + "..."
+}
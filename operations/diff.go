@@ -0,0 +1,86 @@
+package operations
+
+import (
+	"context"
+	"reflect"
+	"sort"
+
+	"github.com/zylisp/repl/protocol"
+)
+
+// SnapshotFunc returns the evaluator's top-level bindings by name. Values
+// only need to compare equal with == while the binding is unchanged.
+type SnapshotFunc func() map[string]interface{}
+
+// EnvSnapshots holds the top-level bindings before and after a with-diff
+// evaluation, as recorded by the evaluator itself.
+type EnvSnapshots struct {
+	Before, After map[string]interface{}
+}
+
+// envSnapshotsKey is the context key for the request's *EnvSnapshots.
+type envSnapshotsKey struct{}
+
+// withEnvSnapshots returns a copy of ctx asking the evaluator to record its
+// bindings in snapshots.
+func withEnvSnapshots(ctx context.Context, snapshots *EnvSnapshots) context.Context {
+	return context.WithValue(ctx, envSnapshotsKey{}, snapshots)
+}
+
+// EnvSnapshotsFromContext returns where a context-aware evaluator should
+// record its top-level bindings, in the form SnapshotFunc returns, when the
+// request set data.with-diff, or nil otherwise. Taking both snapshots while
+// the evaluation has exclusive use of the environment keeps evaluations in
+// other sessions out of the diff. If the evaluator records nothing, the
+// handler falls back to calling Snapshot around the evaluation.
+func EnvSnapshotsFromContext(ctx context.Context) *EnvSnapshots {
+	snapshots, _ := ctx.Value(envSnapshotsKey{}).(*EnvSnapshots)
+	return snapshots
+}
+
+// wantsDiff reports whether the request set data.with-diff.
+func wantsDiff(req *protocol.Message) bool {
+	if req.Data == nil {
+		return false
+	}
+	enabled, _ := req.Data["with-diff"].(bool)
+	return enabled
+}
+
+// setEnvDiff records in data.env-diff the sorted names of the bindings in
+// after that are missing from before ("added") or differ from it
+// ("changed").
+func setEnvDiff(resp *protocol.Message, before, after map[string]interface{}) {
+	added, changed := []string{}, []string{}
+	for name, value := range after {
+		previous, existed := before[name]
+		switch {
+		case !existed:
+			added = append(added, name)
+		case !sameBinding(previous, value):
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(changed)
+
+	if resp.Data == nil {
+		resp.Data = make(map[string]interface{})
+	}
+	resp.Data["env-diff"] = map[string]interface{}{
+		"added":   added,
+		"changed": changed,
+	}
+}
+
+// sameBinding compares two snapshot values, treating values that cannot be
+// compared with == as changed.
+func sameBinding(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if !reflect.ValueOf(a).Comparable() || !reflect.ValueOf(b).Comparable() {
+		return false
+	}
+	return a == b
+}
@@ -0,0 +1,28 @@
+package operations
+
+import "github.com/zylisp/repl/protocol"
+
+// Drain makes the handler reject new "eval", "pipe" and "load-file"
+// requests with status ["error", "draining"], so that clients move to
+// another server before this one stops. Evaluations already running
+// continue, and other operations such as "describe" are still answered.
+// Draining cannot be undone.
+func (h *Handler) Drain() {
+	h.draining.Store(true)
+}
+
+// Draining reports whether Drain has been called.
+func (h *Handler) Draining() bool {
+	return h.draining.Load()
+}
+
+// rejectDraining fills resp and reports true if req would start an
+// evaluation while the handler is draining.
+func (h *Handler) rejectDraining(req *protocol.Message, resp *protocol.Message) bool {
+	if !h.Draining() || (req.Op != "eval" && req.Op != "pipe" && req.Op != "load-file") {
+		return false
+	}
+	resp.Status = []string{"error", "draining"}
+	resp.ProtocolError = "server is draining; no new evaluations are accepted"
+	return true
+}
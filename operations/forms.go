@@ -0,0 +1,95 @@
+package operations
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/zylisp/lang/parser"
+)
+
+// SplitForms splits code into the source text of its top-level forms, as the
+// Zylisp lexer reads them, without the whitespace and comments between them.
+// A closing parenthesis with no list open is a form of its own, so that
+// evaluating it reports the error. complete is false if code ends inside a
+// list or string, where more input could finish the last form. An
+// unfinished list is returned as the last form, but an unfinished string
+// leaves no forms, as the lexer returns no tokens then. err is the lexer's
+// error for code it rejects for any other reason.
+func SplitForms(code string) (forms []string, complete bool, err error) {
+	tokens, err := parser.Tokenize(code)
+	if err != nil {
+		// The lexer reports an unterminated string as an illegal token with
+		// this value; the string could still be finished
+		if strings.HasSuffix(err.Error(), strconv.Quote("unterminated string")) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	// The lexer reports columns but not offsets, and a string's reported
+	// line is the one it ends on, so offsets are recovered by walking the
+	// source past the whitespace and comments the lexer skipped
+	start, pos, depth := 0, 0, 0
+	for _, tok := range tokens {
+		if tok.Type == parser.EOF {
+			break
+		}
+		pos = skipSpace(code, pos)
+		if depth == 0 {
+			start = pos
+		}
+		pos = tokenEnd(code, pos, tok)
+
+		switch tok.Type {
+		case parser.LPAREN:
+			depth++
+		case parser.RPAREN:
+			if depth > 0 {
+				depth--
+			}
+		}
+		if depth == 0 {
+			forms = append(forms, code[start:pos])
+		}
+	}
+	if depth > 0 {
+		return append(forms, code[start:pos]), false, nil
+	}
+	return forms, true, nil
+}
+
+// skipSpace returns the offset of the first byte at or after pos that the
+// lexer does not skip as whitespace or part of a comment.
+func skipSpace(code string, pos int) int {
+	for pos < len(code) {
+		switch code[pos] {
+		case ' ', '\t', '\n', '\r':
+			pos++
+		case ';':
+			for pos < len(code) && code[pos] != '\n' {
+				pos++
+			}
+		default:
+			return pos
+		}
+	}
+	return pos
+}
+
+// tokenEnd returns the offset just past tok, which starts at pos.
+func tokenEnd(code string, pos int, tok parser.Token) int {
+	switch tok.Type {
+	case parser.LPAREN, parser.RPAREN:
+		return pos + 1
+	case parser.STRING:
+		// The token holds the unescaped value, so find the closing quote
+		for pos++; pos < len(code) && code[pos] != '"'; pos++ {
+			if code[pos] == '\\' {
+				pos++
+			}
+		}
+		return pos + 1
+	default:
+		return pos + len(tok.Value)
+	}
+}
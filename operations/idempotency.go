@@ -0,0 +1,192 @@
+package operations
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/zylisp/repl/protocol"
+)
+
+const (
+	// idempotencyTTL is how long the handler remembers the response for an
+	// idempotency key.
+	idempotencyTTL = 5 * time.Minute
+
+	// idempotencyCacheSize bounds how many responses the handler remembers.
+	// The oldest entry is evicted first.
+	idempotencyCacheSize = 128
+)
+
+// replyCache remembers responses by idempotency key across all sessions, so
+// that a retry over a new connection, which gets a new default session,
+// still finds the response.
+type replyCache struct {
+	mu      sync.Mutex
+	entries map[string]*cachedReply // idempotency key -> response
+	order   []string                // idempotency keys, oldest first
+}
+
+// cachedReply is a response remembered for an idempotency key, or the
+// promise of one while the first request with the key is still running.
+type cachedReply struct {
+	done    chan struct{}     // closed once resp is set or the entry is abandoned
+	resp    *protocol.Message // a private copy; nil if the response is not remembered
+	expires time.Time
+}
+
+// idempotencyKey returns the request's data.idempotency-key, or "" if none.
+func idempotencyKey(req *protocol.Message) string {
+	if req.Data == nil {
+		return ""
+	}
+	key, _ := req.Data["idempotency-key"].(string)
+	return key
+}
+
+// idempotent runs op unless a request carrying the same idempotency key was
+// already answered, in which case a copy of the earlier response is
+// returned instead. A duplicate that arrives while the first request is
+// still running waits for its response. Interrupted and timed out responses
+// are not remembered, so a retry after either evaluates again.
+func (h *Handler) idempotent(ctx context.Context, req *protocol.Message, resp *protocol.Message, op func(*protocol.Message) *protocol.Message) *protocol.Message {
+	key := idempotencyKey(req)
+	if key == "" {
+		return op(resp)
+	}
+
+	var entry *cachedReply
+	for {
+		var owner bool
+		entry, owner = h.replies.claim(key, time.Now())
+		if owner {
+			break
+		}
+		select {
+		case <-entry.done:
+		case <-ctx.Done():
+			return evaluatorError(resp, "", ctx.Err())
+		}
+		if entry.resp != nil {
+			copyReply(resp, entry.resp)
+			resp.ID = req.ID
+			resp.Context = req.Context
+			return resp
+		}
+		// The first request was not remembered; run again
+	}
+
+	resp = op(resp)
+	for _, status := range resp.Status {
+		if status == "interrupted" || status == "timeout" {
+			h.replies.abandon(key, entry)
+			return resp
+		}
+	}
+	remembered := &protocol.Message{}
+	copyReply(remembered, resp)
+	h.replies.complete(entry, remembered)
+	return resp
+}
+
+// claim returns the entry for key. If there is none, or it has expired, a
+// new in-flight entry is created and claim reports that the caller owns it
+// and must complete or abandon it. Expired entries and, if the cache is
+// still full, the oldest one are evicted first.
+func (c *replyCache) claim(key string, now time.Time) (entry *cachedReply, owner bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, exists := c.entries[key]; exists && !now.After(entry.expires) {
+		return entry, false
+	}
+
+	// Entries share one TTL, so insertion order is also expiry order
+	for len(c.order) > 0 {
+		oldest := c.order[0]
+		if stale, exists := c.entries[oldest]; exists && len(c.order) < idempotencyCacheSize && !now.After(stale.expires) {
+			break
+		}
+		delete(c.entries, oldest)
+		c.order = c.order[1:]
+	}
+
+	if c.entries == nil {
+		c.entries = make(map[string]*cachedReply)
+	}
+	if _, exists := c.entries[key]; !exists {
+		c.order = append(c.order, key)
+	}
+	entry = &cachedReply{done: make(chan struct{}), expires: now.Add(idempotencyTTL)}
+	c.entries[key] = entry
+	return entry, true
+}
+
+// complete records resp as the response for entry and wakes its waiters.
+func (c *replyCache) complete(entry *cachedReply, resp *protocol.Message) {
+	c.mu.Lock()
+	entry.resp = resp
+	c.mu.Unlock()
+	close(entry.done)
+}
+
+// abandon forgets entry without a response, so that waiters and later
+// retries run the request themselves.
+func (c *replyCache) abandon(key string, entry *cachedReply) {
+	c.mu.Lock()
+	if c.entries[key] == entry {
+		delete(c.entries, key)
+		for i, k := range c.order {
+			if k == key {
+				c.order = append(c.order[:i], c.order[i+1:]...)
+				break
+			}
+		}
+	}
+	c.mu.Unlock()
+	close(entry.done)
+}
+
+// copyReply sets dst to a deep copy of src, so that neither shares the
+// slices and maps of the other.
+func copyReply(dst, src *protocol.Message) {
+	*dst = *src
+	dst.Status = append([]string(nil), src.Status...)
+	dst.Value = cloneValue(src.Value)
+	dst.Data, _ = cloneValue(src.Data).(map[string]interface{})
+	dst.Context, _ = cloneValue(src.Context).(map[string]interface{})
+}
+
+// cloneValue returns a deep copy of v's maps and slices.
+func cloneValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if v == nil {
+			return v
+		}
+		clone := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			clone[key] = cloneValue(value)
+		}
+		return clone
+	case []interface{}:
+		if v == nil {
+			return v
+		}
+		clone := make([]interface{}, len(v))
+		for i, value := range v {
+			clone[i] = cloneValue(value)
+		}
+		return clone
+	case []string:
+		return append([]string(nil), v...)
+	case Values:
+		clone := make(Values, len(v))
+		for i, value := range v {
+			clone[i] = cloneValue(value)
+		}
+		return clone
+	default:
+		return v
+	}
+}
@@ -0,0 +1,83 @@
+package operations
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/zylisp/repl/protocol"
+)
+
+// ValueMarshaler converts a response value into a form the codec can encode,
+// such as a map in place of a domain-specific Go type.
+type ValueMarshaler func(v interface{}) (interface{}, error)
+
+// marshaledKeys are the data keys whose elements are response values.
+var marshaledKeys = []string{"values", "stages-results"}
+
+// handle dispatches req and passes the values of the response, and of every
+// message pushed while it runs, through ValueMarshaler.
+func (h *Handler) handle(ctx context.Context, req *protocol.Message) *protocol.Message {
+	if h.ValueMarshaler == nil {
+		return h.dispatch(ctx, req)
+	}
+	if send := senderFromContext(ctx); send != nil {
+		// Subscriptions and streams keep this sender, so their pushes are
+		// marshaled too
+		ctx = WithSender(ctx, func(msg *protocol.Message) error {
+			marshaled := *msg
+			h.marshalValues(&marshaled)
+			return send(&marshaled)
+		})
+	}
+	resp := h.dispatch(ctx, req)
+	h.marshalValues(resp)
+	return resp
+}
+
+// marshalValues replaces msg.Value and the elements of data.values and
+// data.stages-results with their ValueMarshaler forms. Slices and maps are
+// replaced rather than modified, since they may be shared with other
+// messages or retained results. If a value cannot be converted, msg becomes
+// an error response without values.
+func (h *Handler) marshalValues(msg *protocol.Message) {
+	var err error
+	if msg.Value != nil {
+		msg.Value, err = h.ValueMarshaler(msg.Value)
+	}
+	var data map[string]interface{}
+	for _, key := range marshaledKeys {
+		values, ok := msg.Data[key].([]interface{})
+		if !ok || err != nil {
+			continue
+		}
+		marshaled := make([]interface{}, len(values))
+		for i := 0; err == nil && i < len(values); i++ {
+			marshaled[i], err = h.ValueMarshaler(values[i])
+		}
+		if data == nil {
+			data = copyData(msg.Data)
+		}
+		data[key] = marshaled
+	}
+	if err != nil {
+		data = copyData(msg.Data)
+		for _, key := range marshaledKeys {
+			delete(data, key)
+		}
+		msg.Value = nil
+		msg.Status = []string{"error"}
+		msg.ProtocolError = fmt.Sprintf("failed to marshal value: %v", err)
+	}
+	if data != nil {
+		msg.Data = data
+	}
+}
+
+// copyData returns a shallow copy of data.
+func copyData(data map[string]interface{}) map[string]interface{} {
+	clone := make(map[string]interface{}, len(data))
+	for key, value := range data {
+		clone[key] = value
+	}
+	return clone
+}
@@ -0,0 +1,43 @@
+package operations
+
+import (
+	"time"
+
+	"github.com/zylisp/repl/protocol"
+)
+
+// wantsMeta reports whether the request set data.with-meta.
+func wantsMeta(req *protocol.Message) bool {
+	if req.Data == nil {
+		return false
+	}
+	enabled, _ := req.Data["with-meta"].(bool)
+	return enabled
+}
+
+// setMeta records evaluation metadata in resp.Data["meta"]. The form count
+// is left out if code does not read as complete forms. There is no "ns"
+// field: Zylisp has no namespaces, and every session evaluates in the one
+// environment.
+func setMeta(resp *protocol.Message, code string, elapsed time.Duration) {
+	if resp.Data == nil {
+		resp.Data = make(map[string]interface{})
+	}
+	meta := map[string]interface{}{
+		"duration-ms": float64(elapsed) / float64(time.Millisecond),
+	}
+	if count, ok := formCount(code); ok {
+		meta["form-count"] = count
+	}
+	resp.Data["meta"] = meta
+}
+
+// formCount returns the number of top-level forms in code, as SplitForms
+// reads them, and false if code does not read as complete forms.
+func formCount(code string) (int, bool) {
+	forms, complete, err := SplitForms(code)
+	if err != nil || !complete {
+		return 0, false
+	}
+	return len(forms), true
+}
@@ -1,12 +1,29 @@
 package operations
 
 import (
+	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/zylisp/repl/protocol"
 )
 
+// ZylispVersion is the Zylisp language version reported by the "describe" operation.
+// It is intended to be injected at build time, for example:
+//
+//	go build -ldflags "-X github.com/zylisp/repl/operations.ZylispVersion=0.2.0"
+var ZylispVersion = "0.1.0"
+
 // EvaluatorFunc is the function signature for a Zylisp code evaluator.
 // It returns:
 //   - result: the evaluation result (including error-as-data)
@@ -14,74 +31,603 @@ import (
 //   - error: only for catastrophic failures (should be rare)
 type EvaluatorFunc func(code string) (result interface{}, output string, err error)
 
+// EvaluatorFunc2 is a context-aware evaluator signature.
+// The context is cancelled when the request is interrupted or the server stops,
+// carries the request deadline if any, and exposes the request's session
+// through SessionFromContext. Evaluators should return promptly once the
+// context is done; returning ctx.Err() marks the response as interrupted.
+type EvaluatorFunc2 func(ctx context.Context, code string) (result interface{}, output string, err error)
+
+// EvaluatorFunc3 is a context-aware evaluator that reports its output as
+// ordered segments, so that interleaved stdout and stderr writes keep their
+// relative order. It otherwise follows the EvaluatorFunc2 contract.
+type EvaluatorFunc3 func(ctx context.Context, code string) (result interface{}, output []OutputChunk, err error)
+
+// TypeFunc names the type of an evaluation result for data.value-type.
+type TypeFunc func(value interface{}) string
+
+// ResetFunc restores the evaluation environment to its initial state.
+type ResetFunc func() error
+
+// SymbolsFunc returns the names of the built-in functions known to the evaluator.
+type SymbolsFunc func() []string
+
 // Handler processes a request message and returns a response message.
 type Handler struct {
-	evaluator EvaluatorFunc
+	// Resetter is invoked by the "reset" operation.
+	// If nil, the operation reports that reset is not supported.
+	Resetter ResetFunc
+
+	// Checkpointer and Restorer are invoked by the "checkpoint" and
+	// "restore" operations. If either is nil, its operation reports that it
+	// is not supported. A session can only restore checkpoints it created.
+	Checkpointer CheckpointFunc
+	Restorer     RestoreFunc
+
+	// Symbols is used by the "apropos" operation to list built-in functions.
+	// If nil, the operation reports that apropos is not supported.
+	Symbols SymbolsFunc
+
+	// Snapshot is used by evals that set data.with-diff to compare the
+	// environment before and after. If nil, such evals are rejected.
+	Snapshot SnapshotFunc
+
+	// Settings reports the transport's configuration for the "config"
+	// operation. If nil, only the handler's own settings are reported.
+	Settings SettingsFunc
+
+	// Logger receives diagnostics from the handler and the transports using it.
+	// If nil, diagnostics are discarded.
+	Logger *slog.Logger
+
+	// ContextEvaluator, if set, is used instead of the evaluator passed to
+	// NewHandler so that cancellation and deadlines reach the evaluator.
+	ContextEvaluator EvaluatorFunc2
+
+	// ChunkedEvaluator, if set, is preferred over ContextEvaluator. Its output
+	// segments are returned in data.output-chunks alongside the flattened
+	// output.
+	ChunkedEvaluator EvaluatorFunc3
+
+	// OpTimeouts bounds how long each operation may run, keyed by op name.
+	// An operation that exceeds its timeout responds with status
+	// ["error", "timeout"]. Only context-aware evaluators observe the
+	// deadline. Ops without an entry are not limited.
+	OpTimeouts map[string]time.Duration
+
+	// DefaultEvalTimeout, if positive, bounds each evaluation that has no
+	// other deadline, from OpTimeouts, data.deadline or the caller's context,
+	// once it has been admitted to run. An evaluation that exceeds it
+	// responds with status ["error", "timeout"]. Like OpTimeouts, it is only
+	// observed by context-aware evaluators.
+	DefaultEvalTimeout time.Duration
+
+	// SlowLogThreshold, if positive, makes evaluations that take longer than
+	// it log a warning through Logger with the op, session, duration and the
+	// start of the code.
+	SlowLogThreshold time.Duration
+
+	// TypeOf names the type of eval results when a request sets
+	// data.with-type when the evaluator does not record it through
+	// ValueTypeFromContext. If nil, results are classified by their Go type.
+	TypeOf TypeFunc
+
+	// MaxConcurrentEvals bounds how many evaluations run at once across all
+	// sessions. Further evaluations wait in arrival order, and clients that
+	// can receive pushed messages are told their place in the queue. Zero
+	// means no limit.
+	MaxConcurrentEvals int
+
+	// MaxQueuedEvals bounds how many evaluations may wait for
+	// MaxConcurrentEvals. Further evaluations are refused at once with status
+	// ["error", "server-busy"] and an estimate of when to retry in
+	// data.retry-after-ms. Zero means evaluations always wait.
+	MaxQueuedEvals int
+
+	// Debug logs every request, pushed message and response through Logger
+	// at debug level, with code, values and output truncated. Off by
+	// default, as it formats every message.
+	Debug bool
+
+	// MaxSessions bounds how many sessions the handler holds state for.
+	// Requests that would create another are rejected with status
+	// ["error", "too-many-sessions"], unless SessionIdleTTL lets the least
+	// recently active idle session be evicted to make room. Zero means no
+	// limit.
+	MaxSessions int
+
+	// SessionIdleTTL is how long a session with no evaluation running must
+	// have been inactive before it may be evicted for a new session at
+	// MaxSessions. Zero means sessions are never evicted.
+	SessionIdleTTL time.Duration
+
+	// ValueMarshaler, if set, converts the value, and each of data.values,
+	// of every response and pushed message before it is encoded, giving
+	// embedders control over how their own types appear on the wire. A
+	// conversion error turns the message into a protocol error.
+	ValueMarshaler ValueMarshaler
+
+	// FileRoot, if set, confines "load-file" to files beneath this
+	// directory. Relative paths, and the data.cwd requests may supply to
+	// resolve them, start from it.
+	FileRoot string
+
+	// OutputSink, if set, receives a copy of all evaluation output, each line
+	// prefixed with "[session id] ". Writes happen in the background, so a
+	// slow sink never delays evaluations; output is dropped with a warning
+	// if the sink falls too far behind.
+	OutputSink io.Writer
+
+	evaluator   EvaluatorFunc
+	sessions    map[string]*session
+	subscribers map[string]map[*subscriber]struct{} // observed session -> subscribers
+	queue       evalQueue                           // evaluations waiting for MaxConcurrentEvals
+	replies     replyCache                          // responses by idempotency key
+	draining    atomic.Bool                         // set by Drain
+	resultSeq   atomic.Uint64                       // numbers paged result handles
+	sink        outputSink                          // output waiting for OutputSink
+	mu          sync.Mutex
 }
 
+// ErrNoEvaluator is returned for evaluations by a handler created without an
+// evaluator. Responses report it as a protocol error.
+var ErrNoEvaluator = errors.New("no evaluator configured")
+
+// ErrResourceExhausted is returned by evaluators that abort an evaluation
+// for exceeding a resource limit, such as a maximum call depth. Responses
+// report it with status ["error", "resource-exhausted"].
+var ErrResourceExhausted = errors.New("resource exhausted")
+
 // NewHandler creates a new operation handler with the given evaluator.
+// If evaluator is nil and no ContextEvaluator or ChunkedEvaluator is set,
+// evaluations fail with ErrNoEvaluator instead of panicking.
 func NewHandler(evaluator EvaluatorFunc) *Handler {
+	if evaluator == nil {
+		evaluator = missingEvaluator
+	}
 	return &Handler{
-		evaluator: evaluator,
+		evaluator:   evaluator,
+		sessions:    make(map[string]*session),
+		subscribers: make(map[string]map[*subscriber]struct{}),
 	}
 }
 
+// missingEvaluator stands in for a nil evaluator.
+func missingEvaluator(code string) (interface{}, string, error) {
+	return nil, "", ErrNoEvaluator
+}
+
+// Log returns the configured Logger, or a logger that discards all records.
+func (h *Handler) Log() *slog.Logger {
+	if h.Logger == nil {
+		return discardLogger
+	}
+	return h.Logger
+}
+
+// discardLogger is used when no Logger is configured.
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
 // Handle processes a request message and returns a response message.
 // It dispatches to the appropriate operation handler based on the Op field.
+// The response belongs to the caller.
 func (h *Handler) Handle(req *protocol.Message) *protocol.Message {
+	return h.HandleContext(context.Background(), req)
+}
+
+// HandleContext is like Handle but evaluates under ctx.
+// Cancelling ctx interrupts evaluators configured through ContextEvaluator.
+func (h *Handler) HandleContext(ctx context.Context, req *protocol.Message) *protocol.Message {
+	if !h.Debug {
+		return h.handle(ctx, req)
+	}
+	return h.debugDispatch(ctx, req)
+}
+
+// sessionOps are the operations that keep state in the request's session
+// and so create it on first use.
+var sessionOps = map[string]bool{
+	"eval":           true,
+	"pipe":           true,
+	"load-file":      true,
+	"define-alias":   true,
+	"set-option":     true,
+	"session-stream": true,
+	"stdin":          true,
+	"checkpoint":     true,
+}
+
+// dispatch runs the operation named by req.Op under ctx.
+func (h *Handler) dispatch(ctx context.Context, req *protocol.Message) *protocol.Message {
+	if timeout, ok := h.OpTimeouts[req.Op]; ok && timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 	// Create base response with the same ID
 	resp := &protocol.Message{
-		ID: req.ID,
+		ID:      req.ID,
+		Context: req.Context,
+	}
+
+	// Only operations that keep state in the session create it, so that
+	// describes, pings and lookups neither allocate sessions nor count
+	// against MaxSessions
+	now := time.Now()
+	sess := h.lookupSession(req.Session)
+	if sess == nil && sessionOps[req.Op] {
+		var ok bool
+		if sess, ok = h.openSession(req.Session, now); !ok {
+			resp.Status = []string{"error", "too-many-sessions"}
+			resp.ProtocolError = fmt.Sprintf("session limit of %d reached", h.MaxSessions)
+			return resp
+		}
+	}
+	var options map[string]interface{}
+	if sess != nil {
+		sess.touch(now)
+		options = sess.snapshotOptions()
+	}
+	ctx = withSession(ctx, req.Session)
+	ctx = withOptions(ctx, options)
+
+	if h.rejectDraining(req, resp) {
+		return resp
 	}
 
 	// Dispatch to operation handler
 	switch req.Op {
 	case "eval":
-		return h.handleEval(req, resp)
+		return h.idempotent(ctx, req, resp, func(resp *protocol.Message) *protocol.Message {
+			resp = h.handleEval(ctx, req, resp)
+			h.publish(req, resp)
+			return resp
+		})
+	case "pipe":
+		return h.idempotent(ctx, req, resp, func(resp *protocol.Message) *protocol.Message {
+			resp = h.handlePipe(ctx, req, resp)
+			h.publish(req, resp)
+			return resp
+		})
 	case "load-file":
-		return h.handleLoadFile(req, resp)
+		return h.idempotent(ctx, req, resp, func(resp *protocol.Message) *protocol.Message {
+			resp = h.handleLoadFile(ctx, req, resp)
+			h.publish(req, resp)
+			return resp
+		})
 	case "describe":
-		return h.handleDescribe(req, resp)
+		return h.handleDescribe(ctx, req, resp)
+	case "config":
+		return h.handleConfig(resp)
 	case "interrupt":
 		return h.handleInterrupt(req, resp)
-	case "complete", "info", "eldoc", "lookup", "stdin", "ls-sessions", "clone", "close":
-		// Future operations - return not implemented
+	case "ls-running":
+		return h.handleLsRunning(resp)
+	case "ping":
+		return h.handlePing(resp)
+	case "flush-queue":
+		return h.handleFlushQueue(req, resp)
+	case "pause-session", "resume-session":
+		return h.handlePauseSession(req, resp)
+	case "result-page":
+		return h.handleResultPage(req, resp)
+	case "reset":
+		return h.handleReset(req, resp)
+	case "checkpoint":
+		return h.handleCheckpoint(sess, resp)
+	case "restore":
+		return h.handleRestore(req, sess, resp)
+	case "apropos":
+		return h.handleApropos(req, resp)
+	case "define-alias":
+		return h.handleDefineAlias(req, resp)
+	case "set-option":
+		return h.handleSetOption(req, resp)
+	case "get-options":
+		return h.handleGetOptions(req, resp)
+	case "subscribe":
+		return h.handleSubscribe(ctx, req, resp)
+	case "unsubscribe":
+		return h.handleUnsubscribe(req, resp)
+	case "session-stream":
+		return h.handleSessionStream(ctx, req, resp)
+	case "stdin":
+		return h.handleStdin(req, resp)
+	case "upgrade-codec", "close-connection":
+		// Transports that own a connection answer these themselves
 		resp.Status = []string{"error"}
+		resp.ProtocolError = fmt.Sprintf("%s operation not supported by this transport", req.Op)
+		return resp
+	case "complete", "info", "eldoc", "lookup", "ls-sessions", "clone":
+		// Future operations - return not implemented
+		resp.Status = []string{"error", "not-implemented"}
 		resp.ProtocolError = fmt.Sprintf("operation %q not yet implemented", req.Op)
 		return resp
 	default:
-		resp.Status = []string{"error"}
+		resp.Status = []string{"error", "unknown-op"}
 		resp.ProtocolError = fmt.Sprintf("unknown operation: %q", req.Op)
 		return resp
 	}
 }
 
 // handleEval processes the "eval" operation.
-func (h *Handler) handleEval(req *protocol.Message, resp *protocol.Message) *protocol.Message {
-	if req.Code == "" {
+func (h *Handler) handleEval(ctx context.Context, req *protocol.Message, resp *protocol.Message) *protocol.Message {
+	code, problem := evalCode(req)
+	if problem != "" {
 		resp.Status = []string{"error"}
-		resp.ProtocolError = "eval operation requires 'code' field"
+		resp.ProtocolError = problem
 		return resp
 	}
+	code = h.session(req.Session).expandAlias(code)
+
+	if raw, ok := req.Data["bindings"]; ok {
+		bindings, ok := raw.(map[string]interface{})
+		if !ok {
+			resp.Status = []string{"error"}
+			resp.ProtocolError = "eval operation requires 'bindings' to be a map"
+			return resp
+		}
+		if !h.contextAware() {
+			resp.Status = []string{"error"}
+			resp.ProtocolError = "bindings require a context-aware evaluator"
+			return resp
+		}
+		ctx = withBindings(ctx, bindings)
+	}
+
+	if dryRun, _ := req.Data["dry-run"].(bool); dryRun {
+		if !h.contextAware() {
+			resp.Status = []string{"error"}
+			resp.ProtocolError = "dry-run requires a context-aware evaluator"
+			return resp
+		}
+		ctx = withDryRun(ctx)
+	}
+
+	if _, ok := req.Data["seed"]; ok {
+		seed, ok := intData(req, "seed")
+		if !ok {
+			resp.Status = []string{"error"}
+			resp.ProtocolError = "eval operation requires 'seed' to be an integer"
+			return resp
+		}
+		if !h.contextAware() {
+			resp.Status = []string{"error"}
+			resp.ProtocolError = "seed requires a context-aware evaluator"
+			return resp
+		}
+		ctx = withSeed(ctx, int64(seed))
+	}
+
+	if raw, ok := req.Data["deadline"]; ok {
+		text, _ := raw.(string)
+		deadline, err := time.Parse(time.RFC3339Nano, text)
+		if err != nil {
+			resp.Status = []string{"error"}
+			resp.ProtocolError = "eval operation requires 'deadline' to be an RFC 3339 timestamp"
+			return resp
+		}
+		// The deadline is judged by the server's clock
+		if !time.Now().Before(deadline) {
+			resp.Status = []string{"error", "timeout"}
+			resp.ProtocolError = "deadline has already passed"
+			return resp
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	var valueType *ValueType
+	if wantsType(req) {
+		valueType = &ValueType{}
+		ctx = withValueType(ctx, valueType)
+	}
+
+	var before map[string]interface{}
+	var snapshots *EnvSnapshots
+	if wantsDiff(req) {
+		if h.Snapshot == nil {
+			resp.Status = []string{"error"}
+			resp.ProtocolError = "with-diff is not supported by this server"
+			return resp
+		}
+		before = h.Snapshot()
+		snapshots = &EnvSnapshots{}
+		ctx = withEnvSnapshots(ctx, snapshots)
+	}
 
 	// Evaluate the code
-	result, output, err := h.evaluator(req.Code)
+	start := time.Now()
+	result, output, chunks, err := h.evaluate(ctx, req, code)
+	if snapshots != nil {
+		if snapshots.Before != nil && snapshots.After != nil {
+			setEnvDiff(resp, snapshots.Before, snapshots.After)
+		} else {
+			setEnvDiff(resp, before, h.Snapshot())
+		}
+	}
+	if wantsMeta(req) {
+		setMeta(resp, code, time.Since(start))
+	}
+	setOutputChunks(resp, chunks)
 	if err != nil {
-		// Catastrophic error (not a Zylisp error-as-data)
-		resp.Status = []string{"error"}
-		resp.ProtocolError = fmt.Sprintf("evaluator error: %v", err)
-		return resp
+		return evaluatorError(resp, output, err)
 	}
 
 	// Success - even if result is a Zylisp error, it's in the value field
+	if values, ok := result.(Values); ok {
+		result = setValues(req, resp, values)
+	}
 	resp.Value = result
 	resp.Output = output
 	resp.Status = []string{"done"}
+	if valueType != nil {
+		if valueType.Name == "" {
+			valueType.Name = h.typeOf(result)
+		}
+		setValueType(resp, valueType.Name)
+	}
+	if wantsStringify(req) {
+		resp.Value = stringify(result)
+	}
+	h.pageResult(req, resp)
+	return resp
+}
+
+// evalCode returns the code an eval request asks for: the Code field, or
+// data.code-base64 decoded. Setting both is rejected as ambiguous. If the
+// request is invalid, the reason is returned instead.
+func evalCode(req *protocol.Message) (code string, problem string) {
+	raw, ok := req.Data["code-base64"]
+	if !ok {
+		if req.Code == "" {
+			return "", "eval operation requires 'code' field"
+		}
+		return req.Code, ""
+	}
+
+	if req.Code != "" {
+		return "", "eval operation accepts 'code' or 'code-base64', not both"
+	}
+	encoded, ok := raw.(string)
+	if !ok {
+		return "", "eval operation requires 'code-base64' to be a string"
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Sprintf("invalid 'code-base64': %v", err)
+	}
+	if len(decoded) == 0 {
+		return "", "eval operation requires 'code' field"
+	}
+	return string(decoded), ""
+}
+
+// evaluate runs code through the context-aware evaluator when one is configured,
+// falling back to the plain evaluator otherwise. While it runs, the evaluation
+// is tracked in the request's session so that it can be interrupted. Output
+// chunks are only returned by a ChunkedEvaluator.
+func (h *Handler) evaluate(ctx context.Context, req *protocol.Message, code string) (interface{}, string, []OutputChunk, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sess := h.session(req.Session)
+	sess.track(req.ID, cancel)
+	defer sess.untrack(req.ID)
+
+	if err := sess.waitResumed(ctx); err != nil {
+		return nil, "", nil, err
+	}
+
+	release, err := h.admit(ctx, req)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	defer release()
+
+	if _, ok := ctx.Deadline(); !ok && h.DefaultEvalTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, h.DefaultEvalTimeout)
+		defer cancelTimeout()
+	}
+
+	if h.SlowLogThreshold > 0 {
+		defer h.logIfSlow(req, code, time.Now())
+	}
+
+	if !h.contextAware() {
+		result, output, err := h.evaluator(code)
+		h.teeOutput(req, output)
+		return result, output, nil, err
+	}
+
+	ctx, stream := h.withEvalStream(ctx, req, sess)
+	if h.ChunkedEvaluator != nil {
+		result, chunks, err := h.ChunkedEvaluator(ctx, code)
+		if buffered := stream.finish(); buffered != "" {
+			chunks = append([]OutputChunk{{Stream: StdoutStream, Text: buffered}}, chunks...)
+		}
+		output := flattenChunks(chunks)
+		h.teeOutput(req, output)
+		return result, output, chunks, err
+	}
+
+	result, output, err := h.ContextEvaluator(ctx, code)
+	output = stream.finish() + output
+	h.teeOutput(req, output)
+	return result, output, nil, err
+}
+
+// slowLogCodeLimit is how much of a slow evaluation's code is logged.
+const slowLogCodeLimit = 80
+
+// logIfSlow logs the evaluation of code started at start if it took longer
+// than SlowLogThreshold.
+func (h *Handler) logIfSlow(req *protocol.Message, code string, start time.Time) {
+	elapsed := time.Since(start)
+	if elapsed <= h.SlowLogThreshold {
+		return
+	}
+	h.Log().Warn("slow evaluation",
+		"op", req.Op, "session", req.Session, "id", req.ID, "duration", elapsed, "code", truncate(code, slowLogCodeLimit))
+}
+
+// contextAware reports whether evaluations receive a cancellable context.
+func (h *Handler) contextAware() bool {
+	return h.ChunkedEvaluator != nil || h.ContextEvaluator != nil
+}
+
+// evaluatorError fills resp for an evaluator that returned a Go error.
+// Cancellation errors are reported as interruptions, exceeded deadlines as
+// timeouts, ErrResourceExhausted as "resource-exhausted", evaluations
+// discarded by "flush-queue" as "cancelled", those refused by a paused
+// session as "paused" and those refused by a full queue as "server-busy";
+// anything else is a catastrophic failure (not a Zylisp error-as-data).
+func evaluatorError(resp *protocol.Message, output string, err error) *protocol.Message {
+	resp.Output = output
+	if errors.Is(err, context.Canceled) {
+		resp.Status = []string{"interrupted"}
+		return resp
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		resp.Status = []string{"error", "timeout"}
+		resp.ProtocolError = "operation timed out"
+		return resp
+	}
+	var busy *busyError
+	if errors.As(err, &busy) {
+		resp.Status = []string{"error", "server-busy"}
+		resp.ProtocolError = err.Error()
+		if resp.Data == nil {
+			resp.Data = make(map[string]interface{})
+		}
+		resp.Data["retry-after-ms"] = busy.retryAfter.Milliseconds() + 1
+		return resp
+	}
+	if errors.Is(err, errPaused) {
+		resp.Status = []string{"error", "paused"}
+		resp.ProtocolError = err.Error()
+		return resp
+	}
+	if errors.Is(err, errFlushed) {
+		resp.Status = []string{"error", "cancelled"}
+		resp.ProtocolError = err.Error()
+		return resp
+	}
+	if errors.Is(err, ErrResourceExhausted) {
+		resp.Status = []string{"error", "resource-exhausted"}
+		resp.ProtocolError = err.Error()
+		return resp
+	}
+
+	resp.Status = []string{"error"}
+	resp.ProtocolError = fmt.Sprintf("evaluator error: %v", err)
 	return resp
 }
 
 // handleLoadFile processes the "load-file" operation.
-func (h *Handler) handleLoadFile(req *protocol.Message, resp *protocol.Message) *protocol.Message {
+func (h *Handler) handleLoadFile(ctx context.Context, req *protocol.Message, resp *protocol.Message) *protocol.Message {
 	// Get file path from either 'file' or 'file-path' field
 	var filePath string
 	if req.Data != nil {
@@ -98,21 +644,30 @@ func (h *Handler) handleLoadFile(req *protocol.Message, resp *protocol.Message)
 		return resp
 	}
 
+	cwd, ok := req.Data["cwd"].(string)
+	if _, set := req.Data["cwd"]; set && !ok {
+		resp.Status = []string{"error"}
+		resp.ProtocolError = "load-file operation requires 'cwd' to be a string"
+		return resp
+	}
+
 	// Read the file
-	code, err := os.ReadFile(filePath)
+	code, err := h.readSource(filePath, cwd)
 	if err != nil {
 		resp.Status = []string{"error"}
 		resp.ProtocolError = fmt.Sprintf("failed to read file: %v", err)
 		return resp
 	}
 
+	if wantsProgress(req) {
+		return h.loadWithProgress(ctx, req, resp, string(code))
+	}
+
 	// Evaluate the file contents
-	result, output, err := h.evaluator(string(code))
+	result, output, chunks, err := h.evaluate(ctx, req, string(code))
+	setOutputChunks(resp, chunks)
 	if err != nil {
-		// Catastrophic error
-		resp.Status = []string{"error"}
-		resp.ProtocolError = fmt.Sprintf("evaluator error: %v", err)
-		return resp
+		return evaluatorError(resp, output, err)
 	}
 
 	// Success
@@ -122,34 +677,280 @@ func (h *Handler) handleLoadFile(req *protocol.Message, resp *protocol.Message)
 	return resp
 }
 
+// readSource reads the file a "load-file" request names. A relative path is
+// resolved against cwd, if given. When FileRoot is set, relative paths and
+// cwd start from it, and neither the file nor cwd may lead outside it.
+func (h *Handler) readSource(file, cwd string) ([]byte, error) {
+	if h.FileRoot == "" {
+		if cwd != "" && !filepath.IsAbs(file) {
+			file = filepath.Join(cwd, file)
+		}
+		return os.ReadFile(file)
+	}
+
+	base, err := filepath.Abs(h.FileRoot)
+	if err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(file) {
+		dir := cwd
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(base, cwd)
+		}
+		if !within(base, dir) {
+			return nil, fmt.Errorf("cwd %q is outside the file root", cwd)
+		}
+		file = filepath.Join(dir, file)
+	}
+	if !within(base, file) {
+		return nil, fmt.Errorf("%q is outside the file root", file)
+	}
+	rel, _ := filepath.Rel(base, file)
+
+	// os.Root refuses paths that escape it, including through symlinks
+	root, err := os.OpenRoot(base)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	f, err := root.Open(rel)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// within reports whether path lies in the directory dir, judging by the
+// names alone. Both must be absolute.
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
 // handleDescribe processes the "describe" operation.
-// It returns information about the server's capabilities.
-func (h *Handler) handleDescribe(req *protocol.Message, resp *protocol.Message) *protocol.Message {
+// It returns information about the server's capabilities and, when the
+// transport provides it, the connection the request arrived on.
+func (h *Handler) handleDescribe(ctx context.Context, req *protocol.Message, resp *protocol.Message) *protocol.Message {
 	resp.Status = []string{"done"}
-	resp.Data = map[string]interface{}{
+	resp.Data = Manifest()
+	resp.Data["capabilities"] = h.capabilities(ctx)
+	if info, ok := connInfoFromContext(ctx); ok {
+		resp.Data["connection"] = map[string]interface{}{
+			"transport":   info.Transport,
+			"local-addr":  info.LocalAddr,
+			"remote-addr": info.RemoteAddr,
+			"tls":         info.TLS,
+		}
+	}
+	return resp
+}
+
+// Manifest returns the parts of the "describe" response that do not depend
+// on a running server: "versions", "ops" and "transports". Build tools can
+// embed it without connecting. The "capabilities" and "connection" entries
+// reflect a server's configuration and connection, so only describe has
+// them.
+func Manifest() map[string]interface{} {
+	return map[string]interface{}{
 		"versions": map[string]interface{}{
-			"zylisp":   "0.1.0",
-			"protocol": "0.1.0",
-		},
-		"ops": []string{
-			"eval",
-			"load-file",
-			"describe",
-			"interrupt",
+			"zylisp":   ZylispVersion,
+			"protocol": protocol.Version,
 		},
+		"ops": supportedOps(),
 		"transports": []string{
 			"in-process",
 			"unix",
 			"tcp",
 		},
 	}
-	return resp
+}
+
+// supportedOps lists the operations this handler implements, sorted.
+func supportedOps() []string {
+	return sortedUnique([]string{
+		"eval",
+		"pipe",
+		"load-file",
+		"describe",
+		"config",
+		"interrupt",
+		"ls-running",
+		"ping",
+		"flush-queue",
+		"pause-session",
+		"resume-session",
+		"result-page",
+		"reset",
+		"checkpoint",
+		"restore",
+		"apropos",
+		"define-alias",
+		"set-option",
+		"get-options",
+		"subscribe",
+		"unsubscribe",
+		"session-stream",
+		"stdin",
+		"upgrade-codec",
+		"close-connection",
+	})
+}
+
+// sortedUnique sorts names in place and removes duplicates, so that
+// describe's output is stable however the list is edited.
+func sortedUnique(names []string) []string {
+	sort.Strings(names)
+	unique := names[:0]
+	for _, name := range names {
+		if len(unique) == 0 || name != unique[len(unique)-1] {
+			unique = append(unique, name)
+		}
+	}
+	return unique
+}
+
+// capabilities reports which optional protocol features this handler's
+// configuration and the request's transport support. Clients use it to
+// decide whether to rely on them.
+func (h *Handler) capabilities(ctx context.Context) map[string]interface{} {
+	return map[string]interface{}{
+		// Output can be pushed mid-evaluation only by context-aware
+		// evaluators on transports that can push messages
+		"streaming": h.contextAware() && senderFromContext(ctx) != nil,
+		// Only context-aware evaluators observe interrupts
+		"interrupt": h.contextAware(),
+		// Requests are always scoped to a session
+		"sessions": true,
+		// No authentication is performed
+		"auth": false,
+	}
 }
 
 // handleInterrupt processes the "interrupt" operation.
-// This is a stub for now - full implementation requires context cancellation.
+// It cancels the in-flight evaluation named by data.interrupt-id in the
+// request's session, or every in-flight evaluation in the session when
+// data.all is true, and acknowledges at once how many were signalled and
+// whether any target was found, before the interrupted evaluations respond.
+// Only evaluators configured through ContextEvaluator or ChunkedEvaluator
+// observe the cancellation.
 func (h *Handler) handleInterrupt(req *protocol.Message, resp *protocol.Message) *protocol.Message {
-	resp.Status = []string{"error"}
-	resp.ProtocolError = "interrupt operation not yet fully implemented"
+	var targetID string
+	var all bool
+	if req.Data != nil {
+		targetID, _ = req.Data["interrupt-id"].(string)
+		all, _ = req.Data["all"].(bool)
+	}
+
+	if targetID == "" && !all {
+		resp.Status = []string{"error"}
+		resp.ProtocolError = "interrupt operation requires 'interrupt-id' or 'all' in data field"
+		return resp
+	}
+
+	var count int
+	if sess := h.lookupSession(req.Session); sess == nil {
+		// Nothing has run in a session without state
+	} else if all {
+		count = sess.interruptAll()
+	} else if sess.interrupt(targetID) {
+		count = 1
+	}
+
+	resp.Status = []string{"done"}
+	resp.Data = map[string]interface{}{
+		"interrupted-count": count,
+		"target-found":      count > 0,
+	}
+	return resp
+}
+
+// handleReset processes the "reset" operation.
+// It restores the evaluation environment using the configured Resetter.
+func (h *Handler) handleReset(req *protocol.Message, resp *protocol.Message) *protocol.Message {
+	if h.Resetter == nil {
+		resp.Status = []string{"error"}
+		resp.ProtocolError = "reset operation not supported by this server"
+		return resp
+	}
+
+	if err := h.Resetter(); err != nil {
+		resp.Status = []string{"error"}
+		resp.ProtocolError = fmt.Sprintf("reset failed: %v", err)
+		return resp
+	}
+
+	resp.Status = []string{"done"}
+	return resp
+}
+
+// handleApropos processes the "apropos" operation.
+// It returns the sorted built-in names containing the optional "query" substring.
+func (h *Handler) handleApropos(req *protocol.Message, resp *protocol.Message) *protocol.Message {
+	if h.Symbols == nil {
+		resp.Status = []string{"error"}
+		resp.ProtocolError = "apropos operation not supported by this server"
+		return resp
+	}
+
+	var query string
+	if req.Data != nil {
+		query, _ = req.Data["query"].(string)
+	}
+
+	matches := []string{}
+	for _, name := range h.Symbols() {
+		if strings.Contains(name, query) {
+			matches = append(matches, name)
+		}
+	}
+	sort.Strings(matches)
+
+	resp.Status = []string{"done"}
+	resp.Data = map[string]interface{}{
+		"matches": matches,
+	}
+	return resp
+}
+
+// handleSetOption processes the "set-option" operation.
+// It stores data.value under data.key in the request's session; a missing
+// or null value removes the option.
+func (h *Handler) handleSetOption(req *protocol.Message, resp *protocol.Message) *protocol.Message {
+	var key string
+	if req.Data != nil {
+		key, _ = req.Data["key"].(string)
+	}
+
+	if key == "" {
+		resp.Status = []string{"error"}
+		resp.ProtocolError = "set-option operation requires 'key' in data field"
+		return resp
+	}
+
+	h.session(req.Session).setOption(key, req.Data["value"])
+	resp.Status = []string{"done"}
+	return resp
+}
+
+// handlePing processes the "ping" operation, which clients send to check
+// that the server is still responding.
+func (h *Handler) handlePing(resp *protocol.Message) *protocol.Message {
+	resp.Status = []string{"done"}
+	resp.Data = map[string]interface{}{"pong": true}
+	return resp
+}
+
+// handleGetOptions processes the "get-options" operation.
+// It returns the options set for the request's session.
+func (h *Handler) handleGetOptions(req *protocol.Message, resp *protocol.Message) *protocol.Message {
+	options := map[string]interface{}{}
+	if sess := h.lookupSession(req.Session); sess != nil {
+		options = sess.snapshotOptions()
+	}
+	resp.Status = []string{"done"}
+	resp.Data = map[string]interface{}{
+		"options": options,
+	}
 	return resp
 }
@@ -0,0 +1,2207 @@
+package operations
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zylisp/repl/protocol"
+)
+
+// mockEvaluator is a simple evaluator for testing
+func mockEvaluator(code string) (interface{}, string, error) {
+	return code, "", nil
+}
+
+func TestDescribeVersions(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+
+	resp := h.Handle(&protocol.Message{Op: "describe", ID: "1"})
+	if len(resp.Status) == 0 || resp.Status[0] != "done" {
+		t.Fatalf("Expected status 'done', got %v", resp.Status)
+	}
+
+	versions, ok := resp.Data["versions"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("Expected versions map, got %T", resp.Data["versions"])
+	}
+
+	if versions["protocol"] != protocol.Version {
+		t.Errorf("Expected protocol version %q, got %v", protocol.Version, versions["protocol"])
+	}
+	if versions["zylisp"] != ZylispVersion {
+		t.Errorf("Expected zylisp version %q, got %v", ZylispVersion, versions["zylisp"])
+	}
+}
+
+func TestDescribeOpsSortedAndUnique(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+
+	resp := h.Handle(&protocol.Message{Op: "describe", ID: "1"})
+	ops, ok := resp.Data["ops"].([]string)
+	if !ok || len(ops) == 0 {
+		t.Fatalf("Expected ops list, got %v", resp.Data["ops"])
+	}
+	for i := 1; i < len(ops); i++ {
+		if ops[i-1] >= ops[i] {
+			t.Errorf("Ops not sorted and unique at %d: %q then %q", i, ops[i-1], ops[i])
+		}
+	}
+
+	if got := sortedUnique([]string{"stdin", "eval", "describe", "eval"}); strings.Join(got, ",") != "describe,eval,stdin" {
+		t.Errorf("Expected describe,eval,stdin, got %v", got)
+	}
+}
+
+func TestManifestMatchesDescribe(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+
+	manifest := Manifest()
+	resp := h.Handle(&protocol.Message{Op: "describe", ID: "1"})
+	for _, key := range []string{"versions", "ops", "transports"} {
+		if !reflect.DeepEqual(manifest[key], resp.Data[key]) {
+			t.Errorf("%s: manifest has %v, describe has %v", key, manifest[key], resp.Data[key])
+		}
+	}
+
+	// Every op in the manifest is dispatched by the handler
+	for _, op := range manifest["ops"].([]string) {
+		resp := h.Handle(&protocol.Message{Op: op, ID: "2"})
+		if len(resp.Status) > 1 && resp.Status[1] == "unknown-op" {
+			t.Errorf("Manifest lists %q, which the handler does not know", op)
+		}
+	}
+}
+
+func TestNotImplementedVersusUnknownOp(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+
+	for op, tag := range map[string]string{
+		"complete": "not-implemented",
+		"clone":    "not-implemented",
+		"frobnick": "unknown-op",
+	} {
+		resp := h.Handle(&protocol.Message{Op: op, ID: "1"})
+		if len(resp.Status) != 2 || resp.Status[0] != "error" || resp.Status[1] != tag {
+			t.Errorf("%s: expected status [error %s], got %v", op, tag, resp.Status)
+		}
+		if resp.ProtocolError == "" {
+			t.Errorf("%s: expected a protocol error", op)
+		}
+	}
+}
+
+func TestDescribeCapabilities(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+
+	resp := h.Handle(&protocol.Message{Op: "describe", ID: "1"})
+	caps, ok := resp.Data["capabilities"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("Expected capabilities map, got %T", resp.Data["capabilities"])
+	}
+	if caps["streaming"] != false {
+		t.Errorf("Expected streaming false, got %v", caps["streaming"])
+	}
+	if caps["interrupt"] != false {
+		t.Errorf("Expected interrupt false without a context evaluator, got %v", caps["interrupt"])
+	}
+
+	h.ContextEvaluator = func(ctx context.Context, code string) (interface{}, string, error) {
+		return code, "", nil
+	}
+	resp = h.Handle(&protocol.Message{Op: "describe", ID: "2"})
+	caps = resp.Data["capabilities"].(map[string]interface{})
+	if caps["interrupt"] != true {
+		t.Errorf("Expected interrupt true with a context evaluator, got %v", caps["interrupt"])
+	}
+}
+
+func TestApropos(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+	h.Symbols = func() []string {
+		return []string{"mapcar", "car", "map", "filter", "hash-map"}
+	}
+
+	tests := []struct {
+		name string
+		data map[string]interface{}
+		want []string
+	}{
+		{
+			name: "substring filter",
+			data: map[string]interface{}{"query": "map"},
+			want: []string{"hash-map", "map", "mapcar"},
+		},
+		{
+			name: "no filter",
+			data: nil,
+			want: []string{"car", "filter", "hash-map", "map", "mapcar"},
+		},
+		{
+			name: "no matches",
+			data: map[string]interface{}{"query": "zzz"},
+			want: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := h.Handle(&protocol.Message{Op: "apropos", ID: "1", Data: tt.data})
+			if len(resp.Status) == 0 || resp.Status[0] != "done" {
+				t.Fatalf("Expected status 'done', got %v", resp.Status)
+			}
+
+			matches, ok := resp.Data["matches"].([]string)
+			if !ok {
+				t.Fatalf("Expected matches slice, got %T", resp.Data["matches"])
+			}
+			if strings.Join(matches, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("Expected matches %v, got %v", tt.want, matches)
+			}
+		})
+	}
+}
+
+func TestAproposUnsupported(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+
+	resp := h.Handle(&protocol.Message{Op: "apropos", ID: "1"})
+	if len(resp.Status) == 0 || resp.Status[0] != "error" {
+		t.Errorf("Expected status 'error', got %v", resp.Status)
+	}
+}
+
+func TestContextEvaluatorCancellation(t *testing.T) {
+	h := NewHandler(func(code string) (interface{}, string, error) {
+		t.Error("plain evaluator called while ContextEvaluator is set")
+		return nil, "", nil
+	})
+
+	started := make(chan string, 1)
+	h.ContextEvaluator = func(ctx context.Context, code string) (interface{}, string, error) {
+		started <- SessionFromContext(ctx)
+		<-ctx.Done()
+		return nil, "partial\n", ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	respCh := make(chan *protocol.Message, 1)
+	go func() {
+		respCh <- h.HandleContext(ctx, &protocol.Message{
+			Op:      "eval",
+			ID:      "1",
+			Session: "session-1",
+			Code:    "(loop)",
+		})
+	}()
+
+	select {
+	case session := <-started:
+		if session != "session-1" {
+			t.Errorf("Expected session %q in context, got %q", "session-1", session)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Evaluator was not called")
+	}
+
+	cancel()
+
+	select {
+	case resp := <-respCh:
+		if len(resp.Status) != 1 || resp.Status[0] != "interrupted" {
+			t.Errorf("Expected status 'interrupted', got %v", resp.Status)
+		}
+		if resp.Output != "partial\n" {
+			t.Errorf("Expected partial output to be kept, got %q", resp.Output)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Cancellation did not reach the evaluator")
+	}
+}
+
+func TestPlainEvaluatorStillSupported(t *testing.T) {
+	h := NewHandler(func(code string) (interface{}, string, error) {
+		return float64(3), "", nil
+	})
+
+	resp := h.HandleContext(context.Background(), &protocol.Message{Op: "eval", ID: "1", Code: "(+ 1 2)"})
+	if resp.Value != float64(3) {
+		t.Errorf("Expected value 3, got %v", resp.Value)
+	}
+	if len(resp.Status) == 0 || resp.Status[0] != "done" {
+		t.Errorf("Expected status 'done', got %v", resp.Status)
+	}
+}
+
+func TestSessionOptions(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+
+	var seen map[string]interface{}
+	h.ContextEvaluator = func(ctx context.Context, code string) (interface{}, string, error) {
+		seen = OptionsFromContext(ctx)
+		return nil, "", nil
+	}
+
+	resp := h.Handle(&protocol.Message{
+		Op:      "set-option",
+		ID:      "1",
+		Session: "a",
+		Data:    map[string]interface{}{"key": "*print-length*", "value": float64(10)},
+	})
+	if len(resp.Status) == 0 || resp.Status[0] != "done" {
+		t.Fatalf("Expected status 'done', got %v (%s)", resp.Status, resp.ProtocolError)
+	}
+
+	resp = h.Handle(&protocol.Message{Op: "get-options", ID: "2", Session: "a"})
+	options := resp.Data["options"].(map[string]interface{})
+	if options["*print-length*"] != float64(10) {
+		t.Errorf("Expected option in session a, got %v", options)
+	}
+
+	resp = h.Handle(&protocol.Message{Op: "get-options", ID: "3", Session: "b"})
+	options = resp.Data["options"].(map[string]interface{})
+	if len(options) != 0 {
+		t.Errorf("Expected no options in session b, got %v", options)
+	}
+
+	// The evaluator sees only its own session's options
+	h.Handle(&protocol.Message{Op: "eval", ID: "4", Session: "a", Code: "x"})
+	if seen["*print-length*"] != float64(10) {
+		t.Errorf("Expected evaluator to see session a options, got %v", seen)
+	}
+	h.Handle(&protocol.Message{Op: "eval", ID: "5", Session: "b", Code: "x"})
+	if len(seen) != 0 {
+		t.Errorf("Expected evaluator to see no options in session b, got %v", seen)
+	}
+
+	// Clearing an option removes it
+	h.Handle(&protocol.Message{
+		Op:      "set-option",
+		ID:      "6",
+		Session: "a",
+		Data:    map[string]interface{}{"key": "*print-length*"},
+	})
+	resp = h.Handle(&protocol.Message{Op: "get-options", ID: "7", Session: "a"})
+	if options := resp.Data["options"].(map[string]interface{}); len(options) != 0 {
+		t.Errorf("Expected option to be cleared, got %v", options)
+	}
+}
+
+func TestSetOptionRequiresKey(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+
+	resp := h.Handle(&protocol.Message{Op: "set-option", ID: "1"})
+	if len(resp.Status) == 0 || resp.Status[0] != "error" {
+		t.Errorf("Expected status 'error', got %v", resp.Status)
+	}
+}
+
+// blockingHandler returns a handler whose evaluator blocks until interrupted,
+// along with a channel that receives each evaluation's session once it starts.
+func blockingHandler() (*Handler, chan string) {
+	started := make(chan string, 10)
+	h := NewHandler(mockEvaluator)
+	h.ContextEvaluator = func(ctx context.Context, code string) (interface{}, string, error) {
+		started <- SessionFromContext(ctx)
+		<-ctx.Done()
+		return nil, "", ctx.Err()
+	}
+	return h, started
+}
+
+func TestInterruptAllInSession(t *testing.T) {
+	h, started := blockingHandler()
+
+	responses := make(chan *protocol.Message, 3)
+	for _, req := range []*protocol.Message{
+		{Op: "eval", ID: "1", Session: "notebook", Code: "(slow)"},
+		{Op: "eval", ID: "2", Session: "notebook", Code: "(slow)"},
+		{Op: "eval", ID: "3", Session: "other", Code: "(slow)"},
+	} {
+		go func(req *protocol.Message) {
+			responses <- h.Handle(req)
+		}(req)
+	}
+	for i := 0; i < 3; i++ {
+		<-started
+	}
+
+	resp := h.Handle(&protocol.Message{
+		Op:      "interrupt",
+		ID:      "4",
+		Session: "notebook",
+		Data:    map[string]interface{}{"all": true},
+	})
+	if len(resp.Status) == 0 || resp.Status[0] != "done" {
+		t.Fatalf("Expected status 'done', got %v (%s)", resp.Status, resp.ProtocolError)
+	}
+	if resp.Data["interrupted-count"] != 2 {
+		t.Errorf("Expected 2 interrupted evals, got %v", resp.Data["interrupted-count"])
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-responses:
+			if r.ID == "3" {
+				t.Fatal("Eval in another session was interrupted")
+			}
+			if len(r.Status) == 0 || r.Status[0] != "interrupted" {
+				t.Errorf("Expected eval %s to be interrupted, got %v", r.ID, r.Status)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for interrupted evals")
+		}
+	}
+
+	// Interrupt the remaining eval by ID
+	resp = h.Handle(&protocol.Message{
+		Op:      "interrupt",
+		ID:      "5",
+		Session: "other",
+		Data:    map[string]interface{}{"interrupt-id": "3"},
+	})
+	if resp.Data["interrupted-count"] != 1 {
+		t.Errorf("Expected 1 interrupted eval, got %v", resp.Data["interrupted-count"])
+	}
+	if resp.Data["target-found"] != true {
+		t.Errorf("Expected the ack to report the target found, got %v", resp.Data["target-found"])
+	}
+	select {
+	case r := <-responses:
+		if r.ID != "3" || r.Status[0] != "interrupted" {
+			t.Errorf("Expected eval 3 to be interrupted, got %+v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for eval 3")
+	}
+}
+
+// gatedWriter collects writes, blocking each one until open is closed.
+type gatedWriter struct {
+	open chan struct{}
+	mu   sync.Mutex
+	buf  strings.Builder
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	<-w.open
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *gatedWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+func TestOutputSink(t *testing.T) {
+	sink := &gatedWriter{open: make(chan struct{})}
+	h := NewHandler(func(code string) (interface{}, string, error) {
+		return nil, code + " line 1\n" + code + " line 2\n", nil
+	})
+	h.OutputSink = sink
+
+	// The sink is stuck, but evaluations must not wait for it
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.Handle(&protocol.Message{Op: "eval", ID: "1", Session: "a", Code: "first"})
+		h.Handle(&protocol.Message{Op: "eval", ID: "2", Session: "b", Code: "second"})
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Evaluations blocked on a slow output sink")
+	}
+
+	close(sink.open)
+	want := "[a 1] first line 1\n[a 1] first line 2\n[b 2] second line 1\n[b 2] second line 2\n"
+	deadline := time.Now().Add(2 * time.Second)
+	for sink.String() != want && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := sink.String(); got != want {
+		t.Errorf("Expected sink transcript %q, got %q", want, got)
+	}
+}
+
+func TestMaxSessions(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+	h.MaxSessions = 2
+	eval := func(session string) *protocol.Message {
+		return h.Handle(&protocol.Message{Op: "eval", ID: "1", Session: session, Code: "(+ 1 2)"})
+	}
+
+	eval("a")
+	eval("b")
+	resp := eval("c")
+	if len(resp.Status) != 2 || resp.Status[1] != "too-many-sessions" {
+		t.Fatalf("Expected a third session to be rejected, got %v", resp.Status)
+	}
+	if resp := eval("a"); resp.Status[0] != "done" {
+		t.Errorf("Expected existing sessions to keep working, got %v", resp.Status)
+	}
+
+	// With a TTL, the least recently active idle session makes room
+	h.SessionIdleTTL = 20 * time.Millisecond
+	time.Sleep(30 * time.Millisecond)
+	eval("b")
+	if resp := eval("c"); resp.Status[0] != "done" {
+		t.Fatalf("Expected session c to evict an idle session, got %v", resp.Status)
+	}
+	var ids []string
+	for _, info := range h.Sessions() {
+		ids = append(ids, info.ID)
+	}
+	if want := []string{"b", "c"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("Expected sessions %v after evicting a, got %v", want, ids)
+	}
+	if resp := eval("d"); len(resp.Status) != 2 || resp.Status[1] != "too-many-sessions" {
+		t.Errorf("Expected no session to be evictable yet, got %v", resp.Status)
+	}
+}
+
+func TestOnlySessionOpsCreateSessions(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+	h.MaxSessions = 1
+	h.Handle(&protocol.Message{Op: "eval", ID: "1", Session: "a", Code: "(+ 1 2)"})
+
+	for _, op := range []string{"describe", "ping", "get-options", "ls-running", "result-page", "unsubscribe"} {
+		resp := h.Handle(&protocol.Message{Op: op, ID: "2", Session: "b"})
+		if len(resp.Status) > 1 && resp.Status[1] == "too-many-sessions" {
+			t.Errorf("Expected %s not to count against MaxSessions, got %v", op, resp.Status)
+		}
+	}
+	if resp := h.Handle(&protocol.Message{Op: "interrupt", ID: "3", Session: "b", Data: map[string]interface{}{"all": true}}); resp.Status[0] != "done" {
+		t.Errorf("Expected interrupt in a session without state to succeed, got %v %s", resp.Status, resp.ProtocolError)
+	}
+	if n := len(h.Sessions()); n != 1 {
+		t.Errorf("Expected only the evaluating session to exist, got %d sessions", n)
+	}
+
+	if resp := h.Handle(&protocol.Message{Op: "set-option", ID: "4", Session: "b", Data: map[string]interface{}{"key": "k", "value": 1}}); len(resp.Status) != 2 || resp.Status[1] != "too-many-sessions" {
+		t.Errorf("Expected set-option to need a new session, got %v", resp.Status)
+	}
+}
+
+func TestMaxSessionsConcurrent(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+	h.MaxSessions = 4
+
+	var wg sync.WaitGroup
+	var accepted int32
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp := h.Handle(&protocol.Message{Op: "eval", ID: "1", Session: fmt.Sprint("s", i), Code: "(+ 1 2)"})
+			if resp.Status[0] == "done" {
+				atomic.AddInt32(&accepted, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := len(h.Sessions()); n != h.MaxSessions {
+		t.Errorf("Expected exactly %d sessions, got %d", h.MaxSessions, n)
+	}
+	if n := atomic.LoadInt32(&accepted); int(n) != h.MaxSessions {
+		t.Errorf("Expected %d requests to be accepted, got %d", h.MaxSessions, n)
+	}
+}
+
+// point is a domain type that JSON would encode with exported field names.
+type point struct{ x, y int }
+
+func TestValueMarshaler(t *testing.T) {
+	h := NewHandler(func(code string) (interface{}, string, error) {
+		switch code {
+		case "(values)":
+			return Values{point{1, 2}, "plain"}, "", nil
+		case "(bad)":
+			return make(chan int), "", nil
+		}
+		return point{3, 4}, "", nil
+	})
+	h.ValueMarshaler = func(v interface{}) (interface{}, error) {
+		switch v := v.(type) {
+		case point:
+			return map[string]interface{}{"type": "point", "x": v.x, "y": v.y}, nil
+		case chan int:
+			return nil, fmt.Errorf("channels cannot be sent")
+		}
+		return v, nil
+	}
+
+	resp := h.Handle(&protocol.Message{Op: "eval", ID: "1", Code: "(point)"})
+	encoded, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatalf("Failed to encode response: %v", err)
+	}
+	var decoded protocol.Message
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	want := map[string]interface{}{"type": "point", "x": float64(3), "y": float64(4)}
+	if !reflect.DeepEqual(decoded.Value, want) {
+		t.Errorf("Expected the point as %v on the wire, got %s", want, encoded)
+	}
+
+	resp = h.Handle(&protocol.Message{Op: "eval", ID: "2", Code: "(values)"})
+	values := resp.Data["values"].([]interface{})
+	if _, ok := values[0].(map[string]interface{}); !ok || values[1] != "plain" {
+		t.Errorf("Expected every value to be marshaled, got %v", values)
+	}
+
+	resp = h.Handle(&protocol.Message{Op: "eval", ID: "3", Code: "(bad)"})
+	if resp.Status[0] != "error" || resp.Value != nil || !strings.Contains(resp.ProtocolError, "channels") {
+		t.Errorf("Expected a marshal failure to be a protocol error, got %+v", resp)
+	}
+}
+
+func TestValueMarshalerPushedMessages(t *testing.T) {
+	shared := []interface{}{point{1, 2}, point{3, 4}, point{5, 6}}
+	h := NewHandler(func(code string) (interface{}, string, error) {
+		return shared, "", nil
+	})
+	h.ValueMarshaler = func(v interface{}) (interface{}, error) {
+		switch v := v.(type) {
+		case point:
+			return map[string]interface{}{"x": v.x, "y": v.y}, nil
+		case []interface{}:
+			marshaled := make([]interface{}, len(v))
+			for i, item := range v {
+				marshaled[i] = map[string]interface{}{"x": item.(point).x, "y": item.(point).y}
+			}
+			return marshaled, nil
+		}
+		return v, nil
+	}
+
+	var mu sync.Mutex
+	var pushed []*protocol.Message
+	ctx := WithSender(context.Background(), func(msg *protocol.Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		pushed = append(pushed, msg)
+		return nil
+	})
+	if resp := h.HandleContext(ctx, &protocol.Message{Op: "subscribe", ID: "sub", Session: "worker", Data: map[string]interface{}{"session": "worker"}}); resp.Status[0] != "done" {
+		t.Fatalf("Failed to subscribe: %v", resp.ProtocolError)
+	}
+
+	resp := h.Handle(&protocol.Message{Op: "eval", ID: "1", Session: "worker", Code: "(points)", Data: map[string]interface{}{"page-size": 2}})
+	if page, ok := resp.Value.([]interface{}); !ok || len(page) != 2 {
+		t.Fatalf("Expected a marshaled first page, got %v", resp.Value)
+	} else if _, ok := page[0].(map[string]interface{}); !ok {
+		t.Errorf("Expected the first page to be marshaled, got %v", page)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	mu.Lock()
+	for len(pushed) == 0 && time.Now().Before(deadline) {
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+	}
+	if len(pushed) != 1 {
+		t.Fatalf("Expected one subscriber copy, got %d", len(pushed))
+	}
+	if copied, ok := pushed[0].Value.([]interface{}); !ok || len(copied) == 0 {
+		t.Errorf("Expected the subscriber copy to carry the value, got %v", pushed[0].Value)
+	} else if _, ok := copied[0].(map[string]interface{}); !ok {
+		t.Errorf("Expected the subscriber copy to be marshaled, got %v", copied)
+	}
+	mu.Unlock()
+
+	handle, _ := resp.Data["result-handle"].(string)
+	resp = h.Handle(&protocol.Message{Op: "result-page", ID: "2", Session: "worker", Data: map[string]interface{}{"handle": handle, "offset": 2, "limit": 2}})
+	if page, ok := resp.Value.([]interface{}); !ok || len(page) != 1 {
+		t.Fatalf("Expected the rest of the result, got %v %s", resp.Value, resp.ProtocolError)
+	} else if _, ok := page[0].(map[string]interface{}); !ok {
+		t.Errorf("Expected result-page items to be marshaled, got %v", page)
+	}
+
+	for i, item := range shared {
+		if _, ok := item.(point); !ok {
+			t.Errorf("Expected the evaluator's value to be left alone, item %d is %v", i, item)
+		}
+	}
+}
+
+func TestSubscribeRequiresObservableSession(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+	ctx := WithSender(context.Background(), func(msg *protocol.Message) error { return nil })
+	subscribe := func(id string) *protocol.Message {
+		return h.HandleContext(ctx, &protocol.Message{Op: "subscribe", ID: id, Session: "watcher", Data: map[string]interface{}{"session": "worker"}})
+	}
+
+	h.Handle(&protocol.Message{Op: "eval", ID: "1", Session: "worker", Code: "(+ 1 2)"})
+	if resp := subscribe("2"); len(resp.Status) != 2 || resp.Status[1] != "not-observable" {
+		t.Errorf("Expected another session to be refused, got %v", resp.Status)
+	}
+	if resp := subscribe("3"); resp.Status[0] != "error" {
+		t.Errorf("Expected a missing session to be refused, got %v", resp.Status)
+	}
+
+	h.Handle(&protocol.Message{Op: "set-option", ID: "4", Session: "worker", Data: map[string]interface{}{"key": "observable", "value": true}})
+	if resp := subscribe("5"); resp.Status[0] != "done" {
+		t.Errorf("Expected an observable session to accept subscriptions, got %v %s", resp.Status, resp.ProtocolError)
+	}
+}
+
+func TestSubscriberDoesNotBlockPublisher(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+	release := make(chan struct{})
+	var delivered int32
+	ctx := WithSender(context.Background(), func(msg *protocol.Message) error {
+		<-release
+		atomic.AddInt32(&delivered, 1)
+		return nil
+	})
+	if resp := h.HandleContext(ctx, &protocol.Message{Op: "subscribe", ID: "sub", Session: "s", Data: map[string]interface{}{"session": "s"}}); resp.Status[0] != "done" {
+		t.Fatalf("Failed to subscribe: %v", resp.ProtocolError)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2*subscriberBuffer; i++ {
+			h.Handle(&protocol.Message{Op: "eval", ID: fmt.Sprint(i), Session: "s", Code: "(+ 1 2)"})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected evaluations to finish while the subscriber is stuck")
+	}
+
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&delivered); n == 0 || n > subscriberBuffer+1 {
+		t.Errorf("Expected at most %d copies to be delivered and the rest dropped, got %d", subscriberBuffer+1, n)
+	}
+}
+
+func TestConnectionOpsLeftToTransports(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+
+	resp := h.Handle(&protocol.Message{Op: "close-connection", ID: "1"})
+	if resp.Status[0] != "error" || !strings.Contains(resp.ProtocolError, "not supported by this transport") {
+		t.Errorf("Expected close-connection to be left to the transport, got %v %q", resp.Status, resp.ProtocolError)
+	}
+
+	// "close" is reserved for a session-level operation
+	resp = h.Handle(&protocol.Message{Op: "close", ID: "2"})
+	if resp.Status[0] != "error" || !strings.Contains(resp.ProtocolError, "unknown operation") {
+		t.Errorf("Expected close to be an unknown operation, got %v %q", resp.Status, resp.ProtocolError)
+	}
+}
+
+func TestPauseSession(t *testing.T) {
+	var mu sync.Mutex
+	var evaluated []string
+	h := NewHandler(func(code string) (interface{}, string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		evaluated = append(evaluated, code)
+		return code, "", nil
+	})
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(evaluated)
+	}
+
+	h.Handle(&protocol.Message{Op: "eval", ID: "1", Session: "flaky", Code: "(first)"})
+	resp := h.Handle(&protocol.Message{Op: "pause-session", ID: "2", Session: "operator", Data: map[string]interface{}{"session": "flaky"}})
+	if resp.Status[0] != "done" || resp.Data["paused"] != true {
+		t.Fatalf("Expected the session to be paused, got %v %v", resp.Status, resp.Data)
+	}
+	if state := h.Sessions()[0].State; state != "paused" {
+		t.Errorf("Expected the flaky session to show as paused, got %s", state)
+	}
+
+	done := make(chan *protocol.Message, 2)
+	for _, id := range []string{"3", "4"} {
+		id := id
+		go func() {
+			done <- h.Handle(&protocol.Message{Op: "eval", ID: id, Session: "flaky", Code: "(held)"})
+		}()
+	}
+	if resp := h.Handle(&protocol.Message{Op: "eval", ID: "5", Session: "operator", Code: "(other)"}); resp.Status[0] != "done" {
+		t.Errorf("Expected other sessions to keep running, got %v", resp.Status)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := count(); n != 2 {
+		t.Fatalf("Expected evals in the paused session to wait, got %d evaluations", n)
+	}
+
+	h.Handle(&protocol.Message{Op: "resume-session", ID: "6", Session: "operator", Data: map[string]interface{}{"session": "flaky"}})
+	for i := 0; i < 2; i++ {
+		select {
+		case resp := <-done:
+			if resp.Status[0] != "done" || resp.Value != "(held)" {
+				t.Errorf("Expected a held eval to complete, got %v", resp.Status)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected resume to release the held evals")
+		}
+	}
+
+	// Pausing with reject refuses evaluations instead
+	h.Handle(&protocol.Message{Op: "pause-session", ID: "7", Session: "flaky", Data: map[string]interface{}{"reject": true}})
+	resp = h.Handle(&protocol.Message{Op: "eval", ID: "8", Session: "flaky", Code: "(refused)"})
+	if len(resp.Status) != 2 || resp.Status[1] != "paused" {
+		t.Errorf("Expected a rejected eval, got %v", resp.Status)
+	}
+	if resp := h.Handle(&protocol.Message{Op: "pause-session", ID: "9", Data: map[string]interface{}{"session": "missing"}}); resp.Status[0] != "error" {
+		t.Errorf("Expected pausing an unknown session to fail, got %v", resp.Status)
+	}
+}
+
+func TestSessionsSnapshot(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	h := NewHandler(func(code string) (interface{}, string, error) {
+		if code == "(slow)" {
+			close(started)
+			<-release
+		}
+		return code, "", nil
+	})
+
+	h.Handle(&protocol.Message{Op: "eval", ID: "1", Session: "a", Code: "(+ 1 2)"})
+	h.Handle(&protocol.Message{Op: "describe", ID: "2", Session: "a"})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.Handle(&protocol.Message{Op: "eval", ID: "3", Session: "b", Code: "(slow)"})
+	}()
+	<-started
+
+	sessions := h.Sessions()
+	if len(sessions) != 2 || sessions[0].ID != "a" || sessions[1].ID != "b" {
+		t.Fatalf("Expected sessions a and b, got %+v", sessions)
+	}
+	if a := sessions[0]; a.State != "idle" || a.Requests != 2 || a.LastActivity.IsZero() {
+		t.Errorf("Expected session a idle after 2 requests, got %+v", a)
+	}
+	if b := sessions[1]; b.State != "evaluating" || b.Running != 1 {
+		t.Errorf("Expected session b evaluating, got %+v", b)
+	}
+
+	close(release)
+	<-done
+	if b := h.Sessions()[1]; b.State != "idle" {
+		t.Errorf("Expected session b idle once the eval finished, got %+v", b)
+	}
+}
+
+func TestInterruptUnknownTarget(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+
+	resp := h.Handle(&protocol.Message{
+		Op:   "interrupt",
+		ID:   "1",
+		Data: map[string]interface{}{"interrupt-id": "no-such-eval"},
+	})
+	if len(resp.Status) != 1 || resp.Status[0] != "done" {
+		t.Errorf("Expected status done, got %v", resp.Status)
+	}
+	if resp.Data["target-found"] != false {
+		t.Errorf("Expected the ack to report no target found, got %v", resp.Data["target-found"])
+	}
+}
+
+func TestInterruptRequiresTarget(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+
+	resp := h.Handle(&protocol.Message{Op: "interrupt", ID: "1"})
+	if len(resp.Status) == 0 || resp.Status[0] != "error" {
+		t.Errorf("Expected status 'error', got %v", resp.Status)
+	}
+}
+
+func TestIdempotencyKeyReplaysResponse(t *testing.T) {
+	var calls int
+	h := NewHandler(func(code string) (interface{}, string, error) {
+		calls++
+		return calls, "", nil
+	})
+
+	eval := func(id, session string) *protocol.Message {
+		return h.Handle(&protocol.Message{
+			Op:      "eval",
+			ID:      id,
+			Session: session,
+			Code:    "(side-effect)",
+			Data:    map[string]interface{}{"idempotency-key": "k1"},
+		})
+	}
+
+	first := eval("1", "s1")
+	retry := eval("2", "s1")
+	if calls != 1 {
+		t.Fatalf("Expected evaluator to run once, ran %d times", calls)
+	}
+	if retry.ID != "2" || retry.Value != first.Value {
+		t.Errorf("Expected cached value %v for retry 2, got %+v", first.Value, retry)
+	}
+
+	// A retry over a new connection arrives in another session
+	if other := eval("3", "conn-2"); other.Value != first.Value || calls != 1 {
+		t.Errorf("Expected the cached value in another session, got %v after %d calls", other.Value, calls)
+	}
+
+	// The cached reply is a private copy: changing a response in place
+	// affects neither the cache nor later replays
+	retry.Data = map[string]interface{}{"changed": true}
+	first.Status[0] = "changed"
+	if again := eval("4", "s1"); again.Status[0] != "done" || again.Data != nil {
+		t.Errorf("Expected an unchanged cached reply, got %+v", again)
+	}
+}
+
+func TestIdempotencyKeyConcurrentDuplicates(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	h := NewHandler(mockEvaluator)
+	h.ContextEvaluator = func(ctx context.Context, code string) (interface{}, string, error) {
+		calls.Add(1)
+		<-release
+		return []interface{}{"shared"}, "", nil
+	}
+
+	var wg sync.WaitGroup
+	responses := make([]*protocol.Message, 4)
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = h.Handle(&protocol.Message{
+				Op:   "eval",
+				ID:   fmt.Sprint(i),
+				Code: "(side-effect)",
+				Data: map[string]interface{}{"idempotency-key": "k1"},
+			})
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("Expected duplicates to wait for the first evaluation, ran %d times", n)
+	}
+	for i, resp := range responses {
+		if resp.ID != fmt.Sprint(i) || !reflect.DeepEqual(resp.Value, []interface{}{"shared"}) {
+			t.Errorf("Expected the shared value for request %d, got %+v", i, resp)
+		}
+	}
+}
+
+func TestIdempotencyCacheBounds(t *testing.T) {
+	var cache replyCache
+	now := time.Now()
+
+	for i := 0; i <= idempotencyCacheSize; i++ {
+		entry, _ := cache.claim(fmt.Sprintf("k%d", i), now)
+		cache.complete(entry, &protocol.Message{Status: []string{"done"}})
+	}
+	if _, owner := cache.claim("k1", now); owner {
+		t.Error("Expected k1 to remain cached")
+	}
+	if _, owner := cache.claim("k0", now); !owner {
+		t.Error("Expected the oldest entry to be evicted when the cache is full")
+	}
+	if _, owner := cache.claim("k2", now.Add(idempotencyTTL+time.Second)); !owner {
+		t.Error("Expected k2 to expire after the TTL")
+	}
+}
+
+func TestEvalMeta(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+
+	resp := h.Handle(&protocol.Message{Op: "eval", ID: "1", Code: "(+ 1 2)"})
+	if _, ok := resp.Data["meta"]; ok {
+		t.Errorf("Expected no meta without with-meta, got %v", resp.Data["meta"])
+	}
+
+	resp = h.Handle(&protocol.Message{
+		Op:   "eval",
+		ID:   "2",
+		Code: "(define x 1) ; comment (ignored)\n(+ x \"a)\") y",
+		Data: map[string]interface{}{"with-meta": true},
+	})
+	meta, ok := resp.Data["meta"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("Expected meta map, got %T", resp.Data["meta"])
+	}
+	if d, ok := meta["duration-ms"].(float64); !ok || d < 0 {
+		t.Errorf("Expected non-negative duration-ms, got %v", meta["duration-ms"])
+	}
+	if meta["form-count"] != 3 {
+		t.Errorf("Expected form-count 3, got %v", meta["form-count"])
+	}
+
+	resp = h.Handle(&protocol.Message{
+		Op:   "eval",
+		ID:   "3",
+		Code: "(quote 'y)",
+		Data: map[string]interface{}{"with-meta": true},
+	})
+	meta, _ = resp.Data["meta"].(map[string]interface{})
+	if _, ok := meta["form-count"]; ok {
+		t.Errorf("Expected no form-count for code the lexer rejects, got %v", meta["form-count"])
+	}
+}
+
+func TestWriteOutputWithoutStreaming(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+	h.ContextEvaluator = func(ctx context.Context, code string) (interface{}, string, error) {
+		WriteOutput(ctx, "written ")
+		if _, err := ReadInput(ctx); err == nil {
+			t.Error("Expected ReadInput to fail outside a streaming session")
+		}
+		return nil, "returned", nil
+	}
+
+	resp := h.Handle(&protocol.Message{Op: "eval", ID: "1", Code: "(x)"})
+	if resp.Output != "written returned" {
+		t.Errorf("Expected buffered output before returned output, got %q", resp.Output)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	if (RateLimit{}).NewLimiter() != nil {
+		t.Fatal("Expected the zero RateLimit to be disabled")
+	}
+
+	limiter := RateLimit{Rate: 10, EvictAfter: 2, EvictWindow: time.Second}.NewLimiter()
+	now := time.Now()
+
+	if allowed, _ := limiter.Allow(now); !allowed {
+		t.Error("Expected the first request to be allowed")
+	}
+	if allowed, evict := limiter.Allow(now); allowed || evict {
+		t.Errorf("Expected rejection without eviction, got allowed=%v evict=%v", allowed, evict)
+	}
+
+	// The bucket refills at Rate, and old rejections leave the window
+	if allowed, _ := limiter.Allow(now.Add(100 * time.Millisecond)); !allowed {
+		t.Error("Expected a request to be allowed after refilling")
+	}
+	later := now.Add(2 * time.Second)
+	limiter.Allow(later) // allowed after a full refill
+	if _, evict := limiter.Allow(later); evict {
+		t.Error("Expected the rejection outside the window to be forgotten")
+	}
+	if _, evict := limiter.Allow(later); !evict {
+		t.Error("Expected eviction after two rejections within the window")
+	}
+}
+
+func TestOutputChunksPreserveInterleaving(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+	h.ChunkedEvaluator = func(ctx context.Context, code string) (interface{}, []OutputChunk, error) {
+		// Simulates a program alternating between stdout and stderr
+		var chunks []OutputChunk
+		for i := 0; i < 3; i++ {
+			chunks = append(chunks,
+				OutputChunk{Stream: StdoutStream, Text: fmt.Sprintf("out%d\n", i)},
+				OutputChunk{Stream: StderrStream, Text: fmt.Sprintf("err%d\n", i)},
+			)
+		}
+		return "ok", chunks, nil
+	}
+
+	resp := h.Handle(&protocol.Message{Op: "eval", ID: "1", Code: "(run)"})
+	if resp.Output != "out0\nerr0\nout1\nerr1\nout2\nerr2\n" {
+		t.Errorf("Unexpected flattened output %q", resp.Output)
+	}
+
+	segments, ok := resp.Data["output-chunks"].([]interface{})
+	if !ok || len(segments) != 6 {
+		t.Fatalf("Expected 6 output chunks, got %v", resp.Data["output-chunks"])
+	}
+	for i, segment := range segments {
+		chunk := segment.(map[string]interface{})
+		stream, prefix := StdoutStream, "out"
+		if i%2 == 1 {
+			stream, prefix = StderrStream, "err"
+		}
+		want := fmt.Sprintf("%s%d\n", prefix, i/2)
+		if chunk["stream"] != stream || chunk["text"] != want {
+			t.Errorf("Chunk %d: expected %s %q, got %v", i, stream, want, chunk)
+		}
+	}
+
+	// Plain evaluators report no chunks
+	resp = NewHandler(mockEvaluator).Handle(&protocol.Message{Op: "eval", ID: "2", Code: "(+ 1 2)"})
+	if _, ok := resp.Data["output-chunks"]; ok {
+		t.Errorf("Expected no output chunks, got %v", resp.Data["output-chunks"])
+	}
+}
+
+func TestLsRunning(t *testing.T) {
+	h, started := blockingHandler()
+
+	done := make(chan *protocol.Message, 2)
+	go func() {
+		done <- h.Handle(&protocol.Message{Op: "eval", ID: "slow", Session: "a", Code: "(slow)"})
+	}()
+	<-started
+	time.Sleep(20 * time.Millisecond)
+	go func() {
+		done <- h.Handle(&protocol.Message{Op: "eval", ID: "newer", Session: "b", Code: "(slow)"})
+	}()
+	<-started
+
+	resp := h.Handle(&protocol.Message{Op: "ls-running", ID: "1"})
+	if len(resp.Status) == 0 || resp.Status[0] != "done" {
+		t.Fatalf("Expected status 'done', got %v (%s)", resp.Status, resp.ProtocolError)
+	}
+	running, ok := resp.Data["running"].([]interface{})
+	if !ok || len(running) != 2 {
+		t.Fatalf("Expected 2 running evals, got %v", resp.Data["running"])
+	}
+	first := running[0].(map[string]interface{})
+	if first["id"] != "slow" || first["session"] != "a" {
+		t.Errorf("Expected the longest running eval first, got %v", first)
+	}
+	if elapsed, _ := first["elapsed-ms"].(float64); elapsed <= 0 {
+		t.Errorf("Expected non-zero elapsed-ms, got %v", first["elapsed-ms"])
+	}
+
+	// Listed evals can be interrupted by session and ID
+	for _, entry := range running {
+		eval := entry.(map[string]interface{})
+		h.Handle(&protocol.Message{
+			Op:      "interrupt",
+			ID:      "2",
+			Session: eval["session"].(string),
+			Data:    map[string]interface{}{"interrupt-id": eval["id"]},
+		})
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-done:
+			if r.Status[0] != "interrupted" {
+				t.Errorf("Expected eval %s to be interrupted, got %v", r.ID, r.Status)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for interrupted evals")
+		}
+	}
+
+	resp = h.Handle(&protocol.Message{Op: "ls-running", ID: "3"})
+	if running := resp.Data["running"].([]interface{}); len(running) != 0 {
+		t.Errorf("Expected no running evals, got %v", running)
+	}
+}
+
+func TestOpTimeouts(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+	h.ContextEvaluator = func(ctx context.Context, code string) (interface{}, string, error) {
+		if code == "(slow)" {
+			<-ctx.Done()
+			return nil, "", ctx.Err()
+		}
+		return mockEvaluator(code)
+	}
+	h.OpTimeouts = map[string]time.Duration{
+		"eval":     50 * time.Millisecond,
+		"describe": time.Millisecond,
+	}
+
+	resp := h.Handle(&protocol.Message{Op: "describe", ID: "1"})
+	if len(resp.Status) != 1 || resp.Status[0] != "done" {
+		t.Errorf("Expected describe to be done, got %v", resp.Status)
+	}
+
+	resp = h.Handle(&protocol.Message{Op: "eval", ID: "2", Code: "(+ 1 2)"})
+	if len(resp.Status) != 1 || resp.Status[0] != "done" || resp.Value != "(+ 1 2)" {
+		t.Errorf("Expected fast eval to be done, got %v %v", resp.Status, resp.Value)
+	}
+
+	start := time.Now()
+	resp = h.Handle(&protocol.Message{Op: "eval", ID: "3", Code: "(slow)"})
+	if len(resp.Status) != 2 || resp.Status[0] != "error" || resp.Status[1] != "timeout" {
+		t.Errorf("Expected status [error timeout], got %v", resp.Status)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Slow eval took %v despite its 50ms timeout", elapsed)
+	}
+}
+
+func TestDefaultEvalTimeout(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+	h.ContextEvaluator = func(ctx context.Context, code string) (interface{}, string, error) {
+		if code == "(slow)" {
+			select {
+			case <-ctx.Done():
+				return nil, "", ctx.Err()
+			case <-time.After(200 * time.Millisecond):
+			}
+		}
+		return mockEvaluator(code)
+	}
+	h.DefaultEvalTimeout = 50 * time.Millisecond
+
+	resp := h.Handle(&protocol.Message{Op: "eval", ID: "1", Code: "(+ 1 2)"})
+	if len(resp.Status) != 1 || resp.Status[0] != "done" || resp.Value != "(+ 1 2)" {
+		t.Errorf("Expected fast eval to be done, got %v %v", resp.Status, resp.Value)
+	}
+
+	start := time.Now()
+	resp = h.Handle(&protocol.Message{Op: "eval", ID: "2", Code: "(slow)"})
+	if len(resp.Status) != 2 || resp.Status[0] != "error" || resp.Status[1] != "timeout" {
+		t.Errorf("Expected status [error timeout], got %v", resp.Status)
+	}
+	if elapsed := time.Since(start); elapsed >= 200*time.Millisecond {
+		t.Errorf("Slow eval took %v despite the 50ms default", elapsed)
+	}
+
+	// An explicit timeout takes the place of the default
+	h.OpTimeouts = map[string]time.Duration{"eval": time.Second}
+	resp = h.Handle(&protocol.Message{Op: "eval", ID: "3", Code: "(slow)"})
+	if len(resp.Status) != 1 || resp.Status[0] != "done" {
+		t.Errorf("Expected the op timeout to override the default, got %v", resp.Status)
+	}
+}
+
+func TestResultPaging(t *testing.T) {
+	list := make([]interface{}, 25)
+	for i := range list {
+		list[i] = i
+	}
+	h := NewHandler(func(code string) (interface{}, string, error) {
+		return list, "", nil
+	})
+
+	// Without page-size the whole list is returned
+	resp := h.Handle(&protocol.Message{Op: "eval", ID: "0", Code: "(range 25)"})
+	if items := resp.Value.([]interface{}); len(items) != 25 {
+		t.Errorf("Expected 25 items without paging, got %d", len(items))
+	}
+
+	resp = h.Handle(&protocol.Message{
+		Op:   "eval",
+		ID:   "1",
+		Code: "(range 25)",
+		Data: map[string]interface{}{"page-size": float64(10)},
+	})
+	if items := resp.Value.([]interface{}); len(items) != 10 || items[9] != 9 {
+		t.Fatalf("Expected the first page of 10 items, got %v", resp.Value)
+	}
+	handle, _ := resp.Data["result-handle"].(string)
+	if handle == "" || handle == "1" || resp.Data["result-count"] != 25 {
+		t.Fatalf("Expected a server-generated handle with 25 items, got %v", resp.Data)
+	}
+
+	var paged []interface{}
+	paged = append(paged, resp.Value.([]interface{})...)
+	for offset := 10; offset < 25; offset += 10 {
+		resp = h.Handle(&protocol.Message{
+			Op: "result-page",
+			ID: "page",
+			Data: map[string]interface{}{
+				"handle": handle,
+				"offset": float64(offset),
+				"limit":  float64(10),
+			},
+		})
+		if len(resp.Status) == 0 || resp.Status[0] != "done" {
+			t.Fatalf("Expected status 'done', got %v (%s)", resp.Status, resp.ProtocolError)
+		}
+		paged = append(paged, resp.Value.([]interface{})...)
+	}
+	if len(paged) != 25 {
+		t.Fatalf("Expected 25 paged items, got %d", len(paged))
+	}
+	for i, item := range paged {
+		if item != i {
+			t.Fatalf("Item %d: expected %d, got %v", i, i, item)
+		}
+	}
+
+	resp = h.Handle(&protocol.Message{
+		Op:   "result-page",
+		ID:   "missing",
+		Data: map[string]interface{}{"handle": "nope", "offset": 0, "limit": 10},
+	})
+	if len(resp.Status) == 0 || resp.Status[0] != "error" {
+		t.Errorf("Expected error for unknown handle, got %v", resp.Status)
+	}
+}
+
+func TestResultPagingRetentionLimit(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+	sess := h.session("")
+	now := time.Now()
+
+	for i := 0; i < pagedResultLimit+1; i++ {
+		sess.retainResult(fmt.Sprintf("r%d", i), []interface{}{i}, now)
+	}
+	if _, ok := sess.retainedResult("r0", now); ok {
+		t.Error("Expected the oldest result to be evicted")
+	}
+	if _, ok := sess.retainedResult(fmt.Sprintf("r%d", pagedResultLimit), now); !ok {
+		t.Error("Expected the newest result to be retained")
+	}
+	if _, ok := sess.retainedResult("r1", now.Add(pagedResultTTL+time.Second)); ok {
+		t.Error("Expected results to expire after the TTL")
+	}
+
+	// Items are bounded across results too
+	sess = h.session("items")
+	sess.retainResult("small", make([]interface{}, 10), now)
+	sess.retainResult("large", make([]interface{}, pagedItemLimit), now)
+	if _, ok := sess.retainedResult("small", now); ok {
+		t.Error("Expected the oldest result to be evicted to stay within the item limit")
+	}
+	if sess.retainedItems != pagedItemLimit {
+		t.Errorf("Expected %d retained items, got %d", pagedItemLimit, sess.retainedItems)
+	}
+}
+
+func TestResultPagingSkipsOversizedResults(t *testing.T) {
+	list := make([]interface{}, pagedItemLimit+1)
+	h := NewHandler(func(code string) (interface{}, string, error) {
+		return list, "", nil
+	})
+
+	resp := h.Handle(&protocol.Message{Op: "eval", ID: "1", Code: "(huge)", Data: map[string]interface{}{"page-size": 10}})
+	if items, _ := resp.Value.([]interface{}); len(items) != 10 {
+		t.Fatalf("Expected the first page, got %d items", len(items))
+	}
+	if _, ok := resp.Data["result-handle"]; ok || resp.Data["result-truncated"] != true {
+		t.Errorf("Expected an oversized result to be marked truncated without a handle, got %v", resp.Data)
+	}
+}
+
+func TestEvalStringify(t *testing.T) {
+	for _, value := range []interface{}{3, float64(3), int64(3)} {
+		h := NewHandler(func(code string) (interface{}, string, error) {
+			return value, "", nil
+		})
+
+		resp := h.Handle(&protocol.Message{
+			Op:   "eval",
+			ID:   "1",
+			Code: "(+ 1 2)",
+			Data: map[string]interface{}{"stringify": true},
+		})
+		if resp.Value != "3" {
+			t.Errorf("%T: expected string \"3\", got %T %v", value, resp.Value, resp.Value)
+		}
+	}
+}
+
+func TestSlowLogThreshold(t *testing.T) {
+	var logs strings.Builder
+	h := NewHandler(func(code string) (interface{}, string, error) {
+		if strings.HasPrefix(code, "(slow") {
+			time.Sleep(30 * time.Millisecond)
+		}
+		return code, "", nil
+	})
+	h.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	h.SlowLogThreshold = 10 * time.Millisecond
+
+	h.Handle(&protocol.Message{Op: "eval", ID: "1", Session: "s", Code: "(+ 1 2)"})
+	if logs.Len() != 0 {
+		t.Fatalf("Expected no log for a fast eval, got %q", logs.String())
+	}
+
+	h.Handle(&protocol.Message{Op: "eval", ID: "2", Session: "s", Code: "(slow " + strings.Repeat("x", 200) + ")"})
+	line := logs.String()
+	for _, want := range []string{"slow evaluation", "op=eval", "session=s", "duration=", "(slow xxx"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("Expected log to contain %q, got %q", want, line)
+		}
+	}
+	if strings.Contains(line, strings.Repeat("x", slowLogCodeLimit)) {
+		t.Errorf("Expected code to be truncated, got %q", line)
+	}
+}
+
+func TestDebugLogging(t *testing.T) {
+	var logs strings.Builder
+	h := NewHandler(mockEvaluator)
+	h.Logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	h.Handle(&protocol.Message{Op: "eval", ID: "1", Session: "s", Code: "(+ 1 2)"})
+	if logs.Len() != 0 {
+		t.Fatalf("Expected no logs without Debug, got %q", logs.String())
+	}
+
+	h.Debug = true
+	h.Handle(&protocol.Message{Op: "eval", ID: "2", Session: "s", Code: "(+ 1 2) " + strings.Repeat("x", 300)})
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected a request and a response log line, got %q", logs.String())
+	}
+	for _, want := range []string{"level=DEBUG", "msg=request", "id=2", "op=eval", `code="(+ 1 2) xxx`} {
+		if !strings.Contains(lines[0], want) {
+			t.Errorf("Expected request log to contain %q, got %q", want, lines[0])
+		}
+	}
+	for _, want := range []string{"level=DEBUG", "msg=response", "id=2", "status=[done]", "value="} {
+		if !strings.Contains(lines[1], want) {
+			t.Errorf("Expected response log to contain %q, got %q", want, lines[1])
+		}
+	}
+	if strings.Contains(logs.String(), strings.Repeat("x", debugLogLimit)) {
+		t.Errorf("Expected code and value to be truncated, got %q", logs.String())
+	}
+}
+
+func TestTruncateKeepsRunesWhole(t *testing.T) {
+	// "é" is two bytes, so a 3-byte limit falls inside the second one
+	if got := truncate("éééé", 3); got != "é..." {
+		t.Errorf("Expected the cut to back up to a rune boundary, got %q", got)
+	}
+	if got := truncate("éééé", 4); got != "éé..." {
+		t.Errorf("Expected whole runes up to the limit, got %q", got)
+	}
+	if got := truncate("abc", 3); got != "abc" {
+		t.Errorf("Expected short strings unchanged, got %q", got)
+	}
+}
+
+func TestStreamedOutputPrecedesResponse(t *testing.T) {
+	var mu sync.Mutex
+	var pushed []string
+	returned := false
+	late := 0
+	send := func(msg *protocol.Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if returned {
+			late++
+		}
+		pushed = append(pushed, msg.Output)
+		return nil
+	}
+	ctx := WithSender(context.Background(), send)
+
+	h := NewHandler(mockEvaluator)
+	h.ContextEvaluator = func(ctx context.Context, code string) (interface{}, string, error) {
+		// Output is still being written from other goroutines as the
+		// evaluator returns
+		for i := 0; i < 4; i++ {
+			go func(i int) {
+				for j := 0; ; j++ {
+					if WriteOutput(ctx, fmt.Sprintf("%d.%d ", i, j)) != nil {
+						return
+					}
+				}
+			}(i)
+		}
+		WriteOutput(ctx, "last ")
+		return "value", "", nil
+	}
+	h.HandleContext(ctx, &protocol.Message{Op: "session-stream", ID: "1", Session: "s"})
+
+	for i := 0; i < 20; i++ {
+		resp := h.HandleContext(ctx, &protocol.Message{Op: "eval", ID: "2", Session: "s", Code: "(x)"})
+		mu.Lock()
+		returned = true
+		mu.Unlock()
+		if resp.Value != "value" {
+			t.Fatalf("Expected value, got %v", resp.Value)
+		}
+
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		if late != 0 {
+			t.Fatalf("Iteration %d: %d output messages were pushed after the response", i, late)
+		}
+		if !strings.Contains(strings.Join(pushed, ""), "last ") {
+			t.Fatalf("Iteration %d: output written before returning was not pushed", i)
+		}
+		returned, pushed = false, nil
+		mu.Unlock()
+	}
+}
+
+func TestEvalBindings(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+	h.ContextEvaluator = func(ctx context.Context, code string) (interface{}, string, error) {
+		return BindingsFromContext(ctx)["name"], "", nil
+	}
+
+	resp := h.Handle(&protocol.Message{
+		Op:   "eval",
+		ID:   "1",
+		Code: "name",
+		Data: map[string]interface{}{"bindings": map[string]interface{}{"name": "zy"}},
+	})
+	if resp.Value != "zy" {
+		t.Errorf("Expected the binding to be visible, got %v", resp.Value)
+	}
+
+	resp = h.Handle(&protocol.Message{Op: "eval", ID: "2", Code: "name"})
+	if resp.Value != nil {
+		t.Errorf("Expected no bindings on a later eval, got %v", resp.Value)
+	}
+
+	resp = h.Handle(&protocol.Message{
+		Op:   "eval",
+		ID:   "3",
+		Code: "name",
+		Data: map[string]interface{}{"bindings": []interface{}{"name"}},
+	})
+	if len(resp.Status) == 0 || resp.Status[0] != "error" {
+		t.Errorf("Expected malformed bindings to be rejected, got %v", resp.Status)
+	}
+
+	plain := NewHandler(mockEvaluator)
+	resp = plain.Handle(&protocol.Message{
+		Op:   "eval",
+		ID:   "4",
+		Code: "name",
+		Data: map[string]interface{}{"bindings": map[string]interface{}{"name": "zy"}},
+	})
+	if len(resp.Status) == 0 || resp.Status[0] != "error" {
+		t.Errorf("Expected bindings to require a context-aware evaluator, got %v", resp.Status)
+	}
+}
+
+func TestEvalResourceExhausted(t *testing.T) {
+	h := NewHandler(func(code string) (interface{}, string, error) {
+		return nil, "", fmt.Errorf("too deep: %w", ErrResourceExhausted)
+	})
+
+	resp := h.Handle(&protocol.Message{Op: "eval", ID: "1", Code: "(loop)"})
+	if len(resp.Status) != 2 || resp.Status[0] != "error" || resp.Status[1] != "resource-exhausted" {
+		t.Errorf("Expected status [error resource-exhausted], got %v", resp.Status)
+	}
+}
+
+func TestEvalMultipleValues(t *testing.T) {
+	h := NewHandler(func(code string) (interface{}, string, error) {
+		return Values{int64(1), "two"}, "", nil
+	})
+
+	resp := h.Handle(&protocol.Message{Op: "eval", ID: "1", Code: "(values 1 \"two\")"})
+	if resp.Value != int64(1) {
+		t.Errorf("Expected Value to be the first value, got %v", resp.Value)
+	}
+	if got := resp.Data["values"]; !reflect.DeepEqual(got, []interface{}{int64(1), "two"}) {
+		t.Errorf("Expected both values in data.values, got %v", got)
+	}
+
+	resp = h.Handle(&protocol.Message{Op: "eval", ID: "2", Code: "(values 1 \"two\")",
+		Data: map[string]interface{}{"stringify": true}})
+	if got := resp.Data["values"]; !reflect.DeepEqual(got, []interface{}{"1", "two"}) {
+		t.Errorf("Expected stringified values, got %v", got)
+	}
+}
+
+func TestEvalWithType(t *testing.T) {
+	h := NewHandler(func(code string) (interface{}, string, error) {
+		return int64(3), "", nil
+	})
+
+	resp := h.Handle(&protocol.Message{
+		Op:   "eval",
+		ID:   "1",
+		Code: "(+ 1 2)",
+		Data: map[string]interface{}{"with-type": true},
+	})
+	if got := resp.Data["value-type"]; got != "integer" {
+		t.Errorf("Expected value-type \"integer\", got %v", got)
+	}
+
+	resp = h.Handle(&protocol.Message{Op: "eval", ID: "2", Code: "(+ 1 2)"})
+	if _, ok := resp.Data["value-type"]; ok {
+		t.Error("Expected no value-type without with-type")
+	}
+
+	h.TypeOf = func(value interface{}) string { return "number" }
+	resp = h.Handle(&protocol.Message{
+		Op:   "eval",
+		ID:   "3",
+		Code: "(+ 1 2)",
+		Data: map[string]interface{}{"with-type": true},
+	})
+	if got := resp.Data["value-type"]; got != "number" {
+		t.Errorf("Expected the configured TypeOf to be used, got %v", got)
+	}
+}
+
+func TestNilEvaluator(t *testing.T) {
+	h := NewHandler(nil)
+
+	resp := h.Handle(&protocol.Message{Op: "eval", ID: "1", Code: "(+ 1 2)"})
+	if len(resp.Status) == 0 || resp.Status[0] != "error" {
+		t.Fatalf("Expected an error status, got %v", resp.Status)
+	}
+	if !strings.Contains(resp.ProtocolError, ErrNoEvaluator.Error()) {
+		t.Errorf("Expected the error to name the missing evaluator, got %q", resp.ProtocolError)
+	}
+}
+
+func TestContextEchoed(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+	echo := map[string]interface{}{"widget": "cell-7", "op": "ignored"}
+
+	for _, op := range []string{"eval", "describe", "bogus"} {
+		resp := h.Handle(&protocol.Message{Op: op, ID: "1", Code: "(+ 1 2)", Context: echo})
+		if !reflect.DeepEqual(resp.Context, echo) {
+			t.Errorf("%s: expected context %v, got %v", op, echo, resp.Context)
+		}
+	}
+
+	// A cached idempotent reply carries the retry's context
+	data := map[string]interface{}{"idempotency-key": "k"}
+	h.Handle(&protocol.Message{Op: "eval", ID: "2", Code: "(+ 1 2)", Data: data, Context: echo})
+	retry := map[string]interface{}{"widget": "cell-8"}
+	resp := h.Handle(&protocol.Message{Op: "eval", ID: "3", Code: "(+ 1 2)", Data: data, Context: retry})
+	if !reflect.DeepEqual(resp.Context, retry) {
+		t.Errorf("Expected the retry's context %v, got %v", retry, resp.Context)
+	}
+}
+
+func TestEvalQueuedNotification(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+
+	h := NewHandler(mockEvaluator)
+	h.MaxConcurrentEvals = 1
+	h.ContextEvaluator = func(ctx context.Context, code string) (interface{}, string, error) {
+		if code == "(slow)" {
+			started <- struct{}{}
+			<-release
+		}
+		return code, "", nil
+	}
+
+	slowDone := make(chan *protocol.Message)
+	go func() {
+		slowDone <- h.Handle(&protocol.Message{Op: "eval", ID: "1", Session: "a", Code: "(slow)"})
+	}()
+	<-started
+
+	// The second eval waits behind the first and is told so
+	var mu sync.Mutex
+	var events []string
+	queued := make(chan struct{})
+	ctx := WithSender(context.Background(), func(msg *protocol.Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, fmt.Sprintf("%v %v", msg.Status, msg.Data["queue-position"]))
+		close(queued)
+		return nil
+	})
+	fastDone := make(chan *protocol.Message)
+	go func() {
+		fastDone <- h.HandleContext(ctx, &protocol.Message{Op: "eval", ID: "2", Session: "b", Code: "(fast)"})
+	}()
+
+	select {
+	case <-queued:
+	case <-time.After(time.Second):
+		t.Fatal("Expected a queued notification")
+	}
+	select {
+	case <-fastDone:
+		t.Fatal("Expected the second eval to wait for the first")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if resp := <-slowDone; resp.Value != "(slow)" {
+		t.Errorf("Expected the slow eval's value, got %v", resp.Value)
+	}
+	resp := <-fastDone
+	if resp.Value != "(fast)" || resp.Status[0] != "done" {
+		t.Errorf("Expected the queued eval to run, got %v %v", resp.Value, resp.Status)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 1 || events[0] != "[queued] 1" {
+		t.Errorf("Expected one queued notification at position 1, got %v", events)
+	}
+}
+
+func TestEvalQueuedInterrupt(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{}, 1)
+
+	h := NewHandler(mockEvaluator)
+	h.MaxConcurrentEvals = 1
+	h.ContextEvaluator = func(ctx context.Context, code string) (interface{}, string, error) {
+		started <- struct{}{}
+		<-release
+		return code, "", nil
+	}
+
+	go h.Handle(&protocol.Message{Op: "eval", ID: "1", Session: "a", Code: "(slow)"})
+	<-started
+
+	done := make(chan *protocol.Message)
+	go func() {
+		done <- h.Handle(&protocol.Message{Op: "eval", ID: "2", Session: "b", Code: "(queued)"})
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	h.Handle(&protocol.Message{Op: "interrupt", ID: "3", Session: "b", Data: map[string]interface{}{"interrupt-id": "2"}})
+	select {
+	case resp := <-done:
+		if resp.Status[0] != "interrupted" {
+			t.Errorf("Expected the queued eval to be interrupted, got %v", resp.Status)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Interrupting a queued eval did not release it")
+	}
+}
+
+func TestServerBusy(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+
+	h := NewHandler(mockEvaluator)
+	h.MaxConcurrentEvals = 1
+	h.MaxQueuedEvals = 1
+	h.ContextEvaluator = func(ctx context.Context, code string) (interface{}, string, error) {
+		if code == "(slow)" {
+			started <- struct{}{}
+			<-release
+		}
+		return code, "", nil
+	}
+
+	running := make(chan *protocol.Message)
+	go func() {
+		running <- h.Handle(&protocol.Message{Op: "eval", ID: "1", Session: "a", Code: "(slow)"})
+	}()
+	<-started
+	queued := make(chan *protocol.Message)
+	go func() {
+		queued <- h.Handle(&protocol.Message{Op: "eval", ID: "2", Session: "b", Code: "(queued)"})
+	}()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(5 * time.Millisecond) {
+		h.queue.mu.Lock()
+		waiting := len(h.queue.waiting)
+		h.queue.mu.Unlock()
+		if waiting == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the second eval to queue")
+		}
+	}
+
+	// Both the slot and the queue are full
+	resp := h.Handle(&protocol.Message{Op: "eval", ID: "3", Session: "c", Code: "(+ 1 2)"})
+	if len(resp.Status) != 2 || resp.Status[0] != "error" || resp.Status[1] != "server-busy" {
+		t.Fatalf("Expected a server-busy response, got %v", resp.Status)
+	}
+	if retry, ok := resp.Data["retry-after-ms"].(int64); !ok || retry <= 0 {
+		t.Errorf("Expected a positive retry-after-ms, got %v", resp.Data["retry-after-ms"])
+	}
+
+	close(release)
+	<-running
+	if resp := <-queued; resp.Status[0] != "done" {
+		t.Errorf("Expected the queued eval to complete, got %v", resp.Status)
+	}
+	if resp := h.Handle(&protocol.Message{Op: "eval", ID: "4", Session: "c", Code: "(+ 1 2)"}); resp.Status[0] != "done" {
+		t.Errorf("Expected evals to be accepted once the load cleared, got %v", resp.Status)
+	}
+}
+
+func TestFlushQueue(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+
+	h := NewHandler(mockEvaluator)
+	h.MaxConcurrentEvals = 1
+	h.ContextEvaluator = func(ctx context.Context, code string) (interface{}, string, error) {
+		if code == "(slow)" {
+			started <- struct{}{}
+			<-release
+		}
+		return code, "", nil
+	}
+
+	running := make(chan *protocol.Message)
+	go func() {
+		running <- h.Handle(&protocol.Message{Op: "eval", ID: "1", Session: "a", Code: "(slow)"})
+	}()
+	<-started
+
+	// Two evals queue in session a and one in session b
+	queued := make(chan *protocol.Message, 3)
+	for _, req := range []*protocol.Message{
+		{Op: "eval", ID: "2", Session: "a", Code: "(two)"},
+		{Op: "eval", ID: "3", Session: "b", Code: "(three)"},
+		{Op: "eval", ID: "4", Session: "a", Code: "(four)"},
+	} {
+		req := req
+		go func() { queued <- h.Handle(req) }()
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(5 * time.Millisecond) {
+		h.queue.mu.Lock()
+		waiting := len(h.queue.waiting)
+		h.queue.mu.Unlock()
+		if waiting == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 3 queued evals, got %d", waiting)
+		}
+	}
+
+	resp := h.Handle(&protocol.Message{Op: "flush-queue", ID: "5", Session: "a"})
+	if resp.Status[0] != "done" || resp.Data["flushed"] != 2 {
+		t.Fatalf("Expected 2 evals flushed, got %v %v", resp.Status, resp.Data)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case resp := <-queued:
+			if resp.ID == "3" || len(resp.Status) != 2 || resp.Status[1] != "cancelled" {
+				t.Errorf("Expected a cancelled eval in session a, got %+v", resp)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected flushed evals to be answered")
+		}
+	}
+
+	// The running eval and the other session's eval are unaffected
+	close(release)
+	if resp := <-running; resp.Status[0] != "done" || resp.Value != "(slow)" {
+		t.Errorf("Expected the running eval to complete, got %+v", resp)
+	}
+	if resp := <-queued; resp.Status[0] != "done" || resp.Value != "(three)" {
+		t.Errorf("Expected session b's eval to complete, got %+v", resp)
+	}
+}
+
+func TestLoadFileCwd(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "proj", "src"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "proj", "src", "main.zl"), []byte("(+ 1 2)"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(t.TempDir(), "secret.zl")
+	if err := os.WriteFile(outside, []byte("(secret)"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "proj", "link.zl")); err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHandler(mockEvaluator)
+	h.FileRoot = root
+	load := func(file, cwd string) *protocol.Message {
+		data := map[string]interface{}{"file": file}
+		if cwd != "" {
+			data["cwd"] = cwd
+		}
+		return h.Handle(&protocol.Message{Op: "load-file", ID: "1", Data: data})
+	}
+
+	for _, tt := range []struct{ file, cwd string }{
+		{"src/main.zl", "proj"},
+		{"main.zl", filepath.Join(root, "proj", "src")},
+		{"proj/src/main.zl", ""},
+		{filepath.Join(root, "proj", "src", "main.zl"), "elsewhere"},
+	} {
+		if resp := load(tt.file, tt.cwd); resp.Status[0] != "done" || resp.Value != "(+ 1 2)" {
+			t.Errorf("Loading %s from %q: expected the file, got %v %s", tt.file, tt.cwd, resp.Status, resp.ProtocolError)
+		}
+	}
+
+	// Neither cwd nor the path may leave the root, even through a symlink
+	for _, tt := range []struct{ file, cwd string }{
+		{"secret.zl", ".."},
+		{"secret.zl", filepath.Dir(outside)},
+		{"../../" + filepath.Base(outside), "proj"},
+		{outside, ""},
+		{"link.zl", "proj"},
+	} {
+		if resp := load(tt.file, tt.cwd); resp.Status[0] != "error" {
+			t.Errorf("Loading %s from %q: expected an error, got %v %v", tt.file, tt.cwd, resp.Status, resp.Value)
+		}
+	}
+}
+
+func TestLoadFileProgress(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "three.zl")
+	source := "(define x 1)\n; a comment (\n\"a ) string\"\n\n(+ x\n   2) ; done\n"
+	if err := os.WriteFile(file, []byte(source), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var evaluated []string
+	h := NewHandler(func(code string) (interface{}, string, error) {
+		evaluated = append(evaluated, code)
+		return code, "", nil
+	})
+
+	var progress []map[string]interface{}
+	ctx := WithSender(context.Background(), func(msg *protocol.Message) error {
+		if len(msg.Status) == 1 && msg.Status[0] == "progress" {
+			progress = append(progress, msg.Data)
+		}
+		return nil
+	})
+	resp := h.HandleContext(ctx, &protocol.Message{
+		Op:   "load-file",
+		ID:   "1",
+		Data: map[string]interface{}{"file": file, "progress": true},
+	})
+
+	if resp.Status[0] != "done" || resp.Value != "(+ x\n   2)" {
+		t.Fatalf("Expected the last form's value, got %v %v", resp.Status, resp.Value)
+	}
+	if want := []string{"(define x 1)", `"a ) string"`, "(+ x\n   2)"}; !reflect.DeepEqual(evaluated, want) {
+		t.Errorf("Expected forms %q, got %q", want, evaluated)
+	}
+	if len(progress) != 3 {
+		t.Fatalf("Expected 3 progress messages, got %v", progress)
+	}
+	for i, data := range progress {
+		if data["form-index"] != i+1 || data["total"] != 3 {
+			t.Errorf("Progress %d: expected form-index %d of 3, got %v", i, i+1, data)
+		}
+	}
+}
+
+func TestSplitForms(t *testing.T) {
+	tests := []struct {
+		code     string
+		forms    []string
+		complete bool
+	}{
+		{"(define x 1) ; a (comment\n\"a \\\" )\" x\n", []string{"(define x 1)", `"a \" )"`, "x"}, true},
+		{"(+ 1\n   2) ) 3", []string{"(+ 1\n   2)", ")", "3"}, true},
+		{"(define x 1) (+ x", []string{"(define x 1)", "(+ x"}, false},
+		{"x \"open", nil, false},
+		{" ; only a comment", nil, true},
+	}
+	for _, tt := range tests {
+		forms, complete, err := SplitForms(tt.code)
+		if err != nil {
+			t.Errorf("SplitForms(%q) failed: %v", tt.code, err)
+			continue
+		}
+		if !reflect.DeepEqual(forms, tt.forms) || complete != tt.complete {
+			t.Errorf("SplitForms(%q) = %q, %v; want %q, %v", tt.code, forms, complete, tt.forms, tt.complete)
+		}
+	}
+
+	if _, _, err := SplitForms("(quote 'x)"); err == nil {
+		t.Error("Expected the lexer's error for an illegal character")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+	h.Drain()
+
+	for _, op := range []string{"eval", "pipe", "load-file"} {
+		resp := h.Handle(&protocol.Message{Op: op, ID: "1", Code: "(+ 1 2)", Data: map[string]interface{}{"file": "x.zl", "stages": []interface{}{"(+ 1 2)"}}})
+		if len(resp.Status) != 2 || resp.Status[0] != "error" || resp.Status[1] != "draining" {
+			t.Errorf("%s: expected status [error draining], got %v", op, resp.Status)
+		}
+	}
+
+	resp := h.Handle(&protocol.Message{Op: "describe", ID: "2"})
+	if len(resp.Status) != 1 || resp.Status[0] != "done" {
+		t.Errorf("Expected describe to work while draining, got %v", resp.Status)
+	}
+}
+
+func TestConfigRedactsSecrets(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+	h.MaxConcurrentEvals = 4
+	h.OpTimeouts = map[string]time.Duration{"eval": 30 * time.Second}
+	h.Settings = func() map[string]interface{} {
+		return map[string]interface{}{
+			"transport":  "tcp",
+			"auth-token": "s3cret-auth",
+			"tls": map[string]interface{}{
+				"cert-file": "server.pem",
+				"KeyFile":   "s3cret-key.pem",
+			},
+		}
+	}
+
+	resp := h.Handle(&protocol.Message{Op: "config", ID: "1"})
+	if len(resp.Status) != 1 || resp.Status[0] != "done" {
+		t.Fatalf("Expected status done, got %v (%s)", resp.Status, resp.ProtocolError)
+	}
+	encoded, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatalf("Failed to encode response: %v", err)
+	}
+	if strings.Contains(string(encoded), "s3cret") {
+		t.Errorf("Expected secrets to be redacted, got %s", encoded)
+	}
+
+	transport, _ := resp.Data["transport"].(map[string]interface{})
+	if transport["transport"] != "tcp" || transport["auth-token"] != redacted {
+		t.Errorf("Expected the transport settings with the token redacted, got %v", transport)
+	}
+	if tls, _ := transport["tls"].(map[string]interface{}); tls["cert-file"] != "server.pem" {
+		t.Errorf("Expected non-secret nested settings to be kept, got %v", tls)
+	}
+	if resp.Data["max-concurrent-evals"] != 4 {
+		t.Errorf("Expected max-concurrent-evals 4, got %v", resp.Data["max-concurrent-evals"])
+	}
+	if timeouts, _ := resp.Data["op-timeouts"].(map[string]interface{}); timeouts["eval"] != "30s" {
+		t.Errorf("Expected the eval timeout, got %v", resp.Data["op-timeouts"])
+	}
+	for _, op := range resp.Data["ops"].([]string) {
+		if op == "reset" {
+			t.Error("Expected reset to be left out without a Resetter")
+		}
+	}
+}
+
+func TestCheckpointRestore(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+
+	for _, op := range []string{"checkpoint", "restore"} {
+		resp := h.Handle(&protocol.Message{Op: op, ID: "1"})
+		if len(resp.Status) == 0 || resp.Status[0] != "error" {
+			t.Errorf("%s: expected an error without a handler, got %v", op, resp.Status)
+		}
+	}
+
+	var restored string
+	h.Checkpointer = func() (string, error) { return "cp-1", nil }
+	h.Restorer = func(id string) error {
+		if id != "cp-1" {
+			return fmt.Errorf("unknown checkpoint %q", id)
+		}
+		restored = id
+		return nil
+	}
+
+	resp := h.Handle(&protocol.Message{Op: "checkpoint", ID: "2"})
+	if resp.Data["checkpoint"] != "cp-1" {
+		t.Fatalf("Expected checkpoint ID cp-1, got %v", resp.Data)
+	}
+
+	resp = h.Handle(&protocol.Message{Op: "restore", ID: "3", Data: map[string]interface{}{"checkpoint": "cp-1"}})
+	if resp.Status[0] != "done" || restored != "cp-1" {
+		t.Errorf("Expected cp-1 to be restored, got %v", resp.Status)
+	}
+
+	for _, data := range []map[string]interface{}{nil, {"checkpoint": "cp-9"}} {
+		resp = h.Handle(&protocol.Message{Op: "restore", ID: "4", Data: data})
+		if resp.Status[0] != "error" {
+			t.Errorf("Expected restore with %v to fail, got %v", data, resp.Status)
+		}
+	}
+
+	// Checkpoints belong to the session that created them
+	restored = ""
+	resp = h.Handle(&protocol.Message{Op: "restore", ID: "5", Session: "other", Data: map[string]interface{}{"checkpoint": "cp-1"}})
+	if resp.Status[0] != "error" || restored != "" {
+		t.Errorf("Expected another session's restore to be refused, got %v", resp.Status)
+	}
+}
+
+func TestEvalDryRun(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+	h.ContextEvaluator = func(ctx context.Context, code string) (interface{}, string, error) {
+		return DryRunFromContext(ctx), "", nil
+	}
+
+	resp := h.Handle(&protocol.Message{Op: "eval", ID: "1", Code: "x", Data: map[string]interface{}{"dry-run": true}})
+	if resp.Value != true {
+		t.Errorf("Expected the evaluator to see a dry run, got %v", resp.Value)
+	}
+	resp = h.Handle(&protocol.Message{Op: "eval", ID: "2", Code: "x"})
+	if resp.Value != false {
+		t.Errorf("Expected no dry run by default, got %v", resp.Value)
+	}
+
+	plain := NewHandler(mockEvaluator)
+	resp = plain.Handle(&protocol.Message{Op: "eval", ID: "3", Code: "x", Data: map[string]interface{}{"dry-run": true}})
+	if resp.Status[0] != "error" {
+		t.Errorf("Expected dry-run to require a context-aware evaluator, got %v", resp.Status)
+	}
+}
+
+func TestEvalCodeBase64(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+	source := `(str "say \"hi\"" 'quoted "\\")`
+	encoded := base64.StdEncoding.EncodeToString([]byte(source))
+
+	resp := h.Handle(&protocol.Message{Op: "eval", ID: "1", Data: map[string]interface{}{"code-base64": encoded}})
+	if resp.Status[0] != "done" || resp.Value != source {
+		t.Fatalf("Expected the decoded source to be evaluated, got %v %q", resp.Status, resp.Value)
+	}
+
+	tests := []struct {
+		code string
+		data map[string]interface{}
+	}{
+		{"(+ 1 2)", map[string]interface{}{"code-base64": encoded}},
+		{"", map[string]interface{}{"code-base64": "not base64!"}},
+		{"", map[string]interface{}{"code-base64": 42}},
+		{"", map[string]interface{}{"code-base64": ""}},
+	}
+	for _, tt := range tests {
+		resp := h.Handle(&protocol.Message{Op: "eval", ID: "2", Code: tt.code, Data: tt.data})
+		if resp.Status[0] != "error" || resp.ProtocolError == "" {
+			t.Errorf("Expected code %q with %v to be rejected, got %v", tt.code, tt.data, resp.Status)
+		}
+	}
+}
+
+func TestEvalDeadline(t *testing.T) {
+	var evaluated int
+	h := NewHandler(mockEvaluator)
+	h.ContextEvaluator = func(ctx context.Context, code string) (interface{}, string, error) {
+		evaluated++
+		deadline, ok := ctx.Deadline()
+		if code == "(block)" {
+			<-ctx.Done()
+			return nil, "", ctx.Err()
+		}
+		return map[string]interface{}{"ok": ok, "deadline": deadline}, "", nil
+	}
+	eval := func(code string, deadline string) *protocol.Message {
+		return h.Handle(&protocol.Message{Op: "eval", ID: "1", Code: code, Data: map[string]interface{}{"deadline": deadline}})
+	}
+
+	future := time.Now().Add(time.Hour).Truncate(time.Second)
+	resp := eval("(+ 1 2)", future.Format(time.RFC3339))
+	value := resp.Value.(map[string]interface{})
+	if resp.Status[0] != "done" || value["ok"] != true || !value["deadline"].(time.Time).Equal(future) {
+		t.Errorf("Expected the evaluation to run under the deadline %v, got %v %v", future, resp.Status, value)
+	}
+
+	resp = eval("(block)", time.Now().Add(50*time.Millisecond).Format(time.RFC3339Nano))
+	if len(resp.Status) != 2 || resp.Status[1] != "timeout" {
+		t.Errorf("Expected a near deadline to time out, got %v", resp.Status)
+	}
+
+	evaluated = 0
+	resp = eval("(+ 1 2)", time.Now().Add(-time.Minute).Format(time.RFC3339))
+	if len(resp.Status) != 2 || resp.Status[1] != "timeout" || evaluated != 0 {
+		t.Errorf("Expected a past deadline to be rejected without evaluating, got %v after %d evals", resp.Status, evaluated)
+	}
+
+	if resp := eval("(+ 1 2)", "tomorrow"); resp.Status[0] != "error" || resp.ProtocolError == "" {
+		t.Errorf("Expected an invalid deadline to be rejected, got %v", resp.Status)
+	}
+}
+
+func TestEvalSeed(t *testing.T) {
+	h := NewHandler(mockEvaluator)
+	h.ContextEvaluator = func(ctx context.Context, code string) (interface{}, string, error) {
+		seed, ok := SeedFromContext(ctx)
+		if !ok {
+			return "unseeded", "", nil
+		}
+		return seed, "", nil
+	}
+
+	resp := h.Handle(&protocol.Message{Op: "eval", ID: "1", Code: "x", Data: map[string]interface{}{"seed": float64(42)}})
+	if resp.Value != int64(42) {
+		t.Errorf("Expected the evaluator to see seed 42, got %v", resp.Value)
+	}
+	resp = h.Handle(&protocol.Message{Op: "eval", ID: "2", Code: "x"})
+	if resp.Value != "unseeded" {
+		t.Errorf("Expected no seed by default, got %v", resp.Value)
+	}
+	resp = h.Handle(&protocol.Message{Op: "eval", ID: "3", Code: "x", Data: map[string]interface{}{"seed": 1.5}})
+	if resp.Status[0] != "error" {
+		t.Errorf("Expected a fractional seed to be rejected, got %v", resp.Status)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	transcript := strings.Join([]string{
+		`{"direction":"request","message":{"op":"eval","id":"1","code":"(+ 1 2)"}}`,
+		`{"direction":"response","message":{"op":"","id":"1","status":["done"],"value":"(+ 1 2)","data":{"elapsed-ms":12}}}`,
+		`{"direction":"request","message":{"op":"eval","id":"2","code":"(* 2 3)"}}`,
+		`{"direction":"response","message":{"op":"","id":"2","status":["done"],"value":"6"}}`,
+	}, "\n")
+	entries, err := protocol.ReadTranscript(strings.NewReader(transcript))
+	if err != nil {
+		t.Fatalf("ReadTranscript failed: %v", err)
+	}
+
+	// A fresh handler whose evaluator echoes the code diverges on request 2
+	h := NewHandler(mockEvaluator)
+	mismatches, err := h.Replay(context.Background(), entries, ReplayOptions{Ignore: []string{"data.elapsed-ms"}})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	want := []ReplayMismatch{{ID: "2", Op: "eval", Field: "value", Got: "(* 2 3)", Want: "6"}}
+	if !reflect.DeepEqual(mismatches, want) {
+		t.Errorf("Expected %v, got %v", want, mismatches)
+	}
+
+	// Without the ignore list the missing timing is reported too
+	mismatches, err = NewHandler(mockEvaluator).Replay(context.Background(), entries, ReplayOptions{})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if len(mismatches) != 2 || mismatches[0].Field != "data.elapsed-ms" || mismatches[0].Got != nil {
+		t.Errorf("Expected the timing and value mismatches, got %v", mismatches)
+	}
+}
+
+func TestReplayPushesMessages(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "forms.zl")
+	if err := os.WriteFile(file, []byte("(+ 1 2)\n(* 2 3)\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	request := &protocol.Message{Op: "load-file", ID: "1", Data: map[string]interface{}{"file": file, "progress": true}}
+	entries := []protocol.TranscriptEntry{
+		{Direction: "request", Message: request},
+		{Direction: "response", Message: &protocol.Message{ID: "1", Status: []string{"done"}, Value: "(* 2 3)"}},
+	}
+
+	// Progress needs a sender; without one replay would report an error
+	mismatches, err := NewHandler(mockEvaluator).Replay(context.Background(), entries, ReplayOptions{})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if len(mismatches) != 0 {
+		t.Errorf("Expected no mismatches, got %v", mismatches)
+	}
+
+	// A sender in ctx receives the pushed messages
+	var pushed int
+	ctx := WithSender(context.Background(), func(msg *protocol.Message) error {
+		pushed++
+		return nil
+	})
+	if _, err := NewHandler(mockEvaluator).Replay(ctx, entries, ReplayOptions{}); err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if pushed != 2 {
+		t.Errorf("Expected 2 progress messages, got %d", pushed)
+	}
+}
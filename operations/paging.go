@@ -0,0 +1,153 @@
+package operations
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/zylisp/repl/protocol"
+)
+
+const (
+	// pagedResultTTL is how long a session keeps a paged result.
+	pagedResultTTL = 5 * time.Minute
+
+	// pagedResultLimit bounds how many paged results a session keeps.
+	// The oldest is evicted first.
+	pagedResultLimit = 16
+
+	// pagedItemLimit bounds how many items a session keeps across its paged
+	// results. The oldest results are evicted to make room, and a longer
+	// result is not kept at all.
+	pagedItemLimit = 100000
+)
+
+// pagedResult is a list result retained for "result-page".
+type pagedResult struct {
+	items   []interface{}
+	expires time.Time
+}
+
+// intData returns the integer stored under key in req.Data. JSON numbers
+// decode as float64, so both integer and float values are accepted.
+func intData(req *protocol.Message, key string) (int, bool) {
+	if req.Data == nil {
+		return 0, false
+	}
+	switch v := req.Data[key].(type) {
+	case int:
+		return v, true
+	case int64:
+		return int(v), true
+	case float64:
+		return int(v), v == float64(int(v))
+	default:
+		return 0, false
+	}
+}
+
+// pageResult replaces a list value longer than the request's data.page-size
+// with its first page, retaining the whole list in the session under a new
+// handle so that "result-page" can return the rest. A list longer than
+// pagedItemLimit is not retained; the response marks it as truncated.
+func (h *Handler) pageResult(req *protocol.Message, resp *protocol.Message) {
+	size, ok := intData(req, "page-size")
+	if !ok || size < 1 {
+		return
+	}
+	items, ok := resp.Value.([]interface{})
+	if !ok || len(items) <= size {
+		return
+	}
+
+	resp.Value = items[:size]
+	if resp.Data == nil {
+		resp.Data = make(map[string]interface{})
+	}
+	resp.Data["result-count"] = len(items)
+	if len(items) > pagedItemLimit {
+		resp.Data["result-truncated"] = true
+		return
+	}
+	handle := fmt.Sprintf("result-%d", h.resultSeq.Add(1))
+	h.session(req.Session).retainResult(handle, items, time.Now())
+	resp.Data["result-handle"] = handle
+}
+
+// handleResultPage processes the "result-page" operation.
+// It returns data.limit items of the result named by data.handle, starting
+// at data.offset, along with the result's total length.
+func (h *Handler) handleResultPage(req *protocol.Message, resp *protocol.Message) *protocol.Message {
+	var handle string
+	if req.Data != nil {
+		handle, _ = req.Data["handle"].(string)
+	}
+	offset, offsetOK := intData(req, "offset")
+	limit, limitOK := intData(req, "limit")
+	if handle == "" || !offsetOK || !limitOK || offset < 0 || limit < 1 {
+		resp.Status = []string{"error"}
+		resp.ProtocolError = "result-page operation requires 'handle', 'offset' and a positive 'limit' in data field"
+		return resp
+	}
+
+	var items []interface{}
+	var ok bool
+	if sess := h.lookupSession(req.Session); sess != nil {
+		items, ok = sess.retainedResult(handle, time.Now())
+	}
+	if !ok {
+		resp.Status = []string{"error"}
+		resp.ProtocolError = fmt.Sprintf("unknown or expired result handle: %q", handle)
+		return resp
+	}
+
+	if offset > len(items) {
+		offset = len(items)
+	}
+	end := offset + limit
+	if end > len(items) {
+		end = len(items)
+	}
+
+	resp.Value = items[offset:end]
+	resp.Status = []string{"done"}
+	resp.Data = map[string]interface{}{
+		"result-count": len(items),
+	}
+	return resp
+}
+
+// retainResult stores items under handle, which must be new, evicting expired
+// results and then the oldest ones while the session is at its limit of
+// results or would exceed its limit of items.
+func (s *session) retainResult(handle string, items []interface{}, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Results share one TTL, so insertion order is also expiry order
+	for len(s.resultOrder) > 0 {
+		oldest := s.results[s.resultOrder[0]]
+		full := len(s.resultOrder) >= pagedResultLimit || s.retainedItems+len(items) > pagedItemLimit
+		if !full && !now.After(oldest.expires) {
+			break
+		}
+		delete(s.results, s.resultOrder[0])
+		s.resultOrder = s.resultOrder[1:]
+		s.retainedItems -= len(oldest.items)
+	}
+
+	s.resultOrder = append(s.resultOrder, handle)
+	s.results[handle] = &pagedResult{items: items, expires: now.Add(pagedResultTTL)}
+	s.retainedItems += len(items)
+}
+
+// retainedResult returns the unexpired result stored under handle.
+func (s *session) retainedResult(handle string, now time.Time) ([]interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result, exists := s.results[handle]
+	if !exists || now.After(result.expires) {
+		return nil, false
+	}
+	return result.items, true
+}
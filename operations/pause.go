@@ -0,0 +1,94 @@
+package operations
+
+import (
+	"context"
+	"errors"
+
+	"github.com/zylisp/repl/protocol"
+)
+
+// errPaused is returned for evaluations rejected because their session was
+// paused with data.reject set.
+var errPaused = errors.New("session is paused")
+
+// pause closes the session's gate. Evaluations started while it is closed
+// wait for resume, or fail with errPaused if reject is set.
+func (s *session) pause(reject bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.paused == nil {
+		s.paused = make(chan struct{})
+	}
+	s.rejectPaused = reject
+}
+
+// resume opens the session's gate, releasing the evaluations waiting at it.
+func (s *session) resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.paused != nil {
+		close(s.paused)
+		s.paused = nil
+	}
+}
+
+// isPaused reports whether the session's gate is closed.
+func (s *session) isPaused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused != nil
+}
+
+// waitResumed returns once the session is not paused, or with errPaused if
+// paused evaluations are rejected, or with ctx's error if ctx ends first.
+func (s *session) waitResumed(ctx context.Context) error {
+	for {
+		s.mu.Lock()
+		gate, reject := s.paused, s.rejectPaused
+		s.mu.Unlock()
+		if gate == nil {
+			return nil
+		}
+		if reject {
+			return errPaused
+		}
+
+		select {
+		case <-gate:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// handlePauseSession processes the "pause-session" and "resume-session"
+// operations. They act on the session named by data.session, or the
+// request's own session. While a session is paused, its evaluations wait
+// until it is resumed, or are rejected with status ["error", "paused"] if
+// the pause set data.reject. Evaluations already running are not affected.
+func (h *Handler) handlePauseSession(req *protocol.Message, resp *protocol.Message) *protocol.Message {
+	target := req.Session
+	if name, ok := req.Data["session"].(string); ok && name != "" {
+		target = name
+	}
+
+	sess := h.lookupSession(target)
+	if sess == nil {
+		resp.Status = []string{"error"}
+		resp.ProtocolError = "unknown session: " + target
+		return resp
+	}
+
+	if req.Op == "pause-session" {
+		reject, _ := req.Data["reject"].(bool)
+		sess.pause(reject)
+	} else {
+		sess.resume()
+	}
+	resp.Status = []string{"done"}
+	resp.Data = map[string]interface{}{
+		"session": target,
+		"paused":  sess.isPaused(),
+	}
+	return resp
+}
@@ -0,0 +1,75 @@
+package operations
+
+import (
+	"context"
+	"strings"
+
+	"github.com/zylisp/repl/protocol"
+)
+
+// pipeSymbol is bound to the previous stage's value in each stage of a
+// "pipe" request.
+const pipeSymbol = "$"
+
+// handlePipe processes the "pipe" operation.
+// It evaluates the forms in data.stages in order, binding $ in each to the
+// value of the one before; data.input, if present, is bound in the first.
+// data.stages-results holds the value of every stage evaluated and the
+// response's value is the last of them.
+//
+// The pipeline stops at the first stage whose value is error-as-data (a map
+// with an "error" key) or whose evaluator fails. data.failed-stage then
+// holds its 0-based index: error-as-data is returned as the value with
+// status "done", and an evaluator failure is reported as for "eval".
+func (h *Handler) handlePipe(ctx context.Context, req *protocol.Message, resp *protocol.Message) *protocol.Message {
+	raw, _ := req.Data["stages"].([]interface{})
+	stages := make([]string, len(raw))
+	for i, stage := range raw {
+		form, ok := stage.(string)
+		if !ok {
+			raw = nil
+			break
+		}
+		stages[i] = form
+	}
+	if len(raw) == 0 {
+		resp.Status = []string{"error"}
+		resp.ProtocolError = "pipe operation requires 'stages' to be a non-empty list of forms"
+		return resp
+	}
+	if !h.contextAware() {
+		resp.Status = []string{"error"}
+		resp.ProtocolError = "pipe requires a context-aware evaluator"
+		return resp
+	}
+
+	input, seeded := req.Data["input"]
+	results := make([]interface{}, 0, len(stages))
+	resp.Data = map[string]interface{}{"stages-results": results}
+	var output strings.Builder
+	for i, stage := range stages {
+		stageCtx := ctx
+		if i > 0 || seeded {
+			stageCtx = withBindings(ctx, map[string]interface{}{pipeSymbol: input})
+		}
+		value, stageOutput, _, err := h.evaluate(stageCtx, req, stage)
+		output.WriteString(stageOutput)
+		if err != nil {
+			resp.Data["failed-stage"] = i
+			return evaluatorError(resp, output.String(), err)
+		}
+		results = append(results, value)
+		resp.Data["stages-results"] = results
+		input = value
+
+		if failed, ok := value.(map[string]interface{}); ok && failed["error"] != nil {
+			resp.Data["failed-stage"] = i
+			break
+		}
+	}
+
+	resp.Value = input
+	resp.Output = output.String()
+	resp.Status = []string{"done"}
+	return resp
+}
@@ -0,0 +1,65 @@
+package operations
+
+import (
+	"context"
+	"strings"
+
+	"github.com/zylisp/repl/protocol"
+)
+
+// wantsProgress reports whether the request set data.progress.
+func wantsProgress(req *protocol.Message) bool {
+	if req.Data == nil {
+		return false
+	}
+	enabled, _ := req.Data["progress"].(bool)
+	return enabled
+}
+
+// loadWithProgress evaluates the top-level forms of code one at a time for a
+// "load-file" request, pushing a message with status "progress" and
+// data.form-index (1-based) and data.total after each. The response carries
+// the last form's value and the output of all of them. Evaluation stops at
+// the first evaluator error.
+func (h *Handler) loadWithProgress(ctx context.Context, req *protocol.Message, resp *protocol.Message, code string) *protocol.Message {
+	send := senderFromContext(ctx)
+	if send == nil {
+		resp.Status = []string{"error"}
+		resp.ProtocolError = "progress requires a transport that can push messages"
+		return resp
+	}
+
+	// Code that does not read as complete forms is evaluated whole, as
+	// without progress, so that the evaluator reports the error
+	forms, complete, err := SplitForms(code)
+	if err != nil || !complete {
+		forms = []string{code}
+	}
+	var result interface{}
+	var output strings.Builder
+	var chunks []OutputChunk
+	for i, form := range forms {
+		value, formOutput, formChunks, err := h.evaluate(ctx, req, form)
+		output.WriteString(formOutput)
+		chunks = append(chunks, formChunks...)
+		if err != nil {
+			setOutputChunks(resp, chunks)
+			return evaluatorError(resp, output.String(), err)
+		}
+		result = value
+
+		send(&protocol.Message{
+			ID:      req.ID,
+			Session: req.Session,
+			Context: req.Context,
+			Status:  []string{"progress"},
+			Data:    map[string]interface{}{"form-index": i + 1, "total": len(forms)},
+		})
+	}
+
+	setOutputChunks(resp, chunks)
+	resp.Value = result
+	resp.Output = output.String()
+	resp.Status = []string{"done"}
+	return resp
+}
@@ -0,0 +1,190 @@
+package operations
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/zylisp/repl/protocol"
+)
+
+// evalQueue admits up to a limit of evaluations at once across all sessions.
+// Evaluations beyond the limit wait in arrival order.
+type evalQueue struct {
+	mu      sync.Mutex
+	running int
+	waiting []*waiter     // oldest first
+	average time.Duration // moving average of evaluation durations
+}
+
+// waiter is an evaluation waiting in an evalQueue.
+type waiter struct {
+	session  string
+	admitted chan struct{} // closed when the waiter is admitted
+	flushed  chan struct{} // closed when the waiter is discarded by flush
+}
+
+// errFlushed is returned for evaluations discarded by "flush-queue" before
+// they started.
+var errFlushed = errors.New("evaluation cancelled by flush-queue")
+
+// busyError is returned for evaluations refused because MaxQueuedEvals
+// evaluations are already waiting.
+type busyError struct {
+	retryAfter time.Duration // estimated wait before a slot frees up
+}
+
+func (e *busyError) Error() string {
+	return "server busy; retry later"
+}
+
+// defaultRetryAfter is suggested to refused clients before any evaluation
+// has finished to estimate from.
+const defaultRetryAfter = 100 * time.Millisecond
+
+// acquire waits until an evaluation in session may start under limit, or
+// ctx is done, or the session's queue is flushed. If it has to wait, queued
+// is first called with its 1-based position; if maxQueued evaluations are
+// already waiting, it fails at once with a *busyError. Every successful
+// acquire must be paired with a release.
+func (q *evalQueue) acquire(ctx context.Context, limit, maxQueued int, session string, queued func(position int)) error {
+	q.mu.Lock()
+	if q.running < limit && len(q.waiting) == 0 {
+		q.running++
+		q.mu.Unlock()
+		return nil
+	}
+	if maxQueued > 0 && len(q.waiting) >= maxQueued {
+		err := &busyError{retryAfter: q.retryAfterLocked(limit)}
+		q.mu.Unlock()
+		return err
+	}
+	w := &waiter{session: session, admitted: make(chan struct{}), flushed: make(chan struct{})}
+	q.waiting = append(q.waiting, w)
+	position := len(q.waiting)
+	q.mu.Unlock()
+
+	queued(position)
+
+	select {
+	case <-w.admitted:
+		return nil
+	case <-w.flushed:
+		return errFlushed
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, other := range q.waiting {
+		if other == w {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return ctx.Err()
+		}
+	}
+	select {
+	case <-w.flushed:
+		return ctx.Err()
+	default:
+	}
+	// Admitted while giving up; hand the slot on
+	q.releaseLocked()
+	return ctx.Err()
+}
+
+// flush discards the evaluations waiting in session and returns how many
+// there were. Their acquire calls return errFlushed.
+func (q *evalQueue) flush(session string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	kept := q.waiting[:0]
+	flushed := 0
+	for _, w := range q.waiting {
+		if w.session != session {
+			kept = append(kept, w)
+			continue
+		}
+		close(w.flushed)
+		flushed++
+	}
+	for i := len(kept); i < len(q.waiting); i++ {
+		q.waiting[i] = nil
+	}
+	q.waiting = kept
+	return flushed
+}
+
+// release ends an evaluation admitted by acquire that took elapsed,
+// admitting the oldest waiter in its place.
+func (q *evalQueue) release(elapsed time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.average == 0 {
+		q.average = elapsed
+	} else {
+		q.average += (elapsed - q.average) / 5
+	}
+	q.releaseLocked()
+}
+
+// retryAfterLocked estimates how long until the queue has room again: the
+// time for the running and waiting evaluations ahead to clear limit slots,
+// at the average evaluation duration. q.mu must be held.
+func (q *evalQueue) retryAfterLocked(limit int) time.Duration {
+	if q.average == 0 {
+		return defaultRetryAfter
+	}
+	return q.average * time.Duration(len(q.waiting)+1) / time.Duration(limit)
+}
+
+// releaseLocked is release with q.mu held.
+func (q *evalQueue) releaseLocked() {
+	if len(q.waiting) == 0 {
+		q.running--
+		return
+	}
+	close(q.waiting[0].admitted)
+	q.waiting = q.waiting[1:]
+}
+
+// admit waits for the evaluation of req to be allowed to start under
+// MaxConcurrentEvals. While it waits, the client is sent a message with
+// status "queued" and its position in data.queue-position, if the transport
+// can push messages.
+func (h *Handler) admit(ctx context.Context, req *protocol.Message) (release func(), err error) {
+	if h.MaxConcurrentEvals <= 0 {
+		return func() {}, nil
+	}
+
+	err = h.queue.acquire(ctx, h.MaxConcurrentEvals, h.MaxQueuedEvals, req.Session, func(position int) {
+		if send := senderFromContext(ctx); send != nil {
+			send(&protocol.Message{
+				ID:      req.ID,
+				Session: req.Session,
+				Context: req.Context,
+				Status:  []string{"queued"},
+				Data:    map[string]interface{}{"queue-position": position},
+			})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	return func() { h.queue.release(time.Since(start)) }, nil
+}
+
+// handleFlushQueue processes the "flush-queue" operation.
+// It discards the request's session's evaluations that are waiting for
+// MaxConcurrentEvals and have not started. Each discarded request is
+// answered with status ["error", "cancelled"]; running evaluations are not
+// affected.
+func (h *Handler) handleFlushQueue(req *protocol.Message, resp *protocol.Message) *protocol.Message {
+	resp.Status = []string{"done"}
+	resp.Data = map[string]interface{}{
+		"flushed": h.queue.flush(req.Session),
+	}
+	return resp
+}
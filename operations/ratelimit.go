@@ -0,0 +1,70 @@
+package operations
+
+import "time"
+
+// RateLimit configures per-connection request rate limiting for the
+// networked transports. The zero value disables it.
+type RateLimit struct {
+	// Rate is the sustained number of requests per second a connection may
+	// send. Requests beyond it are rejected with status "rate-limited".
+	Rate float64
+
+	// Burst is how many requests may arrive at once. Values below 1 mean 1.
+	Burst int
+
+	// EvictAfter closes a connection once it has been rejected this many
+	// times within EvictWindow. Zero disables eviction.
+	EvictAfter  int
+	EvictWindow time.Duration
+}
+
+// RateLimiter applies a RateLimit to a single connection using a token
+// bucket. It is not safe for concurrent use.
+type RateLimiter struct {
+	limit      RateLimit
+	tokens     float64
+	last       time.Time
+	violations []time.Time // rejections within the eviction window, oldest first
+}
+
+// NewLimiter returns a limiter for one connection, or nil if r is disabled.
+func (r RateLimit) NewLimiter() *RateLimiter {
+	if r.Rate <= 0 {
+		return nil
+	}
+	if r.Burst < 1 {
+		r.Burst = 1
+	}
+	return &RateLimiter{limit: r, tokens: float64(r.Burst)}
+}
+
+// Allow reports whether a request arriving at now is within the limit and,
+// if it is not, whether the connection has now been over the limit often
+// enough to be evicted.
+func (l *RateLimiter) Allow(now time.Time) (allowed, evict bool) {
+	// Refill the bucket for the time elapsed since the last request
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.limit.Rate
+		if max := float64(l.limit.Burst); l.tokens > max {
+			l.tokens = max
+		}
+	}
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, false
+	}
+
+	if l.limit.EvictAfter <= 0 {
+		return false, false
+	}
+
+	// Forget rejections that fell out of the window
+	cutoff := now.Add(-l.limit.EvictWindow)
+	for len(l.violations) > 0 && !l.violations[0].After(cutoff) {
+		l.violations = l.violations[1:]
+	}
+	l.violations = append(l.violations, now)
+	return false, len(l.violations) >= l.limit.EvictAfter
+}
@@ -0,0 +1,125 @@
+package operations
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/zylisp/repl/protocol"
+)
+
+// ReplayOptions adjust how Replay compares responses.
+type ReplayOptions struct {
+	// Ignore names response fields that are not compared, such as
+	// nondeterministic timings. Top-level fields are named by their JSON
+	// name ("output", "session"); keys of data by "data." and the key
+	// ("data.elapsed-ms").
+	Ignore []string
+}
+
+// ReplayMismatch is a response field that differed from the transcript.
+type ReplayMismatch struct {
+	ID    string // the request's ID
+	Op    string
+	Field string // as named in ReplayOptions.Ignore
+	Got   interface{}
+	Want  interface{} // the recorded value
+}
+
+func (m ReplayMismatch) String() string {
+	return fmt.Sprintf("request %s (%s): %s is %v, recorded %v", m.ID, m.Op, m.Field, m.Got, m.Want)
+}
+
+// Replay handles the requests recorded in a client transcript, in order, and
+// compares each final response field by field with the last response
+// recorded for the same ID, as a client would have decoded it. Requests
+// whose response was not recorded are handled but not compared. Replaying
+// against a handler with a fresh evaluator turns a recorded session into a
+// regression test: it returns every mismatch found, sorted by request order
+// and then field.
+//
+// Requests are handled as if over a transport that can push messages, so
+// that operations such as load-file with progress behave as they did when
+// recorded. Pushed messages go to the SendFunc in ctx, if any, and are
+// otherwise discarded; they are not compared.
+func (h *Handler) Replay(ctx context.Context, entries []protocol.TranscriptEntry, opts ReplayOptions) ([]ReplayMismatch, error) {
+	if senderFromContext(ctx) == nil {
+		ctx = WithSender(ctx, func(msg *protocol.Message) error { return nil })
+	}
+	recorded := make(map[string]*protocol.Message)
+	for _, entry := range entries {
+		if entry.Direction == "response" {
+			recorded[entry.Message.ID] = entry.Message
+		}
+	}
+	ignored := make(map[string]bool, len(opts.Ignore))
+	for _, field := range opts.Ignore {
+		ignored[field] = true
+	}
+
+	var mismatches []ReplayMismatch
+	for _, entry := range entries {
+		if entry.Direction != "request" {
+			continue
+		}
+		resp := h.HandleContext(ctx, entry.Message)
+		want, ok := recorded[entry.Message.ID]
+		if !ok {
+			continue
+		}
+
+		got, err := replayFields(resp)
+		if err != nil {
+			return nil, fmt.Errorf("request %s: %w", entry.Message.ID, err)
+		}
+		expected, err := replayFields(want)
+		if err != nil {
+			return nil, fmt.Errorf("request %s: %w", entry.Message.ID, err)
+		}
+
+		var fields []string
+		for field := range got {
+			fields = append(fields, field)
+		}
+		for field := range expected {
+			if _, ok := got[field]; !ok {
+				fields = append(fields, field)
+			}
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			if !ignored[field] && !reflect.DeepEqual(got[field], expected[field]) {
+				mismatches = append(mismatches, ReplayMismatch{
+					ID:    entry.Message.ID,
+					Op:    entry.Message.Op,
+					Field: field,
+					Got:   got[field],
+					Want:  expected[field],
+				})
+			}
+		}
+	}
+	return mismatches, nil
+}
+
+// replayFields returns msg's fields as a client decodes them, keyed as in
+// ReplayOptions.Ignore.
+func replayFields(msg *protocol.Message) (map[string]interface{}, error) {
+	encoded, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		return nil, err
+	}
+	if data, ok := fields["data"].(map[string]interface{}); ok {
+		delete(fields, "data")
+		for key, value := range data {
+			fields["data."+key] = value
+		}
+	}
+	return fields, nil
+}
@@ -0,0 +1,95 @@
+package operations
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/zylisp/repl/protocol"
+)
+
+// runningEval is an in-flight evaluation tracked by its session.
+type runningEval struct {
+	cancel  context.CancelFunc
+	started time.Time
+}
+
+// runningInfo describes an in-flight evaluation for "ls-running".
+type runningInfo struct {
+	id      string
+	session string
+	elapsed time.Duration
+}
+
+// listRunning returns the in-flight evaluations of every session, longest
+// running first.
+func (h *Handler) listRunning(now time.Time) []runningInfo {
+	h.mu.Lock()
+	sessions := make(map[string]*session, len(h.sessions))
+	for id, sess := range h.sessions {
+		sessions[id] = sess
+	}
+	h.mu.Unlock()
+
+	var running []runningInfo
+	for sessionID, sess := range sessions {
+		sess.mu.Lock()
+		for id, eval := range sess.running {
+			running = append(running, runningInfo{
+				id:      id,
+				session: sessionID,
+				elapsed: now.Sub(eval.started),
+			})
+		}
+		sess.mu.Unlock()
+	}
+
+	sort.Slice(running, func(i, j int) bool {
+		if running[i].elapsed != running[j].elapsed {
+			return running[i].elapsed > running[j].elapsed
+		}
+		return running[i].id < running[j].id
+	})
+	return running
+}
+
+// InterruptAll cancels the in-flight evaluations of every session and
+// returns how many there were. Transports call it when they stop, so that
+// context-aware evaluators return instead of outliving the server.
+func (h *Handler) InterruptAll() int {
+	h.mu.Lock()
+	sessions := make([]*session, 0, len(h.sessions))
+	for _, sess := range h.sessions {
+		sessions = append(sessions, sess)
+	}
+	h.mu.Unlock()
+
+	var count int
+	for _, sess := range sessions {
+		count += sess.interruptAll()
+	}
+	return count
+}
+
+// handleLsRunning processes the "ls-running" operation.
+// It lists the evaluations in flight across all sessions, longest running
+// first. Each can be cancelled with an "interrupt" request naming its
+// session and, in data.interrupt-id, its ID.
+func (h *Handler) handleLsRunning(resp *protocol.Message) *protocol.Message {
+	running := h.listRunning(time.Now())
+
+	evals := make([]interface{}, len(running))
+	for i, info := range running {
+		evals[i] = map[string]interface{}{
+			"id":         info.id,
+			"session":    info.session,
+			"elapsed-ms": float64(info.elapsed) / float64(time.Millisecond),
+		}
+	}
+
+	resp.Status = []string{"done"}
+	resp.Data = map[string]interface{}{
+		"running": evals,
+	}
+	return resp
+}
@@ -0,0 +1,227 @@
+package operations
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// session holds state scoped to a single session ID.
+type session struct {
+	mu      sync.Mutex
+	options map[string]interface{}
+	running map[string]*runningEval // message ID -> in-flight evaluation
+
+	results       map[string]*pagedResult // result handle -> retained list
+	resultOrder   []string                // result handles, oldest first
+	retainedItems int                     // items across all retained results
+
+	streaming bool            // set by "session-stream"
+	input     chan inputChunk // queued "stdin" input
+
+	requests   int       // requests handled, for Sessions
+	lastActive time.Time // when the latest request arrived
+
+	paused       chan struct{} // closed by "resume-session"; nil unless paused
+	rejectPaused bool          // reject evaluations while paused instead of holding them
+
+	aliases map[string]string // name -> form, set by "define-alias"
+
+	checkpoints []string // IDs of the checkpoints the session created, oldest first
+}
+
+// session returns the state for the given session ID, creating it if needed.
+func (h *Handler) session(id string) *session {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sess, exists := h.sessions[id]
+	if !exists {
+		sess = h.newSessionLocked(id)
+	}
+	return sess
+}
+
+// lookupSession returns the state for the given session ID, or nil if the
+// session has none. Unlike session, it never creates state.
+func (h *Handler) lookupSession(id string) *session {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.sessions[id]
+}
+
+// newSessionLocked creates and registers the state for the given session
+// ID. h.mu must be held.
+func (h *Handler) newSessionLocked(id string) *session {
+	sess := &session{
+		options: make(map[string]interface{}),
+		running: make(map[string]*runningEval),
+		results: make(map[string]*pagedResult),
+		input:   make(chan inputChunk, inputBuffer),
+	}
+	h.sessions[id] = sess
+	return sess
+}
+
+// openSession returns the state for the session a request names, creating
+// it if needed. At MaxSessions, a new session takes the place of the least
+// recently active session that has been idle for SessionIdleTTL; if there is
+// none, or no TTL is set, it reports false and creates nothing. The limit
+// check, eviction and creation happen under one hold of h.mu, so concurrent
+// requests cannot push the count past MaxSessions.
+func (h *Handler) openSession(id string, now time.Time) (*session, bool) {
+	h.mu.Lock()
+	if sess, exists := h.sessions[id]; exists {
+		h.mu.Unlock()
+		return sess, true
+	}
+	var evicted string
+	var evictedSess *session
+	if h.MaxSessions > 0 && len(h.sessions) >= h.MaxSessions {
+		evicted = h.evictableLocked(now)
+		if evicted == "" {
+			h.mu.Unlock()
+			return nil, false
+		}
+		evictedSess = h.sessions[evicted]
+		delete(h.sessions, evicted)
+	}
+	sess := h.newSessionLocked(id)
+	h.mu.Unlock()
+
+	if evictedSess != nil {
+		h.Log().Info("evicting idle session", "session", evicted, "for", id)
+		h.discardSession(evicted, evictedSess)
+	}
+	return sess, true
+}
+
+// evictableLocked returns the least recently active session with no
+// evaluation running that has been idle for SessionIdleTTL, or "" if there
+// is none. h.mu must be held.
+func (h *Handler) evictableLocked(now time.Time) string {
+	if h.SessionIdleTTL <= 0 {
+		return ""
+	}
+	var oldest string
+	var oldestActive time.Time
+	for id, sess := range h.sessions {
+		sess.mu.Lock()
+		idle := len(sess.running) == 0 && now.Sub(sess.lastActive) >= h.SessionIdleTTL
+		lastActive := sess.lastActive
+		sess.mu.Unlock()
+		if idle && (oldest == "" || lastActive.Before(oldestActive)) {
+			oldest, oldestActive = id, lastActive
+		}
+	}
+	return oldest
+}
+
+// CloseSession interrupts the session's in-flight evaluations and discards
+// all state held for it. Transports call it when the connection owning the
+// session goes away.
+func (h *Handler) CloseSession(id string) {
+	h.mu.Lock()
+	sess := h.sessions[id]
+	delete(h.sessions, id)
+	h.mu.Unlock()
+
+	h.discardSession(id, sess)
+}
+
+// discardSession interrupts the evaluations of a session already removed
+// from h.sessions, if it had state, and drops the subscriptions it owns.
+func (h *Handler) discardSession(id string, sess *session) {
+	if sess != nil {
+		sess.interruptAll()
+	}
+
+	// Subscriptions owned by the session go away with it
+	h.removeSubscribers(func(sub *subscriber) bool {
+		return sub.owner == id
+	})
+}
+
+// touch records a request arriving at now.
+func (s *session) touch(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	s.lastActive = now
+}
+
+// setOption stores an option value, removing the option if value is nil.
+func (s *session) setOption(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if value == nil {
+		delete(s.options, key)
+		return
+	}
+	s.options[key] = value
+}
+
+// snapshotOptions returns a copy of the session's options.
+func (s *session) snapshotOptions() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	options := make(map[string]interface{}, len(s.options))
+	for k, v := range s.options {
+		options[k] = v
+	}
+	return options
+}
+
+// setStreaming switches the session into streaming mode.
+func (s *session) setStreaming() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streaming = true
+}
+
+// isStreaming reports whether the session is in streaming mode.
+func (s *session) isStreaming() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streaming
+}
+
+// track records an in-flight evaluation so that it can be interrupted.
+func (s *session) track(id string, cancel context.CancelFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running[id] = &runningEval{cancel: cancel, started: time.Now()}
+}
+
+// untrack removes a finished evaluation.
+func (s *session) untrack(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.running, id)
+}
+
+// interrupt cancels the in-flight evaluation with the given message ID.
+// It reports whether such an evaluation was found.
+func (s *session) interrupt(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	eval, exists := s.running[id]
+	if exists {
+		eval.cancel()
+	}
+	return exists
+}
+
+// interruptAll cancels every in-flight evaluation and returns how many there were.
+func (s *session) interruptAll() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, eval := range s.running {
+		eval.cancel()
+	}
+	return len(s.running)
+}
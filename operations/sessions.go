@@ -0,0 +1,51 @@
+package operations
+
+import (
+	"sort"
+	"time"
+)
+
+// SessionInfo is a snapshot of a session's activity.
+type SessionInfo struct {
+	ID           string
+	Requests     int       // requests handled in the session
+	LastActivity time.Time // when the latest request arrived
+	State        string    // "paused", "evaluating" while an evaluation runs, or "idle"
+	Running      int       // evaluations in progress
+}
+
+// Sessions returns a snapshot of every session the handler holds state for,
+// sorted by ID, for embedders such as operations dashboards.
+func (h *Handler) Sessions() []SessionInfo {
+	h.mu.Lock()
+	sessions := make(map[string]*session, len(h.sessions))
+	for id, sess := range h.sessions {
+		sessions[id] = sess
+	}
+	h.mu.Unlock()
+
+	infos := make([]SessionInfo, 0, len(sessions))
+	for id, sess := range sessions {
+		sess.mu.Lock()
+		info := SessionInfo{
+			ID:           id,
+			Requests:     sess.requests,
+			LastActivity: sess.lastActive,
+			State:        "idle",
+			Running:      len(sess.running),
+		}
+		paused := sess.paused != nil
+		sess.mu.Unlock()
+		switch {
+		case paused:
+			info.State = "paused"
+		case info.Running > 0:
+			info.State = "evaluating"
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
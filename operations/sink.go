@@ -0,0 +1,71 @@
+package operations
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/zylisp/repl/protocol"
+)
+
+// sinkBacklog is how many pieces of output may wait for a slow OutputSink
+// before further output is dropped.
+const sinkBacklog = 1024
+
+// outputSink queues output for Handler.OutputSink so that evaluations never
+// wait for the sink. A goroutine writes the queue in order while it is not
+// empty.
+type outputSink struct {
+	mu      sync.Mutex
+	pending []string
+	writing bool // a goroutine is writing pending
+}
+
+// teeOutput copies output produced for req to OutputSink, if one is set,
+// with each line prefixed by the request's session and ID.
+func (h *Handler) teeOutput(req *protocol.Message, output string) {
+	if h.OutputSink == nil || output == "" {
+		return
+	}
+
+	prefix := fmt.Sprintf("[%s %s] ", req.Session, req.ID)
+	var annotated strings.Builder
+	for _, line := range strings.SplitAfter(strings.TrimSuffix(output, "\n"), "\n") {
+		annotated.WriteString(prefix)
+		annotated.WriteString(line)
+	}
+	annotated.WriteString("\n")
+
+	s := &h.sink
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) >= sinkBacklog {
+		h.Log().Warn("output sink is falling behind; dropping output", "session", req.Session, "id", req.ID)
+		return
+	}
+	s.pending = append(s.pending, annotated.String())
+	if !s.writing {
+		s.writing = true
+		go h.writeSink()
+	}
+}
+
+// writeSink writes queued output to OutputSink until the queue is empty.
+func (h *Handler) writeSink() {
+	s := &h.sink
+	for {
+		s.mu.Lock()
+		if len(s.pending) == 0 {
+			s.writing = false
+			s.mu.Unlock()
+			return
+		}
+		next := s.pending[0]
+		s.pending = s.pending[1:]
+		s.mu.Unlock()
+
+		if _, err := h.OutputSink.Write([]byte(next)); err != nil {
+			h.Log().Warn("failed to write to output sink", "error", err)
+		}
+	}
+}
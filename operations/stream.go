@@ -0,0 +1,265 @@
+package operations
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/zylisp/repl/protocol"
+)
+
+// inputBuffer is how many "stdin" messages a session queues before an
+// evaluation reads them.
+const inputBuffer = 16
+
+// inputChunk is the input of one "stdin" message.
+type inputChunk struct {
+	text string
+	eof  bool // the client closed its input after text
+}
+
+// evalStream carries the state evaluators use to exchange output and input
+// with the client while an evaluation runs.
+type evalStream struct {
+	id      string
+	session string
+	context map[string]interface{} // the request's opaque Context
+	sess    *session
+	send    SendFunc            // nil unless the session is streaming
+	tee     func(output string) // copies pushed output to the handler's OutputSink
+
+	mu       sync.Mutex      // held while output is written, so finish waits for writers
+	buffered strings.Builder // output written while not streaming
+	finished bool            // the evaluation has returned
+
+	line      string // input read past the last line returned by ReadLine
+	eof       bool   // the client closed its input; guarded by mu
+	readInput bool   // the evaluation has read input; guarded by mu
+}
+
+// evalStreamKey is the context key for the running evaluation's evalStream.
+type evalStreamKey struct{}
+
+// WriteOutput delivers output produced by the evaluation running under ctx.
+// In a streaming session the output is pushed to the client immediately as a
+// message carrying the request ID and no status; otherwise it is collected
+// and prepended to the response's output. All output written before the
+// evaluator returns reaches the client before the final response; output
+// written afterwards, for example by a goroutine the evaluator left running,
+// is rejected.
+func WriteOutput(ctx context.Context, output string) error {
+	stream, ok := ctx.Value(evalStreamKey{}).(*evalStream)
+	if !ok {
+		return fmt.Errorf("no evaluation in progress")
+	}
+
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	if stream.finished {
+		return fmt.Errorf("evaluation has finished")
+	}
+
+	if stream.send == nil {
+		stream.buffered.WriteString(output)
+		return nil
+	}
+	stream.tee(output)
+	return stream.send(&protocol.Message{
+		ID:      stream.id,
+		Session: stream.session,
+		Context: stream.context,
+		Output:  output,
+	})
+}
+
+// ReadInput asks the client for input on behalf of the evaluation running
+// under ctx and waits for it. It returns the data.input of the next "stdin"
+// request in the session, pushing a message with status "need-input" first
+// unless input is already waiting. Once a "stdin" request sets data.eof and
+// its input has been read, ReadInput returns io.EOF for the rest of the
+// evaluation. Input is only available in streaming sessions.
+func ReadInput(ctx context.Context) (string, error) {
+	stream, ok := ctx.Value(evalStreamKey{}).(*evalStream)
+	if !ok {
+		return "", fmt.Errorf("no evaluation in progress")
+	}
+	if stream.send == nil {
+		return "", fmt.Errorf("input requires a streaming session")
+	}
+
+	stream.mu.Lock()
+	if stream.eof {
+		stream.mu.Unlock()
+		return "", io.EOF
+	}
+	stream.mu.Unlock()
+
+	var chunk inputChunk
+	select {
+	case chunk = <-stream.sess.input:
+	default:
+		if err := stream.askForInput(); err != nil {
+			return "", err
+		}
+		select {
+		case chunk = <-stream.sess.input:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+
+	stream.mu.Lock()
+	stream.readInput = true
+	stream.eof = chunk.eof
+	stream.mu.Unlock()
+	if chunk.eof && chunk.text == "" {
+		return "", io.EOF
+	}
+	return chunk.text, nil
+}
+
+// ReadLine is like ReadInput but returns one line of input at a time,
+// without its newline, however the client split the input across "stdin"
+// requests. At the end of input it returns any final unterminated line,
+// then io.EOF.
+func ReadLine(ctx context.Context) (string, error) {
+	stream, ok := ctx.Value(evalStreamKey{}).(*evalStream)
+	if !ok {
+		return "", fmt.Errorf("no evaluation in progress")
+	}
+
+	for {
+		if line, rest, found := strings.Cut(stream.line, "\n"); found {
+			stream.line = rest
+			return line, nil
+		}
+		input, err := ReadInput(ctx)
+		if err == io.EOF && stream.line != "" {
+			line := stream.line
+			stream.line = ""
+			return line, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		stream.line += input
+	}
+}
+
+// askForInput pushes a "need-input" message for the evaluation.
+func (s *evalStream) askForInput() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished {
+		return fmt.Errorf("evaluation has finished")
+	}
+	return s.send(&protocol.Message{
+		ID:      s.id,
+		Session: s.session,
+		Context: s.context,
+		Status:  []string{"need-input"},
+	})
+}
+
+// withEvalStream returns a copy of ctx carrying the stream for req.
+func (h *Handler) withEvalStream(ctx context.Context, req *protocol.Message, sess *session) (context.Context, *evalStream) {
+	stream := &evalStream{id: req.ID, session: req.Session, context: req.Context, sess: sess}
+	stream.tee = func(output string) { h.teeOutput(req, output) }
+	if sess.isStreaming() {
+		stream.send = senderFromContext(ctx)
+	}
+	return context.WithValue(ctx, evalStreamKey{}, stream), stream
+}
+
+// finish marks the evaluation as returned, waiting for output writes in
+// progress, and returns the output collected while not streaming. If the
+// evaluation read input, input still queued for it, including a closing
+// EOF, is discarded so that it does not reach the next evaluation. After it
+// returns, nothing more is pushed for the evaluation, so the final response
+// can be sent.
+func (s *evalStream) finish() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.finished = true
+	if s.readInput {
+		s.sess.discardInput()
+	}
+	output := s.buffered.String()
+	s.buffered.Reset()
+	return output
+}
+
+// discardInput drops the input queued in the session, left over by an
+// evaluation that stopped reading before its end.
+func (s *session) discardInput() {
+	for {
+		select {
+		case <-s.input:
+		default:
+			return
+		}
+	}
+}
+
+// handleSessionStream processes the "session-stream" operation.
+// It switches the request's session into streaming mode: evaluations push
+// their output as it is written and may ask for input with "need-input".
+// Transports that own a dedicated connection also stop handling requests in
+// lockstep, so "interrupt" and "stdin" are processed while an eval runs.
+func (h *Handler) handleSessionStream(ctx context.Context, req *protocol.Message, resp *protocol.Message) *protocol.Message {
+	if senderFromContext(ctx) == nil {
+		resp.Status = []string{"error"}
+		resp.ProtocolError = "session-stream operation not supported by this transport"
+		return resp
+	}
+
+	h.session(req.Session).setStreaming()
+	resp.Status = []string{"done"}
+	resp.Data = map[string]interface{}{
+		"session": req.Session,
+	}
+	return resp
+}
+
+// handleStdin processes the "stdin" operation.
+// It queues data.input for ReadInput in the request's session. Setting
+// data.eof closes the input after data.input, which may then be omitted:
+// the reading evaluation sees io.EOF once the input queued so far has been
+// read. Input queued before an evaluation starts is kept for the first one
+// that reads; whatever that evaluation leaves unread when it returns,
+// including the EOF, is discarded, so the next starts with input open.
+func (h *Handler) handleStdin(req *protocol.Message, resp *protocol.Message) *protocol.Message {
+	var chunk inputChunk
+	var hasInput bool
+	if req.Data != nil {
+		chunk.text, hasInput = req.Data["input"].(string)
+		chunk.eof, _ = req.Data["eof"].(bool)
+	}
+	if !hasInput && !chunk.eof {
+		resp.Status = []string{"error"}
+		resp.ProtocolError = "stdin operation requires 'input' or 'eof' in data field"
+		return resp
+	}
+
+	select {
+	case h.session(req.Session).input <- chunk:
+		resp.Status = []string{"done"}
+	default:
+		resp.Status = []string{"error"}
+		resp.ProtocolError = "too much pending input"
+	}
+	return resp
+}
+
+// IsControlOp reports whether op should be handled as soon as it arrives
+// rather than queued behind running evaluations in a streaming session.
+func IsControlOp(op string) bool {
+	switch op {
+	case "interrupt", "ls-running", "ping", "flush-queue", "pause-session", "resume-session", "stdin":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,25 @@
+package operations
+
+import (
+	"fmt"
+
+	"github.com/zylisp/repl/protocol"
+)
+
+// wantsStringify reports whether the request set data.stringify.
+func wantsStringify(req *protocol.Message) bool {
+	if req.Data == nil {
+		return false
+	}
+	enabled, _ := req.Data["stringify"].(bool)
+	return enabled
+}
+
+// stringify returns the textual form of an evaluation result: its String
+// method if it has one, and its default formatting otherwise.
+func stringify(value interface{}) string {
+	if s, ok := value.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,173 @@
+package operations
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/zylisp/repl/protocol"
+)
+
+// subscriberBuffer is how many copies may wait for a slow subscriber.
+// Further copies are dropped until it catches up.
+const subscriberBuffer = 64
+
+// subscriber receives copies of another session's evaluation results.
+type subscriber struct {
+	id      string // ID of the subscribe request; pushed copies carry it
+	owner   string // session that created the subscription
+	session string // session being observed
+	send    SendFunc
+	queue   chan *protocol.Message // copies waiting to be sent; closed on removal
+}
+
+// handleSubscribe processes the "subscribe" operation.
+// It registers the requesting connection to receive a copy of every eval and
+// load-file result produced in data.session. Copies are pushed with the
+// subscribe request's ID, the observed session in Session, and the original
+// request ID in data.source-id. Other sessions can only be observed once
+// they set the "observable" option to true. The subscription lasts until an
+// "unsubscribe" naming that ID, or until the subscriber's session closes.
+func (h *Handler) handleSubscribe(ctx context.Context, req *protocol.Message, resp *protocol.Message) *protocol.Message {
+	var target string
+	if req.Data != nil {
+		target, _ = req.Data["session"].(string)
+	}
+	if target == "" {
+		resp.Status = []string{"error"}
+		resp.ProtocolError = "subscribe operation requires 'session' in data field"
+		return resp
+	}
+
+	send := senderFromContext(ctx)
+	if send == nil {
+		resp.Status = []string{"error"}
+		resp.ProtocolError = "subscribe operation not supported by this transport"
+		return resp
+	}
+
+	if target != req.Session && !h.observable(target) {
+		resp.Status = []string{"error", "not-observable"}
+		resp.ProtocolError = fmt.Sprintf("session %q does not allow subscriptions", target)
+		return resp
+	}
+
+	sub := &subscriber{
+		id:      req.ID,
+		owner:   req.Session,
+		session: target,
+		send:    send,
+		queue:   make(chan *protocol.Message, subscriberBuffer),
+	}
+	h.mu.Lock()
+	subs := h.subscribers[target]
+	if subs == nil {
+		subs = make(map[*subscriber]struct{})
+		h.subscribers[target] = subs
+	}
+	subs[sub] = struct{}{}
+	h.mu.Unlock()
+	go h.deliver(sub)
+
+	resp.Status = []string{"done"}
+	resp.Data = map[string]interface{}{
+		"subscription": req.ID,
+	}
+	return resp
+}
+
+// handleUnsubscribe processes the "unsubscribe" operation.
+// It removes the subscription created by the subscribe request whose ID is
+// given in data.subscription.
+func (h *Handler) handleUnsubscribe(req *protocol.Message, resp *protocol.Message) *protocol.Message {
+	var id string
+	if req.Data != nil {
+		id, _ = req.Data["subscription"].(string)
+	}
+	if id == "" {
+		resp.Status = []string{"error"}
+		resp.ProtocolError = "unsubscribe operation requires 'subscription' in data field"
+		return resp
+	}
+
+	removed := h.removeSubscribers(func(sub *subscriber) bool {
+		return sub.owner == req.Session && sub.id == id
+	})
+	if removed == 0 {
+		resp.Status = []string{"error"}
+		resp.ProtocolError = fmt.Sprintf("no subscription %q", id)
+		return resp
+	}
+
+	resp.Status = []string{"done"}
+	return resp
+}
+
+// observable reports whether the session has set the "observable" option.
+func (h *Handler) observable(id string) bool {
+	sess := h.lookupSession(id)
+	if sess == nil {
+		return false
+	}
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.options["observable"] == true
+}
+
+// removeSubscribers removes every subscriber matching fn and returns the count.
+func (h *Handler) removeSubscribers(fn func(*subscriber) bool) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var removed int
+	for session, subs := range h.subscribers {
+		for sub := range subs {
+			if fn(sub) {
+				delete(subs, sub)
+				close(sub.queue)
+				removed++
+			}
+		}
+		if len(subs) == 0 {
+			delete(h.subscribers, session)
+		}
+	}
+	return removed
+}
+
+// publish queues a copy of resp for every subscriber of req's session.
+// A copy is dropped if the subscriber's queue is full, so a slow subscriber
+// never holds up the evaluating session.
+func (h *Handler) publish(req *protocol.Message, resp *protocol.Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subscribers[req.Session] {
+		msg := &protocol.Message{
+			ID:      sub.id,
+			Session: req.Session,
+			Status:  append([]string(nil), resp.Status...),
+			Value:   resp.Value,
+			Output:  resp.Output,
+			Data: map[string]interface{}{
+				"source-id": req.ID,
+			},
+		}
+		select {
+		case sub.queue <- msg:
+		default:
+			h.Log().Warn("subscriber queue full, dropping copy", "subscription", sub.id, "session", req.Session, "source-id", req.ID)
+		}
+	}
+}
+
+// deliver sends sub's queued copies until it is removed. A subscriber whose
+// connection can no longer be written is removed.
+func (h *Handler) deliver(sub *subscriber) {
+	for msg := range sub.queue {
+		if err := sub.send(msg); err != nil {
+			h.removeSubscribers(func(s *subscriber) bool { return s == sub })
+			return
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package operations
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/zylisp/repl/protocol"
+)
+
+// ValueType holds the type name of an evaluation's result, as recorded by
+// the evaluator itself.
+type ValueType struct {
+	Name string
+}
+
+// valueTypeKey is the context key for the request's *ValueType.
+type valueTypeKey struct{}
+
+// withValueType returns a copy of ctx asking the evaluator to record its
+// result's type name in valueType.
+func withValueType(ctx context.Context, valueType *ValueType) context.Context {
+	return context.WithValue(ctx, valueTypeKey{}, valueType)
+}
+
+// ValueTypeFromContext returns where a context-aware evaluator should record
+// its result's type name when the request set data.with-type, or nil
+// otherwise. Evaluators that convert their results to Go values know the
+// type better than the converted value shows; if the evaluator records
+// nothing, the handler names the type of the converted value instead.
+func ValueTypeFromContext(ctx context.Context) *ValueType {
+	valueType, _ := ctx.Value(valueTypeKey{}).(*ValueType)
+	return valueType
+}
+
+// wantsType reports whether the request set data.with-type.
+func wantsType(req *protocol.Message) bool {
+	if req.Data == nil {
+		return false
+	}
+	enabled, _ := req.Data["with-type"].(bool)
+	return enabled
+}
+
+// setValueType records the result's type name in data.value-type.
+func setValueType(resp *protocol.Message, name string) {
+	if resp.Data == nil {
+		resp.Data = make(map[string]interface{})
+	}
+	resp.Data["value-type"] = name
+}
+
+// typeOf names the type of value using the configured TypeOf, or goTypeName.
+func (h *Handler) typeOf(value interface{}) string {
+	if h.TypeOf != nil {
+		return h.TypeOf(value)
+	}
+	return goTypeName(value)
+}
+
+// goTypeName classifies a plain Go result as "nil", "boolean", "integer",
+// "float", "string", "list", "map" or "function", and anything else as
+// "unknown".
+func goTypeName(value interface{}) string {
+	if value == nil {
+		return "nil"
+	}
+	switch reflect.TypeOf(value).Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "float"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		return "list"
+	case reflect.Map:
+		return "map"
+	case reflect.Func:
+		return "function"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,30 @@
+package operations
+
+import "github.com/zylisp/repl/protocol"
+
+// Values is returned by an evaluator for a form that yields several values.
+// The eval response carries all of them, in order, in data.values, and the
+// first (nil if there are none) in Value for clients unaware of multiple
+// values.
+type Values []interface{}
+
+// setValues records values in data.values, stringified if the request asked
+// for it, and returns the primary value.
+func setValues(req *protocol.Message, resp *protocol.Message, values Values) interface{} {
+	all := make([]interface{}, len(values))
+	for i, value := range values {
+		if wantsStringify(req) {
+			value = stringify(value)
+		}
+		all[i] = value
+	}
+	if resp.Data == nil {
+		resp.Data = make(map[string]interface{})
+	}
+	resp.Data["values"] = all
+
+	if len(values) == 0 {
+		return nil
+	}
+	return values[0]
+}
@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 )
@@ -20,15 +21,90 @@ type Codec interface {
 }
 
 // NewCodec creates a codec based on the specified format.
-// Supported formats: "json", "msgpack"
+// Supported formats: "json". "msgpack" is recognized but returns an error
+// until its codec is implemented.
 // The rw parameter is the underlying transport connection.
 func NewCodec(format string, rw io.ReadWriteCloser) (Codec, error) {
 	switch format {
 	case "json":
 		return NewJSONCodec(rw), nil
 	case "msgpack":
-		return NewMessagePackCodec(rw), nil
+		return nil, errMessagePackUnimplemented
 	default:
 		return nil, fmt.Errorf("unsupported codec format: %s", format)
 	}
 }
+
+// NewCodecSize is like NewCodec but reads through a buffer of
+// readBufferSize bytes where the format supports it. Zero means the default
+// size.
+func NewCodecSize(format string, rw io.ReadWriteCloser, readBufferSize int) (Codec, error) {
+	if format == "json" && readBufferSize > 0 {
+		return NewJSONCodecSize(rw, readBufferSize), nil
+	}
+	return NewCodec(format, rw)
+}
+
+// CodecAvailable reports whether NewCodec can create a working codec for
+// format. MessagePack is not available until its codec is implemented.
+func CodecAvailable(format string) bool {
+	return format == "json"
+}
+
+// Upgrade returns a codec for format that continues the stream current was
+// decoding from rw. Bytes current has read ahead of the last message it
+// returned are decoded by the new codec first, so switching codecs between
+// two messages loses nothing. The new codec keeps current's read buffer
+// size. current must not be used afterwards. Until the MessagePack codec is
+// implemented, JSON is the only format available.
+func Upgrade(current Codec, format string, rw io.ReadWriteCloser) (Codec, error) {
+	if !CodecAvailable(format) {
+		return nil, fmt.Errorf("codec %q is not available", format)
+	}
+	return NewCodecSize(format, remaining(current, rw), readBufferSize(current))
+}
+
+// readBufferSize returns the size of current's read buffer, or zero if it
+// does not report one.
+func readBufferSize(current Codec) int {
+	if s, ok := current.(interface{ ReadBufferSize() int }); ok {
+		return s.ReadBufferSize()
+	}
+	return 0
+}
+
+// remaining returns rw preceded by the bytes current has read ahead of the
+// last message it returned, so that a new codec can continue the stream.
+func remaining(current Codec, rw io.ReadWriteCloser) io.ReadWriteCloser {
+	if b, ok := current.(interface{ Buffered() []byte }); ok {
+		if pending := b.Buffered(); len(pending) > 0 {
+			return &readWriteCloser{
+				Reader: io.MultiReader(bytes.NewReader(pending), rw),
+				Writer: rw,
+				Closer: rw,
+			}
+		}
+	}
+	return rw
+}
+
+// readWriteCloser assembles an io.ReadWriteCloser from its parts.
+type readWriteCloser struct {
+	io.Reader
+	io.Writer
+	io.Closer
+}
+
+// FrameError reports a single malformed frame.
+// The codec has skipped past the frame, so decoding can continue with the next message.
+type FrameError struct {
+	Err error
+}
+
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("malformed frame: %v", e.Err)
+}
+
+func (e *FrameError) Unwrap() error {
+	return e.Err
+}
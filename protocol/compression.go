@@ -0,0 +1,88 @@
+package protocol
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Compressions lists the compressions Compress supports.
+var Compressions = []string{"gzip"}
+
+// NoCompression is what NegotiateCompression returns when the peers share
+// no compression.
+const NoCompression = "none"
+
+// NegotiateCompression picks the compression for a connection: the first of
+// accepted, the server's compressions in order of preference, that offered,
+// the client's, also lists. It returns NoCompression if there is none.
+func NegotiateCompression(accepted, offered []string) string {
+	for _, name := range accepted {
+		if !CompressionAvailable(name) {
+			continue
+		}
+		for _, candidate := range offered {
+			if candidate == name {
+				return name
+			}
+		}
+	}
+	return NoCompression
+}
+
+// CompressionAvailable reports whether Compress supports compression.
+func CompressionAvailable(compression string) bool {
+	for _, name := range Compressions {
+		if name == compression {
+			return true
+		}
+	}
+	return false
+}
+
+// Compress is like Upgrade but keeps format and compresses every later
+// message in both directions with compression. Each message is flushed as
+// it is written, so it can be decoded as soon as it arrives.
+func Compress(current Codec, format, compression string, rw io.ReadWriteCloser) (Codec, error) {
+	if compression != "gzip" {
+		return nil, fmt.Errorf("compression %q is not available", compression)
+	}
+	if !CodecAvailable(format) {
+		return nil, fmt.Errorf("codec %q is not available", format)
+	}
+	rw = remaining(current, rw)
+	return NewCodecSize(format, &gzipStream{rw: rw, w: gzip.NewWriter(rw)}, readBufferSize(current))
+}
+
+// gzipStream compresses what is written to rw and decompresses what is read
+// from it.
+type gzipStream struct {
+	rw io.ReadWriteCloser
+	r  *gzip.Reader // created on the first Read, as it reads the header
+	w  *gzip.Writer
+}
+
+func (s *gzipStream) Read(p []byte) (int, error) {
+	if s.r == nil {
+		r, err := gzip.NewReader(s.rw)
+		if err != nil {
+			return 0, err
+		}
+		s.r = r
+	}
+	return s.r.Read(p)
+}
+
+// Write compresses p and flushes it, so that a message written in one call
+// reaches the peer whole.
+func (s *gzipStream) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, s.w.Flush()
+}
+
+func (s *gzipStream) Close() error {
+	return s.rw.Close()
+}
@@ -1,37 +1,157 @@
 package protocol
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"io"
+	"sync"
 )
 
+// maxRetainedBufferSize bounds the capacity of the buffers kept for reuse:
+// pooled encode buffers and each codec's frame buffer. Larger buffers are
+// dropped after use.
+const maxRetainedBufferSize = 64 * 1024
+
+// encodeBuffer pairs a reusable buffer with an encoder that writes into it.
+type encodeBuffer struct {
+	bytes.Buffer
+	encoder *json.Encoder
+}
+
+// encodeBufferPool holds encode buffers shared by all JSON codecs.
+var encodeBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := &encodeBuffer{}
+		buf.encoder = json.NewEncoder(&buf.Buffer)
+		return buf
+	},
+}
+
 // JSONCodec implements the Codec interface using newline-delimited JSON encoding.
-// It uses encoding/json's Encoder and Decoder which automatically handle framing.
+// Each message is written as a single line, and read back one line at a time
+// so that a malformed frame can be skipped without losing the position of the
+// messages that follow it.
 type JSONCodec struct {
-	rw      io.ReadWriteCloser
-	encoder *json.Encoder
-	decoder *json.Decoder
+	rw     io.ReadWriteCloser
+	reader *bufio.Reader
+	delim  byte         // frame terminator
+	frame  bytes.Buffer // reused for frames larger than the read buffer
 }
 
 // NewJSONCodec creates a new JSON codec that reads from and writes to the given ReadWriteCloser.
 func NewJSONCodec(rw io.ReadWriteCloser) *JSONCodec {
+	return NewJSONCodecWithDelimiter(rw, '\n')
+}
+
+// NewJSONCodecWithDelimiter creates a JSON codec that terminates frames with
+// delim instead of a newline, for peers that frame JSON with NUL bytes or
+// record separators (0x1E). The JSON encoder escapes control characters
+// inside strings, so any control character is safe to use.
+func NewJSONCodecWithDelimiter(rw io.ReadWriteCloser, delim byte) *JSONCodec {
 	return &JSONCodec{
-		rw:      rw,
-		encoder: json.NewEncoder(rw),
-		decoder: json.NewDecoder(rw),
+		rw:     rw,
+		reader: bufio.NewReader(rw),
+		delim:  delim,
+	}
+}
+
+// NewJSONCodecSize creates a newline-delimited JSON codec that reads through
+// a buffer of size bytes, so that a peer pipelining many small messages is
+// read with fewer Read calls. Sizes below 16 bytes are raised to 16.
+func NewJSONCodecSize(rw io.ReadWriteCloser, size int) *JSONCodec {
+	return &JSONCodec{
+		rw:     rw,
+		reader: bufio.NewReaderSize(rw, size),
+		delim:  '\n',
 	}
 }
 
 // Encode encodes a message to JSON and writes it to the underlying writer.
-// The encoder automatically adds a newline after each message.
+// The message and its trailing delimiter are written with a single Write call.
 func (c *JSONCodec) Encode(msg *Message) error {
-	return c.encoder.Encode(msg)
+	buf := encodeBufferPool.Get().(*encodeBuffer)
+	defer func() {
+		if buf.Cap() <= maxRetainedBufferSize {
+			encodeBufferPool.Put(buf)
+		}
+	}()
+
+	buf.Reset()
+	if err := buf.encoder.Encode(msg); err != nil {
+		return err
+	}
+	if c.delim != '\n' {
+		// Swap the encoder's trailing newline for the delimiter
+		buf.Bytes()[buf.Len()-1] = c.delim
+	}
+	_, err := c.rw.Write(buf.Bytes())
+	return err
 }
 
-// Decode reads and decodes a JSON message from the underlying reader.
-// The decoder automatically handles newline-delimited JSON.
+// Decode reads the next delimited frame and decodes it into msg.
+// Blank lines are skipped. If the frame is not a valid message, Decode returns
+// a *FrameError; the bad frame has already been consumed, so the caller may
+// report the error and keep decoding subsequent messages.
 func (c *JSONCodec) Decode(msg *Message) error {
-	return c.decoder.Decode(msg)
+	defer c.trimFrame()
+	for {
+		line, err := c.readFrame()
+		line = bytes.TrimSuffix(line, []byte{c.delim})
+		blank := len(bytes.TrimSpace(line)) == 0
+		if err != nil && (err != io.EOF || blank) {
+			// At EOF, a final frame without a trailing delimiter is still decoded
+			return err
+		}
+		if blank {
+			continue
+		}
+
+		if jsonErr := json.Unmarshal(line, msg); jsonErr != nil {
+			return &FrameError{Err: jsonErr}
+		}
+		return nil
+	}
+}
+
+// readFrame returns the next delimiter-terminated frame.
+// The returned slice is only valid until the next call.
+func (c *JSONCodec) readFrame() ([]byte, error) {
+	line, err := c.reader.ReadSlice(c.delim)
+	if err != bufio.ErrBufferFull {
+		return line, err
+	}
+
+	// The frame is larger than the read buffer; accumulate it
+	c.frame.Reset()
+	c.frame.Write(line)
+	for err == bufio.ErrBufferFull {
+		line, err = c.reader.ReadSlice(c.delim)
+		c.frame.Write(line)
+	}
+	return c.frame.Bytes(), err
+}
+
+// trimFrame drops the frame buffer once it has grown beyond
+// maxRetainedBufferSize, so that one large frame is not kept for the life of
+// the connection.
+func (c *JSONCodec) trimFrame() {
+	if c.frame.Cap() > maxRetainedBufferSize {
+		c.frame = bytes.Buffer{}
+	}
+}
+
+// Buffered returns a copy of the bytes read from the underlying reader but
+// not yet decoded. Upgrade hands them to the codec that replaces this one.
+func (c *JSONCodec) Buffered() []byte {
+	pending, _ := c.reader.Peek(c.reader.Buffered())
+	return append([]byte(nil), pending...)
+}
+
+// ReadBufferSize returns the size of the buffer the codec reads through.
+// Upgrade gives the codec that replaces this one the same size.
+func (c *JSONCodec) ReadBufferSize() int {
+	return c.reader.Size()
 }
 
 // Close closes the underlying ReadWriteCloser.
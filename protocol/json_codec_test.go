@@ -2,7 +2,11 @@ package protocol
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"net"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -84,6 +88,9 @@ func TestJSONCodec_EncodeDecodeRoundTrip(t *testing.T) {
 				Data: map[string]interface{}{
 					"key": "value",
 				},
+				Context: map[string]interface{}{
+					"widget": "cell-7",
+				},
 			},
 		},
 	}
@@ -123,6 +130,10 @@ func TestJSONCodec_EncodeDecodeRoundTrip(t *testing.T) {
 				t.Errorf("ProtocolError mismatch: got %q, want %q", decoded.ProtocolError, tt.msg.ProtocolError)
 			}
 
+			if !reflect.DeepEqual(decoded.Context, tt.msg.Context) {
+				t.Errorf("Context mismatch: got %v, want %v", decoded.Context, tt.msg.Context)
+			}
+
 			// Compare Status slice
 			if len(decoded.Status) != len(tt.msg.Status) {
 				t.Errorf("Status length mismatch: got %d, want %d", len(decoded.Status), len(tt.msg.Status))
@@ -171,6 +182,51 @@ func TestJSONCodec_MultipleMessages(t *testing.T) {
 	}
 }
 
+func TestJSONCodec_NULDelimitedRoundTrip(t *testing.T) {
+	buf := newMockReadWriteCloser()
+	codec := NewJSONCodecWithDelimiter(buf, 0)
+
+	messages := []*Message{
+		{Op: "eval", ID: "1", Code: "(println \"a\nb\")"},
+		{ID: "1", Output: "a\nb\n", Status: []string{"done"}},
+	}
+	for _, msg := range messages {
+		if err := codec.Encode(msg); err != nil {
+			t.Fatalf("Failed to encode message: %v", err)
+		}
+	}
+
+	raw := buf.String()
+	if strings.Count(raw, "\x00") != 2 || strings.Contains(raw, "\n") {
+		t.Fatalf("Expected two NUL-terminated frames without newlines, got %q", raw)
+	}
+
+	for i, expected := range messages {
+		decoded := &Message{}
+		if err := codec.Decode(decoded); err != nil {
+			t.Fatalf("Failed to decode message %d: %v", i, err)
+		}
+		if decoded.ID != expected.ID || decoded.Code != expected.Code || decoded.Output != expected.Output {
+			t.Errorf("Message %d mismatch: got %+v, want %+v", i, decoded, expected)
+		}
+	}
+
+	// Frames written by another client, with the last one unterminated
+	buf.WriteString("{\"op\":\"describe\",\"id\":\"2\"}\x00\x00{\"op\":\"eval\",\"id\":\"3\",\"code\":\"1\"}")
+	for _, id := range []string{"2", "3"} {
+		decoded := &Message{}
+		if err := codec.Decode(decoded); err != nil {
+			t.Fatalf("Failed to decode message %s: %v", id, err)
+		}
+		if decoded.ID != id {
+			t.Errorf("Expected message %s, got %+v", id, decoded)
+		}
+	}
+	if err := codec.Decode(&Message{}); err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+}
+
 func TestJSONCodec_DecodeError(t *testing.T) {
 	// Create a buffer with invalid JSON
 	buf := &mockReadWriteCloser{Buffer: bytes.NewBufferString("{invalid json\n")}
@@ -203,3 +259,285 @@ func TestJSONCodec_Close(t *testing.T) {
 		t.Fatalf("Close failed: %v", err)
 	}
 }
+
+func TestJSONCodec_ResyncAfterMalformedFrame(t *testing.T) {
+	buf := &mockReadWriteCloser{Buffer: bytes.NewBufferString(
+		"{invalid json\n" +
+			"\n" +
+			`{"op":"eval","id":"2","code":"(+ 1 2)"}` + "\n" +
+			`{"op":"eval","id":"3","status":5}` + "\n" +
+			`{"op":"describe","id":"4"}`,
+	)}
+	codec := NewJSONCodec(buf)
+
+	msg := &Message{}
+	err := codec.Decode(msg)
+	var frameErr *FrameError
+	if !errors.As(err, &frameErr) {
+		t.Fatalf("Expected FrameError for invalid JSON, got %v", err)
+	}
+
+	msg = &Message{}
+	if err := codec.Decode(msg); err != nil {
+		t.Fatalf("Expected good frame after bad one to decode, got %v", err)
+	}
+	if msg.ID != "2" || msg.Code != "(+ 1 2)" {
+		t.Errorf("Decoded wrong message: %+v", msg)
+	}
+
+	// Well-formed JSON with the wrong shape is also a skippable frame error
+	msg = &Message{}
+	if err := codec.Decode(msg); !errors.As(err, &frameErr) {
+		t.Fatalf("Expected FrameError for mistyped field, got %v", err)
+	}
+
+	// A final frame without a trailing newline is still decoded
+	msg = &Message{}
+	if err := codec.Decode(msg); err != nil {
+		t.Fatalf("Expected unterminated final frame to decode, got %v", err)
+	}
+	if msg.ID != "4" {
+		t.Errorf("Expected message 4, got %+v", msg)
+	}
+
+	if err := codec.Decode(&Message{}); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+}
+
+// discardReadWriteCloser discards writes and serves the same frame on every read.
+type discardReadWriteCloser struct {
+	frame []byte
+	pos   int
+}
+
+func (d *discardReadWriteCloser) Read(p []byte) (int, error) {
+	n := copy(p, d.frame[d.pos:])
+	d.pos = (d.pos + n) % len(d.frame)
+	return n, nil
+}
+
+func (d *discardReadWriteCloser) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (d *discardReadWriteCloser) Close() error {
+	return nil
+}
+
+func BenchmarkJSONCodecEncode(b *testing.B) {
+	codec := NewJSONCodec(&discardReadWriteCloser{})
+	msg := &Message{ID: "1", Value: float64(3), Status: []string{"done"}}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := codec.Encode(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkJSONCodecDecode(b *testing.B) {
+	frame := []byte(`{"op":"eval","id":"1","code":"(+ 1 2)"}` + "\n")
+	codec := NewJSONCodec(&discardReadWriteCloser{frame: frame})
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		msg := &Message{}
+		if err := codec.Decode(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestJSONCodec_LargeFrame(t *testing.T) {
+	buf := newMockReadWriteCloser()
+	codec := NewJSONCodec(buf)
+
+	// Larger than bufio's default read buffer
+	code := strings.Repeat("x", 10000)
+	if err := codec.Encode(&Message{Op: "eval", ID: "1", Code: code}); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if err := codec.Encode(&Message{Op: "eval", ID: "2", Code: "(+ 1 2)"}); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	decoded := &Message{}
+	if err := codec.Decode(decoded); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if decoded.Code != code {
+		t.Errorf("Large frame code mismatch: got %d bytes, want %d", len(decoded.Code), len(code))
+	}
+
+	decoded = &Message{}
+	if err := codec.Decode(decoded); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if decoded.ID != "2" {
+		t.Errorf("Expected message 2 after large frame, got %+v", decoded)
+	}
+}
+
+func TestJSONCodec_DropsOversizedFrameBuffer(t *testing.T) {
+	buf := newMockReadWriteCloser()
+	codec := NewJSONCodec(buf)
+
+	code := strings.Repeat("x", 2*maxRetainedBufferSize)
+	if err := codec.Encode(&Message{Op: "eval", ID: "1", Code: code}); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if err := codec.Decode(&Message{}); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if c := codec.frame.Cap(); c > maxRetainedBufferSize {
+		t.Errorf("Expected the frame buffer to be dropped after a large frame, still holding %d bytes", c)
+	}
+}
+
+func TestMessagePoolDoesNotLeakFields(t *testing.T) {
+	msg := AcquireMessage()
+	msg.Op = "eval"
+	msg.ID = "1"
+	msg.Session = "s"
+	msg.Code = "(+ 1 2)"
+	msg.Status = []string{"done"}
+	msg.Value = float64(3)
+	msg.Output = "out"
+	msg.ProtocolError = "err"
+	msg.Data = map[string]interface{}{"key": "value"}
+	ReleaseMessage(msg)
+
+	// Decoding into a pooled message must not merge with earlier contents
+	buf := &mockReadWriteCloser{Buffer: bytes.NewBufferString(`{"op":"describe","id":"2"}` + "\n")}
+	reused := AcquireMessage()
+	defer ReleaseMessage(reused)
+	if err := NewJSONCodec(buf).Decode(reused); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+
+	want := Message{Op: "describe", ID: "2"}
+	if reused.Op != want.Op || reused.ID != want.ID || reused.Session != "" || reused.Code != "" ||
+		reused.Status != nil || reused.Value != nil || reused.Output != "" ||
+		reused.ProtocolError != "" || reused.Data != nil {
+		t.Errorf("Pooled message leaked fields: %+v", reused)
+	}
+}
+
+func TestUpgradeKeepsReadAheadBytes(t *testing.T) {
+	buf := newMockReadWriteCloser()
+	buf.WriteString(`{"op":"upgrade-codec","id":"1"}` + "\n" + `{"op":"eval","id":"2"}` + "\n")
+
+	codec := NewJSONCodec(buf)
+	first := &Message{}
+	if err := codec.Decode(first); err != nil || first.ID != "1" {
+		t.Fatalf("Failed to decode first message: %+v, %v", first, err)
+	}
+
+	// The first codec has already buffered the second message
+	next, err := Upgrade(codec, "json", buf)
+	if err != nil {
+		t.Fatalf("Upgrade failed: %v", err)
+	}
+	second := &Message{}
+	if err := next.Decode(second); err != nil || second.ID != "2" {
+		t.Fatalf("Expected message 2 from the upgraded codec, got %+v, %v", second, err)
+	}
+
+	if _, err := Upgrade(next, "msgpack", buf); err == nil {
+		t.Error("Expected upgrading to msgpack to fail")
+	}
+}
+
+func TestUpgradeKeepsReadBufferSize(t *testing.T) {
+	buf := newMockReadWriteCloser()
+	codec := NewJSONCodecSize(buf, 64*1024)
+
+	next, err := Upgrade(codec, "json", buf)
+	if err != nil {
+		t.Fatalf("Upgrade failed: %v", err)
+	}
+	if size := next.(*JSONCodec).ReadBufferSize(); size != 64*1024 {
+		t.Errorf("Expected the upgraded codec to read through 64KiB, got %d", size)
+	}
+
+	compressed, err := Compress(next, "json", "gzip", buf)
+	if err != nil {
+		t.Fatalf("Compress failed: %v", err)
+	}
+	if size := compressed.(*JSONCodec).ReadBufferSize(); size != 64*1024 {
+		t.Errorf("Expected the compressed codec to read through 64KiB, got %d", size)
+	}
+}
+
+func TestNewCodecUnavailable(t *testing.T) {
+	buf := newMockReadWriteCloser()
+	for _, format := range []string{"msgpack", "cbor"} {
+		codec, err := NewCodec(format, buf)
+		if err == nil || codec != nil {
+			t.Errorf("Expected NewCodec(%q) to fail, got %v, %v", format, codec, err)
+		}
+	}
+
+	// The placeholder codec reports errors rather than panicking
+	placeholder := NewMessagePackCodec(buf)
+	if err := placeholder.Encode(&Message{Op: "eval"}); err == nil {
+		t.Error("Expected the MessagePack placeholder to refuse to encode")
+	}
+	if err := placeholder.Decode(&Message{}); err == nil {
+		t.Error("Expected the MessagePack placeholder to refuse to decode")
+	}
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	tests := []struct {
+		accepted []string
+		offered  []string
+		expected string
+	}{
+		{[]string{"gzip"}, []string{"gzip"}, "gzip"},
+		{[]string{"gzip"}, []string{"zstd", "gzip"}, "gzip"},
+		{[]string{"gzip"}, nil, NoCompression},
+		{nil, []string{"gzip"}, NoCompression},
+		{[]string{"zstd"}, []string{"zstd"}, NoCompression},
+	}
+	for _, tt := range tests {
+		if got := NegotiateCompression(tt.accepted, tt.offered); got != tt.expected {
+			t.Errorf("NegotiateCompression(%v, %v) = %q, want %q", tt.accepted, tt.offered, got, tt.expected)
+		}
+	}
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	client, err := Compress(NewJSONCodec(clientConn), "json", "gzip", clientConn)
+	if err != nil {
+		t.Fatalf("Compress failed: %v", err)
+	}
+	server, err := Compress(NewJSONCodec(serverConn), "json", "gzip", serverConn)
+	if err != nil {
+		t.Fatalf("Compress failed: %v", err)
+	}
+
+	// Each message is decodable as soon as it is written
+	for _, code := range []string{"(+ 1 2)", strings.Repeat("(list 1 2 3) ", 100)} {
+		errs := make(chan error, 1)
+		go func() {
+			errs <- client.Encode(&Message{Op: "eval", ID: "1", Code: code})
+		}()
+		var msg Message
+		if err := server.Decode(&msg); err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+		if msg.Code != code {
+			t.Errorf("Expected code %q, got %q", code, msg.Code)
+		}
+	}
+}
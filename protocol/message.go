@@ -1,5 +1,7 @@
 package protocol
 
+import "sync"
+
 // Message represents a protocol message exchanged between client and server.
 // Messages use a simple map-based structure that can be encoded in multiple formats.
 type Message struct {
@@ -31,4 +33,38 @@ type Message struct {
 
 	// Data contains additional operation-specific data
 	Data map[string]interface{} `json:"data,omitempty"`
+
+	// Context is opaque client metadata, such as the UI element a request
+	// came from. The server never interprets it and copies it unchanged from
+	// a request to every message it sends for that request.
+	Context map[string]interface{} `json:"context,omitempty"`
+}
+
+// Reset clears every field of the message, dropping references held by
+// Value and Data so that a reused message does not retain or leak them.
+func (m *Message) Reset() {
+	*m = Message{}
+}
+
+// messagePool holds messages for reuse across requests.
+var messagePool = sync.Pool{
+	New: func() interface{} {
+		return &Message{}
+	},
+}
+
+// AcquireMessage returns an empty message from the pool.
+// Callers should return it with ReleaseMessage once it is no longer referenced.
+func AcquireMessage() *Message {
+	return messagePool.Get().(*Message)
+}
+
+// ReleaseMessage resets msg and returns it to the pool.
+// The message must not be used after it has been released.
+func ReleaseMessage(msg *Message) {
+	if msg == nil {
+		return
+	}
+	msg.Reset()
+	messagePool.Put(msg)
 }
@@ -1,9 +1,14 @@
 package protocol
 
 import (
+	"errors"
 	"io"
 )
 
+// errMessagePackUnimplemented is returned wherever MessagePack is requested
+// until its codec is implemented.
+var errMessagePackUnimplemented = errors.New("codec \"msgpack\" is not yet implemented")
+
 // MessagePackCodec implements the Codec interface using MessagePack encoding.
 // This is a placeholder implementation for future binary efficiency optimization.
 // When implemented, it will use github.com/vmihailenco/msgpack/v5.
@@ -12,7 +17,8 @@ type MessagePackCodec struct {
 }
 
 // NewMessagePackCodec creates a new MessagePack codec.
-// This is currently a placeholder and will panic if used.
+// This is currently a placeholder whose Encode and Decode return errors;
+// NewCodec refuses "msgpack" rather than returning it.
 func NewMessagePackCodec(rw io.ReadWriteCloser) *MessagePackCodec {
 	return &MessagePackCodec{
 		rw: rw,
@@ -21,12 +27,12 @@ func NewMessagePackCodec(rw io.ReadWriteCloser) *MessagePackCodec {
 
 // Encode is not yet implemented.
 func (c *MessagePackCodec) Encode(msg *Message) error {
-	panic("MessagePack codec not yet implemented")
+	return errMessagePackUnimplemented
 }
 
 // Decode is not yet implemented.
 func (c *MessagePackCodec) Decode(msg *Message) error {
-	panic("MessagePack codec not yet implemented")
+	return errMessagePackUnimplemented
 }
 
 // Close closes the underlying ReadWriteCloser.
@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// TranscriptEntry is one line of a client transcript: a message the client
+// sent ("request") or received ("response").
+type TranscriptEntry struct {
+	Direction string   `json:"direction"`
+	Message   *Message `json:"message"`
+}
+
+// WriteTranscript appends msg to w as a JSON-encoded TranscriptEntry
+// followed by a newline, in a single Write. Callers writing from several
+// goroutines must serialize calls.
+func WriteTranscript(w io.Writer, direction string, msg *Message) error {
+	line, err := json.Marshal(TranscriptEntry{Direction: direction, Message: msg})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
+
+// ReadTranscript reads the entries written by WriteTranscript from r.
+func ReadTranscript(r io.Reader) ([]TranscriptEntry, error) {
+	var entries []TranscriptEntry
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		frame, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(frame)) > 0 {
+			var entry TranscriptEntry
+			if err := json.Unmarshal(frame, &entry); err != nil {
+				return nil, fmt.Errorf("transcript line %d: %w", line, err)
+			}
+			if entry.Message == nil {
+				return nil, fmt.Errorf("transcript line %d: no message", line)
+			}
+			entries = append(entries, entry)
+		}
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
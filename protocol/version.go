@@ -0,0 +1,5 @@
+package protocol
+
+// Version is the version of the REPL wire protocol implemented by this package.
+// It is reported to clients by the "describe" operation.
+const Version = "0.1.0"
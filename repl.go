@@ -3,7 +3,13 @@ package repl
 import (
 	"context"
 	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
 
+	"github.com/zylisp/repl/operations"
 	"github.com/zylisp/repl/transport/inprocess"
 	"github.com/zylisp/repl/transport/tcp"
 	"github.com/zylisp/repl/transport/unix"
@@ -35,6 +41,20 @@ type Server interface {
 	// It waits for active connections to complete within the context deadline.
 	Stop(ctx context.Context) error
 
+	// Drain makes the server reject new evaluations with status
+	// ["error", "draining"] while running evaluations finish and other
+	// operations are still answered. It does not stop the server.
+	Drain()
+
+	// OnShutdown registers a hook that Stop runs after connections are
+	// closed and before it returns, such as flushing a transcript. Hooks run
+	// once, in registration order.
+	OnShutdown(hook func())
+
+	// Sessions returns a snapshot of every session's request count, last
+	// activity and state ("idle", "evaluating" or "paused"), for dashboards.
+	Sessions() []operations.SessionInfo
+
 	// Addr returns the address the server is listening on.
 	// The format depends on the transport type.
 	Addr() string
@@ -53,6 +73,7 @@ type Client interface {
 	Eval(ctx context.Context, code string) (*Result, error)
 
 	// Close closes the client connection.
+	// It is idempotent and safe to call after the server has stopped.
 	Close() error
 }
 
@@ -78,32 +99,289 @@ type ServerConfig struct {
 	//   - output: captured stdout/stderr
 	//   - error: only for catastrophic failures (should be rare)
 	Evaluator func(code string) (result interface{}, output string, err error)
+
+	// ContextEvaluator is an optional context-aware evaluator.
+	// When set, it is preferred over Evaluator and receives a context that is
+	// cancelled on interrupt or shutdown; see operations.EvaluatorFunc2.
+	ContextEvaluator func(ctx context.Context, code string) (result interface{}, output string, err error)
+
+	// ChunkedEvaluator is an optional context-aware evaluator that returns
+	// its output as ordered stdout/stderr segments. When set, it is preferred
+	// over ContextEvaluator; see operations.EvaluatorFunc3.
+	ChunkedEvaluator func(ctx context.Context, code string) (result interface{}, output []operations.OutputChunk, err error)
+
+	// Logger receives server diagnostics such as dropped responses.
+	// If nil, diagnostics are discarded.
+	Logger *slog.Logger
+
+	// Debug logs every request and response through Logger at debug level;
+	// see operations.Handler.Debug.
+	Debug bool
+
+	// MaxSessions bounds how many sessions the server holds state for, and
+	// SessionIdleTTL lets idle sessions be evicted to make room; see
+	// operations.Handler.MaxSessions. Zero means no limit.
+	MaxSessions    int
+	SessionIdleTTL time.Duration
+
+	// ValueMarshaler converts response values into codec-friendly forms
+	// before encoding; see operations.Handler.ValueMarshaler.
+	ValueMarshaler operations.ValueMarshaler
+
+	// FileRoot confines load-file to files beneath this directory; see
+	// operations.Handler.FileRoot. Empty means any readable file.
+	FileRoot string
+
+	// OutputSink receives a server-side transcript of all evaluation output;
+	// see operations.Handler.OutputSink.
+	OutputSink io.Writer
+
+	// WriteTimeout bounds how long writing a single response may take; a
+	// client that stops reading is disconnected once it expires. Zero means
+	// no timeout, except in-process, where it means a client with a full
+	// response buffer is disconnected at once.
+	WriteTimeout time.Duration
+
+	// SlowLogThreshold, if positive, logs a warning through Logger for every
+	// evaluation that takes longer than it.
+	SlowLogThreshold time.Duration
+
+	// OpTimeouts bounds how long each operation may run, keyed by op name;
+	// see operations.Handler.OpTimeouts.
+	OpTimeouts map[string]time.Duration
+
+	// DefaultEvalTimeout bounds evaluations that have no other deadline; see
+	// operations.Handler.DefaultEvalTimeout. Zero means no limit.
+	DefaultEvalTimeout time.Duration
+
+	// MaxConcurrentEvals bounds how many evaluations run at once across all
+	// clients; see operations.Handler.MaxConcurrentEvals. Zero means no limit.
+	MaxConcurrentEvals int
+
+	// MaxQueuedEvals bounds how many evaluations may wait for
+	// MaxConcurrentEvals before further ones are refused as "server-busy";
+	// see operations.Handler.MaxQueuedEvals. Zero means no bound.
+	MaxQueuedEvals int
+
+	// TypeOf names the type of eval results for requests that set
+	// data.with-type; see operations.Handler.TypeOf.
+	TypeOf operations.TypeFunc
+
+	// ReadBufferSize sizes the buffer each connection's requests are read
+	// through. Only used for unix and tcp transports. Zero means the default.
+	ReadBufferSize int
+
+	// Compressions lists the compressions, such as "gzip", the server agrees
+	// to when a client offers them during "describe". Only used for unix and
+	// tcp transports. Nil means connections are never compressed.
+	Compressions []string
+
+	// GracePeriod bounds how long Stop waits for in-flight requests when it
+	// is called with a context that has no deadline. Zero means waiting
+	// until they finish.
+	GracePeriod time.Duration
+
+	// RateLimit bounds how fast each connection may send requests.
+	// Only used for unix and tcp transports. The zero value disables it.
+	RateLimit operations.RateLimit
+}
+
+// handlerServer is implemented by every transport server.
+type handlerServer interface {
+	Server
+	Handler() *operations.Handler
+}
+
+// listenerServer is implemented by transport servers that can serve on a
+// listener created elsewhere.
+type listenerServer interface {
+	handlerServer
+	Serve(ctx context.Context, l net.Listener) error
+}
+
+// preboundServer serves a listenerServer on a fixed listener.
+type preboundServer struct {
+	listenerServer
+	listener net.Listener
+}
+
+// Start serves on the listener given to NewServerWithListener.
+func (s *preboundServer) Start(ctx context.Context) error {
+	return s.Serve(ctx, s.listener)
+}
+
+// Addr returns the listener's address, even before the server is started.
+func (s *preboundServer) Addr() string {
+	return s.listener.Addr().String()
 }
 
 // NewServer creates a new REPL server with the given configuration.
+// The configuration must provide an evaluator.
 func NewServer(config ServerConfig) (Server, error) {
+	if err := checkEvaluator(config); err != nil {
+		return nil, err
+	}
+
 	// Default codec to "json"
 	if config.Codec == "" {
 		config.Codec = "json"
 	}
 
 	// Create server based on transport type
+	var server handlerServer
 	switch config.Transport {
 	case "in-process", "":
-		return inprocess.NewServer(config.Evaluator), nil
+		inprocessServer := inprocess.NewServer(config.Evaluator)
+		inprocessServer.WriteTimeout = config.WriteTimeout
+		inprocessServer.GracePeriod = config.GracePeriod
+		server = inprocessServer
 	case "unix":
 		if config.Addr == "" {
 			return nil, fmt.Errorf("unix transport requires Addr")
 		}
-		return unix.NewServer(config.Addr, config.Codec, config.Evaluator), nil
+		unixServer := unix.NewServer(config.Addr, config.Codec, config.Evaluator)
+		unixServer.WriteTimeout = config.WriteTimeout
+		unixServer.GracePeriod = config.GracePeriod
+		unixServer.ReadBufferSize = config.ReadBufferSize
+		unixServer.Compressions = config.Compressions
+		unixServer.RateLimit = config.RateLimit
+		server = unixServer
 	case "tcp":
 		if config.Addr == "" {
 			return nil, fmt.Errorf("tcp transport requires Addr")
 		}
-		return tcp.NewServer(config.Addr, config.Codec, config.Evaluator), nil
+		tcpServer := tcp.NewServer(config.Addr, config.Codec, config.Evaluator)
+		tcpServer.WriteTimeout = config.WriteTimeout
+		tcpServer.GracePeriod = config.GracePeriod
+		tcpServer.ReadBufferSize = config.ReadBufferSize
+		tcpServer.Compressions = config.Compressions
+		tcpServer.RateLimit = config.RateLimit
+		server = tcpServer
 	default:
 		return nil, fmt.Errorf("unknown transport: %s", config.Transport)
 	}
+
+	configureHandler(server.Handler(), config)
+	server.Handler().Settings = settings(server, config)
+	return server, nil
+}
+
+// NewServerWithListener creates a REPL server that serves on l instead of
+// binding config.Addr, such as a socket inherited through systemd socket
+// activation (see the activation package). The transport follows the
+// listener's network, which must be "tcp" or "unix"; config.Transport and
+// config.Addr are ignored. Stopping the server closes l.
+func NewServerWithListener(config ServerConfig, l net.Listener) (Server, error) {
+	if err := checkEvaluator(config); err != nil {
+		return nil, err
+	}
+
+	if config.Codec == "" {
+		config.Codec = "json"
+	}
+
+	var server listenerServer
+	switch network := l.Addr().Network(); network {
+	case "unix":
+		unixServer := unix.NewServer("", config.Codec, config.Evaluator)
+		unixServer.WriteTimeout = config.WriteTimeout
+		unixServer.GracePeriod = config.GracePeriod
+		unixServer.ReadBufferSize = config.ReadBufferSize
+		unixServer.Compressions = config.Compressions
+		unixServer.RateLimit = config.RateLimit
+		server = unixServer
+	case "tcp":
+		tcpServer := tcp.NewServer("", config.Codec, config.Evaluator)
+		tcpServer.WriteTimeout = config.WriteTimeout
+		tcpServer.GracePeriod = config.GracePeriod
+		tcpServer.ReadBufferSize = config.ReadBufferSize
+		tcpServer.Compressions = config.Compressions
+		tcpServer.RateLimit = config.RateLimit
+		server = tcpServer
+	default:
+		return nil, fmt.Errorf("unsupported listener network: %s", network)
+	}
+
+	config.Transport = l.Addr().Network()
+	prebound := &preboundServer{listenerServer: server, listener: l}
+	configureHandler(server.Handler(), config)
+	server.Handler().Settings = settings(prebound, config)
+	return prebound, nil
+}
+
+// checkEvaluator reports an error unless config sets at least one of
+// Evaluator, ContextEvaluator and ChunkedEvaluator.
+func checkEvaluator(config ServerConfig) error {
+	if config.Evaluator == nil && config.ContextEvaluator == nil && config.ChunkedEvaluator == nil {
+		return fmt.Errorf("server config requires an Evaluator")
+	}
+	return nil
+}
+
+// settings returns the SettingsFunc reporting config for server to the
+// "config" operation. Only settings listed here are ever reported.
+func settings(server Server, config ServerConfig) operations.SettingsFunc {
+	transport := config.Transport
+	if transport == "" {
+		transport = "in-process"
+	}
+	return func() map[string]interface{} {
+		return map[string]interface{}{
+			"transport":        transport,
+			"addr":             server.Addr(),
+			"codec":            config.Codec,
+			"write-timeout":    config.WriteTimeout.String(),
+			"grace-period":     config.GracePeriod.String(),
+			"read-buffer-size": config.ReadBufferSize,
+			"rate-limit": map[string]interface{}{
+				"rate":  config.RateLimit.Rate,
+				"burst": config.RateLimit.Burst,
+			},
+		}
+	}
+}
+
+// configureHandler applies the optional handler settings from config.
+func configureHandler(h *operations.Handler, config ServerConfig) {
+	if config.ContextEvaluator != nil {
+		h.ContextEvaluator = config.ContextEvaluator
+	}
+	if config.ChunkedEvaluator != nil {
+		h.ChunkedEvaluator = config.ChunkedEvaluator
+	}
+	if config.SlowLogThreshold > 0 {
+		h.SlowLogThreshold = config.SlowLogThreshold
+	}
+	if config.OpTimeouts != nil {
+		h.OpTimeouts = config.OpTimeouts
+	}
+	if config.DefaultEvalTimeout > 0 {
+		h.DefaultEvalTimeout = config.DefaultEvalTimeout
+	}
+	if config.MaxConcurrentEvals > 0 {
+		h.MaxConcurrentEvals = config.MaxConcurrentEvals
+		h.MaxQueuedEvals = config.MaxQueuedEvals
+	}
+	if config.TypeOf != nil {
+		h.TypeOf = config.TypeOf
+	}
+	if config.Logger != nil {
+		h.Logger = config.Logger
+	}
+	if config.OutputSink != nil {
+		h.OutputSink = config.OutputSink
+	}
+	if config.MaxSessions > 0 {
+		h.MaxSessions = config.MaxSessions
+		h.SessionIdleTTL = config.SessionIdleTTL
+	}
+	if config.ValueMarshaler != nil {
+		h.ValueMarshaler = config.ValueMarshaler
+	}
+	if config.FileRoot != "" {
+		h.FileRoot = config.FileRoot
+	}
+	h.Debug = config.Debug
 }
 
 // NewClient creates a new REPL client.
@@ -112,42 +390,188 @@ func NewClient() Client {
 	return &UniversalClient{}
 }
 
+// NewClientWithTransport creates a new REPL client that always uses the given
+// transport and codec, bypassing auto-detection from the address.
+// This is useful for addresses the detection heuristic would misclassify,
+// such as relative socket paths. An empty codec defaults to "json".
+func NewClientWithTransport(transport, codec string) Client {
+	if codec == "" {
+		codec = "json"
+	}
+	return &UniversalClient{
+		explicitTransport: transport,
+		explicitCodec:     codec,
+	}
+}
+
 // UniversalClient is a client that auto-detects the transport from the address.
 type UniversalClient struct {
-	transport string
-	impl      interface{} // Actual transport-specific client
+	// DescribeOnConnect makes Connect perform a "describe" handshake and
+	// cache the server's capability flags for Capabilities. Off by default.
+	DescribeOnConnect bool
+
+	// Probe makes Connect confirm a transport guessed from an address without
+	// a scheme with a "describe" handshake, falling back to the other of tcp
+	// and unix if the guess cannot connect or does not answer. The handshake
+	// also caches Capabilities. Off by default.
+	Probe bool
+
+	// FailOnProtocolError makes Eval return an error, alongside the result,
+	// when the server answers with status "error". Set it before Connect.
+	FailOnProtocolError bool
+
+	// ResponseTimeout, if positive, bounds how long a request waits for each
+	// message from the server, independent of its context. Set it before
+	// Connect.
+	ResponseTimeout time.Duration
+
+	// KeepAlive, KeepAliveTimeout and OnUnhealthy configure the unix and tcp
+	// clients' ping keepalive; see tcp.Client.KeepAlive. Set them before
+	// Connect.
+	KeepAlive        time.Duration
+	KeepAliveTimeout time.Duration
+	OnUnhealthy      func(err error)
+
+	// ValueUnmarshaler, if set, converts each result's decoded Value; see
+	// tcp.Client.ValueUnmarshaler. Set it before Connect.
+	ValueUnmarshaler func(v interface{}) interface{}
+
+	// TranscriptWriter, if set, records every message exchanged; see
+	// tcp.Client.TranscriptWriter. Set it before Connect.
+	TranscriptWriter io.Writer
+
+	transport    string
+	impl         interface{} // Actual transport-specific client
+	capabilities map[string]bool
+
+	// Set by NewClientWithTransport to override the transport ParseAddr guesses
+	explicitTransport string
+	explicitCodec     string
 }
 
-// Connect establishes a connection to a REPL server, auto-detecting the transport.
+// Connect establishes a connection to a REPL server, auto-detecting the transport
+// unless the client was created with an explicit transport.
 func (c *UniversalClient) Connect(ctx context.Context, addr string) error {
-	transport, codec := detectTransport(addr)
-	c.transport = transport
+	transport, codec, target, err := ParseAddr(addr)
+	if err != nil {
+		return err
+	}
+	if c.explicitTransport != "" {
+		transport, codec = c.explicitTransport, c.explicitCodec
+	} else if c.Probe && transport != "in-process" && !strings.Contains(addr, "://") {
+		return c.probe(ctx, transport, codec, target)
+	}
+
+	if err := c.connect(ctx, transport, codec, target); err != nil {
+		return err
+	}
+	if c.DescribeOnConnect {
+		if err := c.handshake(ctx); err != nil {
+			c.disconnect()
+			return fmt.Errorf("describe handshake failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// probe connects to addr over the guessed transport and, if that fails or
+// the server does not answer "describe", over the other network transport.
+func (c *UniversalClient) probe(ctx context.Context, guessed, codec, addr string) error {
+	candidates := []string{guessed}
+	for _, transport := range []string{"tcp", "unix"} {
+		if transport != guessed {
+			candidates = append(candidates, transport)
+		}
+	}
 
+	var failures []string
+	for _, transport := range candidates {
+		err := c.connect(ctx, transport, codec, addr)
+		if err == nil {
+			if err = c.handshake(ctx); err == nil {
+				return nil
+			}
+			c.disconnect()
+		}
+		failures = append(failures, fmt.Sprintf("%s: %v", transport, err))
+	}
+	return fmt.Errorf("no transport reached %s (%s)", addr, strings.Join(failures, "; "))
+}
+
+// connect connects to addr over transport. The transport is recorded only
+// once connected, so that a failed connect leaves the client unconnected.
+func (c *UniversalClient) connect(ctx context.Context, transport, codec, addr string) error {
 	switch transport {
 	case "in-process":
 		// In-process requires special handling - not supported via universal client yet
 		return fmt.Errorf("in-process transport not supported via universal client")
 	case "unix":
 		client := unix.NewClient(codec)
-		if err := client.Connect(ctx, addr, codec); err != nil {
+		client.FailOnProtocolError = c.FailOnProtocolError
+		client.ResponseTimeout = c.ResponseTimeout
+		client.KeepAlive = c.KeepAlive
+		client.KeepAliveTimeout = c.KeepAliveTimeout
+		client.OnUnhealthy = c.OnUnhealthy
+		client.ValueUnmarshaler = c.ValueUnmarshaler
+		client.TranscriptWriter = c.TranscriptWriter
+		if err := client.Connect(ctx, addr, ""); err != nil {
 			return err
 		}
-		c.impl = client
-		return nil
+		c.transport, c.impl = transport, client
 	case "tcp":
-		// Clean up address if it has tcp:// prefix
-		if len(addr) > 6 && addr[:6] == "tcp://" {
-			addr = addr[6:]
-		}
 		client := tcp.NewClient(codec)
-		if err := client.Connect(ctx, addr, codec); err != nil {
+		client.FailOnProtocolError = c.FailOnProtocolError
+		client.ResponseTimeout = c.ResponseTimeout
+		client.KeepAlive = c.KeepAlive
+		client.KeepAliveTimeout = c.KeepAliveTimeout
+		client.OnUnhealthy = c.OnUnhealthy
+		client.ValueUnmarshaler = c.ValueUnmarshaler
+		client.TranscriptWriter = c.TranscriptWriter
+		if err := client.Connect(ctx, addr, ""); err != nil {
 			return err
 		}
-		c.impl = client
-		return nil
+		c.transport, c.impl = transport, client
 	default:
 		return fmt.Errorf("unknown transport: %s", transport)
 	}
+	return nil
+}
+
+// disconnect closes the connection and returns the client to its
+// unconnected state.
+func (c *UniversalClient) disconnect() {
+	c.Close()
+	c.transport, c.impl, c.capabilities = "", nil, nil
+}
+
+// handshake describes the server and caches its capability flags.
+func (c *UniversalClient) handshake(ctx context.Context) error {
+	var data map[string]interface{}
+	var err error
+	switch c.transport {
+	case "unix":
+		data, err = c.impl.(*unix.Client).Describe(ctx)
+	case "tcp":
+		data, err = c.impl.(*tcp.Client).Describe(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	caps, _ := data["capabilities"].(map[string]interface{})
+	c.capabilities = make(map[string]bool, len(caps))
+	for name, value := range caps {
+		enabled, _ := value.(bool)
+		c.capabilities[name] = enabled
+	}
+	return nil
+}
+
+// Capabilities returns the server's capability flags (such as "streaming"
+// and "interrupt") cached by the describe handshake, or nil if the client
+// was not connected with DescribeOnConnect.
+func (c *UniversalClient) Capabilities() map[string]bool {
+	return c.capabilities
 }
 
 // Eval sends code to be evaluated.
@@ -156,7 +580,7 @@ func (c *UniversalClient) Eval(ctx context.Context, code string) (*Result, error
 	case "unix":
 		client := c.impl.(*unix.Client)
 		result, err := client.Eval(ctx, code)
-		if err != nil {
+		if result == nil {
 			return nil, err
 		}
 		return &Result{
@@ -164,11 +588,11 @@ func (c *UniversalClient) Eval(ctx context.Context, code string) (*Result, error
 			Value:  result.Value,
 			Output: result.Output,
 			Status: result.Status,
-		}, nil
+		}, err
 	case "tcp":
 		client := c.impl.(*tcp.Client)
 		result, err := client.Eval(ctx, code)
-		if err != nil {
+		if result == nil {
 			return nil, err
 		}
 		return &Result{
@@ -176,13 +600,100 @@ func (c *UniversalClient) Eval(ctx context.Context, code string) (*Result, error
 			Value:  result.Value,
 			Output: result.Output,
 			Status: result.Status,
-		}, nil
+		}, err
 	default:
 		return nil, fmt.Errorf("not connected")
 	}
 }
 
+// EvalAwait sends code to be evaluated and waits for a message carrying a
+// status in terminal, accumulating the output of the messages before it.
+// An empty terminal set means "done", "error" or "interrupted".
+func (c *UniversalClient) EvalAwait(ctx context.Context, code string, terminal ...string) (*Result, error) {
+	switch c.transport {
+	case "unix":
+		result, err := c.impl.(*unix.Client).EvalAwait(ctx, code, terminal...)
+		if result == nil {
+			return nil, err
+		}
+		return &Result{
+			ID:     result.ID,
+			Value:  result.Value,
+			Output: result.Output,
+			Status: result.Status,
+		}, err
+	case "tcp":
+		result, err := c.impl.(*tcp.Client).EvalAwait(ctx, code, terminal...)
+		if result == nil {
+			return nil, err
+		}
+		return &Result{
+			ID:     result.ID,
+			Value:  result.Value,
+			Output: result.Output,
+			Status: result.Status,
+		}, err
+	default:
+		return nil, fmt.Errorf("not connected")
+	}
+}
+
+// Reset asks the server to restore its evaluation environment to the initial state.
+func (c *UniversalClient) Reset(ctx context.Context) error {
+	switch c.transport {
+	case "unix":
+		return c.impl.(*unix.Client).Reset(ctx)
+	case "tcp":
+		return c.impl.(*tcp.Client).Reset(ctx)
+	default:
+		return fmt.Errorf("not connected")
+	}
+}
+
+// Subscribe receives a copy of every evaluation result produced in the given
+// session. The channel is closed when ctx is cancelled or the connection is lost.
+func (c *UniversalClient) Subscribe(ctx context.Context, session string) (<-chan *Result, error) {
+	results := make(chan *Result)
+	switch c.transport {
+	case "unix":
+		stream, err := c.impl.(*unix.Client).Subscribe(ctx, session)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			defer close(results)
+			for r := range stream {
+				select {
+				case results <- &Result{ID: r.ID, Value: r.Value, Output: r.Output, Status: r.Status}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	case "tcp":
+		stream, err := c.impl.(*tcp.Client).Subscribe(ctx, session)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			defer close(results)
+			for r := range stream {
+				select {
+				case results <- &Result{ID: r.ID, Value: r.Value, Output: r.Output, Status: r.Status}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	default:
+		return nil, fmt.Errorf("not connected")
+	}
+	return results, nil
+}
+
 // Close closes the client connection.
+// It is idempotent and safe to call after the server has stopped or when
+// Connect failed.
 func (c *UniversalClient) Close() error {
 	switch c.transport {
 	case "unix":
@@ -194,28 +705,86 @@ func (c *UniversalClient) Close() error {
 	}
 }
 
-// detectTransport detects the transport type and codec from an address string.
-func detectTransport(addr string) (transport, codec string) {
+// CloseGracefully waits for the server to answer every request sent before
+// closing the connection; see tcp.Client.CloseGracefully.
+func (c *UniversalClient) CloseGracefully(ctx context.Context) error {
+	switch c.transport {
+	case "unix":
+		return c.impl.(*unix.Client).CloseGracefully(ctx)
+	case "tcp":
+		return c.impl.(*tcp.Client).CloseGracefully(ctx)
+	default:
+		return nil
+	}
+}
+
+// ParseAddr splits an address into its transport, codec and target, the
+// address with any scheme removed.
+//
+// An address may carry a scheme of the form "transport[+codec]://", for example
+// "tcp://localhost:5555" or "unix+json:///tmp/zylisp.sock". Without a scheme,
+// the transport is guessed from the address format and the codec defaults to
+// "json": "" and "in-process" are in-process (with no codec), paths starting
+// with '/' or '.' are unix sockets, and anything else is a tcp host:port,
+// including bracketed IPv6 literals such as "[::1]:5555". It fails for
+// schemes naming an unknown transport, for unix and tcp schemes without a
+// target, and for IPv6 literals without brackets or a port.
+func ParseAddr(addr string) (transport, codec, target string, err error) {
 	codec = "json" // default codec
 
-	// Check for explicit transport prefix
-	if len(addr) >= 7 && addr[:7] == "unix://" {
-		return "unix", codec
-	}
-	if len(addr) >= 6 && addr[:6] == "tcp://" {
-		return "tcp", codec
+	// Check for explicit transport[+codec] scheme
+	if i := strings.Index(addr, "://"); i > 0 {
+		scheme, target := addr[:i], addr[i+3:]
+		transport, qualifier, found := strings.Cut(scheme, "+")
+		if found && qualifier != "" {
+			codec = qualifier
+		}
+		switch transport {
+		case "in-process":
+			return transport, "", target, nil
+		case "unix", "tcp":
+			if target == "" {
+				return "", "", "", fmt.Errorf("address %q has no %s target", addr, transport)
+			}
+			if transport == "tcp" {
+				if err := checkIPv6(target); err != nil {
+					return "", "", "", err
+				}
+			}
+			return transport, codec, target, nil
+		default:
+			return "", "", "", fmt.Errorf("address %q names unknown transport %q", addr, transport)
+		}
 	}
 
 	// Empty or "in-process" means in-process
 	if addr == "" || addr == "in-process" {
-		return "in-process", ""
+		return "in-process", "", addr, nil
 	}
 
 	// Path starting with / or . means unix
-	if len(addr) > 0 && (addr[0] == '/' || addr[0] == '.') {
-		return "unix", codec
+	if addr[0] == '/' || addr[0] == '.' {
+		return "unix", codec, addr, nil
 	}
 
 	// Default to TCP for host:port format
-	return "tcp", codec
+	if err := checkIPv6(addr); err != nil {
+		return "", "", "", err
+	}
+	return "tcp", codec, addr, nil
+}
+
+// checkIPv6 rejects tcp targets that hold an IPv6 literal not written as
+// "[host]:port", such as "::1" or "[::1]", which would otherwise fail only
+// when dialed, or be split at the wrong colon.
+func checkIPv6(target string) error {
+	if !strings.HasPrefix(target, "[") && strings.Count(target, ":") < 2 {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(target)
+	host, _, _ = strings.Cut(host, "%") // zone, as in fe80::1%eth0
+	if err != nil || net.ParseIP(host) == nil {
+		return fmt.Errorf("tcp address %q must be an IPv6 literal in brackets with a port, such as [::1]:5555", target)
+	}
+	return nil
 }
@@ -0,0 +1,635 @@
+package repl
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zylisp/repl/protocol"
+)
+
+// mockEvaluator is a simple evaluator for testing
+func mockEvaluator(code string) (interface{}, string, error) {
+	switch code {
+	case "(+ 1 2)":
+		return float64(3), "", nil
+	default:
+		return code, "", nil
+	}
+}
+
+func TestParseAddr(t *testing.T) {
+	tests := []struct {
+		addr      string
+		transport string
+		codec     string
+		target    string
+	}{
+		{"", "in-process", "", ""},
+		{"in-process", "in-process", "", "in-process"},
+		{"/tmp/zylisp.sock", "unix", "json", "/tmp/zylisp.sock"},
+		{"./zylisp.sock", "unix", "json", "./zylisp.sock"},
+		{"localhost:5555", "tcp", "json", "localhost:5555"},
+		// Bracketed IPv6 literals are tcp, never unix paths
+		{"[::1]:5555", "tcp", "json", "[::1]:5555"},
+		{"[2001:db8::1]:5555", "tcp", "json", "[2001:db8::1]:5555"},
+		{"[fe80::1%eth0]:5555", "tcp", "json", "[fe80::1%eth0]:5555"},
+		{"tcp://[::1]:5555", "tcp", "json", "[::1]:5555"},
+		// Ambiguous addresses fall back to tcp
+		{"zylisp.sock", "tcp", "json", "zylisp.sock"},
+		{"localhost", "tcp", "json", "localhost"},
+		// Schemes with optional codec qualifiers
+		{"unix:///tmp/zylisp.sock", "unix", "json", "/tmp/zylisp.sock"},
+		{"tcp://localhost:5555", "tcp", "json", "localhost:5555"},
+		{"tcp+msgpack://localhost:5555", "tcp", "msgpack", "localhost:5555"},
+		{"tcp+json://:5555", "tcp", "json", ":5555"},
+		{"unix+msgpack:///tmp/zylisp.sock", "unix", "msgpack", "/tmp/zylisp.sock"},
+		{"unix+json://./zylisp.sock", "unix", "json", "./zylisp.sock"},
+		{"unix://zylisp.sock", "unix", "json", "zylisp.sock"},
+		{"tcp+://localhost:5555", "tcp", "json", "localhost:5555"},
+		{"in-process://", "in-process", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			transport, codec, target, err := ParseAddr(tt.addr)
+			if err != nil || transport != tt.transport || codec != tt.codec || target != tt.target {
+				t.Errorf("ParseAddr(%q) = (%q, %q, %q, %v), want (%q, %q, %q, nil)",
+					tt.addr, transport, codec, target, err, tt.transport, tt.codec, tt.target)
+			}
+		})
+	}
+
+	for _, addr := range []string{
+		"udp://localhost:5555", "tcp://", "unix+json://", "+json://x",
+		// IPv6 literals need brackets and a port
+		"::1", "2001:db8::1:5555", "[::1]", "tcp://::1", "[not-an-ip]:5555",
+	} {
+		if _, _, _, err := ParseAddr(addr); err == nil {
+			t.Errorf("Expected ParseAddr(%q) to fail", addr)
+		}
+	}
+}
+
+func TestNewClientWithTransport(t *testing.T) {
+	// A relative socket path is indistinguishable from a tcp host name
+	t.Chdir(t.TempDir())
+	sockPath := "zylisp.sock"
+
+	server, err := NewServer(ServerConfig{
+		Transport: "unix",
+		Addr:      sockPath,
+		Evaluator: mockEvaluator,
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+	defer os.Remove(sockPath)
+
+	time.Sleep(100 * time.Millisecond)
+
+	t.Run("auto-detect misclassifies", func(t *testing.T) {
+		dialCtx, dialCancel := context.WithTimeout(context.Background(), time.Second)
+		defer dialCancel()
+
+		client := NewClient()
+		if err := client.Connect(dialCtx, sockPath); err == nil {
+			client.Close()
+			t.Fatal("Expected auto-detected tcp connection to fail")
+		}
+	})
+
+	t.Run("explicit transport overrides detection", func(t *testing.T) {
+		client := NewClientWithTransport("unix", "")
+		if err := client.Connect(context.Background(), sockPath); err != nil {
+			t.Fatalf("Failed to connect client: %v", err)
+		}
+		defer client.Close()
+
+		result, err := client.Eval(context.Background(), "(+ 1 2)")
+		if err != nil {
+			t.Fatalf("Eval failed: %v", err)
+		}
+		if result.Value != float64(3) {
+			t.Errorf("Expected value 3, got %v", result.Value)
+		}
+	})
+
+	t.Run("explicit unknown transport", func(t *testing.T) {
+		client := NewClientWithTransport("carrier-pigeon", "json")
+		if err := client.Connect(context.Background(), "localhost:5555"); err == nil {
+			t.Error("Expected error for unknown transport, got nil")
+		}
+	})
+}
+
+func TestConnectWithCodecScheme(t *testing.T) {
+	sockPath := "/tmp/zylisp-test-scheme.sock"
+	defer os.Remove(sockPath)
+
+	server, err := NewServer(ServerConfig{
+		Transport: "unix",
+		Addr:      sockPath,
+		Evaluator: mockEvaluator,
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := NewClient()
+	if err := client.Connect(context.Background(), "unix+json://"+sockPath); err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer client.Close()
+
+	result, err := client.Eval(context.Background(), "(+ 1 2)")
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	if result.Value != float64(3) {
+		t.Errorf("Expected value 3, got %v", result.Value)
+	}
+
+	if err := NewClient().Connect(context.Background(), "unix+bogus://"+sockPath); err == nil {
+		t.Error("Expected error for unsupported codec, got nil")
+	}
+}
+
+func TestServerConfigContextEvaluator(t *testing.T) {
+	server, err := NewServer(ServerConfig{
+		Transport: "tcp",
+		Addr:      "127.0.0.1:0",
+		Evaluator: mockEvaluator,
+		ContextEvaluator: func(ctx context.Context, code string) (interface{}, string, error) {
+			if _, ok := ctx.Deadline(); ok {
+				return "unexpected deadline", "", nil
+			}
+			return "context", "", nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := NewClient()
+	if err := client.Connect(context.Background(), server.Addr()); err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer client.Close()
+
+	result, err := client.Eval(context.Background(), "(+ 1 2)")
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	if result.Value != "context" {
+		t.Errorf("Expected ContextEvaluator to be used, got %v", result.Value)
+	}
+}
+
+func TestUniversalClientCloseIdempotent(t *testing.T) {
+	server, err := NewServer(ServerConfig{
+		Transport: "tcp",
+		Addr:      "127.0.0.1:0",
+		Evaluator: mockEvaluator,
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := NewClient()
+	if err := client.Connect(context.Background(), server.Addr()); err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+
+	server.Stop(context.Background())
+	for i := 0; i < 2; i++ {
+		if err := client.Close(); err != nil {
+			t.Errorf("Close %d failed: %v", i+1, err)
+		}
+	}
+
+	// A client whose Connect failed can also be closed repeatedly
+	failed := NewClient()
+	if err := failed.Connect(context.Background(), "tcp://127.0.0.1:1"); err == nil {
+		t.Fatal("Expected Connect to fail")
+	}
+	for i := 0; i < 2; i++ {
+		if err := failed.Close(); err != nil {
+			t.Errorf("Close %d after failed Connect: %v", i+1, err)
+		}
+	}
+}
+
+func TestUniversalClientCapabilities(t *testing.T) {
+	server, err := NewServer(ServerConfig{
+		Transport: "tcp",
+		Addr:      "127.0.0.1:0",
+		Evaluator: mockEvaluator,
+		ContextEvaluator: func(ctx context.Context, code string) (interface{}, string, error) {
+			return code, "", nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	plain := &UniversalClient{}
+	if err := plain.Connect(context.Background(), server.Addr()); err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer plain.Close()
+
+	if caps := plain.Capabilities(); caps != nil {
+		t.Errorf("Expected no capabilities without handshake, got %v", caps)
+	}
+
+	client := &UniversalClient{DescribeOnConnect: true}
+	if err := client.Connect(context.Background(), server.Addr()); err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer client.Close()
+
+	caps := client.Capabilities()
+	if !caps["streaming"] || !caps["interrupt"] || !caps["sessions"] {
+		t.Errorf("Expected streaming, interrupt and sessions capabilities, got %v", caps)
+	}
+	if caps["auth"] {
+		t.Error("Expected auth capability to be false")
+	}
+}
+
+func TestUniversalClientProbe(t *testing.T) {
+	// A relative socket path without "./" is misclassified as a tcp address
+	t.Chdir(t.TempDir())
+	addr := "zylisp-probe.sock"
+	if transport, _, _, _ := ParseAddr(addr); transport != "tcp" {
+		t.Fatalf("Expected %s to be guessed as tcp, got %s", addr, transport)
+	}
+
+	server, err := NewServer(ServerConfig{Transport: "unix", Addr: addr, Evaluator: mockEvaluator})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		server.Start(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	guessing := &UniversalClient{}
+	if err := guessing.Connect(context.Background(), addr); err == nil {
+		guessing.Close()
+		t.Fatal("Expected connecting without probing to fail")
+	}
+
+	client := &UniversalClient{Probe: true}
+	if err := client.Connect(context.Background(), addr); err != nil {
+		t.Fatalf("Probing connect failed: %v", err)
+	}
+	defer client.Close()
+	if client.transport != "unix" {
+		t.Errorf("Expected to fall back to unix, got %s", client.transport)
+	}
+	result, err := client.Eval(context.Background(), "(+ 1 2)")
+	if err != nil || result.Status[0] != "done" {
+		t.Fatalf("Eval after probing failed: %v %v", result, err)
+	}
+
+	// Neither transport reaches a missing socket
+	if err := (&UniversalClient{Probe: true}).Connect(context.Background(), "missing.sock"); err == nil {
+		t.Error("Expected probing a missing socket to fail")
+	}
+}
+
+func TestNewServerWithListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	server, err := NewServerWithListener(ServerConfig{Evaluator: mockEvaluator}, listener)
+	if err != nil {
+		t.Fatalf("NewServerWithListener failed: %v", err)
+	}
+	if server.Addr() != listener.Addr().String() {
+		t.Errorf("Expected Addr %s, got %s", listener.Addr(), server.Addr())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+	defer server.Stop(context.Background())
+
+	client := NewClient()
+	if err := client.Connect(context.Background(), server.Addr()); err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer client.Close()
+
+	result, err := client.Eval(context.Background(), "(+ 1 2)")
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	if result.Value != float64(3) {
+		t.Errorf("Expected value 3, got %v", result.Value)
+	}
+}
+
+func TestNewServerRequiresEvaluator(t *testing.T) {
+	for _, transport := range []string{"in-process", "unix", "tcp"} {
+		config := ServerConfig{Transport: transport, Addr: "/tmp/zylisp-test-unused"}
+		if transport == "tcp" {
+			config.Addr = "127.0.0.1:0"
+		}
+		if _, err := NewServer(config); err == nil {
+			t.Errorf("%s: expected an error without an evaluator", transport)
+		}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	if _, err := NewServerWithListener(ServerConfig{}, listener); err == nil {
+		t.Error("Expected NewServerWithListener to require an evaluator")
+	}
+}
+
+func TestServerConfigSettings(t *testing.T) {
+	srv, err := NewServer(ServerConfig{
+		Transport:    "tcp",
+		Addr:         "127.0.0.1:0",
+		Evaluator:    mockEvaluator,
+		WriteTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	resp := srv.(handlerServer).Handler().Handle(&protocol.Message{Op: "config", ID: "1"})
+	settings, _ := resp.Data["transport"].(map[string]interface{})
+	if settings["transport"] != "tcp" || settings["codec"] != "json" || settings["write-timeout"] != "5s" {
+		t.Errorf("Unexpected transport settings: %v", settings)
+	}
+}
+
+func TestServerDrain(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+
+	server, err := NewServer(ServerConfig{
+		Transport: "tcp",
+		Addr:      "127.0.0.1:0",
+		Evaluator: func(code string) (interface{}, string, error) {
+			if code == "(slow)" {
+				started <- struct{}{}
+				<-release
+			}
+			return code, "", nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	go func() {
+		server.Start(context.Background())
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := NewClient()
+	if err := client.Connect(context.Background(), server.Addr()); err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer client.Close()
+
+	type evalResult struct {
+		result *Result
+		err    error
+	}
+	running := make(chan evalResult, 1)
+	go func() {
+		result, err := client.Eval(context.Background(), "(slow)")
+		running <- evalResult{result, err}
+	}()
+	<-started
+
+	server.Drain()
+
+	other := NewClient().(*UniversalClient)
+	other.DescribeOnConnect = true
+	if err := other.Connect(context.Background(), server.Addr()); err != nil {
+		t.Fatalf("Expected describe to work while draining, got %v", err)
+	}
+	defer other.Close()
+
+	result, err := other.Eval(context.Background(), "(+ 1 2)")
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	if len(result.Status) != 2 || result.Status[1] != "draining" {
+		t.Errorf("Expected status [error draining], got %v", result.Status)
+	}
+
+	// The eval that was running when draining began still completes
+	close(release)
+	if r := <-running; r.err != nil || r.result.Value != "(slow)" {
+		t.Errorf("Expected the running eval to complete, got %+v, %v", r.result, r.err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := server.Stop(ctx); err != nil {
+		t.Errorf("Expected Stop to complete promptly after draining, got %v", err)
+	}
+}
+
+// money is a custom value type carried on the wire as a map.
+type money struct {
+	Cents    int64
+	Currency string
+}
+
+func TestValueMarshalingRoundTrip(t *testing.T) {
+	server, err := NewServer(ServerConfig{
+		Transport: "tcp",
+		Addr:      "127.0.0.1:0",
+		Evaluator: func(code string) (interface{}, string, error) {
+			return money{Cents: 1250, Currency: "EUR"}, "", nil
+		},
+		ValueMarshaler: func(v interface{}) (interface{}, error) {
+			if m, ok := v.(money); ok {
+				return map[string]interface{}{"money": m.Cents, "currency": m.Currency}, nil
+			}
+			return v, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		server.Start(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	client := &UniversalClient{
+		ValueUnmarshaler: func(v interface{}) interface{} {
+			fields, ok := v.(map[string]interface{})
+			if !ok {
+				return v
+			}
+			cents, ok := fields["money"].(float64)
+			if !ok {
+				return v
+			}
+			currency, _ := fields["currency"].(string)
+			return money{Cents: int64(cents), Currency: currency}
+		},
+	}
+	if err := client.Connect(context.Background(), server.Addr()); err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer client.Close()
+
+	result, err := client.Eval(context.Background(), "(price)")
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	if want := (money{Cents: 1250, Currency: "EUR"}); result.Value != want {
+		t.Errorf("Expected %#v to be reconstructed, got %#v", want, result.Value)
+	}
+}
+
+func TestServerOnShutdown(t *testing.T) {
+	addrs := map[string]string{
+		"in-process": "",
+		"unix":       filepath.Join(t.TempDir(), "shutdown.sock"),
+		"tcp":        "127.0.0.1:0",
+	}
+	for _, transport := range []string{"in-process", "unix", "tcp"} {
+		server, err := NewServer(ServerConfig{Transport: transport, Addr: addrs[transport], Evaluator: mockEvaluator})
+		if err != nil {
+			t.Fatalf("%s: NewServer failed: %v", transport, err)
+		}
+		go func() {
+			server.Start(context.Background())
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		var calls []string
+		server.OnShutdown(func() { calls = append(calls, "first") })
+		server.OnShutdown(func() { calls = append(calls, "second") })
+
+		for i := 0; i < 2; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			if err := server.Stop(ctx); err != nil {
+				t.Errorf("%s: Stop failed: %v", transport, err)
+			}
+			cancel()
+		}
+		if want := []string{"first", "second"}; !reflect.DeepEqual(calls, want) {
+			t.Errorf("%s: expected hooks to run once in order, got %v", transport, calls)
+		}
+	}
+}
+
+func TestServerStopGracePeriod(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{}, 1)
+
+	server, err := NewServer(ServerConfig{
+		Transport: "tcp",
+		Addr:      "127.0.0.1:0",
+		Evaluator: func(code string) (interface{}, string, error) {
+			started <- struct{}{}
+			<-release
+			return nil, "", nil
+		},
+		GracePeriod: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	go func() {
+		server.Start(context.Background())
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := NewClient()
+	if err := client.Connect(context.Background(), server.Addr()); err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer client.Close()
+
+	go client.Eval(context.Background(), "(stuck)")
+	<-started
+
+	// The evaluator never returns, so Stop gives up after the grace period
+	start := time.Now()
+	err = server.Stop(context.Background())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected Stop to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Stop took %v, expected about the grace period", elapsed)
+	}
+}
@@ -0,0 +1,32 @@
+// Package repltest provides helpers for testing code that talks to a REPL
+// server over the wire protocol without opening OS sockets.
+package repltest
+
+import (
+	"context"
+	"net"
+
+	"github.com/zylisp/repl/operations"
+	"github.com/zylisp/repl/transport/tcp"
+)
+
+// NewInMemoryServerClient returns a server using evaluator and a client
+// connected to it over a net.Pipe. Requests pass through the full JSON codec
+// and operation handler stack, as they would over TCP. The server's Handler
+// can be configured before the first request. Closing the client ends the
+// server side of the connection.
+func NewInMemoryServerClient(evaluator operations.EvaluatorFunc) (*tcp.Server, *tcp.Client, error) {
+	server := tcp.NewServer("in-memory", "json", evaluator)
+
+	client := tcp.NewClient("json")
+	client.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		clientConn, serverConn := net.Pipe()
+		go server.ServeConn(context.Background(), serverConn)
+		return clientConn, nil
+	}
+
+	if err := client.Connect(context.Background(), "in-memory", ""); err != nil {
+		return nil, nil, err
+	}
+	return server, client, nil
+}
@@ -0,0 +1,29 @@
+package repltest
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNewInMemoryServerClient(t *testing.T) {
+	_, client, err := NewInMemoryServerClient(func(code string) (interface{}, string, error) {
+		if code == "(+ 1 2)" {
+			return 3, "", nil
+		}
+		return nil, "", nil
+	})
+	if err != nil {
+		t.Fatalf("NewInMemoryServerClient failed: %v", err)
+	}
+	defer client.Close()
+
+	result, err := client.Eval(context.Background(), "(+ 1 2)")
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+
+	// Values cross the JSON codec, so integers arrive as float64
+	if result.Value != float64(3) {
+		t.Errorf("Expected value 3, got %T %v", result.Value, result.Value)
+	}
+}
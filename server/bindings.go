@@ -0,0 +1,48 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/zylisp/lang/sexpr"
+)
+
+// toSExpr converts a Go value, as decoded from a request, to a Zylisp value:
+//   - nil becomes nil
+//   - bool becomes a boolean
+//   - string becomes a string
+//   - int, int64 and integral float64 become numbers; JSON decodes every
+//     number as float64, and Zylisp numbers are integers
+//   - []interface{} becomes a list of its converted elements
+//
+// Any other value, including a float64 with a fractional part, is an error.
+func toSExpr(value interface{}) (sexpr.SExpr, error) {
+	switch v := value.(type) {
+	case nil:
+		return sexpr.Nil{}, nil
+	case bool:
+		return sexpr.Bool{Value: v}, nil
+	case string:
+		return sexpr.String{Value: v}, nil
+	case int:
+		return sexpr.Number{Value: int64(v)}, nil
+	case int64:
+		return sexpr.Number{Value: v}, nil
+	case float64:
+		if v != float64(int64(v)) {
+			return nil, fmt.Errorf("number %v is not an integer", v)
+		}
+		return sexpr.Number{Value: int64(v)}, nil
+	case []interface{}:
+		elements := make([]sexpr.SExpr, len(v))
+		for i, element := range v {
+			converted, err := toSExpr(element)
+			if err != nil {
+				return nil, err
+			}
+			elements[i] = converted
+		}
+		return sexpr.List{Elements: elements}, nil
+	default:
+		return nil, fmt.Errorf("unsupported value of type %T", value)
+	}
+}
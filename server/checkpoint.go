@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"unsafe"
+
+	"github.com/zylisp/lang/interpreter"
+	"github.com/zylisp/lang/sexpr"
+)
+
+// defaultMaxCheckpoints is how many checkpoints a server retains when
+// MaxCheckpoints is not set.
+const defaultMaxCheckpoints = 16
+
+// checkpoint is a saved copy of the top-level bindings.
+type checkpoint struct {
+	id       string
+	bindings map[string]sexpr.SExpr
+}
+
+// Checkpoint saves the current top-level bindings and returns an ID that
+// Restore accepts. Only the newest MaxCheckpoints checkpoints are retained;
+// older ones are discarded. Ephemeral servers have no state to save.
+func (s *Server) Checkpoint() (string, error) {
+	if s.Ephemeral {
+		return "", fmt.Errorf("checkpoints are not supported by ephemeral servers")
+	}
+
+	s.acquire(context.Background())
+	defer s.release()
+
+	bindings, err := envBindings(s.env)
+	if err != nil {
+		return "", err
+	}
+	current := bindings.Interface().(map[string]sexpr.SExpr)
+	saved := make(map[string]sexpr.SExpr, len(current))
+	for key, value := range current {
+		saved[key] = value
+	}
+
+	s.checkpointSeq++
+	id := fmt.Sprintf("cp-%d", s.checkpointSeq)
+	s.checkpoints = append(s.checkpoints, checkpoint{id: id, bindings: saved})
+
+	limit := s.MaxCheckpoints
+	if limit <= 0 {
+		limit = defaultMaxCheckpoints
+	}
+	if excess := len(s.checkpoints) - limit; excess > 0 {
+		s.checkpoints = s.checkpoints[excess:]
+	}
+	return id, nil
+}
+
+// Restore reverts the top-level bindings to those saved by Checkpoint under
+// id. Bindings are replaced in place, so functions defined before the
+// checkpoint keep seeing the current environment. The checkpoint is kept and
+// can be restored again. The server has one environment, so restoring
+// reverts it for every session.
+func (s *Server) Restore(id string) error {
+	s.acquire(context.Background())
+	defer s.release()
+
+	for _, cp := range s.checkpoints {
+		if cp.id != id {
+			continue
+		}
+		bindings, err := envBindings(s.env)
+		if err != nil {
+			return err
+		}
+		restored := make(map[string]sexpr.SExpr, len(cp.bindings))
+		for key, value := range cp.bindings {
+			restored[key] = value
+		}
+		bindings.Set(reflect.ValueOf(restored))
+		return nil
+	}
+	return fmt.Errorf("unknown checkpoint %q", id)
+}
+
+// errUnsupportedEnv reports that the interpreter no longer stores its
+// bindings the way envBindings expects.
+var errUnsupportedEnv = errors.New("the interpreter's bindings cannot be saved or restored")
+
+// envBindings returns a settable view of env's bindings map. Like
+// bindingNames, it reaches into the interpreter through reflection because
+// the bindings are not exported, and it fails with errUnsupportedEnv rather
+// than panicking if the field is missing or has changed type.
+func envBindings(env *interpreter.Env) (reflect.Value, error) {
+	field := reflect.ValueOf(env).Elem().FieldByName("bindings")
+	if !field.IsValid() || field.Type() != reflect.TypeOf(map[string]sexpr.SExpr(nil)) {
+		return reflect.Value{}, errUnsupportedEnv
+	}
+	return reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem(), nil
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"io"
+	"os"
+)
+
+// RunREPLOptions configure RunREPLWithOptions.
+type RunREPLOptions struct {
+	Prompt string
+
+	// Color selects whether prompts, results and errors are colored with
+	// ANSI escapes. The zero value, ColorAuto, colors only when the output
+	// is a terminal.
+	Color ColorMode
+
+	// Theme gives the colors to use; nil means DefaultTheme.
+	Theme *Theme
+}
+
+// ColorMode selects when RunREPLWithOptions colors its output.
+type ColorMode int
+
+const (
+	// ColorAuto colors output written to a terminal, unless the NO_COLOR
+	// environment variable is set or TERM is "dumb".
+	ColorAuto ColorMode = iota
+	// ColorAlways colors output wherever it is written.
+	ColorAlways
+	// ColorNever never colors output.
+	ColorNever
+)
+
+// Theme holds the ANSI escape sequences that start each kind of colored
+// output. An empty sequence leaves that kind uncolored.
+type Theme struct {
+	Prompt string
+	Result string
+	Error  string
+}
+
+// DefaultTheme colors prompts bold blue, results green and errors red.
+var DefaultTheme = Theme{
+	Prompt: "\x1b[1;34m",
+	Result: "\x1b[32m",
+	Error:  "\x1b[31m",
+}
+
+// ansiReset ends a colored span.
+const ansiReset = "\x1b[0m"
+
+// painter colors text according to theme; the zero value leaves text as
+// is.
+type painter struct {
+	theme Theme
+}
+
+// painter returns the painter for output written to out.
+func (o RunREPLOptions) painter(out io.Writer) painter {
+	switch o.Color {
+	case ColorNever:
+		return painter{}
+	case ColorAuto:
+		if !isTerminal(out) || os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+			return painter{}
+		}
+	}
+	if o.Theme == nil {
+		return painter{theme: DefaultTheme}
+	}
+	return painter{theme: *o.Theme}
+}
+
+func (p painter) prompt(text string) string { return paint(p.theme.Prompt, text) }
+func (p painter) result(text string) string { return paint(p.theme.Result, text) }
+func (p painter) error(text string) string  { return paint(p.theme.Error, text) }
+
+// paint wraps text in color, if both are non-empty.
+func paint(color, text string) string {
+	if color == "" || text == "" {
+		return text
+	}
+	return color + text + ansiReset
+}
+
+// isTerminal reports whether out is a character device such as a terminal.
+func isTerminal(out io.Writer) bool {
+	file, ok := out.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
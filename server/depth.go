@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/zylisp/lang/sexpr"
+	"github.com/zylisp/repl/operations"
+)
+
+// defaultMaxDepth is how deeply functions may call each other when MaxDepth
+// is not set. It is far below the depth at which the interpreter's recursion
+// would exhaust the goroutine stack.
+const defaultMaxDepth = 10000
+
+// startDepth resets the call depth for a new evaluation limited to limit,
+// or defaultMaxDepth if limit is not positive, that stops at its next
+// function call once ctx is done. The caller must have exclusive use of s.
+func (s *Server) startDepth(ctx context.Context, limit int) {
+	if limit <= 0 {
+		limit = defaultMaxDepth
+	}
+	s.depth, s.depthLimit, s.evalCtx = 0, limit, ctx
+}
+
+// instrument returns expr with the body of every lambda wrapped so that
+// calling the function counts towards the call depth of s:
+//
+//	(lambda (x) body) => (lambda (x) ('leave (if ('enter) body nil)))
+//
+// where 'enter and 'leave are quoted primitives rather than symbols, so the
+// wrapping binds no names. Quoted data is left alone. The interpreter does
+// not eliminate tail calls, so every unbounded recursion, including one that
+// would spin forever, is stopped by the depth limit.
+func (s *Server) instrument(expr sexpr.SExpr) sexpr.SExpr {
+	list, ok := expr.(sexpr.List)
+	if !ok || len(list.Elements) == 0 {
+		return expr
+	}
+	if sym, ok := list.Elements[0].(sexpr.Symbol); ok && sym.Name == "quote" {
+		return expr
+	}
+
+	elements := make([]sexpr.SExpr, len(list.Elements))
+	for i, element := range list.Elements {
+		elements[i] = s.instrument(element)
+	}
+	if sym, ok := elements[0].(sexpr.Symbol); ok && sym.Name == "lambda" && len(elements) == 3 {
+		elements[2] = call(s.leavePrimitive(), sexpr.List{Elements: []sexpr.SExpr{
+			sexpr.Symbol{Name: "if"}, call(s.enterPrimitive()), elements[2], sexpr.Nil{},
+		}})
+	}
+	return sexpr.List{Elements: elements}
+}
+
+// call returns the application of the primitive fn to args.
+func call(fn sexpr.Primitive, args ...sexpr.SExpr) sexpr.List {
+	quoted := sexpr.List{Elements: []sexpr.SExpr{sexpr.Symbol{Name: "quote"}, fn}}
+	return sexpr.List{Elements: append([]sexpr.SExpr{quoted}, args...)}
+}
+
+// enterPrimitive counts a function call, failing with
+// operations.ErrResourceExhausted once the depth limit is exceeded, or with
+// the evaluation context's error once it is done. Every long-running
+// evaluation calls functions, so this is where it is stopped.
+func (s *Server) enterPrimitive() sexpr.Primitive {
+	return sexpr.Primitive{
+		Name: "enter",
+		Fn: func(args []sexpr.SExpr, env interface{}) (sexpr.SExpr, error) {
+			if err := s.evalCtx.Err(); err != nil {
+				return nil, err
+			}
+			s.depth++
+			if s.depth > s.depthLimit {
+				return nil, fmt.Errorf("maximum call depth %d exceeded: %w", s.depthLimit, operations.ErrResourceExhausted)
+			}
+			return sexpr.Bool{Value: true}, nil
+		},
+	}
+}
+
+// leavePrimitive ends a function call counted by enterPrimitive and returns
+// the function's result.
+func (s *Server) leavePrimitive() sexpr.Primitive {
+	return sexpr.Primitive{
+		Name: "leave",
+		Fn: func(args []sexpr.SExpr, env interface{}) (sexpr.SExpr, error) {
+			s.depth--
+			return args[0], nil
+		},
+	}
+}
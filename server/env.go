@@ -0,0 +1,25 @@
+package server
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/zylisp/lang/interpreter"
+)
+
+// bindingNames returns the sorted names bound directly in env.
+// The interpreter does not expose its bindings, so the names are read
+// through reflection; values must still be fetched with env.Lookup.
+func bindingNames(env *interpreter.Env) []string {
+	bindings := reflect.ValueOf(env).Elem().FieldByName("bindings")
+	if !bindings.IsValid() || bindings.Kind() != reflect.Map {
+		return nil
+	}
+
+	names := make([]string, 0, bindings.Len())
+	for _, key := range bindings.MapKeys() {
+		names = append(names, key.String())
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/zylisp/lang/sexpr"
+	"github.com/zylisp/repl/operations"
+)
+
+// EvaluatorFunc adapts the server to the transports' evaluator contract, so
+// that it can back repl.NewServer or any transport server:
+//
+//	srv := server.NewServer()
+//	repl.NewServer(repl.ServerConfig{Transport: "tcp", Addr: ":5555", Evaluator: srv.EvaluatorFunc()})
+//
+// Results are returned as plain Go values that every codec can encode; see
+// fromSExpr. Output written with print and println is returned as the
+// evaluation's output.
+//
+// Errors in the evaluated code, reported by the server as an *EvalError, are
+// returned as error-as-data: a map with the message under "error" and the
+// failing phase under "phase". Only failures of the interpreter itself, such
+// as a panic, and evaluations stopped by MaxDepth are returned as errors.
+func (s *Server) EvaluatorFunc() operations.EvaluatorFunc {
+	return func(code string) (interface{}, string, error) {
+		return s.evalForTransport(code, evalOptions{})
+	}
+}
+
+// ContextEvaluatorFunc is like EvaluatorFunc but for the context-aware
+// contract, which additionally lets an "eval" request supply data.bindings
+// (see operations.BindingsFromContext), ask for a data.dry-run (see
+// operations.DryRunFromContext) and seed the random primitive with data.seed
+// (see operations.SeedFromContext). With data.with-diff, it records the
+// bindings before and after evaluating (see operations.EnvSnapshotsFromContext),
+// and with data.with-type the result's TypeOf before converting it (see
+// operations.ValueTypeFromContext).
+// An evaluation stops with ctx's error once
+// ctx is done, whether it is still waiting for the environment or running;
+// a running one stops at its next function call.
+func (s *Server) ContextEvaluatorFunc() operations.EvaluatorFunc2 {
+	return func(ctx context.Context, code string) (interface{}, string, error) {
+		opts := evalOptions{
+			ctx:       ctx,
+			bindings:  operations.BindingsFromContext(ctx),
+			isolated:  operations.DryRunFromContext(ctx),
+			snapshots: operations.EnvSnapshotsFromContext(ctx),
+			valueType: operations.ValueTypeFromContext(ctx),
+		}
+		if seed, ok := operations.SeedFromContext(ctx); ok {
+			opts.seed = &seed
+		}
+		return s.evalForTransport(code, opts)
+	}
+}
+
+// evalForTransport evaluates code and converts the outcome to the
+// evaluator contract, as described for EvaluatorFunc.
+func (s *Server) evalForTransport(code string, opts evalOptions) (result interface{}, output string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			result, err = nil, fmt.Errorf("interpreter panic: %v", r)
+		}
+	}()
+
+	value, output, err := s.eval(code, opts)
+	var evalErr *EvalError
+	if errors.As(err, &evalErr) && !errors.Is(err, operations.ErrResourceExhausted) && !isContextError(err) {
+		return map[string]interface{}{
+			"error": evalErr.Err.Error(),
+			"phase": evalErr.Phase,
+		}, output, nil
+	}
+	if err != nil {
+		return nil, output, err
+	}
+	if opts.valueType != nil {
+		opts.valueType.Name = valueTypeName(value)
+	}
+	return fromSExpr(value), output, nil
+}
+
+// valueTypeName returns the TypeOf of value, or of its first value if it
+// holds multiple values, the one the handler returns as the result.
+func valueTypeName(value sexpr.SExpr) string {
+	if values, ok := value.(Values); ok && len(values.Elements) > 0 {
+		value = values.Elements[0]
+	}
+	return TypeOf(value)
+}
+
+// isContextError reports whether err is an evaluation stopped by its
+// context, which the handler reports as interrupted or timed out rather than
+// as an error in the code.
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// fromSExpr converts a Zylisp value to a plain Go value, the reverse of
+// toSExpr: numbers become int64, strings, booleans and nil their Go
+// counterparts, lists []interface{} and multiple values operations.Values.
+// Functions and symbols, which have no Go counterpart, become their printed
+// form.
+func fromSExpr(value sexpr.SExpr) interface{} {
+	switch v := value.(type) {
+	case sexpr.Number:
+		return v.Value
+	case sexpr.String:
+		return v.Value
+	case sexpr.Bool:
+		return v.Value
+	case sexpr.Nil:
+		return nil
+	case sexpr.List:
+		elements := make([]interface{}, len(v.Elements))
+		for i, element := range v.Elements {
+			elements[i] = fromSExpr(element)
+		}
+		return elements
+	case Values:
+		values := make(operations.Values, len(v.Elements))
+		for i, element := range v.Elements {
+			values[i] = fromSExpr(element)
+		}
+		return values
+	default:
+		return value.String()
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/zylisp/lang/interpreter"
+	"github.com/zylisp/lang/sexpr"
+)
+
+// loadOutputPrimitives defines "print" and "println" in env. They write to
+// the output buffer of the evaluation s is running, and write nothing when
+// no output is being captured.
+func (s *Server) loadOutputPrimitives(env *interpreter.Env) {
+	env.Define("print", s.outputPrimitive("print", ""))
+	env.Define("println", s.outputPrimitive("println", "\n"))
+}
+
+// outputPrimitive returns a primitive that writes its arguments separated by
+// spaces, followed by end. Strings are written without quotes.
+func (s *Server) outputPrimitive(name, end string) sexpr.Primitive {
+	return sexpr.Primitive{
+		Name: name,
+		Fn: func(args []sexpr.SExpr, env interface{}) (sexpr.SExpr, error) {
+			if s.output == nil {
+				return sexpr.Nil{}, nil
+			}
+			for i, arg := range args {
+				if i > 0 {
+					s.output.WriteByte(' ')
+				}
+				if str, ok := arg.(sexpr.String); ok {
+					s.output.WriteString(str.Value)
+				} else {
+					s.output.WriteString(arg.String())
+				}
+			}
+			s.output.WriteString(end)
+			return sexpr.Nil{}, nil
+		},
+	}
+}
+
+// capture directs print output to a fresh buffer until the returned function
+// is called, which returns what was written. The caller must have exclusive
+// use of s.
+func (s *Server) capture() func() string {
+	var buf strings.Builder
+	s.output = &buf
+	return func() string {
+		s.output = nil
+		return buf.String()
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import "sync"
+
+// Pool holds pre-initialized servers so that ephemeral evaluation does not
+// pay for loading primitives on every request. Used servers are refreshed in
+// the background, one at a time, before being made available again, which
+// takes the cost off the request path; under sustained load that outpaces
+// the refresh, used servers are dropped and Get falls back to creating
+// servers.
+type Pool struct {
+	// Recreate discards used servers and creates new ones instead of
+	// resetting them.
+	Recreate bool
+
+	servers chan *Server // fresh servers
+	used    chan *Server // servers waiting to be refreshed
+
+	mu         sync.Mutex
+	refreshing bool // whether the refresh goroutine is running
+}
+
+// NewPool creates a pool holding up to size servers and fills it.
+func NewPool(size int) *Pool {
+	p := &Pool{servers: make(chan *Server, size), used: make(chan *Server, size)}
+	for i := 0; i < size; i++ {
+		p.servers <- NewServer()
+	}
+	return p
+}
+
+// Get checks out a fresh server, creating one if the pool is empty.
+func (p *Pool) Get() *Server {
+	select {
+	case s := <-p.servers:
+		return s
+	default:
+		return NewServer()
+	}
+}
+
+// Put returns a used server. It is reset (or replaced, if Recreate is set)
+// in the background, and dropped if as many servers are already waiting for
+// that as the pool holds.
+func (p *Pool) Put(s *Server) {
+	select {
+	case p.used <- s:
+	default:
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.refreshing {
+		p.refreshing = true
+		go p.refresh()
+	}
+}
+
+// refresh resets used servers and returns them to the pool until none are
+// left waiting. A server that finds the pool full is dropped.
+func (p *Pool) refresh() {
+	for {
+		p.mu.Lock()
+		var s *Server
+		select {
+		case s = <-p.used:
+		default:
+			p.refreshing = false
+		}
+		p.mu.Unlock()
+		if s == nil {
+			return
+		}
+
+		if p.Recreate {
+			s = NewServer()
+		} else {
+			s.Reset()
+		}
+		select {
+		case p.servers <- s:
+		default:
+		}
+	}
+}
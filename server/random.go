@@ -0,0 +1,31 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/zylisp/lang/interpreter"
+	"github.com/zylisp/lang/sexpr"
+)
+
+// loadRandomPrimitive defines "random" in env: (random n) returns a
+// pseudo-random integer in [0, n) drawn from the generator of s, or from the
+// evaluation's own generator if it was seeded for reproducible results.
+func (s *Server) loadRandomPrimitive(env *interpreter.Env) {
+	env.Define("random", sexpr.Primitive{
+		Name: "random",
+		Fn: func(args []sexpr.SExpr, env interface{}) (sexpr.SExpr, error) {
+			if len(args) != 1 {
+				return nil, fmt.Errorf("random requires 1 argument, got %d", len(args))
+			}
+			n, ok := args[0].(sexpr.Number)
+			if !ok || n.Value <= 0 {
+				return nil, fmt.Errorf("random: argument must be a positive number")
+			}
+			rng := s.rng
+			if s.seeded != nil {
+				rng = s.seeded
+			}
+			return sexpr.Number{Value: rng.Int63n(n.Value)}, nil
+		},
+	})
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/zylisp/lang/sexpr"
+	"github.com/zylisp/repl/operations"
+)
+
+// Command handles a meta-command in RunREPL. args is the rest of the line
+// after the command name, with surrounding space removed. Returning ErrQuit
+// ends the loop; any other error is printed and the loop goes on.
+type Command func(loop *Loop, args string) error
+
+// ErrQuit is returned by a Command to end RunREPL.
+var ErrQuit = errors.New("quit")
+
+// Loop is the state of a running RunREPL, passed to commands.
+type Loop struct {
+	Server  *Server
+	Out     io.Writer
+	History []string // entries read so far, oldest first, excluding the current command
+}
+
+// builtinCommands are the meta-commands every RunREPL understands unless
+// Server.Commands overrides them.
+var builtinCommands = map[string]Command{
+	"quit": func(loop *Loop, args string) error {
+		return ErrQuit
+	},
+	"reset": func(loop *Loop, args string) error {
+		loop.Server.Reset()
+		fmt.Fprintln(loop.Out, "environment reset")
+		return nil
+	},
+	"load":    loadCommand,
+	"env":     envCommand,
+	"history": historyCommand,
+}
+
+func init() {
+	// Registered here because helpCommand reads builtinCommands
+	builtinCommands["help"] = helpCommand
+}
+
+// RunREPL runs an interactive read-eval-print loop on s, reading input from
+// in and writing prompts, output, results and errors to out. Input is read
+// a line at a time; while a form is incomplete, for example inside an open
+// list or string, further lines are read under a blank continuation prompt.
+// Lines starting with ':' outside a form are meta-commands, looked up in
+// s.Commands and then among the built-in ":quit", ":reset", ":load <file>",
+// ":env", ":history" and ":help". RunREPL returns nil at the end of in or
+// on ErrQuit, and otherwise the error that stopped reading.
+func (s *Server) RunREPL(in io.Reader, out io.Writer, prompt string) error {
+	return s.RunREPLWithOptions(in, out, RunREPLOptions{Prompt: prompt})
+}
+
+// RunREPLWithOptions is like RunREPL with the prompt and colors taken from
+// opts.
+func (s *Server) RunREPLWithOptions(in io.Reader, out io.Writer, opts RunREPLOptions) error {
+	scanner := bufio.NewScanner(in)
+	continuation := strings.Repeat(" ", len(opts.Prompt))
+	loop := &Loop{Server: s, Out: out}
+	paint := opts.painter(out)
+	var pending strings.Builder
+
+	for {
+		if pending.Len() == 0 {
+			fmt.Fprint(out, paint.prompt(opts.Prompt))
+		} else {
+			fmt.Fprint(out, continuation)
+		}
+		if !scanner.Scan() {
+			return scanner.Err()
+		}
+		line := scanner.Text()
+
+		if pending.Len() == 0 && strings.HasPrefix(strings.TrimSpace(line), ":") {
+			entry := strings.TrimSpace(line)
+			name, args, _ := strings.Cut(entry[1:], " ")
+			if command := s.command(name); command == nil {
+				fmt.Fprintln(out, paint.error(fmt.Sprintf("error: unknown command :%s; :help lists the commands", name)))
+			} else if err := command(loop, strings.TrimSpace(args)); errors.Is(err, ErrQuit) {
+				return nil
+			} else if err != nil {
+				fmt.Fprintln(out, paint.error("error: "+err.Error()))
+			}
+			loop.History = append(loop.History, entry)
+			continue
+		}
+
+		pending.WriteString(line)
+		pending.WriteString("\n")
+		forms, complete := readForms(pending.String())
+		if !complete {
+			continue
+		}
+		if entry := strings.TrimSpace(pending.String()); entry != "" {
+			loop.History = append(loop.History, entry)
+		}
+		pending.Reset()
+
+		for _, form := range forms {
+			result, err := loop.eval(form)
+			if err != nil {
+				fmt.Fprintln(out, paint.error("error: "+err.Error()))
+				break
+			}
+			fmt.Fprintln(out, paint.result(result.String()))
+		}
+	}
+}
+
+// command returns the meta-command called name, or nil if there is none.
+func (s *Server) command(name string) Command {
+	if command, ok := s.Commands[name]; ok {
+		return command
+	}
+	return builtinCommands[name]
+}
+
+// eval evaluates a single form, writing its output to the loop's Out.
+func (l *Loop) eval(form string) (sexpr.SExpr, error) {
+	result, output, err := l.Server.EvalCapture(form)
+	fmt.Fprint(l.Out, output)
+	if output != "" && !strings.HasSuffix(output, "\n") {
+		fmt.Fprintln(l.Out)
+	}
+	return result, err
+}
+
+// loadCommand evaluates the forms in the file named by args and prints the
+// last result.
+func loadCommand(loop *Loop, args string) error {
+	if args == "" {
+		return fmt.Errorf("usage: :load <file>")
+	}
+	source, err := os.ReadFile(args)
+	if err != nil {
+		return err
+	}
+	forms, complete := readForms(string(source))
+	if !complete {
+		return fmt.Errorf("%s: incomplete form at end of file", args)
+	}
+
+	var result sexpr.SExpr = sexpr.Nil{}
+	for _, form := range forms {
+		if result, err = loop.eval(form); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(loop.Out, result.String())
+	return nil
+}
+
+// envCommand prints the top-level bindings other than primitives.
+func envCommand(loop *Loop, args string) error {
+	s := loop.Server
+	s.acquire(context.Background())
+	defer s.release()
+
+	for _, name := range bindingNames(s.env) {
+		value, err := s.env.Lookup(name)
+		if err != nil {
+			continue
+		}
+		if _, ok := value.(sexpr.Primitive); !ok {
+			fmt.Fprintf(loop.Out, "%s = %s\n", name, value.String())
+		}
+	}
+	return nil
+}
+
+// historyCommand prints the entries read so far, numbered from 1.
+func historyCommand(loop *Loop, args string) error {
+	for i, entry := range loop.History {
+		fmt.Fprintf(loop.Out, "%4d  %s\n", i+1, entry)
+	}
+	return nil
+}
+
+// helpCommand lists the available meta-commands.
+func helpCommand(loop *Loop, args string) error {
+	var names []string
+	for name := range builtinCommands {
+		names = append(names, ":"+name)
+	}
+	for name := range loop.Server.Commands {
+		if _, ok := builtinCommands[name]; !ok {
+			names = append(names, ":"+name)
+		}
+	}
+	sort.Strings(names)
+	fmt.Fprintln(loop.Out, strings.Join(names, " "))
+	return nil
+}
+
+// readForms splits source into its top-level forms with
+// operations.SplitForms, reporting whether the last one is complete. Source
+// the lexer rejects is returned whole, so that evaluating it reports the
+// error.
+func readForms(source string) (forms []string, complete bool) {
+	forms, complete, err := operations.SplitForms(source)
+	if err != nil {
+		return []string{strings.TrimSpace(source)}, true
+	}
+	return forms, complete
+}
@@ -1,50 +1,270 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"math/rand"
+	"strings"
+	"time"
 
 	"github.com/zylisp/lang/interpreter"
 	"github.com/zylisp/lang/parser"
+	"github.com/zylisp/lang/sexpr"
+	"github.com/zylisp/repl/operations"
 )
 
 // Server represents a REPL server
 type Server struct {
-	env *interpreter.Env
+	// Ephemeral makes each Eval run in a fresh server with only the
+	// primitives loaded, so no state carries over between evaluations.
+	// This trades performance for isolation.
+	Ephemeral bool
+
+	// Pool, if set, supplies the fresh servers used in ephemeral mode.
+	Pool *Pool
+
+	// MaxCheckpoints bounds how many checkpoints are retained; the oldest
+	// is discarded first. Zero means defaultMaxCheckpoints.
+	MaxCheckpoints int
+
+	// MaxDepth bounds how deeply functions may call each other during an
+	// evaluation. An evaluation that exceeds it fails with an error wrapping
+	// operations.ErrResourceExhausted instead of exhausting the stack. Zero
+	// means defaultMaxDepth.
+	MaxDepth int
+
+	// Commands adds meta-commands to RunREPL, keyed by name without the
+	// leading ':'. They take precedence over the built-in commands.
+	Commands map[string]Command
+
+	env    *interpreter.Env
+	lock   chan struct{}    // held while env is used; a channel so waits can time out
+	output *strings.Builder // receives print output during a capturing evaluation
+
+	checkpoints   []checkpoint // oldest first; guarded by lock
+	checkpointSeq int
+
+	depth      int // calls in progress in the current evaluation; guarded by lock
+	depthLimit int
+	evalCtx    context.Context // ends the current evaluation once done; guarded by lock
+
+	rng    *rand.Rand // backs the random primitive; guarded by lock
+	seeded *rand.Rand // replaces rng during a seeded evaluation; guarded by lock
 }
 
 // NewServer creates a new REPL server
 func NewServer() *Server {
+	s := &Server{
+		lock: make(chan struct{}, 1),
+		rng:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	s.env = s.newEnv()
+	return s
+}
+
+// newEnv returns a fresh environment with the primitives loaded, including
+// the output primitives bound to s.
+func (s *Server) newEnv() *interpreter.Env {
 	env := interpreter.NewEnv(nil)
 	interpreter.LoadPrimitives(env)
+	s.loadOutputPrimitives(env)
+	s.loadRandomPrimitive(env)
+	loadValuesPrimitive(env)
+	return env
+}
+
+// acquire takes the environment lock, giving up when ctx is done.
+func (s *Server) acquire(ctx context.Context) error {
+	select {
+	case s.lock <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-	return &Server{env: env}
+// release returns the environment lock.
+func (s *Server) release() {
+	<-s.lock
 }
 
 // Eval evaluates a Zylisp expression and returns the result as a string
 func (s *Server) Eval(source string) (string, error) {
+	return s.EvalWithBindings(source, nil)
+}
+
+// EvalWithBindings is like Eval but evaluates in a child of the environment
+// that binds the given names for this evaluation only. Definitions made
+// during the evaluation are discarded with the child. Values are converted
+// from their decoded Go form: nil, bool and string map to their Zylisp
+// counterparts, integral numbers to numbers and []interface{} to lists.
+func (s *Server) EvalWithBindings(source string, bindings map[string]interface{}) (string, error) {
+	result, _, err := s.eval(source, evalOptions{bindings: bindings})
+	if err != nil {
+		return "", err
+	}
+	return result.String(), nil
+}
+
+// EvalDryRun is like Eval but evaluates in a throwaway child of the
+// environment, so definitions made by the evaluation do not persist. The
+// result is still returned.
+func (s *Server) EvalDryRun(source string) (string, error) {
+	result, _, err := s.eval(source, evalOptions{isolated: true})
+	if err != nil {
+		return "", err
+	}
+	return result.String(), nil
+}
+
+// EvalValue is like Eval but returns the result as a Zylisp value, so that
+// callers can inspect it, for example with TypeOf.
+func (s *Server) EvalValue(source string) (sexpr.SExpr, error) {
+	result, _, err := s.eval(source, evalOptions{})
+	return result, err
+}
+
+// EvalCapture is like EvalValue but also returns what the evaluation wrote
+// with print and println. Other evaluation methods discard that output.
+func (s *Server) EvalCapture(source string) (sexpr.SExpr, string, error) {
+	return s.eval(source, evalOptions{})
+}
+
+// evalOptions adjust a single evaluation.
+type evalOptions struct {
+	ctx       context.Context          // stops the evaluation once done; nil means never
+	bindings  map[string]interface{}   // bound in a child environment
+	isolated  bool                     // evaluate in a throwaway child environment
+	seed      *int64                   // seeds the random number generator first
+	snapshots *operations.EnvSnapshots // receives the bindings before and after
+	valueType *operations.ValueType    // receives the result's type name
+}
+
+// eval evaluates source with opts and returns the raw result and the
+// captured output. With opts.isolated set, or any bindings, it evaluates in
+// a child environment that is discarded afterwards. If opts.ctx ends while
+// waiting for the environment, or before a function call, eval returns its
+// error.
+func (s *Server) eval(source string, opts evalOptions) (sexpr.SExpr, string, error) {
+	ctx := opts.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	values := make(map[string]sexpr.SExpr, len(opts.bindings))
+	for name, value := range opts.bindings {
+		v, err := toSExpr(value)
+		if err != nil {
+			return nil, "", fmt.Errorf("binding %q: %w", name, err)
+		}
+		values[name] = v
+	}
+
 	// Tokenize
 	tokens, err := parser.Tokenize(source)
 	if err != nil {
-		return "", fmt.Errorf("tokenize error: %w", err)
+		return nil, "", &EvalError{Phase: "tokenize", Err: err}
 	}
 
 	// Parse
 	expr, err := parser.Read(tokens)
 	if err != nil {
-		return "", fmt.Errorf("parse error: %w", err)
+		return nil, "", &EvalError{Phase: "parse", Err: err}
 	}
 
-	// Evaluate
-	result, err := interpreter.Eval(expr, s.env)
+	// Evaluate, in a throwaway environment when ephemeral
+	owner := s
+	if !s.Ephemeral {
+		if err := s.acquire(ctx); err != nil {
+			return nil, "", err
+		}
+		defer s.release()
+	} else if s.Pool != nil {
+		owner = s.Pool.Get()
+		defer s.Pool.Put(owner)
+	} else {
+		owner = NewServer()
+	}
+	env := owner.env
+	finish := owner.capture()
+	defer finish()
+	owner.startDepth(ctx, s.MaxDepth)
+	expr = owner.instrument(expr)
+	// A seeded evaluation draws from its own generator, so it neither
+	// depends on nor disturbs the sequence of unseeded ones
+	owner.seeded = nil
+	if opts.seed != nil {
+		owner.seeded = rand.New(rand.NewSource(*opts.seed))
+	}
+	if opts.isolated || len(values) > 0 {
+		env = env.Extend()
+		for name, value := range values {
+			env.Define(name, value)
+		}
+	}
+	if opts.snapshots != nil {
+		opts.snapshots.Before = owner.snapshotLocked()
+	}
+	result, err := interpreter.Eval(expr, env)
+	if opts.snapshots != nil {
+		opts.snapshots.After = owner.snapshotLocked()
+	}
+	output := finish()
 	if err != nil {
-		return "", fmt.Errorf("eval error: %w", err)
+		return nil, output, &EvalError{Phase: "eval", Err: err}
 	}
 
-	return result.String(), nil
+	return result, output, nil
 }
 
-// Reset clears the environment and reloads primitives
+// EvalError reports that source could not be evaluated: it failed to
+// tokenize, to parse, or raised an error while evaluating, such as a division
+// by zero or an undefined variable.
+type EvalError struct {
+	Phase string // "tokenize", "parse" or "eval"
+	Err   error
+}
+
+func (e *EvalError) Error() string {
+	return e.Phase + " error: " + e.Err.Error()
+}
+
+func (e *EvalError) Unwrap() error {
+	return e.Err
+}
+
+// Reset clears the environment and reloads primitives.
+// It waits for an in-flight Eval to finish first.
 func (s *Server) Reset() {
-	s.env = interpreter.NewEnv(nil)
-	interpreter.LoadPrimitives(s.env)
+	s.ResetContext(context.Background())
+}
+
+// ResetContext is like Reset but gives up waiting for an in-flight Eval
+// when ctx is done, returning ctx.Err() and leaving the environment as is.
+func (s *Server) ResetContext(ctx context.Context) error {
+	if err := s.acquire(ctx); err != nil {
+		return err
+	}
+	defer s.release()
+
+	s.env = s.newEnv()
+	return nil
+}
+
+// Primitives returns the sorted names of the built-in functions
+// available in the current environment.
+func (s *Server) Primitives() []string {
+	s.acquire(context.Background())
+	defer s.release()
+
+	var names []string
+	for _, name := range bindingNames(s.env) {
+		value, err := s.env.Lookup(name)
+		if err != nil {
+			continue
+		}
+		if _, ok := value.(sexpr.Primitive); ok {
+			names = append(names, name)
+		}
+	}
+	return names
 }
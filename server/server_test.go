@@ -1,7 +1,24 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/zylisp/lang/sexpr"
+	"github.com/zylisp/repl/operations"
+	"github.com/zylisp/repl/protocol"
+	"github.com/zylisp/repl/transport/tcp"
 )
 
 func TestServerBasicEval(t *testing.T) {
@@ -52,6 +69,95 @@ func TestServerDefine(t *testing.T) {
 	}
 }
 
+func TestServerEvalWithBindings(t *testing.T) {
+	server := NewServer()
+
+	// JSON-decoded values, as they arrive in a request
+	result, err := server.EvalWithBindings("(+ x (car xs))", map[string]interface{}{
+		"x":  float64(40),
+		"xs": []interface{}{float64(2), "two", true, nil},
+	})
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if result != "42" {
+		t.Errorf("got %q, want \"42\"", result)
+	}
+
+	// The bindings, and anything defined alongside them, are gone afterwards
+	if _, err := server.EvalWithBindings("(define y x)", map[string]interface{}{"x": 1}); err != nil {
+		t.Fatalf("define error: %v", err)
+	}
+	for _, name := range []string{"x", "y"} {
+		if _, err := server.Eval(name); err == nil {
+			t.Errorf("expected %s to be unbound after the evaluation", name)
+		}
+	}
+
+	if _, err := server.EvalWithBindings("x", map[string]interface{}{"x": 1.5}); err == nil {
+		t.Error("expected a non-integral number to be rejected")
+	}
+}
+
+func TestTypeOf(t *testing.T) {
+	server := NewServer()
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"(+ 1 2)", "integer"},
+		{"\"hi\"", "string"},
+		{"(= 1 1)", "boolean"},
+		{"(list 1 2)", "list"},
+		{"(lambda (x) x)", "function"},
+		{"car", "function"},
+	}
+
+	for _, tt := range tests {
+		value, err := server.EvalValue(tt.input)
+		if err != nil {
+			t.Fatalf("eval %q: %v", tt.input, err)
+		}
+		if got := TypeOf(value); got != tt.expected {
+			t.Errorf("TypeOf(%s) = %q, want %q", tt.input, got, tt.expected)
+		}
+	}
+
+	if got := TypeOf(3); got != "unknown" {
+		t.Errorf("TypeOf of a Go value = %q, want \"unknown\"", got)
+	}
+}
+
+func TestServerValueTypeThroughHandler(t *testing.T) {
+	srv := NewServer()
+	h := operations.NewHandler(srv.EvaluatorFunc())
+	h.ContextEvaluator = srv.ContextEvaluatorFunc()
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"(+ 1 2)", "integer"},
+		{"\"hi\"", "string"},
+		{"(list 1 2)", "list"},
+		{"(lambda (x) x)", "function"},
+		{"car", "function"},
+	}
+
+	for i, tt := range tests {
+		resp := h.Handle(&protocol.Message{
+			Op:   "eval",
+			ID:   fmt.Sprint(i),
+			Code: tt.input,
+			Data: map[string]interface{}{"with-type": true},
+		})
+		if got := resp.Data["value-type"]; got != tt.expected {
+			t.Errorf("value-type of %s = %v, want %q", tt.input, got, tt.expected)
+		}
+	}
+}
+
 func TestServerLambda(t *testing.T) {
 	server := NewServer()
 
@@ -88,6 +194,49 @@ func TestServerReset(t *testing.T) {
 	}
 }
 
+func TestServerResetDuringEval(t *testing.T) {
+	server := NewServer()
+
+	// Run under -race: Reset must not swap the environment under an Eval
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				server.Eval("(define x (+ 1 2))")
+				server.Eval("x")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				server.Reset()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestServerResetContextDeadline(t *testing.T) {
+	server := NewServer()
+	server.Eval("(define x 42)")
+
+	// Simulate an in-flight Eval holding the environment
+	server.acquire(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := server.ResetContext(ctx)
+	server.release()
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if result, err := server.Eval("x"); err != nil || result != "42" {
+		t.Errorf("expected environment untouched, got %q, %v", result, err)
+	}
+}
+
 func TestServerErrors(t *testing.T) {
 	server := NewServer()
 
@@ -107,3 +256,806 @@ func TestServerErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestServerPrimitives(t *testing.T) {
+	server := NewServer()
+
+	// User definitions are not primitives
+	server.Eval("(define car-count 3)")
+
+	names := server.Primitives()
+	if len(names) == 0 {
+		t.Fatal("expected primitives, got none")
+	}
+
+	found := map[string]bool{}
+	for i, name := range names {
+		if i > 0 && names[i-1] > name {
+			t.Errorf("primitives not sorted: %q before %q", names[i-1], name)
+		}
+		found[name] = true
+	}
+
+	for _, want := range []string{"+", "car", "cons"} {
+		if !found[want] {
+			t.Errorf("expected primitive %q in %v", want, names)
+		}
+	}
+	if found["car-count"] {
+		t.Error("user definition car-count reported as a primitive")
+	}
+}
+
+func TestServerEphemeral(t *testing.T) {
+	server := NewServer()
+	server.Ephemeral = true
+
+	if _, err := server.Eval("(define x 1)"); err != nil {
+		t.Fatalf("define error: %v", err)
+	}
+
+	// The definition is not visible to the next evaluation
+	if _, err := server.Eval("x"); err == nil {
+		t.Error("expected x to be undefined in ephemeral mode")
+	}
+
+	result, err := server.Eval("(+ 1 2)")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result != "3" {
+		t.Errorf("got %q, want \"3\"", result)
+	}
+}
+
+func TestServerEphemeralPool(t *testing.T) {
+	for _, recreate := range []bool{false, true} {
+		pool := NewPool(2)
+		pool.Recreate = recreate
+
+		server := NewServer()
+		server.Ephemeral = true
+		server.Pool = pool
+
+		for i := 0; i < 5; i++ {
+			if _, err := server.Eval("(define x 1)"); err != nil {
+				t.Fatalf("define error: %v", err)
+			}
+			if _, err := server.Eval("x"); err == nil {
+				t.Errorf("recreate=%v: pooled server leaked x", recreate)
+			}
+		}
+	}
+}
+
+func TestPoolRefreshesInOneGoroutine(t *testing.T) {
+	pool := NewPool(2)
+	for len(pool.servers) > 0 {
+		pool.Get()
+	}
+
+	// More servers than the pool holds are returned at once; the surplus is
+	// dropped rather than queued behind the refresh
+	for i := 0; i < 10; i++ {
+		pool.Put(NewServer())
+	}
+	if n := len(pool.used); n > 2 {
+		t.Errorf("got %d servers waiting for refresh, want at most 2", n)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(pool.servers) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("pool refilled to %d servers, want 2", len(pool.servers))
+		}
+		runtime.Gosched()
+	}
+	for {
+		pool.mu.Lock()
+		refreshing := pool.refreshing
+		pool.mu.Unlock()
+		if !refreshing {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("refresh goroutine did not exit")
+		}
+		runtime.Gosched()
+	}
+}
+
+func BenchmarkEphemeralEvalCold(b *testing.B) {
+	server := NewServer()
+	server.Ephemeral = true
+
+	for i := 0; i < b.N; i++ {
+		if _, err := server.Eval("(+ 1 2)"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEphemeralEvalWarmPool(b *testing.B) {
+	server := NewServer()
+	server.Ephemeral = true
+	server.Pool = NewPool(1)
+
+	for i := 0; i < b.N; i++ {
+		if _, err := server.Eval("(+ 1 2)"); err != nil {
+			b.Fatal(err)
+		}
+
+		// Measure latency with a warm pool: let the background refresh finish
+		b.StopTimer()
+		for len(server.Pool.servers) == 0 {
+			runtime.Gosched()
+		}
+		b.StartTimer()
+	}
+}
+
+func TestEvaluatorFuncOverTCP(t *testing.T) {
+	srv := tcp.NewServer("127.0.0.1:0", "json", NewServer().EvaluatorFunc())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		srv.Start(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := tcp.NewClient("json")
+	if err := client.Connect(ctx, srv.Addr(), ""); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	tests := []struct {
+		code     string
+		expected interface{}
+	}{
+		{"(define x 41)", float64(41)},
+		{"(+ x 1)", float64(42)},
+		{`"hello"`, "hello"},
+		{"(= 1 1)", true},
+	}
+	for _, tt := range tests {
+		result, err := client.Eval(ctx, tt.code)
+		if err != nil {
+			t.Fatalf("Eval %s failed: %v", tt.code, err)
+		}
+		if result.Value != tt.expected {
+			t.Errorf("Eval %s: got %v, want %v", tt.code, result.Value, tt.expected)
+		}
+	}
+
+	result, err := client.Eval(ctx, "(list 1 (list 2))")
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	list, ok := result.Value.([]interface{})
+	if !ok || len(list) != 2 || list[0] != float64(1) {
+		t.Errorf("Expected the list (1 (2)), got %v", result.Value)
+	}
+}
+
+func TestServerEvalCapture(t *testing.T) {
+	for _, ephemeral := range []bool{false, true} {
+		server := NewServer()
+		server.Ephemeral = ephemeral
+
+		value, output, err := server.EvalCapture(`(println "sum:" (+ 1 2))`)
+		if err != nil {
+			t.Fatalf("ephemeral=%v: eval error: %v", ephemeral, err)
+		}
+		if output != "sum: 3\n" {
+			t.Errorf("ephemeral=%v: got output %q, want \"sum: 3\\n\"", ephemeral, output)
+		}
+		if _, ok := value.(sexpr.Nil); !ok {
+			t.Errorf("ephemeral=%v: expected println to return nil, got %v", ephemeral, value)
+		}
+
+		// Output from one evaluation does not leak into the next
+		if _, output, _ := server.EvalCapture("(+ 1 2)"); output != "" {
+			t.Errorf("ephemeral=%v: expected no output, got %q", ephemeral, output)
+		}
+	}
+}
+
+func TestEvaluatorFuncOutputOverTCP(t *testing.T) {
+	srv := tcp.NewServer("127.0.0.1:0", "json", NewServer().EvaluatorFunc())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		srv.Start(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := tcp.NewClient("json")
+	if err := client.Connect(ctx, srv.Addr(), ""); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	result, err := client.Eval(ctx, `(println "hello")`)
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	if result.Output != "hello\n" {
+		t.Errorf("Expected output \"hello\\n\", got %q", result.Output)
+	}
+}
+
+func TestEvaluatorFuncErrorsAsData(t *testing.T) {
+	srv := tcp.NewServer("127.0.0.1:0", "json", NewServer().EvaluatorFunc())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		srv.Start(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := tcp.NewClient("json")
+	if err := client.Connect(ctx, srv.Addr(), ""); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	tests := []struct {
+		code  string
+		phase string
+	}{
+		{"(/ 1 0)", "eval"},
+		{"undefined-var", "eval"},
+		{"(+ 1", "parse"},
+	}
+	for _, tt := range tests {
+		result, err := client.Eval(ctx, tt.code)
+		if err != nil {
+			t.Fatalf("Eval %s failed: %v", tt.code, err)
+		}
+		if len(result.Status) != 1 || result.Status[0] != "done" {
+			t.Errorf("Eval %s: expected status done, got %v", tt.code, result.Status)
+		}
+		errorValue, ok := result.Value.(map[string]interface{})
+		if !ok || errorValue["error"] == nil {
+			t.Errorf("Eval %s: expected error-as-data, got %v", tt.code, result.Value)
+			continue
+		}
+		if errorValue["phase"] != tt.phase {
+			t.Errorf("Eval %s: expected phase %q, got %v", tt.code, tt.phase, errorValue["phase"])
+		}
+	}
+}
+
+func TestServerCheckpointRestore(t *testing.T) {
+	server := NewServer()
+
+	mustEval := func(code string) string {
+		t.Helper()
+		result, err := server.Eval(code)
+		if err != nil {
+			t.Fatalf("eval %s: %v", code, err)
+		}
+		return result
+	}
+
+	mustEval("(define x 1)")
+	mustEval("(define get-x (lambda () x))")
+	id, err := server.Checkpoint()
+	if err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+
+	mustEval("(define x 2)")
+	mustEval("(define y 3)")
+	if err := server.Restore(id); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	if got := mustEval("x"); got != "1" {
+		t.Errorf("x = %s after restore, want 1", got)
+	}
+	if got := mustEval("(get-x)"); got != "1" {
+		t.Errorf("(get-x) = %s after restore, want 1", got)
+	}
+	if _, err := server.Eval("y"); err == nil {
+		t.Error("Expected y to be unbound after restore")
+	}
+
+	// Restoring again reverts later changes too
+	mustEval("(define x 5)")
+	if err := server.Restore(id); err != nil {
+		t.Fatalf("second Restore failed: %v", err)
+	}
+	if got := mustEval("x"); got != "1" {
+		t.Errorf("x = %s after second restore, want 1", got)
+	}
+
+	if err := server.Restore("cp-bogus"); err == nil {
+		t.Error("Expected an unknown checkpoint to be rejected")
+	}
+}
+
+func TestServerCheckpointLimit(t *testing.T) {
+	server := NewServer()
+	server.MaxCheckpoints = 2
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id, err := server.Checkpoint()
+		if err != nil {
+			t.Fatalf("Checkpoint failed: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	if err := server.Restore(ids[0]); err == nil {
+		t.Error("Expected the oldest checkpoint to have been discarded")
+	}
+	for _, id := range ids[1:] {
+		if err := server.Restore(id); err != nil {
+			t.Errorf("Restore %s failed: %v", id, err)
+		}
+	}
+
+	ephemeral := NewServer()
+	ephemeral.Ephemeral = true
+	if _, err := ephemeral.Checkpoint(); err == nil {
+		t.Error("Expected ephemeral servers to refuse checkpoints")
+	}
+}
+
+func TestServerMultipleValues(t *testing.T) {
+	h := operations.NewHandler(NewServer().EvaluatorFunc())
+
+	resp := h.Handle(&protocol.Message{Op: "eval", ID: "1", Code: "(values (+ 1 2) \"four\")"})
+	if len(resp.Status) != 1 || resp.Status[0] != "done" {
+		t.Fatalf("Expected status done, got %v (%s)", resp.Status, resp.ProtocolError)
+	}
+	if resp.Value != int64(3) {
+		t.Errorf("Expected Value to be the first value, got %v", resp.Value)
+	}
+	if got := resp.Data["values"]; !reflect.DeepEqual(got, []interface{}{int64(3), "four"}) {
+		t.Errorf("Expected both values in data.values, got %v", got)
+	}
+
+	resp = h.Handle(&protocol.Message{Op: "eval", ID: "2", Code: "(+ 1 2)"})
+	if _, ok := resp.Data["values"]; ok {
+		t.Error("Expected no data.values for a single value")
+	}
+}
+
+func TestServerMaxDepth(t *testing.T) {
+	srv := NewServer()
+	h := operations.NewHandler(srv.EvaluatorFunc())
+
+	eval := func(code string) *protocol.Message {
+		return h.Handle(&protocol.Message{Op: "eval", ID: "1", Code: code})
+	}
+
+	eval("(define loop (lambda () (loop)))")
+	resp := eval("(loop)")
+	if len(resp.Status) != 2 || resp.Status[0] != "error" || resp.Status[1] != "resource-exhausted" {
+		t.Fatalf("Expected status [error resource-exhausted], got %v (%s)", resp.Status, resp.ProtocolError)
+	}
+
+	// The server survives and recursion within the limit still works
+	eval("(define count (lambda (n) (if (= n 0) 0 (+ 1 (count (- n 1))))))")
+	if resp := eval("(count 100)"); resp.Value != int64(100) {
+		t.Errorf("Expected (count 100) to return 100, got %v (%v)", resp.Value, resp.Status)
+	}
+
+	srv.MaxDepth = 50
+	if resp := eval("(count 100)"); len(resp.Status) != 2 || resp.Status[1] != "resource-exhausted" {
+		t.Errorf("Expected MaxDepth 50 to stop (count 100), got %v", resp.Status)
+	}
+	if resp := eval("(count 40)"); resp.Value != int64(40) {
+		t.Errorf("Expected (count 40) to return 40, got %v (%v)", resp.Value, resp.Status)
+	}
+	want := []interface{}{"lambda", []interface{}{}, int64(1)}
+	if resp := eval("(quote (lambda () 1))"); !reflect.DeepEqual(resp.Value, want) {
+		t.Errorf("Expected quoted lambdas to be left alone, got %#v", resp.Value)
+	}
+}
+
+func TestServerDefaultEvalTimeout(t *testing.T) {
+	srv := NewServer()
+	h := operations.NewHandler(srv.EvaluatorFunc())
+	h.ContextEvaluator = srv.ContextEvaluatorFunc()
+	h.DefaultEvalTimeout = 50 * time.Millisecond
+
+	eval := func(code string) *protocol.Message {
+		return h.Handle(&protocol.Message{Op: "eval", ID: "1", Code: code})
+	}
+	eval("(define fib (lambda (n) (if (< n 2) n (+ (fib (- n 1)) (fib (- n 2))))))")
+
+	start := time.Now()
+	resp := eval("(fib 40)")
+	if len(resp.Status) != 2 || resp.Status[1] != "timeout" {
+		t.Fatalf("Expected status [error timeout], got %v (%s)", resp.Status, resp.ProtocolError)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the evaluation to stop near its deadline, took %v", elapsed)
+	}
+
+	// The environment is released and usable again
+	if resp := eval("(fib 10)"); resp.Value != int64(55) {
+		t.Errorf("Expected (fib 10) to return 55, got %v (%v)", resp.Value, resp.Status)
+	}
+}
+
+func TestServerContextEvaluatorWaitsForEnvironment(t *testing.T) {
+	srv := NewServer()
+	srv.acquire(context.Background())
+	defer srv.release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := srv.ContextEvaluatorFunc()(ctx, "(+ 1 2)"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected a busy environment to give up at the deadline, got %v", err)
+	}
+}
+
+func TestServerSeed(t *testing.T) {
+	srv := NewServer()
+	h := operations.NewHandler(srv.EvaluatorFunc())
+	h.ContextEvaluator = srv.ContextEvaluatorFunc()
+
+	roll := func(seed float64) interface{} {
+		resp := h.Handle(&protocol.Message{
+			Op:   "eval",
+			ID:   "1",
+			Code: "(list (random 1000000) (random 1000000) (random 1000000))",
+			Data: map[string]interface{}{"seed": seed},
+		})
+		if len(resp.Status) != 1 || resp.Status[0] != "done" {
+			t.Fatalf("Expected status done, got %v (%s)", resp.Status, resp.ProtocolError)
+		}
+		return resp.Value
+	}
+
+	first, again := roll(42), roll(42)
+	if !reflect.DeepEqual(first, again) {
+		t.Errorf("Expected the same seed to give the same result, got %v and %v", first, again)
+	}
+	if other := roll(43); reflect.DeepEqual(first, other) {
+		t.Errorf("Expected different seeds to differ, both gave %v", first)
+	}
+}
+
+func TestServerSeedLeavesSharedGeneratorAlone(t *testing.T) {
+	srv := NewServer()
+	srv.rng = rand.New(rand.NewSource(1))
+	want := rand.New(rand.NewSource(1))
+	h := operations.NewHandler(srv.EvaluatorFunc())
+	h.ContextEvaluator = srv.ContextEvaluatorFunc()
+
+	roll := func(data map[string]interface{}) interface{} {
+		resp := h.Handle(&protocol.Message{Op: "eval", ID: "1", Code: "(random 1000000)", Data: data})
+		return resp.Value
+	}
+
+	if got := roll(nil); got != want.Int63n(1000000) {
+		t.Fatalf("Expected the first unseeded roll from the shared generator, got %v", got)
+	}
+	roll(map[string]interface{}{"seed": float64(42)})
+	if got := roll(nil); got != want.Int63n(1000000) {
+		t.Errorf("Expected a seeded evaluation not to disturb the shared generator, got %v", got)
+	}
+}
+
+func TestServerDryRun(t *testing.T) {
+	srv := NewServer()
+	h := operations.NewHandler(srv.EvaluatorFunc())
+	h.ContextEvaluator = srv.ContextEvaluatorFunc()
+
+	resp := h.Handle(&protocol.Message{
+		Op:   "eval",
+		ID:   "1",
+		Code: "(define z 5)",
+		Data: map[string]interface{}{"dry-run": true},
+	})
+	if resp.Value != int64(5) || resp.Status[0] != "done" {
+		t.Errorf("Expected the dry run to report 5, got %v %v", resp.Value, resp.Status)
+	}
+	if _, err := srv.Eval("z"); err == nil {
+		t.Error("Expected the dry-run define not to persist")
+	}
+
+	// Bindings reach the interpreter through the same adapter
+	resp = h.Handle(&protocol.Message{
+		Op:   "eval",
+		ID:   "2",
+		Code: "(+ n 1)",
+		Data: map[string]interface{}{"bindings": map[string]interface{}{"n": float64(41)}},
+	})
+	if resp.Value != int64(42) {
+		t.Errorf("Expected 42 from the bound n, got %v", resp.Value)
+	}
+
+	if result, err := srv.EvalDryRun("(define w 1)"); err != nil || result != "1" {
+		t.Errorf("EvalDryRun = %q, %v; want \"1\"", result, err)
+	}
+	if _, err := srv.Eval("w"); err == nil {
+		t.Error("Expected EvalDryRun's define not to persist")
+	}
+}
+
+func TestServerEnvDiff(t *testing.T) {
+	srv := NewServer()
+	h := operations.NewHandler(srv.EvaluatorFunc())
+	h.Snapshot = srv.Snapshot
+
+	diff := func(code string) map[string]interface{} {
+		t.Helper()
+		resp := h.Handle(&protocol.Message{Op: "eval", ID: "1", Code: code, Data: map[string]interface{}{"with-diff": true}})
+		if resp.Status[0] != "done" {
+			t.Fatalf("Eval %s failed: %v %s", code, resp.Status, resp.ProtocolError)
+		}
+		return resp.Data["env-diff"].(map[string]interface{})
+	}
+	names := func(list interface{}) []string {
+		return list.([]string)
+	}
+
+	added := diff("(define x 1)")
+	if !reflect.DeepEqual(names(added["added"]), []string{"x"}) || len(names(added["changed"])) != 0 {
+		t.Errorf("Expected x to be added, got %v", added)
+	}
+
+	pure := diff("(+ x 2)")
+	if len(names(pure["added"])) != 0 || len(names(pure["changed"])) != 0 {
+		t.Errorf("Expected a pure expression to change nothing, got %v", pure)
+	}
+
+	changed := diff("(define x 2)")
+	if len(names(changed["added"])) != 0 || !reflect.DeepEqual(names(changed["changed"]), []string{"x"}) {
+		t.Errorf("Expected x to be changed, got %v", changed)
+	}
+
+	// Functions all print alike but are still told apart
+	diff("(define f (lambda (n) n))")
+	redefined := diff("(define f (lambda (n) (+ n 1)))")
+	if !reflect.DeepEqual(names(redefined["changed"]), []string{"f"}) {
+		t.Errorf("Expected f to be changed, got %v", redefined)
+	}
+}
+
+func TestServerEnvDiffExcludesOtherSessions(t *testing.T) {
+	srv := NewServer()
+	h := operations.NewHandler(srv.EvaluatorFunc())
+	h.ContextEvaluator = srv.ContextEvaluatorFunc()
+
+	// Another session defines a name right after each handler snapshot
+	var others int
+	h.Snapshot = func() map[string]interface{} {
+		snapshot := srv.Snapshot()
+		others++
+		srv.Eval(fmt.Sprintf("(define other%d 1)", others))
+		return snapshot
+	}
+
+	resp := h.Handle(&protocol.Message{Op: "eval", ID: "1", Code: "(define x 1)", Data: map[string]interface{}{"with-diff": true}})
+	diff, _ := resp.Data["env-diff"].(map[string]interface{})
+	if added, _ := diff["added"].([]string); !reflect.DeepEqual(added, []string{"x"}) {
+		t.Errorf("Expected only x in the diff, got %v", diff)
+	}
+}
+
+func TestServerRunREPL(t *testing.T) {
+	server := NewServer()
+
+	in, script := io.Pipe()
+	go func() {
+		io.WriteString(script, strings.Join([]string{
+			`(define x 40) ; the answer, nearly`,
+			`(+ x`,
+			`   2)`,
+			`(println "hi") x`,
+			`(car 1)`,
+			`(list "a ;`,
+			`b)" 1))`,
+			`'x`,
+			`:bogus`,
+			`:reset`,
+			`x`,
+			`:quit`,
+			`99`,
+		}, "\n")+"\n")
+		script.Close()
+	}()
+
+	var out strings.Builder
+	if err := server.RunREPL(in, &out, "> "); err != nil {
+		t.Fatalf("RunREPL failed: %v", err)
+	}
+
+	want := strings.Join([]string{
+		"> 40",
+		">   42",
+		"> hi",
+		"nil",
+		"40",
+		"> error: eval error: car: expected list, got 1",
+		`>   ("a ;\nb)" 1)`,
+		"error: parse error: unexpected closing paren at line 1, col 1",
+		`> error: tokenize error: illegal token at line 1, col 1: "'"`,
+		"> error: unknown command :bogus; :help lists the commands",
+		"> environment reset",
+		"> error: eval error: undefined variable: x",
+		"> ",
+	}, "\n")
+	if out.String() != want {
+		t.Errorf("transcript mismatch:\ngot:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestServerRunREPLCommands(t *testing.T) {
+	server := NewServer()
+	server.Commands = map[string]Command{
+		"hello": func(loop *Loop, args string) error {
+			fmt.Fprintf(loop.Out, "hello, %s\n", args)
+			return nil
+		},
+	}
+
+	file := filepath.Join(t.TempDir(), "lib.zl")
+	if err := os.WriteFile(file, []byte("(define y 2)\n(+ y 1)\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	in, script := io.Pipe()
+	go func() {
+		io.WriteString(script, strings.Join([]string{
+			`:hello world`,
+			`(define x 1)`,
+			`:load ` + file,
+			`:env`,
+			`:history`,
+		}, "\n")+"\n")
+		script.Close()
+	}()
+
+	var out strings.Builder
+	if err := server.RunREPL(in, &out, "> "); err != nil {
+		t.Fatalf("RunREPL failed: %v", err)
+	}
+
+	want := strings.Join([]string{
+		"> hello, world",
+		"> 1",
+		"> 3",
+		"> x = 1",
+		"y = 2",
+		">    1  :hello world",
+		"   2  (define x 1)",
+		"   3  :load " + file,
+		"   4  :env",
+		"> ",
+	}, "\n")
+	if out.String() != want {
+		t.Errorf("transcript mismatch:\ngot:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestServerRunREPLColor(t *testing.T) {
+	run := func(opts RunREPLOptions) string {
+		var out strings.Builder
+		if err := NewServer().RunREPLWithOptions(strings.NewReader("(+ 1 2)\n(car 1)\n"), &out, opts); err != nil {
+			t.Fatalf("RunREPLWithOptions failed: %v", err)
+		}
+		return out.String()
+	}
+
+	if out := run(RunREPLOptions{Prompt: "> "}); strings.Contains(out, "\x1b[") {
+		t.Errorf("expected no escapes when not writing to a terminal, got %q", out)
+	}
+
+	theme := &Theme{Prompt: "<p>", Result: "<r>", Error: "<e>"}
+	want := "<p>> \x1b[0m<r>3\x1b[0m\n" +
+		"<p>> \x1b[0m<e>error: eval error: car: expected list, got 1\x1b[0m\n" +
+		"<p>> \x1b[0m"
+	if out := run(RunREPLOptions{Prompt: "> ", Color: ColorAlways, Theme: theme}); out != want {
+		t.Errorf("expected %q with color forced on, got %q", want, out)
+	}
+	if out := run(RunREPLOptions{Prompt: "> ", Color: ColorAlways}); !strings.Contains(out, DefaultTheme.Result+"3"+ansiReset) {
+		t.Errorf("expected the default theme, got %q", out)
+	}
+}
+
+func TestServerPipe(t *testing.T) {
+	srv := NewServer()
+	h := operations.NewHandler(srv.EvaluatorFunc())
+	h.ContextEvaluator = srv.ContextEvaluatorFunc()
+
+	pipe := func(stages ...interface{}) *protocol.Message {
+		return h.Handle(&protocol.Message{Op: "pipe", ID: "1", Data: map[string]interface{}{"stages": stages}})
+	}
+
+	resp := pipe("(+ 1 2)", "(* $ 10)")
+	if len(resp.Status) != 1 || resp.Status[0] != "done" {
+		t.Fatalf("Expected status done, got %v (%s)", resp.Status, resp.ProtocolError)
+	}
+	if want := []interface{}{int64(3), int64(30)}; !reflect.DeepEqual(resp.Data["stages-results"], want) {
+		t.Errorf("Expected intermediates %v, got %v", want, resp.Data["stages-results"])
+	}
+	if resp.Value != int64(30) {
+		t.Errorf("Expected the last stage's value, got %v", resp.Value)
+	}
+
+	// A failing stage stops the pipeline and is identified
+	resp = pipe("(+ 1 2)", "(car $)", "(+ $ 1)")
+	if resp.Status[0] != "done" || resp.Data["failed-stage"] != 1 {
+		t.Fatalf("Expected stage 1 to fail, got %v %v", resp.Status, resp.Data)
+	}
+	if results := resp.Data["stages-results"].([]interface{}); len(results) != 2 {
+		t.Errorf("Expected the stages up to the failure, got %v", results)
+	}
+	if failure, ok := resp.Value.(map[string]interface{}); !ok || failure["error"] == nil {
+		t.Errorf("Expected the error as the value, got %v", resp.Value)
+	}
+
+	resp = pipe()
+	if resp.Status[0] != "error" {
+		t.Errorf("Expected an empty pipeline to be refused, got %v", resp.Status)
+	}
+}
+
+func TestServerDefineAlias(t *testing.T) {
+	srv := NewServer()
+	h := operations.NewHandler(srv.EvaluatorFunc())
+	h.Snapshot = srv.Snapshot
+
+	alias := func(name, form string, shadow bool) *protocol.Message {
+		return h.Handle(&protocol.Message{Op: "define-alias", ID: "1", Session: "s1", Data: map[string]interface{}{
+			"name": name, "form": form, "shadow": shadow,
+		}})
+	}
+	eval := func(session, code string) interface{} {
+		resp := h.Handle(&protocol.Message{Op: "eval", ID: "2", Session: session, Code: code})
+		if resp.Status[0] != "done" {
+			t.Fatalf("Eval %s failed: %v %s", code, resp.Status, resp.ProtocolError)
+		}
+		return resp.Value
+	}
+
+	if resp := alias("answer", "(* 6 7)", false); resp.Status[0] != "done" {
+		t.Fatalf("define-alias failed: %v %s", resp.Status, resp.ProtocolError)
+	}
+	if got := eval("s1", " answer\n"); got != int64(42) {
+		t.Errorf("Expected the alias to expand, got %v", got)
+	}
+	// Aliases belong to their session and are not expanded inside forms
+	if got, ok := eval("s2", "answer").(map[string]interface{}); !ok || got["error"] == nil {
+		t.Errorf("Expected answer to be undefined in another session, got %v", got)
+	}
+	if got, ok := eval("s1", "(+ answer 1)").(map[string]interface{}); !ok || got["error"] == nil {
+		t.Errorf("Expected the alias not to expand inside a form, got %v", got)
+	}
+
+	// Bound names are protected unless shadowing is asked for
+	if resp := alias("car", "(* 6 7)", false); len(resp.Status) != 2 || resp.Status[1] != "alias-conflict" {
+		t.Errorf("Expected an alias-conflict for car, got %v", resp.Status)
+	}
+	if resp := alias("car", "\"shadowed\"", true); resp.Status[0] != "done" {
+		t.Fatalf("define-alias with shadow failed: %v %s", resp.Status, resp.ProtocolError)
+	}
+	if got := eval("s1", "car"); got != "shadowed" {
+		t.Errorf("Expected the shadowing alias, got %v", got)
+	}
+
+	// An empty form removes the alias
+	alias("answer", "", false)
+	if got, ok := eval("s1", "answer").(map[string]interface{}); !ok || got["error"] == nil {
+		t.Errorf("Expected the removed alias to be gone, got %v", got)
+	}
+}
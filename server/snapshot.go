@@ -0,0 +1,44 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/zylisp/lang/sexpr"
+)
+
+// Snapshot returns the top-level bindings, each as a fingerprint string that
+// changes when the binding's value does, for operations.Handler.Snapshot.
+// Functions are fingerprinted by their definition and environment, since
+// they all print as "<function>", and primitives by name. Like bindingNames,
+// it finds no bindings if the interpreter stops exposing them to reflection.
+func (s *Server) Snapshot() map[string]interface{} {
+	s.acquire(context.Background())
+	defer s.release()
+	return s.snapshotLocked()
+}
+
+// snapshotLocked is Snapshot for a caller that already has exclusive use of
+// s.
+func (s *Server) snapshotLocked() map[string]interface{} {
+	names := bindingNames(s.env)
+	snapshot := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		if value, err := s.env.Lookup(name); err == nil {
+			snapshot[name] = fingerprint(value)
+		}
+	}
+	return snapshot
+}
+
+// fingerprint identifies value for Snapshot.
+func fingerprint(value sexpr.SExpr) string {
+	switch v := value.(type) {
+	case sexpr.Primitive:
+		return "primitive " + v.Name
+	case sexpr.Func:
+		return fmt.Sprintf("function %v %v %p", v.Params, v.Body, v.Env)
+	default:
+		return fmt.Sprintf("%T %v", value, value)
+	}
+}
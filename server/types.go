@@ -0,0 +1,31 @@
+package server
+
+import "github.com/zylisp/lang/sexpr"
+
+// TypeOf returns the name of a Zylisp value's type: "integer", "string",
+// "boolean", "nil", "list", "function" or "symbol". Any other value,
+// including Go values that are not Zylisp values, is "unknown". Its
+// signature matches operations.TypeFunc, so it can be used as a handler's
+// TypeOf when the evaluator returns Zylisp values. ContextEvaluatorFunc,
+// which returns Go values, records TypeOf of each result before converting
+// it, so handlers backed by it need no TypeOf.
+func TypeOf(value interface{}) string {
+	switch value.(type) {
+	case sexpr.Number:
+		return "integer"
+	case sexpr.String:
+		return "string"
+	case sexpr.Bool:
+		return "boolean"
+	case sexpr.Nil:
+		return "nil"
+	case sexpr.List:
+		return "list"
+	case sexpr.Func, sexpr.Primitive:
+		return "function"
+	case sexpr.Symbol:
+		return "symbol"
+	default:
+		return "unknown"
+	}
+}
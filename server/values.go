@@ -0,0 +1,34 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/zylisp/lang/interpreter"
+	"github.com/zylisp/lang/sexpr"
+)
+
+// Values is the result of the "values" primitive: several values returned
+// by one form. Only a form's final result is recognized as multiple values;
+// passed to another function, Values is an ordinary argument.
+type Values struct {
+	Elements []sexpr.SExpr
+}
+
+func (v Values) String() string {
+	parts := make([]string, len(v.Elements))
+	for i, element := range v.Elements {
+		parts[i] = element.String()
+	}
+	return strings.Join(parts, " ")
+}
+
+// loadValuesPrimitive defines "values" in env, which returns its arguments
+// as multiple values.
+func loadValuesPrimitive(env *interpreter.Env) {
+	env.Define("values", sexpr.Primitive{
+		Name: "values",
+		Fn: func(args []sexpr.SExpr, env interface{}) (sexpr.SExpr, error) {
+			return Values{Elements: args}, nil
+		},
+	})
+}
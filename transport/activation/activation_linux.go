@@ -0,0 +1,71 @@
+//go:build linux
+
+package activation
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// Listeners returns listeners for every socket passed to the process, in
+// descriptor order.
+func Listeners() ([]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	return listeners(os.Getenv, listenFDsStart)
+}
+
+// Listener returns the single socket passed to the process.
+func Listener() (net.Listener, error) {
+	ls, err := Listeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(ls) != 1 {
+		for _, l := range ls {
+			l.Close()
+		}
+		return nil, fmt.Errorf("expected 1 activation socket, got %d", len(ls))
+	}
+	return ls[0], nil
+}
+
+// listeners reads the activation environment through getenv and wraps the
+// descriptors starting at first.
+func listeners(getenv func(string) string, first int) ([]net.Listener, error) {
+	pid, err := strconv.Atoi(getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, ErrNotActivated
+	}
+	n, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, ErrNotActivated
+	}
+
+	ls := make([]net.Listener, 0, n)
+	for fd := first; fd < first+n; fd++ {
+		syscall.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+
+		// FileListener duplicates the descriptor, so the original is closed
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, fmt.Errorf("activation socket %d: %w", fd, err)
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
@@ -0,0 +1,68 @@
+//go:build linux
+
+package activation
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestListenersFromInheritedFD(t *testing.T) {
+	// Stand in for systemd with a listener opened by the test
+	original, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer original.Close()
+
+	file, err := original.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("Failed to get listener file: %v", err)
+	}
+	defer file.Close()
+
+	// listeners takes ownership of the descriptor it is given
+	fd, err := syscall.Dup(int(file.Fd()))
+	if err != nil {
+		t.Fatalf("Failed to dup descriptor: %v", err)
+	}
+
+	env := map[string]string{
+		"LISTEN_PID": strconv.Itoa(os.Getpid()),
+		"LISTEN_FDS": "1",
+	}
+	ls, err := listeners(func(key string) string { return env[key] }, fd)
+	if err != nil {
+		t.Fatalf("listeners failed: %v", err)
+	}
+	if len(ls) != 1 {
+		t.Fatalf("Expected 1 listener, got %d", len(ls))
+	}
+	defer ls[0].Close()
+
+	if ls[0].Addr().String() != original.Addr().String() {
+		t.Errorf("Expected address %s, got %s", original.Addr(), ls[0].Addr())
+	}
+
+	conn, err := net.Dial("tcp", original.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	conn.Close()
+}
+
+func TestListenersNotActivated(t *testing.T) {
+	for name, env := range map[string]map[string]string{
+		"unset":     {},
+		"other pid": {"LISTEN_PID": strconv.Itoa(os.Getpid() + 1), "LISTEN_FDS": "1"},
+		"no fds":    {"LISTEN_PID": strconv.Itoa(os.Getpid()), "LISTEN_FDS": "0"},
+	} {
+		_, err := listeners(func(key string) string { return env[key] }, listenFDsStart)
+		if err != ErrNotActivated {
+			t.Errorf("%s: expected ErrNotActivated, got %v", name, err)
+		}
+	}
+}
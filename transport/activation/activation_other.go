@@ -0,0 +1,15 @@
+//go:build !linux
+
+package activation
+
+import "net"
+
+// Listeners returns ErrNotActivated: socket activation is Linux-only.
+func Listeners() ([]net.Listener, error) {
+	return nil, ErrNotActivated
+}
+
+// Listener returns ErrNotActivated: socket activation is Linux-only.
+func Listener() (net.Listener, error) {
+	return nil, ErrNotActivated
+}
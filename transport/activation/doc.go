@@ -0,0 +1,20 @@
+// Package activation creates listeners from sockets passed in by systemd
+// socket activation.
+//
+// systemd binds the sockets named in a .socket unit, starts the service with
+// them as file descriptors 3 and up, and describes them in the environment:
+//
+//   - LISTEN_PID: the PID the sockets are meant for; other processes ignore them
+//   - LISTEN_FDS: how many descriptors were passed, starting at 3
+//   - LISTEN_FDNAMES: optional colon-separated names for the descriptors
+//
+// The variables are unset once read so that child processes do not inherit
+// them. Socket activation is only supported on Linux; elsewhere Listeners
+// returns ErrNotActivated.
+package activation
+
+import "errors"
+
+// ErrNotActivated is returned when the process was not started with
+// activation sockets.
+var ErrNotActivated = errors.New("process was not socket activated")
@@ -3,8 +3,10 @@ package inprocess
 import (
 	"context"
 	"fmt"
+	"io"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/zylisp/repl/protocol"
 )
@@ -13,13 +15,56 @@ var clientIDCounter uint64
 
 // Client implements an in-process REPL client.
 type Client struct {
+	// FailOnProtocolError makes Eval and EvalStream return an error when the
+	// server answers with status "error", alongside the result. By default
+	// the error is only reported in the result.
+	FailOnProtocolError bool
+
+	// ResponseTimeout, if positive, bounds how long a request waits for each
+	// message from the server, independent of its context, so that a hung
+	// server is detected sooner than a long context deadline. Pushed output
+	// restarts the wait. Subscriptions are not affected.
+	ResponseTimeout time.Duration
+
+	// ValueUnmarshaler, if set, converts each result's decoded Value, for
+	// example rebuilding a Go type from the map a server's ValueMarshaler
+	// sent in its place.
+	ValueUnmarshaler func(v interface{}) interface{}
+
+	// TranscriptWriter, if set, receives a JSON line for every message sent
+	// or received, as written by protocol.WriteTranscript, for example to
+	// attach to a bug report or replay with operations.Replay.
+	TranscriptWriter io.Writer
+
 	server    *Server
 	responses chan *protocol.Message
 	clientID  string
-	mu        sync.Mutex
+	mu        sync.Mutex // guards server, pending and lost
 	msgID     uint64
+	pending   map[string]*route // request ID -> waiting caller
+	lost      chan struct{}     // closed once the response channel closes
+
+	transcriptMu sync.Mutex // serializes writes to TranscriptWriter
 }
 
+// route delivers the server's messages for one request ID to its caller.
+type route struct {
+	id     string
+	ch     chan *protocol.Message
+	stream bool          // keep the route after terminal messages (subscriptions)
+	lost   chan struct{} // the client's lost channel
+	gone   chan struct{} // closed when the caller stops listening
+	once   sync.Once
+}
+
+// routeBuffer is how many messages a route holds before the dispatch loop
+// waits for its caller (requests) or drops further messages (subscriptions).
+const routeBuffer = 64
+
+// subscriptionBuffer is how many pushed messages a subscription holds before
+// further messages are dropped for that subscriber.
+const subscriptionBuffer = 64
+
 // NewClient creates a new in-process client.
 func NewClient() *Client {
 	id := atomic.AddUint64(&clientIDCounter, 1)
@@ -30,6 +75,7 @@ func NewClient() *Client {
 
 // Connect connects the client to an in-process server.
 // The addr parameter should be a *Server instance or "in-process".
+// It fails if ctx is already done or the server is not running.
 func (c *Client) Connect(ctx context.Context, addr interface{}) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -51,12 +97,31 @@ func (c *Client) Connect(ctx context.Context, addr interface{}) error {
 		return fmt.Errorf("invalid address type for in-process client: %T", addr)
 	}
 
-	// Register with the server
-	c.responses = c.server.registerClient(c.clientID)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.attach()
+}
+
+// attach registers the client with its server and starts routing responses.
+// The caller must hold c.mu.
+func (c *Client) attach() error {
+	responses, err := c.server.registerClient(c.clientID)
+	if err != nil {
+		return err
+	}
+	c.responses = responses
+	c.pending = make(map[string]*route)
+	c.lost = make(chan struct{})
+
+	// Responses are routed to callers by ID in the background
+	go c.dispatchLoop(c.responses, c.lost)
 	return nil
 }
 
 // SetServer sets the server for this client (used by the factory).
+// Requests sent after SetServer connect the client on first use if Connect
+// has not been called.
 func (c *Client) SetServer(server *Server) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -64,34 +129,416 @@ func (c *Client) SetServer(server *Server) {
 }
 
 // Eval sends code to be evaluated and returns the result.
+// In a streaming session, output pushed during the evaluation is collected
+// into the result's Output.
 func (c *Client) Eval(ctx context.Context, code string) (*Result, error) {
-	c.mu.Lock()
-	msgID := atomic.AddUint64(&c.msgID, 1)
-	c.mu.Unlock()
+	return c.EvalStream(ctx, code, nil)
+}
+
+// EvalStream is like Eval but calls handle with every message the server
+// pushes before the final result, such as output chunks and "need-input"
+// requests in a streaming session. A nil handle collects output like Eval.
+// handle runs on the calling goroutine and may call other client methods,
+// such as SendInput.
+func (c *Client) EvalStream(ctx context.Context, code string, handle func(*Result)) (*Result, error) {
+	r, err := c.send(&protocol.Message{
+		Op:   "eval",
+		Code: code,
+	}, false)
+	if err != nil {
+		return nil, err
+	}
+	defer r.leave(c)
+
+	var output string
+	for {
+		resp, err := c.receive(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		if isTerminal(resp) {
+			result := c.messageToResult(resp)
+			result.Output = output + result.Output
+			if c.FailOnProtocolError && hasStatus(resp, []string{"error"}) {
+				return result, fmt.Errorf("server error: %s", resp.ProtocolError)
+			}
+			return result, nil
+		}
+		if handle != nil {
+			handle(c.messageToResult(resp))
+		} else {
+			output += resp.Output
+		}
+	}
+}
+
+// EvalAwait sends code to be evaluated and consumes the messages pushed
+// while it runs, accumulating their output, until one carries a status in
+// terminal. An empty terminal set means "done", "error" or "interrupted".
+// The result has the output of every message consumed and the value and
+// status of the last. If the request finishes without reaching a status in
+// terminal, that final result is returned with an error.
+func (c *Client) EvalAwait(ctx context.Context, code string, terminal ...string) (*Result, error) {
+	r, err := c.send(&protocol.Message{
+		Op:   "eval",
+		Code: code,
+	}, false)
+	if err != nil {
+		return nil, err
+	}
+	defer r.leave(c)
+
+	var output string
+	for {
+		resp, err := c.receive(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		output += resp.Output
+
+		reached := hasStatus(resp, terminal)
+		if reached || isTerminal(resp) {
+			result := c.messageToResult(resp)
+			result.Output = output
+			if !reached {
+				return result, fmt.Errorf("eval finished with status %v", resp.Status)
+			}
+			return result, nil
+		}
+	}
+}
+
+// Reset asks the server to restore its evaluation environment to the initial state.
+func (c *Client) Reset(ctx context.Context) error {
+	resp, err := c.roundTrip(ctx, &protocol.Message{
+		Op: "reset",
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, status := range resp.Status {
+		if status == "error" {
+			return fmt.Errorf("reset failed: %s", resp.ProtocolError)
+		}
+	}
+	return nil
+}
+
+// StartStreaming switches the client's session into streaming mode.
+// Evaluations then push output as it is produced and may ask for input,
+// which EvalStream surfaces and SendInput answers.
+func (c *Client) StartStreaming(ctx context.Context) error {
+	resp, err := c.roundTrip(ctx, &protocol.Message{
+		Op: "session-stream",
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, status := range resp.Status {
+		if status == "error" {
+			return fmt.Errorf("session-stream failed: %s", resp.ProtocolError)
+		}
+	}
+	return nil
+}
+
+// SendInput answers a "need-input" request from an evaluation in a
+// streaming session. Input may also be sent ahead of the request, and may
+// hold several lines; see operations.ReadLine.
+func (c *Client) SendInput(ctx context.Context, input string) error {
+	resp, err := c.roundTrip(ctx, &protocol.Message{
+		Op:   "stdin",
+		Data: map[string]interface{}{"input": input},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, status := range resp.Status {
+		if status == "error" {
+			return fmt.Errorf("stdin failed: %s", resp.ProtocolError)
+		}
+	}
+	return nil
+}
+
+// CloseInput ends the input of an evaluation in a streaming session: once
+// it has read the input sent so far, operations.ReadInput returns io.EOF.
+func (c *Client) CloseInput(ctx context.Context) error {
+	resp, err := c.roundTrip(ctx, &protocol.Message{
+		Op:   "stdin",
+		Data: map[string]interface{}{"eof": true},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, status := range resp.Status {
+		if status == "error" {
+			return fmt.Errorf("stdin failed: %s", resp.ProtocolError)
+		}
+	}
+	return nil
+}
+
+// Subscribe registers with the server to receive a copy of every evaluation
+// result produced in the given session. Each Result carries the observed
+// session's output, value and status; the original request ID is not exposed.
+// The session must have set the "observable" option unless it is the
+// client's own.
+//
+// The returned channel is closed when ctx is cancelled, which also removes
+// the subscription on the server, or when the server stops. Results that
+// arrive while the channel's buffer is full are dropped.
+func (c *Client) Subscribe(ctx context.Context, session string) (<-chan *Result, error) {
+	r, err := c.send(&protocol.Message{
+		Op:   "subscribe",
+		Data: map[string]interface{}{"session": session},
+	}, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// The first message is the server's acknowledgement
+	ack, err := c.receive(ctx, r)
+	if err != nil {
+		r.leave(c)
+		return nil, err
+	}
+	for _, status := range ack.Status {
+		if status == "error" {
+			r.leave(c)
+			return nil, fmt.Errorf("subscribe failed: %s", ack.ProtocolError)
+		}
+	}
 
-	// Create request message
+	results := make(chan *Result, subscriptionBuffer)
+	go func() {
+		defer close(results)
+		for {
+			select {
+			case msg := <-r.ch:
+				select {
+				case results <- c.messageToResult(msg):
+				default:
+				}
+			case <-r.lost:
+				return
+			case <-ctx.Done():
+				r.leave(c)
+				c.unsubscribe(r.id)
+				return
+			}
+		}
+	}()
+	return results, nil
+}
+
+// unsubscribe tells the server to drop a subscription. The server's reply is
+// not awaited, so it is discarded by the dispatch loop.
+func (c *Client) unsubscribe(id string) {
 	req := &protocol.Message{
-		Op:      "eval",
-		ID:      fmt.Sprintf("%d", msgID),
-		Session: c.clientID, // Use Session field to identify client
-		Code:    code,
+		Op:      "unsubscribe",
+		ID:      fmt.Sprintf("%d", atomic.AddUint64(&c.msgID, 1)),
+		Session: c.clientID,
+		Data:    map[string]interface{}{"subscription": id},
 	}
+	c.write(req)
+}
 
-	// Send request
-	if err := c.server.sendRequest(req); err != nil {
+// roundTrip sends req and waits for its final response.
+func (c *Client) roundTrip(ctx context.Context, req *protocol.Message) (*protocol.Message, error) {
+	r, err := c.send(req, false)
+	if err != nil {
+		return nil, err
+	}
+	defer r.leave(c)
+
+	for {
+		resp, err := c.receive(ctx, r)
+		if err != nil || isTerminal(resp) {
+			return resp, err
+		}
+	}
+}
+
+// send assigns a message ID and client session to req, registers a route
+// for its responses, and hands it to the server.
+func (c *Client) send(req *protocol.Message, stream bool) (*route, error) {
+	r, err := c.register(req, stream)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.write(req); err != nil {
+		r.leave(c)
 		return nil, err
 	}
+	return r, nil
+}
+
+// receive waits for the next message on r, for at most ResponseTimeout.
+func (c *Client) receive(ctx context.Context, r *route) (*protocol.Message, error) {
+	var timeout <-chan time.Time
+	if c.ResponseTimeout > 0 {
+		timer := time.NewTimer(c.ResponseTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
 
-	// Wait for response
 	select {
-	case resp := <-c.responses:
-		return messageToResult(resp), nil
+	case resp := <-r.ch:
+		return resp, nil
+	case <-r.lost:
+		// Messages that arrived before the server stopped come first
+		select {
+		case resp := <-r.ch:
+			return resp, nil
+		default:
+		}
+		return nil, fmt.Errorf("server stopped")
 	case <-ctx.Done():
 		return nil, ctx.Err()
+	case <-timeout:
+		return nil, fmt.Errorf("no response within %v", c.ResponseTimeout)
+	}
+}
+
+// register assigns a message ID and client session to req and creates the
+// route for its responses.
+func (c *Client) register(req *protocol.Message, stream bool) (*route, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.server == nil {
+		return nil, fmt.Errorf("not connected")
+	}
+	if c.pending == nil {
+		// SetServer without Connect; register before the request is sent,
+		// so that its response has somewhere to go
+		if err := c.attach(); err != nil {
+			return nil, fmt.Errorf("connect to in-process server: %w", err)
+		}
+	}
+
+	msgID := atomic.AddUint64(&c.msgID, 1)
+	req.ID = fmt.Sprintf("%d", msgID)
+	req.Session = c.clientID // Use Session field to identify client
+
+	r := &route{
+		id:     req.ID,
+		ch:     make(chan *protocol.Message, routeBuffer),
+		stream: stream,
+		lost:   c.lost,
+		gone:   make(chan struct{}),
+	}
+	c.pending[req.ID] = r
+	return r, nil
+}
+
+// leave removes the route and releases a dispatch loop blocked delivering to it.
+func (r *route) leave(c *Client) {
+	r.once.Do(func() {
+		c.mu.Lock()
+		if c.pending[r.id] == r {
+			delete(c.pending, r.id)
+		}
+		c.mu.Unlock()
+		close(r.gone)
+	})
+}
+
+// write hands a request to the server.
+func (c *Client) write(req *protocol.Message) error {
+	c.mu.Lock()
+	server := c.server
+	c.mu.Unlock()
+	if server == nil {
+		return fmt.Errorf("not connected")
+	}
+	c.record("request", req)
+	return server.sendRequest(req)
+}
+
+// record appends msg to TranscriptWriter, if one is set. Failures to write
+// the transcript do not affect the client.
+func (c *Client) record(direction string, msg *protocol.Message) {
+	if c.TranscriptWriter == nil {
+		return
+	}
+	c.transcriptMu.Lock()
+	defer c.transcriptMu.Unlock()
+	protocol.WriteTranscript(c.TranscriptWriter, direction, msg)
+}
+
+// dispatchLoop routes messages from the server to callers by ID until the
+// response channel closes. Messages with no waiting caller are discarded.
+func (c *Client) dispatchLoop(responses chan *protocol.Message, lost chan struct{}) {
+	for msg := range responses {
+		c.record("response", msg)
+		c.dispatch(msg)
+	}
+	close(lost)
+}
+
+// dispatch delivers msg to the caller waiting on its ID. Request callers
+// that fall behind are waited for, so their messages are never dropped;
+// subscriptions drop messages when full rather than stall the client.
+func (c *Client) dispatch(msg *protocol.Message) {
+	c.mu.Lock()
+	r, exists := c.pending[msg.ID]
+	if exists && !r.stream && isTerminal(msg) {
+		delete(c.pending, msg.ID)
+	}
+	c.mu.Unlock()
+	if !exists {
+		return
+	}
+
+	if r.stream {
+		select {
+		case r.ch <- msg:
+		default:
+		}
+		return
+	}
+	select {
+	case r.ch <- msg:
+	case <-r.gone:
 	}
 }
 
+// isTerminal reports whether msg is the final response to its request,
+// as opposed to output or an input request pushed while it runs.
+func isTerminal(msg *protocol.Message) bool {
+	for _, status := range msg.Status {
+		switch status {
+		case "done", "error", "interrupted":
+			return true
+		}
+	}
+	return false
+}
+
+// hasStatus reports whether msg carries one of statuses, or whether it is
+// terminal if statuses is empty.
+func hasStatus(msg *protocol.Message, statuses []string) bool {
+	if len(statuses) == 0 {
+		return isTerminal(msg)
+	}
+	for _, status := range msg.Status {
+		for _, want := range statuses {
+			if status == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Close closes the client connection.
+// It is idempotent and safe to call after the server has stopped.
 func (c *Client) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -99,6 +546,7 @@ func (c *Client) Close() error {
 	if c.server != nil {
 		c.server.unregisterClient(c.clientID)
 		c.server = nil
+		c.pending = nil
 	}
 	return nil
 }
@@ -111,11 +559,16 @@ type Result struct {
 	Status []string
 }
 
-// messageToResult converts a protocol.Message to a Result.
-func messageToResult(msg *protocol.Message) *Result {
+// messageToResult converts a protocol.Message to a Result, passing its
+// value through ValueUnmarshaler.
+func (c *Client) messageToResult(msg *protocol.Message) *Result {
+	value := msg.Value
+	if c.ValueUnmarshaler != nil && value != nil {
+		value = c.ValueUnmarshaler(value)
+	}
 	return &Result{
 		ID:     msg.ID,
-		Value:  msg.Value,
+		Value:  value,
 		Output: msg.Output,
 		Status: msg.Status,
 	}
@@ -3,8 +3,14 @@ package inprocess
 import (
 	"context"
 	"fmt"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/zylisp/repl/operations"
+	"github.com/zylisp/repl/protocol"
 )
 
 // mockEvaluator is a simple evaluator for testing
@@ -28,6 +34,42 @@ func mockEvaluator(code string) (interface{}, string, error) {
 	}
 }
 
+// statefulEvaluator remembers "(define name value)" forms until reset.
+type statefulEvaluator struct {
+	mu   sync.Mutex
+	vars map[string]interface{}
+}
+
+func newStatefulEvaluator() *statefulEvaluator {
+	return &statefulEvaluator{vars: make(map[string]interface{})}
+}
+
+func (e *statefulEvaluator) eval(code string) (interface{}, string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var name string
+	var value float64
+	if n, _ := fmt.Sscanf(code, "(define %s %g)", &name, &value); n == 2 {
+		e.vars[name] = value
+		return value, "", nil
+	}
+
+	if v, ok := e.vars[code]; ok {
+		return v, "", nil
+	}
+	return map[string]interface{}{
+		"error": "undefined variable: " + code,
+	}, "", nil
+}
+
+func (e *statefulEvaluator) reset() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.vars = make(map[string]interface{})
+	return nil
+}
+
 func TestInProcessServerClient(t *testing.T) {
 	// Create server
 	server := NewServer(mockEvaluator)
@@ -247,3 +289,669 @@ func TestClientContextCancellation(t *testing.T) {
 		t.Errorf("Expected DeadlineExceeded, got %v", err)
 	}
 }
+
+func TestClientReset(t *testing.T) {
+	evaluator := newStatefulEvaluator()
+	server := NewServer(evaluator.eval)
+	server.Handler().Resetter = evaluator.reset
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	client := NewClient()
+	client.SetServer(server)
+	if err := client.Connect(context.Background(), server); err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.Eval(context.Background(), "(define x 42)"); err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+
+	result, err := client.Eval(context.Background(), "x")
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	if result.Value != float64(42) {
+		t.Fatalf("Expected value 42 before reset, got %v", result.Value)
+	}
+
+	if err := client.Reset(context.Background()); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+
+	result, err = client.Eval(context.Background(), "x")
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	if _, ok := result.Value.(map[string]interface{}); !ok {
+		t.Errorf("Expected x to be undefined after reset, got %v", result.Value)
+	}
+}
+
+func TestClientResetUnsupported(t *testing.T) {
+	server := NewServer(mockEvaluator)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	client := NewClient()
+	client.SetServer(server)
+	if err := client.Connect(context.Background(), server); err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.Reset(context.Background()); err == nil {
+		t.Error("Expected error when server has no resetter, got nil")
+	}
+}
+
+func TestServerStopWithStuckHandler(t *testing.T) {
+	release := make(chan struct{})
+	stuckEvaluator := func(code string) (interface{}, string, error) {
+		<-release
+		return nil, "", nil
+	}
+
+	server := NewServer(stuckEvaluator)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	client := NewClient()
+	client.SetServer(server)
+	if err := client.Connect(context.Background(), server); err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer client.Close()
+
+	// Leave a handler blocked inside the evaluator
+	evalDone := make(chan error, 1)
+	go func() {
+		_, err := client.Eval(context.Background(), "(stuck)")
+		evalDone <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	cancel()
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer stopCancel()
+
+	start := time.Now()
+	if err := server.Stop(stopCtx); err != context.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Stop took %v, expected it to return by the deadline", elapsed)
+	}
+
+	// The client's response channel was closed, so its Eval must not hang
+	select {
+	case err := <-evalDone:
+		if err == nil {
+			t.Error("Expected Eval to fail after server stop")
+		}
+	case <-time.After(time.Second):
+		t.Error("Eval did not return after server stop")
+	}
+
+	// Repeated Stop calls must not accumulate waiter goroutines
+	before := runtime.NumGoroutine()
+	for i := 0; i < 5; i++ {
+		expired, expiredCancel := context.WithTimeout(context.Background(), time.Millisecond)
+		server.Stop(expired)
+		expiredCancel()
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Goroutines grew from %d to %d across repeated Stop calls", before, after)
+	}
+
+	// Once the evaluator returns, Stop completes
+	close(release)
+	finalCtx, finalCancel := context.WithTimeout(context.Background(), time.Second)
+	defer finalCancel()
+	if err := server.Stop(finalCtx); err != nil {
+		t.Errorf("Expected Stop to succeed after release, got %v", err)
+	}
+}
+
+func TestClientSubscribe(t *testing.T) {
+	server := NewServer(mockEvaluator)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	connect := func() *Client {
+		client := NewClient()
+		if err := client.Connect(context.Background(), server); err != nil {
+			t.Fatalf("Failed to connect client: %v", err)
+		}
+		return client
+	}
+
+	evaluator := connect()
+	defer evaluator.Close()
+	if _, err := evaluator.roundTrip(context.Background(), &protocol.Message{
+		Op:   "set-option",
+		Data: map[string]interface{}{"key": "observable", "value": true},
+	}); err != nil {
+		t.Fatalf("Failed to allow observers: %v", err)
+	}
+
+	// Two observers subscribe to the evaluating client's session
+	subCtx, subCancel := context.WithCancel(context.Background())
+	defer subCancel()
+
+	var streams []<-chan *Result
+	for i := 0; i < 2; i++ {
+		observer := connect()
+		defer observer.Close()
+
+		results, err := observer.Subscribe(subCtx, evaluator.clientID)
+		if err != nil {
+			t.Fatalf("Subscribe failed: %v", err)
+		}
+		streams = append(streams, results)
+	}
+
+	if _, err := evaluator.Eval(context.Background(), "(println \"hello\")"); err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+
+	for i, results := range streams {
+		select {
+		case result := <-results:
+			if result.Output != "hello\n" {
+				t.Errorf("Subscriber %d: expected output %q, got %q", i, "hello\n", result.Output)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Subscriber %d received nothing", i)
+		}
+	}
+
+	// Cancelling the context unsubscribes and closes the channels
+	subCancel()
+	for i, results := range streams {
+		select {
+		case _, ok := <-results:
+			if ok {
+				t.Errorf("Subscriber %d: expected closed channel", i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Subscriber %d channel not closed", i)
+		}
+	}
+}
+
+func TestClientConnectCancelledOrNotRunning(t *testing.T) {
+	server := NewServer(mockEvaluator)
+
+	// Not started yet
+	if err := NewClient().Connect(context.Background(), server); err == nil {
+		t.Error("Expected Connect to fail before the server starts")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		server.Start(ctx)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	cancelled, cancelConnect := context.WithCancel(context.Background())
+	cancelConnect()
+	if err := NewClient().Connect(cancelled, server); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	// Stopped
+	cancel()
+	server.Stop(context.Background())
+	if err := NewClient().Connect(context.Background(), server); err == nil {
+		t.Error("Expected Connect to fail after the server stops")
+	}
+}
+
+func TestClientSessionStream(t *testing.T) {
+	server := NewServer(mockEvaluator)
+	server.Handler().ContextEvaluator = func(ctx context.Context, code string) (interface{}, string, error) {
+		operations.WriteOutput(ctx, "name? ")
+		name, err := operations.ReadInput(ctx)
+		if err != nil {
+			return nil, "", err
+		}
+		return "hello " + name, "", nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	client := NewClient()
+	if err := client.Connect(context.Background(), server); err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.StartStreaming(context.Background()); err != nil {
+		t.Fatalf("StartStreaming failed: %v", err)
+	}
+
+	var outputs []string
+	result, err := client.EvalStream(context.Background(), "(greet)", func(msg *Result) {
+		if len(msg.Status) > 0 && msg.Status[0] == "need-input" {
+			if err := client.SendInput(context.Background(), "zy"); err != nil {
+				t.Errorf("SendInput failed: %v", err)
+			}
+			return
+		}
+		outputs = append(outputs, msg.Output)
+	})
+	if err != nil {
+		t.Fatalf("EvalStream failed: %v", err)
+	}
+	if result.Value != "hello zy" {
+		t.Errorf("Expected value %q, got %v", "hello zy", result.Value)
+	}
+	if len(outputs) != 1 || outputs[0] != "name? " {
+		t.Errorf("Unexpected streamed output %q", outputs)
+	}
+}
+
+func TestServerCodecCoercion(t *testing.T) {
+	intEvaluator := func(code string) (interface{}, string, error) {
+		return 3, "", nil
+	}
+
+	for _, codec := range []string{"", "json"} {
+		server := NewServer(intEvaluator)
+		server.Codec = codec
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			server.Start(ctx)
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		client := NewClient()
+		if err := client.Connect(context.Background(), server); err != nil {
+			t.Fatalf("Failed to connect client: %v", err)
+		}
+
+		result, err := client.Eval(context.Background(), "(+ 1 2)")
+		if err != nil {
+			t.Fatalf("Eval failed: %v", err)
+		}
+
+		var want interface{} = 3
+		if codec == "json" {
+			want = float64(3)
+		}
+		if result.Value != want {
+			t.Errorf("codec %q: expected %T %v, got %T %v", codec, want, want, result.Value, result.Value)
+		}
+
+		client.Close()
+		cancel()
+	}
+}
+
+func TestClientCloseIdempotent(t *testing.T) {
+	server := NewServer(mockEvaluator)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	client := NewClient()
+	if err := client.Connect(context.Background(), server); err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+
+	server.Stop(context.Background())
+	for i := 0; i < 2; i++ {
+		if err := client.Close(); err != nil {
+			t.Errorf("Close %d failed: %v", i+1, err)
+		}
+	}
+	if _, err := client.Eval(context.Background(), "(+ 1 2)"); err == nil {
+		t.Error("Expected Eval to fail after Close")
+	}
+}
+
+func TestClientEvalAwait(t *testing.T) {
+	server := NewServer(mockEvaluator)
+	server.Handler().ContextEvaluator = func(ctx context.Context, code string) (interface{}, string, error) {
+		operations.WriteOutput(ctx, "one\n")
+		operations.WriteOutput(ctx, "two\n")
+		return code, "", nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	client := NewClient()
+	if err := client.Connect(context.Background(), server); err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.StartStreaming(context.Background()); err != nil {
+		t.Fatalf("StartStreaming failed: %v", err)
+	}
+
+	result, err := client.EvalAwait(context.Background(), "(run)")
+	if err != nil {
+		t.Fatalf("EvalAwait failed: %v", err)
+	}
+	if result.Value != "(run)" || result.Output != "one\ntwo\n" {
+		t.Errorf("Expected value (run) with output %q, got %v %q", "one\ntwo\n", result.Value, result.Output)
+	}
+	if len(result.Status) == 0 || result.Status[0] != "done" {
+		t.Errorf("Expected status done, got %v", result.Status)
+	}
+}
+
+func TestClientEvalStringify(t *testing.T) {
+	server := NewServer(func(code string) (interface{}, string, error) {
+		return 3, "", nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	client := NewClient()
+	if err := client.Connect(context.Background(), server); err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer client.Close()
+
+	resp, err := client.roundTrip(context.Background(), &protocol.Message{
+		Op:   "eval",
+		Code: "(+ 1 2)",
+		Data: map[string]interface{}{"stringify": true},
+	})
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	if resp.Value != "3" {
+		t.Errorf("Expected string \"3\", got %T %v", resp.Value, resp.Value)
+	}
+}
+
+func TestClientFailOnProtocolError(t *testing.T) {
+	server := NewServer(mockEvaluator)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	for _, fail := range []bool{false, true} {
+		client := NewClient()
+		client.FailOnProtocolError = fail
+		if err := client.Connect(context.Background(), server); err != nil {
+			t.Fatalf("Failed to connect client: %v", err)
+		}
+
+		// An eval without code is a protocol error
+		result, err := client.Eval(context.Background(), "")
+		if result == nil || len(result.Status) == 0 || result.Status[0] != "error" {
+			t.Errorf("fail=%v: expected an error result, got %+v", fail, result)
+		}
+		if fail && err == nil {
+			t.Error("Expected an error with FailOnProtocolError")
+		}
+		if !fail && err != nil {
+			t.Errorf("Expected no error by default, got %v", err)
+		}
+		client.Close()
+	}
+}
+
+func TestServerNilEvaluator(t *testing.T) {
+	server := NewServer(nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	client := NewClient()
+	if err := client.Connect(context.Background(), server); err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer client.Close()
+
+	result, err := client.Eval(context.Background(), "(+ 1 2)")
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	if len(result.Status) == 0 || result.Status[0] != "error" {
+		t.Errorf("Expected an error status without an evaluator, got %v", result.Status)
+	}
+}
+
+func TestClientEvalWithoutConnect(t *testing.T) {
+	server := NewServer(mockEvaluator)
+
+	// Before the server runs, Eval reports it rather than losing the request
+	client := NewClient()
+	client.SetServer(server)
+	if _, err := client.Eval(context.Background(), "(+ 1 2)"); err == nil || !strings.Contains(err.Error(), "not started") {
+		t.Errorf("Expected a server not started error, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	// Concurrent first requests all register the client before sending
+	client = NewClient()
+	client.SetServer(server)
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			evalCtx, evalCancel := context.WithTimeout(context.Background(), time.Second)
+			defer evalCancel()
+
+			result, err := client.Eval(evalCtx, "(+ 1 2)")
+			if err != nil {
+				t.Errorf("Eval failed: %v", err)
+				return
+			}
+			if result.Value != float64(3) {
+				t.Errorf("Expected value 3, got %v", result.Value)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestServerDisconnectsSlowClient(t *testing.T) {
+	server := NewServer(mockEvaluator)
+	server.WriteTimeout = 50 * time.Millisecond
+	server.ResponseBuffer = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	// A client that never reads its responses
+	slow, err := server.registerClient("slow")
+	if err != nil {
+		t.Fatalf("registerClient failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		server.sendRequest(&protocol.Message{Op: "eval", ID: fmt.Sprint(i), Session: "slow", Code: "(+ 1 2)"})
+	}
+
+	client := NewClient()
+	if err := client.Connect(context.Background(), server); err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer client.Close()
+
+	evalCtx, evalCancel := context.WithTimeout(context.Background(), time.Second)
+	defer evalCancel()
+	result, err := client.Eval(evalCtx, "(+ 1 2)")
+	if err != nil {
+		t.Fatalf("Eval stalled behind the slow client: %v", err)
+	}
+	if result.Value != float64(3) {
+		t.Errorf("Expected value 3, got %v", result.Value)
+	}
+
+	// The slow client was disconnected: its channel is closed after the
+	// response that fit in its buffer
+	<-slow
+	if _, ok := <-slow; ok {
+		t.Error("Expected the slow client's channel to be closed")
+	}
+}
+
+func TestServerDisconnectsFullClientWithoutWaiting(t *testing.T) {
+	server := NewServer(mockEvaluator)
+	server.ResponseBuffer = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	slow, err := server.registerClient("slow")
+	if err != nil {
+		t.Fatalf("registerClient failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		server.sendRequest(&protocol.Message{Op: "eval", ID: fmt.Sprint(i), Session: "slow", Code: "(+ 1 2)"})
+	}
+
+	// Without WriteTimeout the overflowing response disconnects the client
+	// at once rather than stalling the server
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-slow:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the first response in the slow client's buffer")
+	}
+	select {
+	case _, ok := <-slow:
+		if ok {
+			t.Error("Expected the slow client's channel to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the slow client to be disconnected")
+	}
+}
+
+func TestControlOpDoesNotWaitOnCallersBuffer(t *testing.T) {
+	server := NewServer(mockEvaluator)
+	server.WriteTimeout = 10 * time.Second
+	server.ResponseBuffer = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	full, err := server.registerClient("full")
+	if err != nil {
+		t.Fatalf("registerClient failed: %v", err)
+	}
+	server.sendRequest(&protocol.Message{Op: "ping", ID: "1", Session: "full"})
+
+	// The caller's buffer is full and only the caller would drain it
+	returned := make(chan struct{})
+	go func() {
+		server.sendRequest(&protocol.Message{Op: "ping", ID: "2", Session: "full"})
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("Expected a control op to return instead of waiting on its caller's buffer")
+	}
+
+	<-full
+	if _, ok := <-full; ok {
+		t.Error("Expected the client to be disconnected when its control response did not fit")
+	}
+}
@@ -1,9 +1,11 @@
 package inprocess
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/zylisp/repl/operations"
 	"github.com/zylisp/repl/protocol"
@@ -12,28 +14,69 @@ import (
 // Server implements an in-process REPL server using Go channels for message passing.
 // This provides zero-overhead communication for testing and embedded use cases.
 type Server struct {
+	// Codec, if set, names a codec ("json" or "msgpack") that every message
+	// delivered to clients is round-tripped through, so that values are
+	// coerced as they would be over a network transport (for example, JSON
+	// turns integers into float64). Empty means values are passed unchanged.
+	Codec string
+
+	// WriteTimeout bounds how long delivering a single response to a client
+	// may wait for room in its buffer. A client that stops reading is
+	// disconnected once it expires, so that it does not stall the requests
+	// of other clients. Zero means a client whose buffer is full is
+	// disconnected at once. Responses to control operations, which are
+	// handled on the client's own goroutine, never wait.
+	WriteTimeout time.Duration
+
+	// ResponseBuffer is how many responses a client may have waiting to be
+	// read. Zero means defaultResponseBuffer.
+	ResponseBuffer int
+
+	// GracePeriod bounds how long Stop waits for handlers to finish when its
+	// context has no deadline. Zero means waiting until they finish.
+	GracePeriod time.Duration
+
 	handler  *operations.Handler
 	requests chan *protocol.Message
-	clients  map[string]chan *protocol.Message // clientID -> response channel
+	clients  map[string]*clientConn // clientID -> connected client
 	mu       sync.RWMutex
 	ctx      context.Context
 	cancel   context.CancelFunc
 	wg       sync.WaitGroup
+	doneOnce sync.Once
+	done     chan struct{}
+
+	shutdownHooks []func() // registered by OnShutdown
+	shutdownOnce  sync.Once
+}
+
+// defaultResponseBuffer is the response buffer of each client when
+// ResponseBuffer is not set.
+const defaultResponseBuffer = 256
+
+// clientConn is a connected client's response channel.
+type clientConn struct {
+	responses chan *protocol.Message
+	closing   chan struct{}  // closed once the client is removed
+	senders   sync.WaitGroup // deliveries in progress; responses closes after them
 }
 
 // NewServer creates a new in-process REPL server.
+// A nil evaluator makes evaluations fail with operations.ErrNoEvaluator.
 func NewServer(evaluator operations.EvaluatorFunc) *Server {
 	return &Server{
 		handler:  operations.NewHandler(evaluator),
 		requests: make(chan *protocol.Message, 100),
-		clients:  make(map[string]chan *protocol.Message),
+		clients:  make(map[string]*clientConn),
 	}
 }
 
 // Start begins processing requests.
 // It blocks until the context is cancelled.
 func (s *Server) Start(ctx context.Context) error {
+	s.mu.Lock()
 	s.ctx, s.cancel = context.WithCancel(ctx)
+	s.mu.Unlock()
 
 	s.wg.Add(1)
 	go s.processRequests()
@@ -44,32 +87,101 @@ func (s *Server) Start(ctx context.Context) error {
 }
 
 // Stop gracefully shuts down the server.
+// It closes every client response channel so that waiting clients return
+// immediately, then waits for the processing goroutine within the context
+// deadline, or GracePeriod if ctx has none. In-flight evaluations are
+// interrupted, so context-aware evaluators return promptly. A request
+// blocked inside any other evaluator cannot be forcibly stopped: if the
+// deadline passes first, Stop returns ctx.Err() and the processing goroutine
+// exits once the evaluator returns. Repeated Stop calls share a single
+// waiter goroutine, so the residual leak does not grow.
 func (s *Server) Stop(ctx context.Context) error {
 	if s.cancel != nil {
 		s.cancel()
 	}
+	s.handler.InterruptAll()
 
 	// Close all client response channels
 	s.mu.Lock()
-	for _, ch := range s.clients {
-		close(ch)
+	clients := s.clients
+	s.clients = make(map[string]*clientConn)
+	for _, conn := range clients {
+		close(conn.closing)
 	}
-	s.clients = make(map[string]chan *protocol.Message)
 	s.mu.Unlock()
+	for _, conn := range clients {
+		conn.finish()
+	}
 
-	// Wait for processing goroutine to finish
-	done := make(chan struct{})
-	go func() {
-		s.wg.Wait()
-		close(done)
-	}()
+	// Without a deadline from the caller, wait at most GracePeriod
+	if _, ok := ctx.Deadline(); !ok && s.GracePeriod > 0 {
+		var cancelWait context.CancelFunc
+		ctx, cancelWait = context.WithTimeout(ctx, s.GracePeriod)
+		defer cancelWait()
+	}
 
+	// Wait for processing goroutine to finish
+	var err error
 	select {
-	case <-done:
-		return nil
+	case <-s.waitDone():
 	case <-ctx.Done():
-		return ctx.Err()
+		err = ctx.Err()
 	}
+
+	s.runShutdownHooks()
+	return err
+}
+
+// OnShutdown registers hook to be run by Stop once clients are disconnected,
+// before Stop returns. Hooks run once, in registration order.
+func (s *Server) OnShutdown(hook func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shutdownHooks = append(s.shutdownHooks, hook)
+}
+
+// runShutdownHooks runs the hooks registered with OnShutdown the first time
+// it is called.
+func (s *Server) runShutdownHooks() {
+	s.shutdownOnce.Do(func() {
+		s.mu.RLock()
+		hooks := s.shutdownHooks
+		s.mu.RUnlock()
+		for _, hook := range hooks {
+			hook()
+		}
+	})
+}
+
+// waitDone returns a channel that is closed once the processing goroutine has exited.
+func (s *Server) waitDone() <-chan struct{} {
+	s.doneOnce.Do(func() {
+		s.done = make(chan struct{})
+		go func() {
+			s.wg.Wait()
+			close(s.done)
+		}()
+	})
+	return s.done
+}
+
+// Handler returns the operation handler used by this server.
+// It can be used to configure optional behavior before the server is started.
+func (s *Server) Handler() *operations.Handler {
+	return s.handler
+}
+
+// Drain stops the server from accepting new evaluations while it keeps
+// answering other requests; see operations.Handler.Drain. Call Stop to shut
+// the server down once clients have moved away.
+func (s *Server) Drain() {
+	s.handler.Drain()
+}
+
+// Sessions returns a snapshot of every session's activity; see
+// operations.Handler.Sessions.
+func (s *Server) Sessions() []operations.SessionInfo {
+	return s.handler.Sessions()
 }
 
 // Addr returns the address (always "in-process" for this transport).
@@ -90,60 +202,224 @@ func (s *Server) processRequests() {
 				return
 			}
 
-			// Get client ID from the request
-			// For in-process, we use the Session field to identify the client
-			clientID := req.Session
-			if clientID == "" {
-				// Skip requests without client ID
-				continue
+			if err := s.handle(req, true); err == errServerStopped {
+				return
 			}
+		}
+	}
+}
 
-			// Process the request
-			resp := s.handler.Handle(req)
+// handle processes a request and delivers the response to its client.
+// Unless wait is set, deliveries never wait for room in the client's buffer.
+func (s *Server) handle(req *protocol.Message, wait bool) error {
+	// Get client ID from the request
+	// For in-process, we use the Session field to identify the client
+	clientID := req.Session
+	if clientID == "" {
+		// Skip requests without client ID
+		return nil
+	}
 
-			// Send response to the client
-			s.mu.RLock()
-			respChan, exists := s.clients[clientID]
-			s.mu.RUnlock()
+	// Process the request
+	ctx := operations.WithSender(s.ctx, func(msg *protocol.Message) error {
+		return s.deliver(clientID, msg, wait)
+	})
+	ctx = operations.WithConnInfo(ctx, operations.ConnInfo{Transport: "in-process"})
+	resp := s.handler.HandleContext(ctx, req)
 
-			if exists {
-				select {
-				case respChan <- resp:
-				case <-s.ctx.Done():
-					return
-				}
-			}
+	// Send response to the client
+	err := s.deliver(clientID, resp, wait)
+	if err != nil && err != errServerStopped {
+		s.handler.Log().Warn("dropped response",
+			"client", clientID, "id", resp.ID, "error", err)
+	}
+	return err
+}
+
+// errServerStopped is returned when the server stops before a delivery completes.
+var errServerStopped = fmt.Errorf("server stopped")
+
+// errServerNotStarted is returned when a client connects before Start.
+var errServerNotStarted = fmt.Errorf("server not started")
+
+// errClientTooSlow is returned when a client is disconnected because its
+// response buffer was full.
+var errClientTooSlow = fmt.Errorf("client stopped reading responses")
+
+// errClientGone is returned when a client disconnects during a delivery.
+var errClientGone = fmt.Errorf("client disconnected")
+
+// deliver sends msg to the response channel of the given client. If the
+// channel is full and wait is set, it waits up to WriteTimeout for room;
+// otherwise, or once that expires, the client is disconnected. No server
+// lock is held while waiting.
+func (s *Server) deliver(clientID string, msg *protocol.Message, wait bool) error {
+	if s.Codec != "" {
+		msg = s.coerce(msg)
+	}
+
+	s.mu.RLock()
+	conn, exists := s.clients[clientID]
+	if exists {
+		// Keeps the channel open until this delivery is over
+		conn.senders.Add(1)
+	}
+	s.mu.RUnlock()
+	if !exists {
+		return fmt.Errorf("client %q not connected", clientID)
+	}
+
+	err := s.send(conn, msg, wait)
+	conn.senders.Done()
+	if err == errClientTooSlow {
+		s.disconnect(clientID, conn)
+	}
+	return err
+}
+
+// send puts msg on conn's response channel. The caller must have counted
+// itself in conn.senders.
+func (s *Server) send(conn *clientConn, msg *protocol.Message, wait bool) error {
+	select {
+	case conn.responses <- msg:
+		return nil
+	default:
+	}
+	if !wait || s.WriteTimeout <= 0 {
+		return errClientTooSlow
+	}
+
+	timer := time.NewTimer(s.WriteTimeout)
+	defer timer.Stop()
+	select {
+	case conn.responses <- msg:
+		return nil
+	case <-conn.closing:
+		return errClientGone
+	case <-s.ctx.Done():
+		return errServerStopped
+	case <-timer.C:
+		return errClientTooSlow
+	}
+}
+
+// disconnect removes a client that stopped reading, closing its response
+// channel so that its waiting callers return. It does nothing if the client
+// has since reconnected with a new channel.
+func (s *Server) disconnect(clientID string, conn *clientConn) {
+	if s.removeClient(clientID, conn) {
+		s.handler.CloseSession(clientID)
+	}
+}
+
+// removeClient removes conn if it is still the given client's connection,
+// and closes its response channel once deliveries to it have returned.
+func (s *Server) removeClient(clientID string, conn *clientConn) bool {
+	s.mu.Lock()
+	if s.clients[clientID] != conn {
+		s.mu.Unlock()
+		return false
+	}
+	delete(s.clients, clientID)
+	close(conn.closing)
+	s.mu.Unlock()
+
+	conn.finish()
+	return true
+}
+
+// finish closes the response channel once every delivery has returned.
+// conn.closing must already be closed.
+func (conn *clientConn) finish() {
+	conn.senders.Wait()
+	close(conn.responses)
+}
+
+// coerce round-trips msg through the configured codec. If that fails, the
+// client receives an error response instead.
+func (s *Server) coerce(msg *protocol.Message) *protocol.Message {
+	var buf bytes.Buffer
+	codec, err := protocol.NewCodec(s.Codec, nopCloser{&buf})
+	if err == nil {
+		err = codec.Encode(msg)
+	}
+	if err == nil {
+		decoded := &protocol.Message{}
+		if err = codec.Decode(decoded); err == nil {
+			return decoded
 		}
 	}
+
+	return &protocol.Message{
+		ID:            msg.ID,
+		Session:       msg.Session,
+		Status:        []string{"error"},
+		ProtocolError: fmt.Sprintf("failed to encode response: %v", err),
+	}
 }
 
+// nopCloser adds a no-op Close to an in-memory buffer for use as a codec stream.
+type nopCloser struct {
+	*bytes.Buffer
+}
+
+func (nopCloser) Close() error { return nil }
+
 // registerClient registers a new client and returns its response channel.
-func (s *Server) registerClient(clientID string) chan *protocol.Message {
+// It fails if the server has not been started or has stopped.
+func (s *Server) registerClient(clientID string) (chan *protocol.Message, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	respChan := make(chan *protocol.Message, 10)
-	s.clients[clientID] = respChan
-	return respChan
+	if s.ctx == nil {
+		return nil, errServerNotStarted
+	}
+	if s.ctx.Err() != nil {
+		return nil, errServerStopped
+	}
+
+	size := s.ResponseBuffer
+	if size <= 0 {
+		size = defaultResponseBuffer
+	}
+	conn := &clientConn{
+		responses: make(chan *protocol.Message, size),
+		closing:   make(chan struct{}),
+	}
+	s.clients[clientID] = conn
+	return conn.responses, nil
 }
 
 // unregisterClient removes a client.
 func (s *Server) unregisterClient(clientID string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.mu.RLock()
+	conn := s.clients[clientID]
+	s.mu.RUnlock()
 
-	if ch, exists := s.clients[clientID]; exists {
-		close(ch)
-		delete(s.clients, clientID)
+	if conn != nil {
+		s.removeClient(clientID, conn)
 	}
+	s.handler.CloseSession(clientID)
 }
 
 // sendRequest sends a request from a client to the server.
+// Control operations are handled on the caller's goroutine so that they
+// reach an evaluation that is waiting on them, as on a streaming connection.
+// Their responses never wait for room in the caller's buffer, since the
+// caller may be the one that would drain it.
 func (s *Server) sendRequest(req *protocol.Message) error {
+	if operations.IsControlOp(req.Op) {
+		if err := s.ctx.Err(); err != nil {
+			return errServerStopped
+		}
+		s.handle(req, false)
+		return nil
+	}
+
 	select {
 	case s.requests <- req:
 		return nil
 	case <-s.ctx.Done():
-		return fmt.Errorf("server stopped")
+		return errServerStopped
 	}
 }
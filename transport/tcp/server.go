@@ -2,16 +2,51 @@ package tcp
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/zylisp/repl/operations"
 	"github.com/zylisp/repl/protocol"
 )
 
+var connIDCounter uint64
+
+// streamQueueSize is how many requests a streaming connection reads ahead
+// of the request being evaluated.
+const streamQueueSize = 64
+
 // Server implements a TCP REPL server.
 type Server struct {
+	// WriteTimeout bounds how long writing a single response may take.
+	// A client that stops reading is disconnected once it expires.
+	// Zero means no timeout.
+	WriteTimeout time.Duration
+
+	// RateLimit bounds how fast each connection may send requests, and
+	// optionally closes connections that keep exceeding it.
+	RateLimit operations.RateLimit
+
+	// ReadBufferSize sizes the buffer each connection's requests are read
+	// through. A larger buffer reads pipelined requests in fewer system
+	// calls. Zero means the codec's default of 4096 bytes. Responses need no
+	// buffering: each is written with a single write.
+	ReadBufferSize int
+
+	// GracePeriod bounds how long Stop waits for handlers to finish when its
+	// context has no deadline. Zero means waiting until they finish.
+	GracePeriod time.Duration
+
+	// Compressions lists the compressions the server agrees to when a client
+	// offers them in a "describe" request, in order of preference. Nil means
+	// connections are never compressed.
+	Compressions []string
+
 	addr     string
 	codec    string
 	handler  *operations.Handler
@@ -21,9 +56,29 @@ type Server struct {
 	ctx      context.Context
 	cancel   context.CancelFunc
 	wg       sync.WaitGroup
+	doneOnce sync.Once
+	done     chan struct{}
+	stats    ConnStats
+
+	shutdownHooks []func() // registered by OnShutdown
+	shutdownOnce  sync.Once
+}
+
+// ConnStats counts how connections ended.
+type ConnStats struct {
+	// Disconnects counts connections closed by the client or by Stop.
+	Disconnects uint64
+
+	// DecodeErrors counts connections dropped because a request could not be read.
+	DecodeErrors uint64
+
+	// EncodeErrors counts connections dropped because a response could not be
+	// written. Each one is a response the client never received.
+	EncodeErrors uint64
 }
 
 // NewServer creates a new TCP REPL server.
+// A nil evaluator makes evaluations fail with operations.ErrNoEvaluator.
 func NewServer(addr string, codec string, evaluator operations.EvaluatorFunc) *Server {
 	return &Server{
 		addr:    addr,
@@ -34,36 +89,60 @@ func NewServer(addr string, codec string, evaluator operations.EvaluatorFunc) *S
 }
 
 // Start begins listening for connections on the TCP port.
+// It binds the server's address and then behaves like Serve.
 func (s *Server) Start(ctx context.Context) error {
-	s.ctx, s.cancel = context.WithCancel(ctx)
-
-	// Create listener
 	listener, err := net.Listen("tcp", s.addr)
 	if err != nil {
 		return fmt.Errorf("failed to listen on tcp: %w", err)
 	}
-	s.listener = listener
+	return s.Serve(ctx, listener)
+}
+
+// Serve accepts connections on l, which may have been created elsewhere (for
+// example inherited through socket activation), and blocks until ctx is
+// cancelled or Stop is called. Stop closes l.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	s.mu.Lock()
+	s.ctx, s.cancel = ctx, cancel
+	s.listener = l
+	s.mu.Unlock()
 
 	// Accept connections in the background
 	s.wg.Add(1)
 	go s.acceptLoop()
 
 	// Wait for context cancellation
-	<-s.ctx.Done()
-	return s.ctx.Err()
+	<-ctx.Done()
+	return ctx.Err()
 }
 
 // Stop gracefully shuts down the server.
+// It closes the listener and every open connection so that handlers blocked
+// on network I/O return immediately, then waits for them within the context
+// deadline, or GracePeriod if ctx has none. In-flight evaluations are
+// interrupted, so context-aware evaluators return promptly. A handler
+// blocked inside any other evaluator cannot be forcibly stopped: if the
+// deadline passes first, Stop returns ctx.Err() and that handler's goroutine
+// exits once the evaluator returns. Repeated Stop calls share a single
+// waiter goroutine, so the residual leak does not grow.
 func (s *Server) Stop(ctx context.Context) error {
-	if s.cancel != nil {
-		s.cancel()
+	s.mu.RLock()
+	cancel, listener := s.cancel, s.listener
+	s.mu.RUnlock()
+
+	if cancel != nil {
+		cancel()
 	}
 
 	// Close the listener
-	if s.listener != nil {
-		s.listener.Close()
+	if listener != nil {
+		listener.Close()
 	}
 
+	// Evaluations stop even on connections served under another context
+	s.handler.InterruptAll()
+
 	// Close all connections
 	s.mu.Lock()
 	for conn := range s.conns {
@@ -72,23 +151,91 @@ func (s *Server) Stop(ctx context.Context) error {
 	s.conns = make(map[net.Conn]bool)
 	s.mu.Unlock()
 
-	// Wait for all goroutines to finish
-	done := make(chan struct{})
-	go func() {
-		s.wg.Wait()
-		close(done)
-	}()
+	// Without a deadline from the caller, wait at most GracePeriod
+	if _, ok := ctx.Deadline(); !ok && s.GracePeriod > 0 {
+		var cancelWait context.CancelFunc
+		ctx, cancelWait = context.WithTimeout(ctx, s.GracePeriod)
+		defer cancelWait()
+	}
 
+	// Wait for all goroutines to finish
+	var err error
 	select {
-	case <-done:
-		return nil
+	case <-s.waitDone():
 	case <-ctx.Done():
-		return ctx.Err()
+		err = ctx.Err()
+	}
+
+	s.runShutdownHooks()
+	return err
+}
+
+// OnShutdown registers hook to be run by Stop once connections are closed,
+// before Stop returns. Hooks run once, in registration order.
+func (s *Server) OnShutdown(hook func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shutdownHooks = append(s.shutdownHooks, hook)
+}
+
+// runShutdownHooks runs the hooks registered with OnShutdown the first time
+// it is called.
+func (s *Server) runShutdownHooks() {
+	s.shutdownOnce.Do(func() {
+		s.mu.RLock()
+		hooks := s.shutdownHooks
+		s.mu.RUnlock()
+		for _, hook := range hooks {
+			hook()
+		}
+	})
+}
+
+// waitDone returns a channel that is closed once all server goroutines have exited.
+func (s *Server) waitDone() <-chan struct{} {
+	s.doneOnce.Do(func() {
+		s.done = make(chan struct{})
+		go func() {
+			s.wg.Wait()
+			close(s.done)
+		}()
+	})
+	return s.done
+}
+
+// Stats returns a snapshot of the server's connection counters.
+func (s *Server) Stats() ConnStats {
+	return ConnStats{
+		Disconnects:  atomic.LoadUint64(&s.stats.Disconnects),
+		DecodeErrors: atomic.LoadUint64(&s.stats.DecodeErrors),
+		EncodeErrors: atomic.LoadUint64(&s.stats.EncodeErrors),
 	}
 }
 
+// Handler returns the operation handler used by this server.
+// It can be used to configure optional behavior before the server is started.
+func (s *Server) Handler() *operations.Handler {
+	return s.handler
+}
+
+// Drain stops the server from accepting new evaluations while it keeps
+// answering other requests; see operations.Handler.Drain. Call Stop to shut
+// the server down once clients have moved away.
+func (s *Server) Drain() {
+	s.handler.Drain()
+}
+
+// Sessions returns a snapshot of every session's activity; see
+// operations.Handler.Sessions.
+func (s *Server) Sessions() []operations.SessionInfo {
+	return s.handler.Sessions()
+}
+
 // Addr returns the TCP address.
 func (s *Server) Addr() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	if s.listener != nil {
 		return s.listener.Addr().String()
 	}
@@ -118,12 +265,26 @@ func (s *Server) acceptLoop() {
 
 		// Handle connection in a goroutine
 		s.wg.Add(1)
-		go s.handleConnection(conn)
+		go s.handleConnection(s.ctx, conn)
 	}
 }
 
+// ServeConn handles requests from conn, which need not come from the
+// server's listener (for example one end of a net.Pipe), and blocks until the
+// connection closes. Cancelling ctx interrupts running evaluations, and Stop
+// closes the connection.
+func (s *Server) ServeConn(ctx context.Context, conn net.Conn) {
+	s.mu.Lock()
+	s.conns[conn] = true
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	s.handleConnection(ctx, conn)
+}
+
 // handleConnection processes requests from a single connection.
-func (s *Server) handleConnection(conn net.Conn) {
+// Evaluations run under ctx, so cancelling it interrupts them.
+func (s *Server) handleConnection(ctx context.Context, conn net.Conn) {
 	defer s.wg.Done()
 	defer func() {
 		conn.Close()
@@ -133,25 +294,334 @@ func (s *Server) handleConnection(conn net.Conn) {
 	}()
 
 	// Create codec for this connection
-	codec, err := protocol.NewCodec(s.codec, conn)
+	codec, err := protocol.NewCodecSize(s.codec, conn, s.ReadBufferSize)
 	if err != nil {
+		// Explain the refusal in JSON, which every client can read
+		s.encode(conn, protocol.NewJSONCodec(conn), &protocol.Message{
+			Status:        []string{"error"},
+			ProtocolError: err.Error(),
+		})
 		return
 	}
+	w := &wire{codec: codec, format: s.codec, compression: protocol.NoCompression}
+
+	// Each connection is its own session unless requests name one explicitly
+	session := fmt.Sprintf("conn-%d", atomic.AddUint64(&connIDCounter, 1))
+	defer s.handler.CloseSession(session)
+
+	// Responses and pushed messages share the connection, so writes are serialized
+	var writeMu sync.Mutex
+	send := func(msg *protocol.Message) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return s.encode(conn, w.codec, msg)
+	}
+	ctx = operations.WithSender(ctx, send)
+	ctx = operations.WithConnInfo(ctx, connInfo(conn))
+
+	// Requests are handled in lockstep until a "session-stream" request
+	// switches the connection to streaming; then a worker evaluates requests
+	// in order while this loop keeps reading. Leaving the loop cancels the
+	// worker's evaluations and waits for it.
+	ctx, cancel := context.WithCancel(ctx)
+	var queue chan *protocol.Message
+	var worker sync.WaitGroup
+	defer func() {
+		cancel()
+		if queue != nil {
+			close(queue)
+			worker.Wait()
+		}
+	}()
+
+	limiter := s.RateLimit.NewLimiter()
 
 	// Process messages
 	for {
 		// Read request
-		req := &protocol.Message{}
-		if err := codec.Decode(req); err != nil {
+		req := protocol.AcquireMessage()
+		if err := w.codec.Decode(req); err != nil {
+			protocol.ReleaseMessage(req)
+			// A malformed frame is reported to the client without dropping the connection
+			var frameErr *protocol.FrameError
+			if errors.As(err, &frameErr) {
+				if err := send(&protocol.Message{
+					Status:        []string{"error"},
+					ProtocolError: frameErr.Error(),
+				}); err != nil {
+					s.recordEncodeError(conn, "", "", err)
+					return
+				}
+				continue
+			}
+			s.recordDecodeError(conn, err)
+			return
+		}
+		if req.Session == "" {
+			req.Session = session
+		}
+
+		// Over-limit requests are rejected; persistent offenders are dropped
+		if limiter != nil {
+			if allowed, evict := limiter.Allow(time.Now()); !allowed {
+				if !s.reject(conn, send, req, evict) {
+					return
+				}
+				continue
+			}
+		}
+
+		// The codec is swapped between the acknowledgement and the next message
+		if req.Op == "upgrade-codec" {
+			if !s.upgradeCodec(conn, w, &writeMu, req, queue != nil) {
+				return
+			}
+			continue
+		}
+		if req.Op == "describe" && req.Data["compressions"] != nil {
+			if !s.negotiateCompression(ctx, conn, w, &writeMu, req, queue != nil) {
+				return
+			}
+			continue
+		}
+
+		// A graceful close is acknowledged once every earlier request has
+		// been answered, then the connection is closed
+		if req.Op == "close-connection" {
+			if queue != nil {
+				close(queue)
+				worker.Wait()
+				queue = nil
+			}
+			if err := send(&protocol.Message{ID: req.ID, Context: req.Context, Status: []string{"done"}}); err != nil {
+				s.recordEncodeError(conn, req.ID, req.Op, err)
+			}
+			protocol.ReleaseMessage(req)
 			return
 		}
 
-		// Handle request
-		resp := s.handler.Handle(req)
+		// Once streaming, control ops are handled as they arrive and
+		// everything else is evaluated in order by the worker
+		if queue != nil && !operations.IsControlOp(req.Op) {
+			queue <- req
+			continue
+		}
 
-		// Send response
-		if err := codec.Encode(resp); err != nil {
+		streamed := req.Op == "session-stream"
+		ok, err := s.serve(ctx, conn, send, req)
+		if err != nil {
 			return
 		}
+		if streamed && ok && queue == nil {
+			queue = make(chan *protocol.Message, streamQueueSize)
+			worker.Add(1)
+			go func() {
+				defer worker.Done()
+				var failed bool
+				for req := range queue {
+					if failed {
+						// Nobody can read the response
+						protocol.ReleaseMessage(req)
+						continue
+					}
+					if _, err := s.serve(ctx, conn, send, req); err != nil {
+						// Unblock the reader; remaining requests are
+						// discarded without being evaluated
+						failed = true
+						conn.Close()
+					}
+				}
+			}()
+		}
+	}
+}
+
+// reject answers a request refused by the rate limiter and recycles it.
+// When evict is set the response is final and the connection is to be
+// closed. It reports whether the connection should stay open.
+func (s *Server) reject(conn net.Conn, send operations.SendFunc, req *protocol.Message, evict bool) bool {
+	resp := &protocol.Message{
+		ID:            req.ID,
+		Context:       req.Context,
+		Status:        []string{"error", "rate-limited"},
+		ProtocolError: "rate limit exceeded",
+	}
+	if evict {
+		resp.ProtocolError = "rate limit exceeded repeatedly; closing connection"
+		s.handler.Log().Warn("evicting connection over rate limit",
+			"transport", "tcp", "remote", conn.RemoteAddr().String())
+	}
+
+	err := send(resp)
+	if err != nil {
+		s.recordEncodeError(conn, req.ID, req.Op, err)
+	}
+	protocol.ReleaseMessage(req)
+	return err == nil && !evict
+}
+
+// serve handles req, sends the response and recycles the request.
+// It reports whether the operation succeeded, and returns an error only if
+// the response could not be written.
+func (s *Server) serve(ctx context.Context, conn net.Conn, send operations.SendFunc, req *protocol.Message) (bool, error) {
+	resp := s.handler.HandleContext(ctx, req)
+	ok := len(resp.Status) > 0 && resp.Status[0] == "done"
+
+	err := send(resp)
+	if err != nil {
+		s.recordEncodeError(conn, req.ID, req.Op, err)
+	}
+	protocol.ReleaseMessage(req)
+	return ok, err
+}
+
+// wire is the codec a connection is using and how it came about.
+type wire struct {
+	codec       protocol.Codec
+	format      string // codec format, changed by "upgrade-codec"
+	compression string // negotiated through "describe"
+}
+
+// upgradeCodec answers an "upgrade-codec" request. If the upgrade is
+// accepted, w.codec is replaced by the requested codec right after the
+// acknowledgement is written, while writeMu is still held, so every later
+// message in either direction uses the new codec. Streaming connections read
+// ahead of the request being handled, and compressed connections keep their
+// codec, so neither can be upgraded. It reports whether the connection is
+// still usable.
+func (s *Server) upgradeCodec(conn net.Conn, w *wire, writeMu *sync.Mutex, req *protocol.Message, streaming bool) bool {
+	defer protocol.ReleaseMessage(req)
+
+	format, _ := req.Data["codec"].(string)
+	resp := &protocol.Message{ID: req.ID, Context: req.Context}
+	switch {
+	case streaming:
+		resp.Status = []string{"error"}
+		resp.ProtocolError = "upgrade-codec is not supported on a streaming connection"
+	case w.compression != protocol.NoCompression:
+		resp.Status = []string{"error"}
+		resp.ProtocolError = "upgrade-codec is not supported on a compressed connection"
+	case !protocol.CodecAvailable(format):
+		resp.Status = []string{"error"}
+		resp.ProtocolError = fmt.Sprintf("codec %q is not available", format)
+	default:
+		resp.Status = []string{"done"}
+		resp.Data = map[string]interface{}{"codec": format}
+	}
+
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	if err := s.encode(conn, w.codec, resp); err != nil {
+		s.recordEncodeError(conn, req.ID, req.Op, err)
+		return false
+	}
+	if resp.Status[0] != "done" {
+		return true
+	}
+
+	next, err := protocol.Upgrade(w.codec, format, conn)
+	if err != nil {
+		return false
+	}
+	w.codec, w.format = next, format
+	return true
+}
+
+// negotiateCompression answers a "describe" request whose data.compressions
+// offers compressions. The response names the first of Compressions the
+// client offered in data.compression, or "none". Once it is written, while
+// writeMu is still held, both directions switch to that compression, much as
+// for "upgrade-codec". Streaming connections, and connections already
+// compressed, keep their framing. It reports whether the connection is still
+// usable.
+func (s *Server) negotiateCompression(ctx context.Context, conn net.Conn, w *wire, writeMu *sync.Mutex, req *protocol.Message, streaming bool) bool {
+	offered := stringList(req.Data["compressions"])
+	resp := s.handler.HandleContext(ctx, req)
+	defer protocol.ReleaseMessage(req)
+
+	chosen := w.compression
+	if chosen == protocol.NoCompression && !streaming {
+		chosen = protocol.NegotiateCompression(s.Compressions, offered)
+	}
+	if resp.Data == nil {
+		resp.Data = make(map[string]interface{})
+	}
+	resp.Data["compression"] = chosen
+
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	if err := s.encode(conn, w.codec, resp); err != nil {
+		s.recordEncodeError(conn, req.ID, req.Op, err)
+		return false
+	}
+	if chosen == w.compression {
+		return true
+	}
+
+	next, err := protocol.Compress(w.codec, w.format, chosen, conn)
+	if err != nil {
+		return false
+	}
+	w.codec, w.compression = next, chosen
+	return true
+}
+
+// stringList returns the strings in a decoded JSON array, skipping other
+// elements.
+func stringList(value interface{}) []string {
+	var list []string
+	switch v := value.(type) {
+	case []string:
+		list = v
+	case []interface{}:
+		for _, element := range v {
+			if s, ok := element.(string); ok {
+				list = append(list, s)
+			}
+		}
+	}
+	return list
+}
+
+// connInfo describes conn for the "describe" operation.
+func connInfo(conn net.Conn) operations.ConnInfo {
+	info := operations.ConnInfo{Transport: "tcp"}
+	if addr := conn.LocalAddr(); addr != nil {
+		info.LocalAddr = addr.String()
+	}
+	if addr := conn.RemoteAddr(); addr != nil {
+		info.RemoteAddr = addr.String()
+	}
+	_, info.TLS = conn.(*tls.Conn)
+	return info
+}
+
+// encode writes msg to the connection, applying WriteTimeout if configured.
+func (s *Server) encode(conn net.Conn, codec protocol.Codec, msg *protocol.Message) error {
+	if s.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+	return codec.Encode(msg)
+}
+
+// recordDecodeError classifies a failure to read a request.
+// End of stream and closed connections are ordinary disconnects.
+func (s *Server) recordDecodeError(conn net.Conn, err error) {
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
+		atomic.AddUint64(&s.stats.Disconnects, 1)
+		return
 	}
+	atomic.AddUint64(&s.stats.DecodeErrors, 1)
+	s.handler.Log().Warn("failed to read request",
+		"transport", "tcp", "remote", conn.RemoteAddr().String(), "error", err)
+}
+
+// recordEncodeError records a response that could not be delivered.
+// Partial writes leave the stream in an unknown state, so the response is not
+// retried; the connection is closed and the loss is logged with the request ID.
+func (s *Server) recordEncodeError(conn net.Conn, id, op string, err error) {
+	atomic.AddUint64(&s.stats.EncodeErrors, 1)
+	s.handler.Log().Warn("failed to write response",
+		"transport", "tcp", "remote", conn.RemoteAddr().String(), "id", id, "op", op, "error", err)
 }
@@ -2,84 +2,837 @@ package unix
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/zylisp/repl/protocol"
 )
 
+// DialFunc establishes a connection to addr on the named network.
+// It has the same signature as net.Dialer.DialContext.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
 // Client implements a Unix domain socket REPL client.
 type Client struct {
-	conn  net.Conn
-	codec protocol.Codec
-	mu    sync.Mutex
-	msgID uint64
+	// Dial, if set, is used instead of a default net.Dialer to establish
+	// the connection. This allows dialing through proxies or in-memory pipes.
+	Dial DialFunc
+
+	// FailOnProtocolError makes Eval and EvalStream return an error when the
+	// server answers with status "error", alongside the result. By default
+	// the error is only reported in the result.
+	FailOnProtocolError bool
+
+	// ResponseTimeout, if positive, bounds how long a request waits for each
+	// message from the server, independent of its context, so that a hung
+	// server is detected sooner than a long context deadline. Pushed output
+	// restarts the wait. Subscriptions are not affected.
+	ResponseTimeout time.Duration
+
+	// KeepAlive, if positive, makes Connect start a background loop that
+	// sends a "ping" request at this interval. If a pong does not arrive
+	// within KeepAliveTimeout, the server is considered hung: the connection
+	// is closed, requests in flight fail, and OnUnhealthy is called. Outside
+	// streaming sessions a ping waits behind running evaluations, so the
+	// timeout should exceed the longest expected evaluation.
+	KeepAlive time.Duration
+
+	// KeepAliveTimeout bounds how long a ping waits for its pong. Zero means
+	// KeepAlive.
+	KeepAliveTimeout time.Duration
+
+	// OnUnhealthy, if set, is called from the keepalive loop with the reason
+	// once it gives up on a connection, for example to reconnect.
+	OnUnhealthy func(err error)
+
+	// ValueUnmarshaler, if set, converts each result's decoded Value, for
+	// example rebuilding a Go type from the map a server's ValueMarshaler
+	// sent in its place.
+	ValueUnmarshaler func(v interface{}) interface{}
+
+	// TranscriptWriter, if set, receives a JSON line for every message sent
+	// or received, as written by protocol.WriteTranscript, for example to
+	// attach to a bug report or replay with operations.Replay.
+	TranscriptWriter io.Writer
+
+	format  string // codec format used when Connect is given none
+	conn    net.Conn
+	codec   protocol.Codec
+	inUse   string     // format of codec
+	mu      sync.Mutex // guards conn, codec, inUse, pending, lost, readErr and upgrade
+	writeMu sync.Mutex // serializes writes to the codec
+	msgID   uint64
+	pending map[string]*route // request ID -> waiting caller
+	lost    chan struct{}     // closed once the read loop stops
+	readErr error             // why the read loop stopped
+	upgrade *codecUpgrade     // codec change awaiting its answer
+
+	transcriptMu sync.Mutex // serializes writes to TranscriptWriter
 }
 
-// NewClient creates a new Unix domain socket client.
+// codecUpgrade is an "upgrade-codec" request, or a "describe" request
+// negotiating compression, that the read loop watches for.
+type codecUpgrade struct {
+	id       string
+	format   string
+	compress bool // negotiating compression for format, the codec in use
+}
+
+// route delivers the server's messages for one request ID to its caller.
+type route struct {
+	id     string
+	ch     chan *protocol.Message
+	stream bool          // keep the route after terminal messages (subscriptions)
+	lost   chan struct{} // the connection's lost channel
+	gone   chan struct{} // closed when the caller stops listening
+	once   sync.Once
+}
+
+// routeBuffer is how many messages a route holds before the read loop waits
+// for its caller (requests) or drops further messages (subscriptions).
+const routeBuffer = 64
+
+// subscriptionBuffer is how many pushed messages a subscription holds before
+// further messages are dropped for that subscriber.
+const subscriptionBuffer = 64
+
+// NewClient creates a new Unix domain socket client that encodes messages with
+// codecFormat. An empty format defaults to "json".
 func NewClient(codecFormat string) *Client {
-	return &Client{}
+	if codecFormat == "" {
+		codecFormat = "json"
+	}
+	return &Client{format: codecFormat}
 }
 
 // Connect establishes a connection to a Unix domain socket server.
+// A non-empty codecFormat overrides the format given to NewClient.
 func (c *Client) Connect(ctx context.Context, addr string, codecFormat string) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	// Dial the Unix socket
-	var dialer net.Dialer
-	conn, err := dialer.DialContext(ctx, "unix", addr)
+	dial := c.Dial
+	if dial == nil {
+		var dialer net.Dialer
+		dial = dialer.DialContext
+	}
+	conn, err := dial(ctx, "unix", addr)
 	if err != nil {
 		return fmt.Errorf("failed to connect to unix socket: %w", err)
 	}
 
-	c.conn = conn
-
 	// Create codec
+	if codecFormat == "" {
+		codecFormat = c.format
+	}
+	if codecFormat == "" {
+		codecFormat = "json"
+	}
 	codec, err := protocol.NewCodec(codecFormat, conn)
 	if err != nil {
 		conn.Close()
 		return fmt.Errorf("failed to create codec: %w", err)
 	}
+	c.conn = conn
 	c.codec = codec
+	c.inUse = codecFormat
+	c.pending = make(map[string]*route)
+	c.lost = make(chan struct{})
+	c.readErr = nil
+
+	// Responses are read in the background and routed to callers by ID
+	go c.readLoop(conn, codec, c.lost)
+	if c.KeepAlive > 0 {
+		go c.keepAlive(conn, c.lost)
+	}
 
 	return nil
 }
 
 // Eval sends code to be evaluated and returns the result.
-// This is a synchronous request-response operation.
+// Concurrent calls are multiplexed over the connection. In a streaming
+// session, output pushed during the evaluation is collected into the
+// result's Output.
 func (c *Client) Eval(ctx context.Context, code string) (*Result, error) {
+	return c.EvalStream(ctx, code, nil)
+}
+
+// EvalStream is like Eval but calls handle with every message the server
+// pushes before the final result, such as output chunks and "need-input"
+// requests in a streaming session. A nil handle collects output like Eval.
+// handle runs on the calling goroutine and may call other client methods,
+// such as SendInput; the connection stalls only if it falls more than
+// routeBuffer messages behind.
+func (c *Client) EvalStream(ctx context.Context, code string, handle func(*Result)) (*Result, error) {
+	r, err := c.sendEval(code)
+	if err != nil {
+		return nil, err
+	}
+	defer r.leave(c)
+
+	var output string
+	for {
+		resp, err := c.receive(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		if isTerminal(resp) {
+			result := c.messageToResult(resp)
+			result.Output = output + result.Output
+			if c.FailOnProtocolError && hasStatus(resp, []string{"error"}) {
+				err = fmt.Errorf("server error: %s", resp.ProtocolError)
+			}
+			protocol.ReleaseMessage(resp)
+			return result, err
+		}
+		if handle != nil {
+			handle(c.messageToResult(resp))
+		} else {
+			output += resp.Output
+		}
+		protocol.ReleaseMessage(resp)
+	}
+}
+
+// EvalAwait sends code to be evaluated and consumes the messages pushed
+// while it runs, accumulating their output, until one carries a status in
+// terminal. An empty terminal set means "done", "error" or "interrupted".
+// The result has the output of every message consumed and the value and
+// status of the last. If the request finishes without reaching a status in
+// terminal, that final result is returned with an error.
+func (c *Client) EvalAwait(ctx context.Context, code string, terminal ...string) (*Result, error) {
+	r, err := c.sendEval(code)
+	if err != nil {
+		return nil, err
+	}
+	defer r.leave(c)
+
+	var output string
+	for {
+		resp, err := c.receive(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		output += resp.Output
+
+		reached := hasStatus(resp, terminal)
+		if reached || isTerminal(resp) {
+			result := c.messageToResult(resp)
+			result.Output = output
+			if !reached {
+				err = fmt.Errorf("eval finished with status %v", resp.Status)
+			}
+			protocol.ReleaseMessage(resp)
+			return result, err
+		}
+		protocol.ReleaseMessage(resp)
+	}
+}
+
+// sendEval sends an "eval" request for code. The request message is pooled
+// and returned to the pool once written; EvalStream and EvalAwait likewise
+// return the responses they consume, so that a client issuing many evals
+// allocates few messages.
+func (c *Client) sendEval(code string) (*route, error) {
+	req := protocol.AcquireMessage()
+	defer protocol.ReleaseMessage(req)
+	req.Op = "eval"
+	req.Code = code
+	return c.send(req, false)
+}
+
+// UpgradeCodec switches the connection to the codec named format without
+// reconnecting. The handshake is:
+//
+//  1. The client stops writing and sends "upgrade-codec" with data.codec
+//     set to format, in the current codec.
+//  2. The server answers in the current codec. If it accepts, every message
+//     it writes after that answer uses the new codec.
+//  3. The client reads the answer in the current codec, switches its reader
+//     and writer to the new codec, and resumes writing.
+//
+// Requests from other goroutines wait for the handshake to finish. The
+// server refuses upgrades on streaming connections, and to any codec other
+// than "json" until the MessagePack codec is implemented. If ctx is done or
+// ResponseTimeout passes before the server answers, the codec in use is
+// unknown, so the connection is closed.
+func (c *Client) UpgradeCodec(ctx context.Context, format string) error {
+	if !protocol.CodecAvailable(format) {
+		return fmt.Errorf("codec %q is not available", format)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	req := &protocol.Message{
+		Op:   "upgrade-codec",
+		Data: map[string]interface{}{"codec": format},
+	}
+	r, err := c.register(req, false)
+	if err != nil {
+		return err
+	}
+	defer r.leave(c)
+
+	c.mu.Lock()
+	c.upgrade = &codecUpgrade{id: req.ID, format: format}
+	c.mu.Unlock()
+
+	if err := c.encode(req); err != nil {
+		c.mu.Lock()
+		c.upgrade = nil
+		c.mu.Unlock()
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+
+	for {
+		resp, err := c.receive(ctx, r)
+		if err != nil {
+			// Whether the connection was lost or the answer never came,
+			// the codec in use is unknown
+			c.Close()
+			return err
+		}
+		if !isTerminal(resp) {
+			continue
+		}
+		if resp.Status[0] != "done" {
+			return fmt.Errorf("codec upgrade refused: %s", resp.ProtocolError)
+		}
+		return nil
+	}
+}
+
+// NegotiateCompression offers the server compressions, in order of
+// preference, in a "describe" request and returns the one the server chose,
+// or "none". If one was chosen, every later message in either direction is
+// compressed with it. As with UpgradeCodec, other requests wait for the
+// handshake, and the connection is closed if it fails midway.
+func (c *Client) NegotiateCompression(ctx context.Context, compressions ...string) (string, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	req := &protocol.Message{
+		Op:   "describe",
+		Data: map[string]interface{}{"compressions": compressions},
+	}
+	r, err := c.register(req, false)
+	if err != nil {
+		return "", err
+	}
+	defer r.leave(c)
+
+	c.mu.Lock()
+	c.upgrade = &codecUpgrade{id: req.ID, format: c.inUse, compress: true}
+	c.mu.Unlock()
+
+	if err := c.encode(req); err != nil {
+		c.mu.Lock()
+		c.upgrade = nil
+		c.mu.Unlock()
+		return "", fmt.Errorf("failed to send request: %w", err)
+	}
+
+	for {
+		resp, err := c.receive(ctx, r)
+		if err != nil {
+			// Whether the server switched to compression is unknown
+			c.Close()
+			return "", err
+		}
+		if !isTerminal(resp) {
+			continue
+		}
+		if resp.Status[0] != "done" {
+			return "", fmt.Errorf("describe failed: %s", resp.ProtocolError)
+		}
+		compression, _ := resp.Data["compression"].(string)
+		if compression == "" {
+			compression = protocol.NoCompression
+		}
+		return compression, nil
+	}
+}
+
+// Reset asks the server to restore its evaluation environment to the initial state.
+func (c *Client) Reset(ctx context.Context) error {
+	resp, err := c.roundTrip(ctx, &protocol.Message{
+		Op: "reset",
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, status := range resp.Status {
+		if status == "error" {
+			return fmt.Errorf("reset failed: %s", resp.ProtocolError)
+		}
+	}
+	return nil
+}
+
+// Describe asks the server for its versions, operations and capabilities
+// and returns the response's data.
+func (c *Client) Describe(ctx context.Context) (map[string]interface{}, error) {
+	resp, err := c.roundTrip(ctx, &protocol.Message{
+		Op: "describe",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, status := range resp.Status {
+		if status == "error" {
+			return nil, fmt.Errorf("describe failed: %s", resp.ProtocolError)
+		}
+	}
+	return resp.Data, nil
+}
+
+// StartStreaming switches the connection's session into streaming mode.
+// Evaluations then push output as it is produced and may ask for input,
+// which EvalStream surfaces and SendInput answers.
+func (c *Client) StartStreaming(ctx context.Context) error {
+	resp, err := c.roundTrip(ctx, &protocol.Message{
+		Op: "session-stream",
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, status := range resp.Status {
+		if status == "error" {
+			return fmt.Errorf("session-stream failed: %s", resp.ProtocolError)
+		}
+	}
+	return nil
+}
+
+// SendInput answers a "need-input" request from an evaluation in a
+// streaming session. Input may also be sent ahead of the request, and may
+// hold several lines; see operations.ReadLine.
+func (c *Client) SendInput(ctx context.Context, input string) error {
+	resp, err := c.roundTrip(ctx, &protocol.Message{
+		Op:   "stdin",
+		Data: map[string]interface{}{"input": input},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, status := range resp.Status {
+		if status == "error" {
+			return fmt.Errorf("stdin failed: %s", resp.ProtocolError)
+		}
+	}
+	return nil
+}
+
+// CloseInput ends the input of an evaluation in a streaming session: once
+// it has read the input sent so far, operations.ReadInput returns io.EOF.
+func (c *Client) CloseInput(ctx context.Context) error {
+	resp, err := c.roundTrip(ctx, &protocol.Message{
+		Op:   "stdin",
+		Data: map[string]interface{}{"eof": true},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, status := range resp.Status {
+		if status == "error" {
+			return fmt.Errorf("stdin failed: %s", resp.ProtocolError)
+		}
+	}
+	return nil
+}
+
+// Subscribe registers with the server to receive a copy of every evaluation
+// result produced in the given session. Each Result carries the observed
+// session's output, value and status; the original request ID is not exposed.
+// The session must have set the "observable" option unless it is the
+// client's own.
+//
+// The returned channel is closed when ctx is cancelled, which also removes
+// the subscription on the server, or when the connection is lost. Results
+// that arrive while the channel's buffer is full are dropped.
+func (c *Client) Subscribe(ctx context.Context, session string) (<-chan *Result, error) {
+	r, err := c.send(&protocol.Message{
+		Op:   "subscribe",
+		Data: map[string]interface{}{"session": session},
+	}, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// The first message is the server's acknowledgement
+	ack, err := c.receive(ctx, r)
+	if err != nil {
+		r.leave(c)
+		return nil, err
+	}
+	for _, status := range ack.Status {
+		if status == "error" {
+			r.leave(c)
+			return nil, fmt.Errorf("subscribe failed: %s", ack.ProtocolError)
+		}
+	}
+
+	results := make(chan *Result, subscriptionBuffer)
+	go func() {
+		defer close(results)
+		for {
+			select {
+			case msg := <-r.ch:
+				select {
+				case results <- c.messageToResult(msg):
+				default:
+				}
+			case <-r.lost:
+				return
+			case <-ctx.Done():
+				r.leave(c)
+				c.unsubscribe(r.id)
+				return
+			}
+		}
+	}()
+	return results, nil
+}
+
+// unsubscribe tells the server to drop a subscription. The server's reply is
+// not awaited, so it is discarded by the read loop.
+func (c *Client) unsubscribe(id string) {
+	req := &protocol.Message{
+		Op:   "unsubscribe",
+		ID:   fmt.Sprintf("%d", atomic.AddUint64(&c.msgID, 1)),
+		Data: map[string]interface{}{"subscription": id},
+	}
+	c.write(req)
+}
+
+// roundTrip sends req and waits for its final response.
+func (c *Client) roundTrip(ctx context.Context, req *protocol.Message) (*protocol.Message, error) {
+	r, err := c.send(req, false)
+	if err != nil {
+		return nil, err
+	}
+	defer r.leave(c)
+
+	for {
+		resp, err := c.receive(ctx, r)
+		if err != nil || isTerminal(resp) {
+			return resp, err
+		}
+	}
+}
+
+// send assigns a message ID to req, registers a route for its responses,
+// and writes it to the connection.
+func (c *Client) send(req *protocol.Message, stream bool) (*route, error) {
+	r, err := c.register(req, stream)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.write(req); err != nil {
+		r.leave(c)
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	return r, nil
+}
+
+// receive waits for the next message on r, for at most ResponseTimeout.
+func (c *Client) receive(ctx context.Context, r *route) (*protocol.Message, error) {
+	var timeout <-chan time.Time
+	if c.ResponseTimeout > 0 {
+		timer := time.NewTimer(c.ResponseTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case resp := <-r.ch:
+		return resp, nil
+	case <-r.lost:
+		// Messages that arrived before the connection was lost come first
+		select {
+		case resp := <-r.ch:
+			return resp, nil
+		default:
+		}
+		return nil, fmt.Errorf("failed to receive response: %w", c.err())
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timeout:
+		return nil, fmt.Errorf("no response within %v", c.ResponseTimeout)
+	}
+}
+
+// register assigns a message ID to req and creates the route for its responses.
+func (c *Client) register(req *protocol.Message, stream bool) (*route, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if c.codec == nil {
+		return nil, fmt.Errorf("not connected")
+	}
+	if c.readErr != nil {
+		return nil, fmt.Errorf("connection lost: %w", c.readErr)
+	}
+
 	// Generate message ID
 	msgID := atomic.AddUint64(&c.msgID, 1)
+	req.ID = fmt.Sprintf("%d", msgID)
 
-	// Create request
-	req := &protocol.Message{
-		Op:   "eval",
-		ID:   fmt.Sprintf("%d", msgID),
-		Code: code,
+	r := &route{
+		id:     req.ID,
+		ch:     make(chan *protocol.Message, routeBuffer),
+		stream: stream,
+		lost:   c.lost,
+		gone:   make(chan struct{}),
 	}
+	c.pending[req.ID] = r
+	return r, nil
+}
 
-	// Send request
-	if err := c.codec.Encode(req); err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
+// leave removes the route and releases a read loop blocked delivering to it.
+func (r *route) leave(c *Client) {
+	r.once.Do(func() {
+		c.mu.Lock()
+		if c.pending[r.id] == r {
+			delete(c.pending, r.id)
+		}
+		c.mu.Unlock()
+		close(r.gone)
+	})
+}
+
+// write encodes a message onto the connection.
+func (c *Client) write(msg *protocol.Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.encode(msg)
+}
+
+// encode writes msg with the current codec. Callers hold writeMu, which
+// keeps the codec from changing underneath them.
+func (c *Client) encode(msg *protocol.Message) error {
+	c.mu.Lock()
+	codec := c.codec
+	c.mu.Unlock()
+	if codec == nil {
+		return fmt.Errorf("not connected")
 	}
+	c.record("request", msg)
+	return codec.Encode(msg)
+}
 
-	// Receive response
-	resp := &protocol.Message{}
-	if err := c.codec.Decode(resp); err != nil {
-		return nil, fmt.Errorf("failed to receive response: %w", err)
+// record appends msg to TranscriptWriter, if one is set. Failures to write
+// the transcript do not affect the connection.
+func (c *Client) record(direction string, msg *protocol.Message) {
+	if c.TranscriptWriter == nil {
+		return
 	}
+	c.transcriptMu.Lock()
+	defer c.transcriptMu.Unlock()
+	protocol.WriteTranscript(c.TranscriptWriter, direction, msg)
+}
+
+// err returns the error that stopped the read loop.
+func (c *Client) err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.readErr == nil {
+		return fmt.Errorf("connection closed")
+	}
+	return c.readErr
+}
+
+// readLoop decodes messages from the server and routes them to callers by ID
+// until the connection fails. Messages with no waiting caller are discarded.
+// An accepted codec upgrade switches the codec before the next message.
+func (c *Client) readLoop(conn net.Conn, codec protocol.Codec, lost chan struct{}) {
+	for {
+		msg := protocol.AcquireMessage()
+		err := codec.Decode(msg)
+		if err == nil {
+			c.record("response", msg)
+			codec, err = c.switchCodec(conn, codec, msg)
+		}
+		if err != nil {
+			protocol.ReleaseMessage(msg)
+			var frameErr *protocol.FrameError
+			if errors.As(err, &frameErr) {
+				continue
+			}
+			c.mu.Lock()
+			if c.readErr == nil {
+				c.readErr = err
+			}
+			c.mu.Unlock()
+			close(lost)
+			return
+		}
+		c.dispatch(msg)
+	}
+}
+
+// keepAlive pings the server every KeepAlive until the connection is lost,
+// closing conn if a ping goes unanswered.
+func (c *Client) keepAlive(conn net.Conn, lost chan struct{}) {
+	timeout := c.KeepAliveTimeout
+	if timeout <= 0 {
+		timeout = c.KeepAlive
+	}
+	ticker := time.NewTicker(c.KeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lost:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		_, err := c.roundTrip(ctx, &protocol.Message{Op: "ping"})
+		cancel()
+		if err == nil {
+			continue
+		}
+
+		err = fmt.Errorf("keepalive failed: %w", err)
+		c.mu.Lock()
+		if c.conn != conn || c.readErr != nil {
+			// Closed, or already failed for another reason
+			c.mu.Unlock()
+			return
+		}
+		c.readErr = err
+		c.mu.Unlock()
+		conn.Close()
+		if c.OnUnhealthy != nil {
+			c.OnUnhealthy(err)
+		}
+		return
+	}
+}
+
+// switchCodec returns the codec to read the message after msg with: a new
+// one if msg accepts the pending codec upgrade, and codec otherwise.
+func (c *Client) switchCodec(conn net.Conn, codec protocol.Codec, msg *protocol.Message) (protocol.Codec, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	up := c.upgrade
+	if up == nil || msg.ID != up.id || !isTerminal(msg) {
+		return codec, nil
+	}
+	c.upgrade = nil
+	if len(msg.Status) == 0 || msg.Status[0] != "done" {
+		return codec, nil
+	}
+
+	var next protocol.Codec
+	var err error
+	if up.compress {
+		compression, _ := msg.Data["compression"].(string)
+		if compression == "" || compression == protocol.NoCompression {
+			return codec, nil
+		}
+		next, err = protocol.Compress(codec, up.format, compression, conn)
+	} else {
+		next, err = protocol.Upgrade(codec, up.format, conn)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to upgrade codec: %w", err)
+	}
+	if c.codec == codec {
+		c.codec = next
+		c.inUse = up.format
+	}
+	return next, nil
+}
+
+// dispatch delivers msg to the caller waiting on its ID. Request callers
+// that fall behind are waited for, so their messages are never dropped;
+// subscriptions drop messages when full rather than stall the connection.
+func (c *Client) dispatch(msg *protocol.Message) {
+	c.mu.Lock()
+	r, exists := c.pending[msg.ID]
+	if exists && !r.stream && isTerminal(msg) {
+		delete(c.pending, msg.ID)
+	}
+	c.mu.Unlock()
+	if !exists {
+		protocol.ReleaseMessage(msg)
+		return
+	}
+
+	if r.stream {
+		select {
+		case r.ch <- msg:
+		default:
+			protocol.ReleaseMessage(msg)
+		}
+		return
+	}
+	select {
+	case r.ch <- msg:
+	case <-r.gone:
+		protocol.ReleaseMessage(msg)
+	}
+}
+
+// isTerminal reports whether msg is the final response to its request,
+// as opposed to output or an input request pushed while it runs.
+func isTerminal(msg *protocol.Message) bool {
+	for _, status := range msg.Status {
+		switch status {
+		case "done", "error", "interrupted":
+			return true
+		}
+	}
+	return false
+}
+
+// hasStatus reports whether msg carries one of statuses, or whether it is
+// terminal if statuses is empty.
+func hasStatus(msg *protocol.Message, statuses []string) bool {
+	if len(statuses) == 0 {
+		return isTerminal(msg)
+	}
+	for _, status := range msg.Status {
+		for _, want := range statuses {
+			if status == want {
+				return true
+			}
+		}
+	}
+	return false
+}
 
-	// Convert to Result
-	return messageToResult(resp), nil
+// CloseGracefully asks the server to close the connection once it has
+// answered every request sent before, then closes the client. Responses to
+// requests in flight are delivered to their callers rather than lost with
+// the connection. The connection is closed even if ctx ends first.
+func (c *Client) CloseGracefully(ctx context.Context) error {
+	_, err := c.roundTrip(ctx, &protocol.Message{Op: "close-connection"})
+	c.Close()
+	if err != nil {
+		return fmt.Errorf("graceful close failed: %w", err)
+	}
+	return nil
 }
 
 // Close closes the client connection.
+// It is idempotent and safe to call after the server has stopped.
 func (c *Client) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -105,11 +858,16 @@ type Result struct {
 	Status []string
 }
 
-// messageToResult converts a protocol.Message to a Result.
-func messageToResult(msg *protocol.Message) *Result {
+// messageToResult converts a protocol.Message to a Result, passing its
+// value through ValueUnmarshaler.
+func (c *Client) messageToResult(msg *protocol.Message) *Result {
+	value := msg.Value
+	if c.ValueUnmarshaler != nil && value != nil {
+		value = c.ValueUnmarshaler(value)
+	}
 	return &Result{
 		ID:     msg.ID,
-		Value:  msg.Value,
+		Value:  value,
 		Output: msg.Output,
 		Status: msg.Status,
 	}
@@ -1,11 +1,23 @@
 package unix
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"os"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/zylisp/repl/operations"
+	"github.com/zylisp/repl/protocol"
 )
 
 // mockEvaluator is a simple evaluator for testing
@@ -20,6 +32,42 @@ func mockEvaluator(code string) (interface{}, string, error) {
 	}
 }
 
+// statefulEvaluator remembers "(define name value)" forms until reset.
+type statefulEvaluator struct {
+	mu   sync.Mutex
+	vars map[string]interface{}
+}
+
+func newStatefulEvaluator() *statefulEvaluator {
+	return &statefulEvaluator{vars: make(map[string]interface{})}
+}
+
+func (e *statefulEvaluator) eval(code string) (interface{}, string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var name string
+	var value float64
+	if n, _ := fmt.Sscanf(code, "(define %s %g)", &name, &value); n == 2 {
+		e.vars[name] = value
+		return value, "", nil
+	}
+
+	if v, ok := e.vars[code]; ok {
+		return v, "", nil
+	}
+	return map[string]interface{}{
+		"error": "undefined variable: " + code,
+	}, "", nil
+}
+
+func (e *statefulEvaluator) reset() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.vars = make(map[string]interface{})
+	return nil
+}
+
 func TestUnixSocketServerClient(t *testing.T) {
 	// Use /tmp for Unix socket to avoid path length issues
 	sockPath := "/tmp/zylisp-test.sock"
@@ -152,3 +200,1331 @@ func TestUnixSocketMultipleClients(t *testing.T) {
 		}
 	}
 }
+
+func TestUnixSocketReset(t *testing.T) {
+	sockPath := "/tmp/zylisp-test-reset.sock"
+	defer os.Remove(sockPath)
+
+	evaluator := newStatefulEvaluator()
+	server := NewServer(sockPath, "json", evaluator.eval)
+	server.Handler().Resetter = evaluator.reset
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := NewClient("json")
+	if err := client.Connect(context.Background(), sockPath, "json"); err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.Eval(context.Background(), "(define x 42)"); err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+
+	result, err := client.Eval(context.Background(), "x")
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	if result.Value != float64(42) {
+		t.Fatalf("Expected value 42 before reset, got %v", result.Value)
+	}
+
+	if err := client.Reset(context.Background()); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+
+	result, err = client.Eval(context.Background(), "x")
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	if _, ok := result.Value.(map[string]interface{}); !ok {
+		t.Errorf("Expected x to be undefined after reset, got %v", result.Value)
+	}
+}
+
+func TestUnixSocketStopWithStuckHandler(t *testing.T) {
+	sockPath := "/tmp/zylisp-test-stuck.sock"
+	defer os.Remove(sockPath)
+
+	release := make(chan struct{})
+	stuckEvaluator := func(code string) (interface{}, string, error) {
+		<-release
+		return nil, "", nil
+	}
+
+	server := NewServer(sockPath, "json", stuckEvaluator)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := NewClient("json")
+	if err := client.Connect(context.Background(), sockPath, "json"); err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer client.Close()
+
+	// Leave a handler blocked inside the evaluator
+	evalDone := make(chan error, 1)
+	go func() {
+		_, err := client.Eval(context.Background(), "(stuck)")
+		evalDone <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	cancel()
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer stopCancel()
+
+	start := time.Now()
+	if err := server.Stop(stopCtx); err != context.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Stop took %v, expected it to return by the deadline", elapsed)
+	}
+
+	// The client's connection was closed, so its Eval must not hang
+	select {
+	case err := <-evalDone:
+		if err == nil {
+			t.Error("Expected Eval to fail after server stop")
+		}
+	case <-time.After(time.Second):
+		t.Error("Eval did not return after server stop")
+	}
+
+	// Repeated Stop calls must not accumulate waiter goroutines
+	before := runtime.NumGoroutine()
+	for i := 0; i < 5; i++ {
+		expired, expiredCancel := context.WithTimeout(context.Background(), time.Millisecond)
+		server.Stop(expired)
+		expiredCancel()
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Goroutines grew from %d to %d across repeated Stop calls", before, after)
+	}
+
+	// Once the evaluator returns, Stop completes
+	close(release)
+	finalCtx, finalCancel := context.WithTimeout(context.Background(), time.Second)
+	defer finalCancel()
+	if err := server.Stop(finalCtx); err != nil {
+		t.Errorf("Expected Stop to succeed after release, got %v", err)
+	}
+}
+
+func TestUnixSocketStopInterruptsEvaluations(t *testing.T) {
+	server := NewServer("/tmp/zylisp-test-stop-interrupts.sock", "json", mockEvaluator)
+	server.Handler().ContextEvaluator = func(ctx context.Context, code string) (interface{}, string, error) {
+		<-ctx.Done()
+		return nil, "", ctx.Err()
+	}
+
+	// A connection served under a context Stop does not cancel
+	clientConn, serverConn := net.Pipe()
+	go server.ServeConn(context.Background(), serverConn)
+
+	client := NewClient("json")
+	client.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return clientConn, nil
+	}
+	if err := client.Connect(context.Background(), "pipe", ""); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	go client.Eval(context.Background(), "(block)")
+	time.Sleep(50 * time.Millisecond)
+
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer stopCancel()
+	start := time.Now()
+	if err := server.Stop(stopCtx); err != nil {
+		t.Errorf("Expected Stop to succeed once the evaluation was interrupted, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected Stop to return well before its deadline, took %v", elapsed)
+	}
+}
+
+func TestUnixSocketClientCustomDialer(t *testing.T) {
+	server := NewServer("/tmp/zylisp-test-dial.sock", "json", mockEvaluator)
+
+	var dialedNetwork, dialedAddr string
+	client := NewClient("json")
+	client.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialedNetwork, dialedAddr = network, addr
+
+		// Serve the other end of an in-memory pipe with the server's handler
+		clientConn, serverConn := net.Pipe()
+		server.wg.Add(1)
+		go server.handleConnection(context.Background(), serverConn)
+		return clientConn, nil
+	}
+
+	if err := client.Connect(context.Background(), "in-memory", "json"); err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer client.Close()
+
+	if dialedNetwork != "unix" || dialedAddr != "in-memory" {
+		t.Errorf("Expected dial of unix/in-memory, got %s/%s", dialedNetwork, dialedAddr)
+	}
+
+	result, err := client.Eval(context.Background(), "(+ 1 2)")
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	if result.Value != float64(3) {
+		t.Errorf("Expected value 3, got %v", result.Value)
+	}
+}
+
+func TestUnixSocketClientUsesNewClientCodec(t *testing.T) {
+	server := NewServer(":0", "json", mockEvaluator)
+
+	pipeDial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		clientConn, serverConn := net.Pipe()
+		server.wg.Add(1)
+		go server.handleConnection(context.Background(), serverConn)
+		return clientConn, nil
+	}
+
+	// The codec given to NewClient is used when Connect names none
+	client := NewClient("bogus")
+	client.Dial = pipeDial
+	err := client.Connect(context.Background(), "in-memory", "")
+	if err == nil || !strings.Contains(err.Error(), "unsupported codec format: bogus") {
+		t.Fatalf("Expected unsupported codec error, got %v", err)
+	}
+
+	client = NewClient("json")
+	client.Dial = pipeDial
+	if err := client.Connect(context.Background(), "in-memory", ""); err != nil {
+		t.Fatalf("Failed to connect client: %v", err)
+	}
+	defer client.Close()
+
+	result, err := client.Eval(context.Background(), "(+ 1 2)")
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	if result.Value != float64(3) {
+		t.Errorf("Expected value 3, got %v", result.Value)
+	}
+}
+
+func TestUnixSocketMalformedFrameKeepsConnection(t *testing.T) {
+	sockPath := "/tmp/zylisp-test-frame.sock"
+	defer os.Remove(sockPath)
+
+	server := NewServer(sockPath, "json", mockEvaluator)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		t.Fatalf("Failed to dial server: %v", err)
+	}
+	defer conn.Close()
+
+	// Send a bad frame followed by a good one on the same connection
+	fmt.Fprint(conn, "{\"op\": \"eval\", \"id\": \n")
+	fmt.Fprint(conn, `{"op":"eval","id":"2","code":"(+ 1 2)"}`+"\n")
+
+	decoder := json.NewDecoder(conn)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	var bad protocol.Message
+	if err := decoder.Decode(&bad); err != nil {
+		t.Fatalf("Failed to read error response: %v", err)
+	}
+	if len(bad.Status) == 0 || bad.Status[0] != "error" || bad.ProtocolError == "" {
+		t.Errorf("Expected protocol error for bad frame, got %+v", bad)
+	}
+
+	var good protocol.Message
+	if err := decoder.Decode(&good); err != nil {
+		t.Fatalf("Connection dropped after bad frame: %v", err)
+	}
+	if good.ID != "2" || good.Value != float64(3) {
+		t.Errorf("Expected value 3 for message 2, got %+v", good)
+	}
+}
+
+func TestUnixSocketPooledMessagesDoNotLeak(t *testing.T) {
+	sockPath := "/tmp/zylisp-test-pool.sock"
+	defer os.Remove(sockPath)
+
+	server := NewServer(sockPath, "json", mockEvaluator)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		t.Fatalf("Failed to dial server: %v", err)
+	}
+	defer conn.Close()
+
+	codec := protocol.NewJSONCodec(conn)
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// The second request omits code; it must not inherit the first one's
+	requests := []*protocol.Message{
+		{Op: "eval", ID: "1", Code: "(+ 1 2)", Data: map[string]interface{}{"key": "value"}},
+		{Op: "eval", ID: "2"},
+	}
+	for _, req := range requests {
+		if err := codec.Encode(req); err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+	}
+
+	first := &protocol.Message{}
+	if err := codec.Decode(first); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if first.Value != float64(3) {
+		t.Errorf("Expected value 3, got %+v", first)
+	}
+
+	second := &protocol.Message{}
+	if err := codec.Decode(second); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if len(second.Status) == 0 || second.Status[0] != "error" || second.Value != nil || second.Data != nil {
+		t.Errorf("Expected missing-code error with no leaked fields, got %+v", second)
+	}
+}
+
+func TestUnixSocketEncodeFailureRecordedDistinctly(t *testing.T) {
+	server := NewServer("/tmp/zylisp-test-encode.sock", "json", mockEvaluator)
+
+	var logs bytes.Buffer
+	server.Handler().Logger = slog.New(slog.NewTextHandler(&logs, nil))
+
+	// A client that sends a request and goes away before reading the response
+	clientConn, serverConn := net.Pipe()
+	server.wg.Add(1)
+	go server.handleConnection(context.Background(), serverConn)
+
+	codec := protocol.NewJSONCodec(clientConn)
+	if err := codec.Encode(&protocol.Message{Op: "eval", ID: "7", Code: "(+ 1 2)"}); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	clientConn.Close()
+	server.wg.Wait()
+
+	// A client that disconnects cleanly
+	clientConn, serverConn = net.Pipe()
+	server.wg.Add(1)
+	go server.handleConnection(context.Background(), serverConn)
+	clientConn.Close()
+	server.wg.Wait()
+
+	stats := server.Stats()
+	if stats.EncodeErrors != 1 {
+		t.Errorf("Expected 1 encode error, got %d", stats.EncodeErrors)
+	}
+	if stats.DecodeErrors != 0 {
+		t.Errorf("Expected 0 decode errors, got %d", stats.DecodeErrors)
+	}
+	if stats.Disconnects != 1 {
+		t.Errorf("Expected 1 disconnect, got %d", stats.Disconnects)
+	}
+	if !strings.Contains(logs.String(), "failed to write response") || !strings.Contains(logs.String(), "id=7") {
+		t.Errorf("Expected dropped response to be logged with its ID, got %q", logs.String())
+	}
+}
+
+func TestUnixSocketSubscribe(t *testing.T) {
+	sockPath := "/tmp/zylisp-test-subscribe.sock"
+	defer os.Remove(sockPath)
+
+	server := NewServer(sockPath, "json", mockEvaluator)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// A third connection evaluates in the observed session, which must
+	// first allow observers
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		t.Fatalf("Failed to dial server: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, `{"op":"set-option","id":"0","session":"shared","data":{"key":"observable","value":true}}`+"\n")
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+		t.Fatalf("Failed to read set-option response: %v", err)
+	}
+
+	// Two observers subscribe to the same session
+	subCtx, subCancel := context.WithCancel(ctx)
+	defer subCancel()
+
+	var streams []<-chan *Result
+	for i := 0; i < 2; i++ {
+		client := NewClient("json")
+		if err := client.Connect(ctx, sockPath, "json"); err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer client.Close()
+
+		results, err := client.Subscribe(subCtx, "shared")
+		if err != nil {
+			t.Fatalf("Subscribe failed: %v", err)
+		}
+		streams = append(streams, results)
+	}
+
+	fmt.Fprint(conn, `{"op":"eval","id":"1","session":"shared","code":"(+ 1 2)"}`+"\n")
+
+	for i, results := range streams {
+		select {
+		case result := <-results:
+			if result.Value != float64(3) {
+				t.Errorf("Subscriber %d: expected value 3, got %v", i, result.Value)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Subscriber %d received nothing", i)
+		}
+	}
+
+	// Cancelling the context unsubscribes and closes the channels
+	subCancel()
+	for i, results := range streams {
+		select {
+		case _, ok := <-results:
+			if ok {
+				t.Errorf("Subscriber %d: expected closed channel", i)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Subscriber %d channel not closed", i)
+		}
+	}
+}
+
+func TestUnixSocketSessionStream(t *testing.T) {
+	sockPath := "/tmp/zylisp-test-stream.sock"
+	defer os.Remove(sockPath)
+
+	server := NewServer(sockPath, "json", mockEvaluator)
+	server.Handler().ContextEvaluator = func(ctx context.Context, code string) (interface{}, string, error) {
+		if code == "(greet)" {
+			operations.WriteOutput(ctx, "name? ")
+			name, err := operations.ReadInput(ctx)
+			if err != nil {
+				return nil, "", err
+			}
+			operations.WriteOutput(ctx, "hello "+name+"\n")
+			return "greeted", "", nil
+		}
+		operations.WriteOutput(ctx, code+" 1\n")
+		operations.WriteOutput(ctx, code+" 2\n")
+		return code, "", nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := NewClient("json")
+	if err := client.Connect(ctx, sockPath, ""); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.StartStreaming(ctx); err != nil {
+		t.Fatalf("StartStreaming failed: %v", err)
+	}
+
+	// Output arrives before the result, and input is requested mid-eval
+	var outputs []string
+	result, err := client.EvalStream(ctx, "(greet)", func(msg *Result) {
+		if len(msg.Status) > 0 && msg.Status[0] == "need-input" {
+			if err := client.SendInput(ctx, "zy"); err != nil {
+				t.Errorf("SendInput failed: %v", err)
+			}
+			return
+		}
+		outputs = append(outputs, msg.Output)
+	})
+	if err != nil {
+		t.Fatalf("EvalStream failed: %v", err)
+	}
+	if result.Value != "greeted" {
+		t.Errorf("Expected value greeted, got %v", result.Value)
+	}
+	if strings.Join(outputs, "|") != "name? |hello zy\n" {
+		t.Errorf("Unexpected streamed output %q", outputs)
+	}
+
+	// Forms sent back to back each receive their own interleaved output
+	var wg sync.WaitGroup
+	for _, form := range []string{"a", "b", "c"} {
+		wg.Add(1)
+		go func(form string) {
+			defer wg.Done()
+			result, err := client.Eval(ctx, form)
+			if err != nil {
+				t.Errorf("Eval %s failed: %v", form, err)
+				return
+			}
+			if want := form + " 1\n" + form + " 2\n"; result.Output != want {
+				t.Errorf("Eval %s: expected output %q, got %q", form, want, result.Output)
+			}
+		}(form)
+	}
+	wg.Wait()
+}
+
+func TestUnixSocketClientCloseIdempotent(t *testing.T) {
+	sockPath := "/tmp/zylisp-test-close.sock"
+	defer os.Remove(sockPath)
+
+	server := NewServer(sockPath, "json", mockEvaluator)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := NewClient("json")
+	if err := client.Connect(ctx, sockPath, ""); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	server.Stop(context.Background())
+	for i := 0; i < 2; i++ {
+		if err := client.Close(); err != nil {
+			t.Errorf("Close %d failed: %v", i+1, err)
+		}
+	}
+	if _, err := client.Eval(context.Background(), "(+ 1 2)"); err == nil {
+		t.Error("Expected Eval to fail after Close")
+	}
+}
+
+func TestUnixSocketServeListener(t *testing.T) {
+	sockPath := "/tmp/zylisp-test-serve.sock"
+	os.Remove(sockPath)
+	defer os.Remove(sockPath)
+
+	listener, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	server := NewServer("", "json", mockEvaluator)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(context.Background(), listener)
+	}()
+
+	// The listener is already bound, so the client can connect right away
+	client := NewClient("json")
+	if err := client.Connect(context.Background(), sockPath, ""); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	result, err := client.Eval(context.Background(), "(+ 1 2)")
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	if result.Value != float64(3) {
+		t.Errorf("Expected value 3, got %v", result.Value)
+	}
+	if server.Addr() != sockPath {
+		t.Errorf("Expected Addr %s, got %s", sockPath, server.Addr())
+	}
+
+	if err := server.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	select {
+	case err := <-served:
+		if err != context.Canceled {
+			t.Errorf("Expected Serve to return context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return after Stop")
+	}
+}
+
+func TestUnixSocketEvalAwait(t *testing.T) {
+	sockPath := "/tmp/zylisp-test-await.sock"
+	defer os.Remove(sockPath)
+
+	server := NewServer(sockPath, "json", mockEvaluator)
+	server.Handler().ContextEvaluator = func(ctx context.Context, code string) (interface{}, string, error) {
+		if code == "(ask)" {
+			operations.WriteOutput(ctx, "name? ")
+			name, err := operations.ReadInput(ctx)
+			return name, "", err
+		}
+		operations.WriteOutput(ctx, "one\n")
+		operations.WriteOutput(ctx, "two\n")
+		return code, "", nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := NewClient("json")
+	if err := client.Connect(ctx, sockPath, ""); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.StartStreaming(ctx); err != nil {
+		t.Fatalf("StartStreaming failed: %v", err)
+	}
+
+	// Two pushed output messages are folded into the final result
+	result, err := client.EvalAwait(ctx, "(+ 1 2)")
+	if err != nil {
+		t.Fatalf("EvalAwait failed: %v", err)
+	}
+	if result.Value != "(+ 1 2)" || result.Output != "one\ntwo\n" {
+		t.Errorf("Expected value (+ 1 2) with output %q, got %v %q", "one\ntwo\n", result.Value, result.Output)
+	}
+	if len(result.Status) == 0 || result.Status[0] != "done" {
+		t.Errorf("Expected status done, got %v", result.Status)
+	}
+
+	// A custom terminal set stops at the first matching status
+	result, err = client.EvalAwait(ctx, "(ask)", "need-input")
+	if err != nil {
+		t.Fatalf("EvalAwait failed: %v", err)
+	}
+	if result.Output != "name? " || len(result.Status) == 0 || result.Status[0] != "need-input" {
+		t.Errorf("Expected to stop at need-input after the prompt, got %v %q", result.Status, result.Output)
+	}
+	client.SendInput(ctx, "zy")
+
+	// Finishing without the awaited status is an error
+	if _, err := client.EvalAwait(ctx, "(+ 1 2)", "need-input"); err == nil {
+		t.Error("Expected an error when the eval finishes without the awaited status")
+	}
+}
+
+func TestUnixSocketEvalStringify(t *testing.T) {
+	sockPath := "/tmp/zylisp-test-stringify.sock"
+	defer os.Remove(sockPath)
+
+	server := NewServer(sockPath, "json", mockEvaluator)
+	server.Handler().ContextEvaluator = func(ctx context.Context, code string) (interface{}, string, error) {
+		return 3, "", nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := NewClient("json")
+	if err := client.Connect(ctx, sockPath, ""); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	resp, err := client.roundTrip(ctx, &protocol.Message{
+		Op:   "eval",
+		Code: "(+ 1 2)",
+		Data: map[string]interface{}{"stringify": true},
+	})
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	if resp.Value != "3" {
+		t.Errorf("Expected string \"3\", got %T %v", resp.Value, resp.Value)
+	}
+}
+
+func TestUnixSocketUpgradeCodec(t *testing.T) {
+	sockPath := "/tmp/zylisp-test-upgrade.sock"
+	defer os.Remove(sockPath)
+
+	server := NewServer(sockPath, "json", mockEvaluator)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := NewClient("json")
+	if err := client.Connect(ctx, sockPath, ""); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.Eval(ctx, "(+ 1 2)"); err != nil {
+		t.Fatalf("Eval before upgrade failed: %v", err)
+	}
+
+	// The server refuses codecs it cannot provide and keeps the current one
+	resp, err := client.roundTrip(ctx, &protocol.Message{
+		Op:   "upgrade-codec",
+		Data: map[string]interface{}{"codec": "msgpack"},
+	})
+	if err != nil {
+		t.Fatalf("upgrade-codec request failed: %v", err)
+	}
+	if resp.Status[0] != "error" {
+		t.Errorf("Expected msgpack upgrade to be refused, got %v", resp.Status)
+	}
+	if err := client.UpgradeCodec(ctx, "msgpack"); err == nil {
+		t.Error("Expected UpgradeCodec to msgpack to fail")
+	}
+
+	// JSON is the only codec available, so an accepted upgrade renews it;
+	// both ends still swap to a new codec mid-connection
+	client.mu.Lock()
+	before := client.codec
+	client.mu.Unlock()
+	if err := client.UpgradeCodec(ctx, "json"); err != nil {
+		t.Fatalf("UpgradeCodec failed: %v", err)
+	}
+	client.mu.Lock()
+	after := client.codec
+	client.mu.Unlock()
+	if after == before {
+		t.Error("Expected the client codec to be replaced")
+	}
+
+	result, err := client.Eval(ctx, "(+ 1 2)")
+	if err != nil {
+		t.Fatalf("Eval after upgrade failed: %v", err)
+	}
+	if result.Value != float64(3) {
+		t.Errorf("Expected value 3, got %v", result.Value)
+	}
+
+	// Streaming connections read ahead, so they cannot be upgraded
+	if err := client.StartStreaming(ctx); err != nil {
+		t.Fatalf("StartStreaming failed: %v", err)
+	}
+	if err := client.UpgradeCodec(ctx, "json"); err == nil {
+		t.Error("Expected UpgradeCodec on a streaming connection to fail")
+	}
+	if _, err := client.Eval(ctx, "(+ 1 2)"); err != nil {
+		t.Errorf("Eval after refused upgrade failed: %v", err)
+	}
+}
+
+func TestUnixSocketNegotiateCompression(t *testing.T) {
+	tests := []struct {
+		name     string
+		server   []string
+		offered  []string
+		expected string
+	}{
+		{"both support gzip", []string{"gzip"}, []string{"gzip"}, "gzip"},
+		{"only the server", []string{"gzip"}, []string{"zstd"}, "none"},
+		{"only the client", nil, []string{"gzip"}, "none"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sockPath := "/tmp/zylisp-test-compression.sock"
+			defer os.Remove(sockPath)
+
+			server := NewServer(sockPath, "json", mockEvaluator)
+			server.Compressions = tt.server
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			go func() {
+				server.Start(ctx)
+			}()
+
+			time.Sleep(100 * time.Millisecond)
+
+			client := NewClient("json")
+			if err := client.Connect(ctx, sockPath, ""); err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			defer client.Close()
+
+			client.mu.Lock()
+			before := client.codec
+			client.mu.Unlock()
+
+			compression, err := client.NegotiateCompression(ctx, tt.offered...)
+			if err != nil {
+				t.Fatalf("NegotiateCompression failed: %v", err)
+			}
+			if compression != tt.expected {
+				t.Errorf("Expected compression %q, got %q", tt.expected, compression)
+			}
+			client.mu.Lock()
+			replaced := client.codec != before
+			client.mu.Unlock()
+			if replaced != (tt.expected != "none") {
+				t.Errorf("Expected the codec to be replaced only when compressing, replaced=%v", replaced)
+			}
+
+			// Both ends agree on the framing afterwards
+			for i := 0; i < 3; i++ {
+				result, err := client.Eval(ctx, "(+ 1 2)")
+				if err != nil {
+					t.Fatalf("Eval after negotiation failed: %v", err)
+				}
+				if result.Value != float64(3) {
+					t.Errorf("Expected value 3, got %v", result.Value)
+				}
+			}
+		})
+	}
+}
+
+func TestUnixSocketFailOnProtocolError(t *testing.T) {
+	// A server that rejects every operation as unknown
+	sockPath := "/tmp/zylisp-test-fail.sock"
+	os.Remove(sockPath)
+	listener, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				codec := protocol.NewJSONCodec(conn)
+				for {
+					var req protocol.Message
+					if codec.Decode(&req) != nil {
+						return
+					}
+					codec.Encode(&protocol.Message{
+						ID:            req.ID,
+						Status:        []string{"error", "unknown-op"},
+						ProtocolError: fmt.Sprintf("unknown operation: %q", req.Op),
+					})
+				}
+			}()
+		}
+	}()
+
+	for _, fail := range []bool{false, true} {
+		client := NewClient("json")
+		client.FailOnProtocolError = fail
+		if err := client.Connect(context.Background(), sockPath, ""); err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+
+		result, err := client.Eval(context.Background(), "(+ 1 2)")
+		if result == nil || len(result.Status) != 2 || result.Status[1] != "unknown-op" {
+			t.Errorf("fail=%v: expected an unknown-op result, got %+v", fail, result)
+		}
+		if fail && err == nil {
+			t.Error("Expected an error with FailOnProtocolError")
+		}
+		if !fail && err != nil {
+			t.Errorf("Expected no error by default, got %v", err)
+		}
+		client.Close()
+	}
+}
+
+func TestUnixSocketResponseTimeout(t *testing.T) {
+	// A server that reads requests but never answers
+	sockPath := "/tmp/zylisp-test-response-timeout.sock"
+	os.Remove(sockPath)
+	listener, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	client := NewClient("json")
+	client.ResponseTimeout = 50 * time.Millisecond
+	if err := client.Connect(context.Background(), sockPath, ""); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := client.Eval(ctx, "(+ 1 2)"); err == nil {
+		t.Fatal("Expected a response timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Eval took %v despite the response timeout", elapsed)
+	}
+	if ctx.Err() != nil {
+		t.Error("Expected the outer context to be unaffected")
+	}
+}
+
+func TestUnixSocketClientPooledMessagesDoNotLeak(t *testing.T) {
+	sockPath := "/tmp/zylisp-test-pooled.sock"
+	defer os.Remove(sockPath)
+
+	server := NewServer(sockPath, "json", func(code string) (interface{}, string, error) {
+		if code == "(noisy)" {
+			return map[string]interface{}{"big": "value"}, "output", nil
+		}
+		return nil, "", nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := NewClient("json")
+	if err := client.Connect(ctx, sockPath, ""); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	for i := 0; i < 20; i++ {
+		noisy, err := client.Eval(ctx, "(noisy)")
+		if err != nil {
+			t.Fatalf("Eval failed: %v", err)
+		}
+		quiet, err := client.Eval(ctx, "(quiet)")
+		if err != nil {
+			t.Fatalf("Eval failed: %v", err)
+		}
+		if quiet.Value != nil || quiet.Output != "" {
+			t.Fatalf("Expected nothing from a previous eval to leak, got %+v", quiet)
+		}
+		if noisy.Output != "output" || noisy.Value == nil {
+			t.Fatalf("Expected the noisy result to be intact, got %+v", noisy)
+		}
+	}
+}
+
+func TestUnixSocketNilEvaluator(t *testing.T) {
+	sockPath := "/tmp/zylisp-test-nil-evaluator.sock"
+	defer os.Remove(sockPath)
+
+	server := NewServer(sockPath, "json", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := NewClient("json")
+	if err := client.Connect(ctx, sockPath, ""); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	result, err := client.Eval(ctx, "(+ 1 2)")
+	if err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	if len(result.Status) == 0 || result.Status[0] != "error" {
+		t.Errorf("Expected an error status without an evaluator, got %v", result.Status)
+	}
+}
+
+func TestUnixSocketUnavailableCodecRefused(t *testing.T) {
+	sockPath := "/tmp/zylisp-test-unavailable-codec.sock"
+	defer os.Remove(sockPath)
+
+	server := NewServer(sockPath, "msgpack", mockEvaluator)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		t.Fatalf("Failed to dial server: %v", err)
+	}
+	defer conn.Close()
+
+	var resp protocol.Message
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		t.Fatalf("Failed to read refusal: %v", err)
+	}
+	if len(resp.Status) == 0 || resp.Status[0] != "error" || !strings.Contains(resp.ProtocolError, "msgpack") {
+		t.Errorf("Expected a protocol error naming msgpack, got %+v", resp)
+	}
+}
+
+func TestUnixSocketKeepAliveDetectsHungServer(t *testing.T) {
+	sockPath := "/tmp/zylisp-test-keepalive.sock"
+	hungPath := "/tmp/zylisp-test-keepalive-hung.sock"
+	defer os.Remove(sockPath)
+	defer os.Remove(hungPath)
+
+	// A healthy server answers pings and the connection stays up
+	server := NewServer(sockPath, "json", mockEvaluator)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		server.Start(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	unhealthy := make(chan error, 1)
+	client := NewClient("json")
+	client.KeepAlive = 20 * time.Millisecond
+	client.OnUnhealthy = func(err error) { unhealthy <- err }
+	if err := client.Connect(ctx, sockPath, ""); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if _, err := client.Eval(ctx, "(+ 1 2)"); err != nil {
+		t.Fatalf("Eval failed with keepalive running: %v", err)
+	}
+	client.Close()
+	select {
+	case err := <-unhealthy:
+		t.Fatalf("Expected a responsive server to stay healthy, got %v", err)
+	default:
+	}
+
+	// A server that accepts the connection but never answers is detected
+	listener, err := net.Listen("unix", hungPath)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	}()
+
+	hung := NewClient("json")
+	hung.KeepAlive = 20 * time.Millisecond
+	hung.KeepAliveTimeout = 50 * time.Millisecond
+	hung.OnUnhealthy = func(err error) { unhealthy <- err }
+	if err := hung.Connect(ctx, listener.Addr().String(), ""); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer hung.Close()
+
+	select {
+	case err := <-unhealthy:
+		if !strings.Contains(err.Error(), "keepalive") {
+			t.Errorf("Expected a keepalive error, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the hung server to be detected")
+	}
+	if _, err := hung.Eval(ctx, "(+ 1 2)"); err == nil {
+		t.Error("Expected Eval to fail on an unhealthy connection")
+	}
+}
+
+func TestUnixSocketCloseGracefully(t *testing.T) {
+	sockPath := "/tmp/zylisp-test-close-gracefully.sock"
+	defer os.Remove(sockPath)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := NewServer(sockPath, "json", func(code string) (interface{}, string, error) {
+		close(started)
+		<-release
+		return code, "", nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := NewClient("json")
+	if err := client.Connect(ctx, sockPath, ""); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	type outcome struct {
+		result *Result
+		err    error
+	}
+	evaluated := make(chan outcome, 1)
+	go func() {
+		result, err := client.Eval(ctx, "(slow)")
+		evaluated <- outcome{result, err}
+	}()
+	<-started
+
+	// The close is requested while the eval's response is still pending
+	closed := make(chan error, 1)
+	go func() {
+		closed <- client.CloseGracefully(ctx)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if err := <-closed; err != nil {
+		t.Fatalf("CloseGracefully failed: %v", err)
+	}
+	got := <-evaluated
+	if got.err != nil || got.result.Value != "(slow)" {
+		t.Fatalf("Expected the in-flight response to survive the close, got %+v, %v", got.result, got.err)
+	}
+	if _, err := client.Eval(ctx, "(+ 1 2)"); err == nil {
+		t.Error("Expected Eval to fail after the connection was closed")
+	}
+}
+
+func TestUnixSocketTranscript(t *testing.T) {
+	sockPath := "/tmp/zylisp-test-transcript.sock"
+	defer os.Remove(sockPath)
+
+	evaluate := func(code string) (interface{}, string, error) {
+		return code, "", nil
+	}
+	server := NewServer(sockPath, "json", evaluate)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	var transcript bytes.Buffer
+	client := NewClient("json")
+	client.TranscriptWriter = &transcript
+	if err := client.Connect(ctx, sockPath, ""); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if _, err := client.Eval(ctx, "(+ 1 2)"); err != nil {
+		t.Fatalf("Eval failed: %v", err)
+	}
+	client.Close()
+
+	entries, err := protocol.ReadTranscript(&transcript)
+	if err != nil {
+		t.Fatalf("ReadTranscript failed: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 transcript lines, got %d: %s", len(entries), transcript.String())
+	}
+	request, response := entries[0], entries[1]
+	if request.Direction != "request" || request.Message.Op != "eval" || request.Message.Code != "(+ 1 2)" {
+		t.Errorf("Expected the eval request first, got %+v", request)
+	}
+	if response.Direction != "response" || response.Message.ID != request.Message.ID || response.Message.Value != "(+ 1 2)" {
+		t.Errorf("Expected its response second, got %+v", response)
+	}
+
+	mismatches, err := operations.NewHandler(evaluate).Replay(ctx, entries, operations.ReplayOptions{})
+	if err != nil || len(mismatches) != 0 {
+		t.Errorf("Expected the transcript to replay cleanly, got %v, %v", mismatches, err)
+	}
+}
+
+func TestUnixSocketStreamedInputUntilEOF(t *testing.T) {
+	sockPath := "/tmp/zylisp-test-stream-eof.sock"
+	defer os.Remove(sockPath)
+
+	server := NewServer(sockPath, "json", mockEvaluator)
+	server.Handler().ContextEvaluator = func(ctx context.Context, code string) (interface{}, string, error) {
+		if code == "(first-line)" {
+			// Stops reading early, leaving lines and the EOF unread
+			line, err := operations.ReadLine(ctx)
+			return line, "", err
+		}
+		// (count-lines) reads lines like a filter until the client closes input
+		lines := 0
+		for {
+			_, err := operations.ReadLine(ctx)
+			if err == io.EOF {
+				return lines, "", nil
+			}
+			if err != nil {
+				return nil, "", err
+			}
+			lines++
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		server.Start(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := NewClient("json")
+	if err := client.Connect(ctx, sockPath, ""); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.StartStreaming(ctx); err != nil {
+		t.Fatalf("StartStreaming failed: %v", err)
+	}
+
+	// Lines split across messages, the last one unterminated
+	var sent bool
+	result, err := client.EvalStream(ctx, "(count-lines)", func(msg *Result) {
+		if len(msg.Status) == 0 || msg.Status[0] != "need-input" || sent {
+			return
+		}
+		sent = true
+		for _, input := range []string{"one\ntw", "o\nthree\n", "four"} {
+			if err := client.SendInput(ctx, input); err != nil {
+				t.Errorf("SendInput failed: %v", err)
+			}
+		}
+		if err := client.CloseInput(ctx); err != nil {
+			t.Errorf("CloseInput failed: %v", err)
+		}
+	})
+	if err != nil {
+		t.Fatalf("EvalStream failed: %v", err)
+	}
+	if result.Value != float64(4) {
+		t.Errorf("Expected 4 lines, got %v", result.Value)
+	}
+
+	// Input sent ahead is read without asking, and the EOF only closed
+	// input for the evaluation that read it
+	if err := client.SendInput(ctx, "again\n"); err != nil {
+		t.Fatalf("SendInput failed: %v", err)
+	}
+	if err := client.CloseInput(ctx); err != nil {
+		t.Fatalf("CloseInput failed: %v", err)
+	}
+	asked := 0
+	result, err = client.EvalStream(ctx, "(count-lines)", func(msg *Result) {
+		if len(msg.Status) > 0 && msg.Status[0] == "need-input" {
+			asked++
+		}
+	})
+	if err != nil || result.Value != float64(1) || asked != 0 {
+		t.Errorf("Expected input sent ahead to be counted without asking, got %v, %v after %d requests", result, err, asked)
+	}
+
+	// Input a program leaves unread does not reach the next one
+	for _, input := range []string{"head\nleft\n", "over\n"} {
+		if err := client.SendInput(ctx, input); err != nil {
+			t.Fatalf("SendInput failed: %v", err)
+		}
+	}
+	if err := client.CloseInput(ctx); err != nil {
+		t.Fatalf("CloseInput failed: %v", err)
+	}
+	result, err = client.Eval(ctx, "(first-line)")
+	if err != nil || result.Value != "head" {
+		t.Fatalf("Expected the first line, got %v, %v", result, err)
+	}
+	sent = false
+	result, err = client.EvalStream(ctx, "(count-lines)", func(msg *Result) {
+		if len(msg.Status) == 0 || msg.Status[0] != "need-input" || sent {
+			return
+		}
+		sent = true
+		client.SendInput(ctx, "fresh\n")
+		client.CloseInput(ctx)
+	})
+	if err != nil || result.Value != float64(1) || !sent {
+		t.Errorf("Expected only the fresh line to be counted, got %v, %v", result, err)
+	}
+}